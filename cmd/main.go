@@ -2,7 +2,22 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/file"
+	"github.com/perbu/yrpoller/sink/graphite"
+	"github.com/perbu/yrpoller/sink/kafka"
+	"github.com/perbu/yrpoller/sink/otlp"
+	"github.com/perbu/yrpoller/sink/parquet"
+	"github.com/perbu/yrpoller/sink/postgres"
+	"github.com/perbu/yrpoller/sink/sqlite"
+	"github.com/perbu/yrpoller/sink/statsd"
+	"github.com/perbu/yrpoller/spool"
+	"github.com/perbu/yrpoller/timestream"
 	"github.com/perbu/yrpoller/yrsensor"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -20,20 +35,272 @@ const AWS_REGION = "eu-west-1"
 const DBNAME = "yrpoller-fjas"
 const BINDADDRESS = ":8080"
 
+// parseHeaders parses "name=value,name=value", the format of OTEL_EXPORTER_OTLP_HEADERS.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if s == "" {
+		return headers, nil
+	}
+	for _, h := range strings.Split(s, ",") {
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid header '%s', use name=value", h)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers, nil
+}
+
+// parquetExport is the parquet-export subcommand, converting file sink archives to Parquet.
+func parquetExport(args []string) {
+	fs := flag.NewFlagSet("parquet-export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s parquet-export -dir <dir> [options] <csv or jsonl files>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dirPtr := fs.String("dir", "", "Write the Parquet files to this directory")
+	compressionPtr := fs.String("compression", parquet.CompressionGzip, "Compression of the Parquet files: gzip or none")
+	variablesPtr := fs.String("variables", "", "Comma separated list of variables to export, all if none given")
+	fs.Parse(args)
+	if *dirPtr == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	err := yrsensor.ExportParquet(fs.Args(), parquet.Config{
+		Dir:         *dirPtr,
+		Compression: *compressionPtr,
+	}, *variablesPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// validateLocations is the validate-locations subcommand, checking location files in CI.
+// The problems are printed like compiler errors, as file:line:column: message.
+func validateLocations(args []string) {
+	fs := flag.NewFlagSet("validate-locations", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s validate-locations [location files]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Checks %s if no files are given.\n", LOCATIONFILEPATH)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{LOCATIONFILEPATH}
+	}
+	failed := false
+	for _, path := range files {
+		n, err := yrsensor.ValidateLocationFile(path)
+		if problems, ok := err.(yrsensor.LocationProblems); ok {
+			for _, p := range problems {
+				fmt.Printf("%s:%s\n", path, p.String())
+			}
+			failed = true
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", path, err.Error())
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: %d locations, no problems\n", path, n)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-locations" {
+		validateLocations(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "parquet-export" {
+		parquetExport(os.Args[2:])
+		return
+	}
 	// func run(userAgentPtr string, apiUrlPtr string, apiVersionPtr string, emitterIntervalPtr time.Duration, locationFileLocation string) {
-	locationPathPtr := flag.String("locationsfile", LOCATIONFILEPATH, "JSON file containing locations")
+	locationPathPtr := flag.String("locationsfile", LOCATIONFILEPATH, "Location file, JSON, YAML (.yaml, .yml), CSV (.csv) or GeoJSON (.geojson)")
 	userAgentPtr := flag.String("user-agent", CLIENT_ID, "User-agent to use")
 	apiUrlPtr := flag.String("api-url", API_URL, "Baseurl for Yr API")
 	emitterIntervalPtr := flag.Duration("interval", EMITTERINTERVAL, "How often to emit data")
+	timestreamPtr := flag.Bool("timestream", true, "Emit to AWS Timestream")
 	awsRegionPtr := flag.String("aws-region", AWS_REGION, "AWS region")
 	awsTimeseriesDbnamePtr := flag.String("dbname", DBNAME, "DB name in AWS Timestream")
+	awsTimestreamMultiTablePtr := flag.String("multi-measure-table", "",
+		"Write one multi-measure record per location and tick to this table instead of one table per variable")
+	memoryStoreRetentionPtr := flag.Int64("memory-store-retention", 0,
+		"Memory store retention of the Timestream tables in hours, left as it is if 0")
+	magneticStoreRetentionPtr := flag.Int64("magnetic-store-retention", 0,
+		"Magnetic store retention of the Timestream tables in days, left as it is if 0")
+	tableRetentionPtr := flag.String("table-retention", "",
+		"Per table retention overriding the above, like \"air_temperature:24:365,wind_speed:12:30\"")
+	spoolDirPtr := flag.String("spool-dir", "",
+		"Spool writes that fail to this directory and replay them in the background, kept in memory if none given")
+	spoolMaxSizePtr := flag.Int64("spool-max-size", 256<<20, "Spool size limit in bytes, the oldest writes are dropped beyond it")
+	spoolMaxAgePtr := flag.Duration("spool-max-age", 24*time.Hour, "Spooled writes older than this are dropped")
+	spoolDrainIntervalPtr := flag.Duration("spool-drain-interval", time.Minute, "How often to replay the spool")
+	historyPtr := flag.Bool("history", false,
+		"Read back stored values with the Timestream Query API and serve them on /locations/<id>/history")
+	sqlitePtr := flag.String("sqlite", "", "Store the observations in this SQLite database")
+	sqliteRetentionPtr := flag.Duration("sqlite-retention", 0, "Delete observations older than this from SQLite, kept forever if 0")
+	postgresPtr := flag.String("postgres", "",
+		"Store the observations in PostgreSQL/TimescaleDB, like \"postgres://yrpoller@localhost/weather?sslmode=disable\"")
+	postgresMaxPendingPtr := flag.Int("postgres-max-pending", postgres.DefaultMaxPendingRows,
+		"Rows kept for retrying while PostgreSQL is unavailable")
+	fileDirPtr := flag.String("file-dir", "", "Append the observations to daily files in this directory")
+	fileFormatPtr := flag.String("file-format", file.FormatCSV, "Format of the files: csv or jsonl")
+	fileMaxSizePtr := flag.Int64("file-max-size", 0, "Continue in a new file when a file reaches this many bytes, no limit if 0")
+	fileCompressPtr := flag.Bool("file-compress", true, "Gzip the files that are no longer written to")
+	parquetDirPtr := flag.String("parquet-dir", "",
+		"Write the observations to Parquet files in this directory, partitioned by location and date")
+	parquetCompressionPtr := flag.String("parquet-compression", parquet.CompressionGzip, "Compression of the Parquet files: gzip or none")
+	kafkaBrokersPtr := flag.String("kafka-brokers", "",
+		"Publish the observations to Kafka, a comma separated list of brokers like \"localhost:9092\"")
+	kafkaTopicPtr := flag.String("kafka-topic", "observations", "Kafka topic to publish to")
+	kafkaFormatPtr := flag.String("kafka-format", kafka.FormatJSON, "Format of the Kafka messages: json or avro")
+	kafkaBatchSizePtr := flag.Int("kafka-batch-size", kafka.DefaultBatchSize, "Kafka messages produced at a time")
+	kafkaCompressionPtr := flag.String("kafka-compression", kafka.CompressionNone, "Compression of the Kafka record batches: none or gzip")
+	kafkaIdempotentPtr := flag.Bool("kafka-idempotent", true, "Idempotent Kafka delivery, so retries don't make duplicates")
+	kafkaMaxPendingPtr := flag.Int("kafka-max-pending", kafka.DefaultMaxPending,
+		"Messages kept for retrying while Kafka is unavailable")
+	graphitePtr := flag.String("graphite", "", "Send the observations to Graphite, the host:port of carbon's plaintext listener")
+	graphitePrefixPtr := flag.String("graphite-prefix", graphite.DefaultPrefix, "First part of the Graphite metric paths")
+	graphiteTagsPtr := flag.Bool("graphite-tags", false, "Add the location dimensions and tags as Graphite tags, needs Graphite 1.1")
+	statsdPtr := flag.String("statsd", "", "Send the observations to StatsD as gauges, the host:port to send to")
+	statsdPrefixPtr := flag.String("statsd-prefix", statsd.DefaultPrefix, "First part of the StatsD gauge names")
+	otlpEndpointPtr := flag.String("otlp-endpoint", "",
+		"Export the observations and the daemon metrics to an OpenTelemetry collector with OTLP/HTTP, like \"http://localhost:4318\"")
+	otlpHeadersPtr := flag.String("otlp-headers", "", "Headers of the OTLP requests, like \"Authorization=Bearer xyz,X-Scope-OrgID=weather\"")
+	otlpIntervalPtr := flag.Duration("otlp-interval", time.Minute, "How often to export the daemon metrics")
+	webhooksPtr := flag.String("webhooks", "", "JSON file with webhooks to POST the observations to")
+	sinkQueueSizePtr := flag.Int("sink-queue-size", sink.DefaultMaxQueuedRecords,
+		"Records queued per sink while it is slow or down, the oldest are dropped beyond it")
+	sinkFlushPtr := flag.String("sink-flush", "",
+		"How often to write to a sink, every emit if not given. Like \"postgres:5m,kafka:30s\"")
+	sinkMinBackoffPtr := flag.Duration("sink-min-backoff", sink.DefaultMinBackoff, "Wait before retrying a sink after a failed write, doubled for each failure")
+	sinkMaxBackoffPtr := flag.Duration("sink-max-backoff", sink.DefaultMaxBackoff, "Longest wait before retrying a sink")
 	bindAddressPtr := flag.String("bind", BINDADDRESS, "bind address")
+	apiTokenPtr := flag.String("api-token", os.Getenv("YRPOLLER_API_TOKEN"),
+		"Enable the location API on /api/locations for requests with this bearer token, $YRPOLLER_API_TOKEN if not given")
+	apiWriteBackPtr := flag.Bool("api-write-back", false, "Write the changes from the location API back to the location file")
 	logFileNamePtr := flag.String("logfile", "", "logfile, if none given it will go to STDOUT")
+	skiWaxPtr := flag.Bool("skiwax", false, "Classify snow conditions and recommend ski wax per location")
+	skiWaxRulesPtr := flag.String("skiwax-rules", "", "JSON file with ski wax rules, built in rules if none given")
+	snowpackStatePtr := flag.String("snowpack-state", "", "Run the snowpack model, keeping its state in this file")
+	snowpackThresholdPtr := flag.Float64("snowpack-threshold", 1.0, "Snowpack model: rain/snow threshold temperature (°C)")
+	snowpackMeltTempPtr := flag.Float64("snowpack-melt-temperature", 0.0, "Snowpack model: melt temperature (°C)")
+	snowpackDDFPtr := flag.Float64("snowpack-ddf", 3.0, "Snowpack model: degree-day factor (mm/°C/day)")
+	alertsPtr := flag.String("alerts", "", "JSON file with alert rules and notifiers")
+	variablesPtr := flag.String("variables", "", "Comma separated list of variables to emit, all if none given")
 
 	flag.Parse()
+	retention := timestream.Retention{
+		MemoryStoreHours:  *memoryStoreRetentionPtr,
+		MagneticStoreDays: *magneticStoreRetentionPtr,
+	}
+	if err := retention.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	tableRetention, err := timestream.ParseTableRetention(*tableRetentionPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	flushIntervals, err := sink.ParseFlushIntervals(*sinkFlushPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	otlpHeaders, err := parseHeaders(*otlpHeadersPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var kafkaBrokers []string
+	if *kafkaBrokersPtr != "" {
+		kafkaBrokers = strings.Split(*kafkaBrokersPtr, ",")
+	}
 	// Note: these are all pointers.
-	yrsensor.Run(*userAgentPtr, *apiUrlPtr,
-		*emitterIntervalPtr, *locationPathPtr, *awsRegionPtr,
-		*awsTimeseriesDbnamePtr, *bindAddressPtr, *logFileNamePtr)
+	yrsensor.Run(yrsensor.Config{
+		UserAgent:        *userAgentPtr,
+		ApiUrl:           *apiUrlPtr,
+		EmitterInterval:  *emitterIntervalPtr,
+		LocationFile:     *locationPathPtr,
+		EnableTimestream: *timestreamPtr,
+		Timestream: timestream.Config{
+			AwsRegion:           *awsRegionPtr,
+			AwsTimestreamDbname: *awsTimeseriesDbnamePtr,
+			MultiMeasureTable:   *awsTimestreamMultiTablePtr,
+			Retention:           retention,
+			TableRetention:      tableRetention,
+			Query:               *historyPtr,
+		},
+		Spool: spool.Config{
+			Dir:      *spoolDirPtr,
+			MaxBytes: *spoolMaxSizePtr,
+			MaxAge:   *spoolMaxAgePtr,
+		},
+		SpoolDrainInterval: *spoolDrainIntervalPtr,
+		Sqlite: sqlite.Config{
+			Path:      *sqlitePtr,
+			Retention: *sqliteRetentionPtr,
+		},
+		Postgres: postgres.Config{
+			DSN:            *postgresPtr,
+			MaxPendingRows: *postgresMaxPendingPtr,
+		},
+		File: file.Config{
+			Dir:      *fileDirPtr,
+			Format:   *fileFormatPtr,
+			MaxBytes: *fileMaxSizePtr,
+			Compress: *fileCompressPtr,
+		},
+		Parquet: parquet.Config{
+			Dir:         *parquetDirPtr,
+			Compression: *parquetCompressionPtr,
+		},
+		Kafka: kafka.Config{
+			Brokers:     kafkaBrokers,
+			Topic:       *kafkaTopicPtr,
+			Format:      *kafkaFormatPtr,
+			BatchSize:   *kafkaBatchSizePtr,
+			Compression: *kafkaCompressionPtr,
+			Idempotent:  *kafkaIdempotentPtr,
+			MaxPending:  *kafkaMaxPendingPtr,
+		},
+		Graphite: graphite.Config{
+			Address: *graphitePtr,
+			Prefix:  *graphitePrefixPtr,
+			Tags:    *graphiteTagsPtr,
+		},
+		Statsd: statsd.Config{
+			Address: *statsdPtr,
+			Prefix:  *statsdPrefixPtr,
+		},
+		Otlp: otlp.Config{
+			Endpoint: *otlpEndpointPtr,
+			Headers:  otlpHeaders,
+		},
+		OtlpInterval: *otlpIntervalPtr,
+		WebhookFile:  *webhooksPtr,
+		Queue: sink.QueueConfig{
+			MaxRecords: *sinkQueueSizePtr,
+			MinBackoff: *sinkMinBackoffPtr,
+			MaxBackoff: *sinkMaxBackoffPtr,
+		},
+		FlushIntervals:    flushIntervals,
+		BindAddress:       *bindAddressPtr,
+		ApiToken:          *apiTokenPtr,
+		ApiWriteBack:      *apiWriteBackPtr,
+		LogFileName:       *logFileNamePtr,
+		Variables:         *variablesPtr,
+		SkiWax:            *skiWaxPtr,
+		SkiWaxRulesFile:   *skiWaxRulesPtr,
+		SnowpackStateFile: *snowpackStatePtr,
+		Snowpack: yrsensor.SnowpackParams{
+			ThresholdTemperature: *snowpackThresholdPtr,
+			MeltTemperature:      *snowpackMeltTempPtr,
+			DegreeDayFactor:      *snowpackDDFPtr,
+		},
+		AlertFile: *alertsPtr,
+	})
 }
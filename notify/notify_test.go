@@ -0,0 +1,114 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateTestNotification() Notification {
+	return Notification{
+		Rule:      "cold",
+		Location:  "tryvannstua",
+		State:     "firing",
+		Variable:  "air_temperature",
+		Value:     -12.5,
+		Threshold: -10,
+		Message:   "air_temperature below -10",
+		Time:      time.Date(2021, 1, 10, 6, 0, 0, 0, time.UTC),
+	}
+}
+
+// smtpStandIn is a minimal SMTP server that accepts one mail and sends it on the channel.
+func smtpStandIn(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	mails := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP stand-in")
+		var data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				mails <- data.String()
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestSmtpNotifier(t *testing.T) {
+	addr, mails := smtpStandIn(t)
+	n := SmtpNotifier{
+		Addr: addr,
+		From: "poller@example.com",
+		To:   []string{"ops@example.com"},
+	}
+	err := n.Notify(generateTestNotification())
+	assert.Nil(t, err)
+	select {
+	case mail := <-mails:
+		assert.Contains(t, mail, "Subject: [FIRING] cold at tryvannstua")
+		assert.Contains(t, mail, "air_temperature is -12.5, threshold is -10.0")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Notification
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	n := NewWebhookNotifier(server.URL, map[string]string{"Authorization": "Bearer secret"})
+	assert.Nil(t, n.Notify(generateTestNotification()))
+	assert.Equal(t, generateTestNotification(), got)
+	assert.Equal(t, "Bearer secret", auth)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.NotNil(t, NewWebhookNotifier(failing.URL, nil).Notify(generateTestNotification()))
+}
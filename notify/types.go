@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"net/http"
+	"time"
+)
+
+type Notification struct {
+	Rule      string    `json:"rule"`
+	Location  string    `json:"location"`
+	State     string    `json:"state"` // "firing" or "resolved"
+	Variable  string    `json:"variable"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+type WebhookNotifier struct {
+	Url     string
+	Headers map[string]string
+	Client  *http.Client
+}
+
+type SmtpNotifier struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string // No authentication if empty.
+	Password string
+}
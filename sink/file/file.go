@@ -0,0 +1,421 @@
+package file
+
+/*
+  Appends the emitted observations to local files, as CSV with a header or as JSON Lines.
+  There is a file per day, named after the date of the observations, like
+  observations-2021-01-10.csv. A day that grows beyond the size limit continues in
+  observations-2021-01-10.1.csv and so on. Files we are done with are gzipped.
+*/
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+
+	filePrefix = "observations-"
+	dateLayout = "2006-01-02"
+)
+
+// Matches observations-<date>[.<seq>].<ext>[.gz]
+var fileNameRe = regexp.MustCompile(`^observations-(\d{4}-\d{2}-\d{2})(?:\.(\d+))?\.(csv|jsonl)(\.gz)?$`)
+
+type Config struct {
+	Dir       string
+	Format    string   // FormatCSV or FormatJSONL
+	MaxBytes  int64    // Continue in a new file when the current one is this big. No limit if 0.
+	Compress  bool     // Gzip the files we are done with.
+	Variables []string // The CSV columns after time and location.
+}
+
+// jsonRecord is a line in the JSON Lines files.
+type jsonRecord struct {
+	Time       time.Time          `json:"time"`
+	Location   string             `json:"location"`
+	Dimensions map[string]string  `json:"dimensions"`
+	Values     map[string]float64 `json:"values"`
+}
+
+type Sink struct {
+	config      Config
+	header      string // the first line of every CSV file
+	day         string
+	seq         int
+	file        *os.File
+	size        int64
+	compressMu  sync.Mutex
+	compressing map[string]bool
+	compressWg  sync.WaitGroup
+}
+
+func Open(config Config) (*Sink, error) {
+	if config.Format != FormatCSV && config.Format != FormatJSONL {
+		return nil, fmt.Errorf("unknown format '%s', use %s or %s", config.Format, FormatCSV, FormatJSONL)
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Sink{config: config, compressing: make(map[string]bool)}
+	if config.Format == FormatCSV {
+		s.header = csvLine(append([]string{"time", "location"}, config.Variables...))
+	}
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return "file"
+}
+
+func csvLine(fields []string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(fields)
+	w.Flush()
+	return b.String()
+}
+
+func (s *Sink) fileName(day string, seq int) string {
+	name := filePrefix + day
+	if seq > 0 {
+		name += "." + strconv.Itoa(seq)
+	}
+	return filepath.Join(s.config.Dir, name+"."+s.config.Format)
+}
+
+// encode formats a record as a line in the current format.
+func (s *Sink) encode(r sink.Record) (string, error) {
+	if s.config.Format == FormatJSONL {
+		jr := jsonRecord{
+			Time:       r.Time.UTC(),
+			Location:   r.Location,
+			Dimensions: make(map[string]string, len(r.Dimensions)),
+			Values:     make(map[string]float64, len(r.Values)),
+		}
+		for _, d := range r.Dimensions {
+			jr.Dimensions[d.Name] = d.Value
+		}
+		for _, v := range r.Values {
+			jr.Values[v.Name] = v.Value
+		}
+		data, err := json.Marshal(jr)
+		return string(data) + "\n", err
+	}
+	fields := make([]string, 2, 2+len(s.config.Variables))
+	fields[0] = r.Time.UTC().Format(time.RFC3339)
+	fields[1] = r.Location
+	for _, name := range s.config.Variables {
+		value := ""
+		for _, v := range r.Values {
+			if v.Name == name {
+				value = strconv.FormatFloat(v.Value, 'f', -1, 64)
+			}
+		}
+		fields = append(fields, value)
+	}
+	return csvLine(fields), nil
+}
+
+// usable tells if we can append to an existing file. CSV files must have the same columns.
+func (s *Sink) usable(path string) bool {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil || (s.config.MaxBytes > 0 && info.Size() >= s.config.MaxBytes) {
+		return false
+	}
+	if s.config.Format != FormatCSV || info.Size() == 0 {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	first, err := bufio.NewReader(f).ReadString('\n')
+	return err == nil && first == s.header
+}
+
+// open switches to the file for the day, starting after the files that are compressed or can't be appended to.
+func (s *Sink) open(day string, seq int) error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	for {
+		if _, err := os.Stat(s.fileName(day, seq) + ".gz"); err == nil || !s.usable(s.fileName(day, seq)) {
+			seq++
+			continue
+		}
+		break
+	}
+	f, err := os.OpenFile(s.fileName(day, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.day, s.seq, s.size = f, day, seq, info.Size()
+	if s.size == 0 && s.header != "" {
+		n, err := f.WriteString(s.header)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if s.config.Compress {
+		s.compressOld()
+	}
+	return nil
+}
+
+func (s *Sink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *Sink) Write(records []sink.Record) error {
+	var buf strings.Builder
+	for _, r := range records {
+		line, err := s.encode(r)
+		if err != nil {
+			return err
+		}
+		day := r.Time.UTC().Format(dateLayout)
+		switch {
+		case s.file == nil || day != s.day:
+			if err := s.flush(&buf); err != nil {
+				return err
+			}
+			if err := s.open(day, 0); err != nil {
+				return err
+			}
+		case s.config.MaxBytes > 0 && s.size+int64(buf.Len()+len(line)) > s.config.MaxBytes &&
+			s.size+int64(buf.Len()) > int64(len(s.header)):
+			if err := s.flush(&buf); err != nil {
+				return err
+			}
+			if err := s.open(day, s.seq+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(line)
+	}
+	return s.flush(&buf)
+}
+
+func (s *Sink) flush(buf *strings.Builder) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	n, err := s.file.WriteString(buf.String())
+	s.size += int64(n)
+	buf.Reset()
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// compressOld gzips the files other than the current one in the background.
+func (s *Sink) compressOld() {
+	files, err := ioutil.ReadDir(s.config.Dir)
+	if err != nil {
+		log.Errorf("(file) could not list %s: %s", s.config.Dir, err.Error())
+		return
+	}
+	current := filepath.Base(s.file.Name())
+	for _, f := range files {
+		m := fileNameRe.FindStringSubmatch(f.Name())
+		if m == nil || m[3] != s.config.Format || m[4] != "" || f.Name() == current {
+			continue
+		}
+		path := filepath.Join(s.config.Dir, f.Name())
+		s.compressMu.Lock()
+		busy := s.compressing[path]
+		s.compressing[path] = true
+		s.compressMu.Unlock()
+		if busy {
+			continue
+		}
+		s.compressWg.Add(1)
+		go func() {
+			defer s.compressWg.Done()
+			if err := gzipFile(path); err != nil {
+				log.Errorf("(file) could not compress %s: %s", path, err.Error())
+			}
+			s.compressMu.Lock()
+			delete(s.compressing, path)
+			s.compressMu.Unlock()
+		}()
+	}
+}
+
+// gzipFile replaces a file with a gzipped copy.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Compressed already.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *Sink) Close() error {
+	err := s.closeFile()
+	s.compressWg.Wait()
+	return err
+}
+
+// ReadFile reads the records from a file written by the sink, gzipped or not. The format is
+// told by the name. CSV files have no dimensions but the location.
+func ReadFile(path string) ([]sink.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	name := path
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		defer zr.Close()
+		r, name = zr, strings.TrimSuffix(name, ".gz")
+	}
+	var records []sink.Record
+	switch filepath.Ext(name) {
+	case "." + FormatCSV:
+		records, err = readCSV(r)
+	case "." + FormatJSONL:
+		records, err = readJSONL(r)
+	default:
+		return nil, fmt.Errorf("%s: not a .%s or .%s file", path, FormatCSV, FormatJSONL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return records, nil
+}
+
+func readCSV(r io.Reader) ([]sink.Record, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 2 || header[0] != "time" || header[1] != "location" {
+		return nil, fmt.Errorf("the header should start with time,location")
+	}
+	records := make([]sink.Record, 0)
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			return nil, err
+		}
+		record := sink.Record{
+			Time:       t,
+			Location:   fields[1],
+			Dimensions: []sink.Dimension{{Name: "location", Value: fields[1]}},
+		}
+		for i, field := range fields[2:] {
+			if field == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, err
+			}
+			record.Values = append(record.Values, sink.Value{Name: header[i+2], Value: v})
+		}
+		records = append(records, record)
+	}
+}
+
+func readJSONL(r io.Reader) ([]sink.Record, error) {
+	records := make([]sink.Record, 0)
+	dec := json.NewDecoder(r)
+	for {
+		var jr jsonRecord
+		err := dec.Decode(&jr)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := sink.Record{Time: jr.Time, Location: jr.Location}
+		for name, value := range jr.Dimensions {
+			record.Dimensions = append(record.Dimensions, sink.Dimension{Name: name, Value: value})
+		}
+		for name, value := range jr.Values {
+			record.Values = append(record.Values, sink.Value{Name: name, Value: value})
+		}
+		// The order is lost in the JSON objects.
+		sort.Slice(record.Dimensions, func(i, j int) bool { return record.Dimensions[i].Name < record.Dimensions[j].Name })
+		sort.Slice(record.Values, func(i, j int) bool { return record.Values[i].Name < record.Values[j].Name })
+		records = append(records, record)
+	}
+}
@@ -0,0 +1,149 @@
+package file
+
+import (
+	"compress/gzip"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/sinktest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2021, 1, 10, 23, 30, 0, 0, time.UTC)
+
+// testRecords are observations from skrindo, in hallingdal.
+func testRecords(start time.Time, n int) []sink.Record {
+	return sinktest.Records("skrindo", start, n, sink.Dimension{Name: "region", Value: "hallingdal"})
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func readGzip(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func listDir(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Test_CSVDailyRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Format: FormatCSV, Compress: true,
+		Variables: []string{"air_temperature", "snow_water_equivalent", "wind_speed"}})
+	assert.Nil(t, err)
+	// 23:30, 23:40, 23:50 and 00:00 the next day.
+	assert.Nil(t, s.Write(testRecords(testStart, 4)))
+	assert.Nil(t, s.Close())
+
+	assert.Equal(t, []string{"observations-2021-01-10.csv.gz", "observations-2021-01-11.csv"}, listDir(t, dir))
+	assert.Equal(t, "time,location,air_temperature,snow_water_equivalent,wind_speed\n"+
+		"2021-01-10T23:30:00Z,skrindo,0,,0\n"+
+		"2021-01-10T23:40:00Z,skrindo,-1,,0.5\n"+
+		"2021-01-10T23:50:00Z,skrindo,-2,,1\n",
+		readGzip(t, filepath.Join(dir, "observations-2021-01-10.csv.gz")))
+	assert.Equal(t, "time,location,air_temperature,snow_water_equivalent,wind_speed\n"+
+		"2021-01-11T00:00:00Z,skrindo,-3,,1.5\n",
+		readFile(t, filepath.Join(dir, "observations-2021-01-11.csv")))
+}
+
+func Test_CSVRestart(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Dir: dir, Format: FormatCSV, Variables: []string{"air_temperature"}}
+	s, err := Open(config)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write(testRecords(testStart, 1)))
+	assert.Nil(t, s.Close())
+
+	// Same columns, continue in the same file.
+	s, err = Open(config)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write(testRecords(testStart.Add(10*time.Minute), 1)))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, "time,location,air_temperature\n"+
+		"2021-01-10T23:30:00Z,skrindo,0\n"+
+		"2021-01-10T23:40:00Z,skrindo,0\n",
+		readFile(t, filepath.Join(dir, "observations-2021-01-10.csv")))
+
+	// Other columns need a new file.
+	config.Variables = []string{"air_temperature", "wind_speed"}
+	s, err = Open(config)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write(testRecords(testStart.Add(20*time.Minute), 1)))
+	assert.Nil(t, s.Close())
+	assert.Equal(t, "time,location,air_temperature,wind_speed\n"+
+		"2021-01-10T23:50:00Z,skrindo,0,0\n",
+		readFile(t, filepath.Join(dir, "observations-2021-01-10.1.csv")))
+}
+
+func Test_JSONLSizeRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Format: FormatJSONL, MaxBytes: 350, Compress: true})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write(testRecords(sinktest.Start, 5)))
+	assert.Nil(t, s.Close())
+
+	// Every line is around 140 bytes, so two fit in a file.
+	assert.Equal(t, []string{"observations-2021-01-10.1.jsonl.gz", "observations-2021-01-10.2.jsonl",
+		"observations-2021-01-10.jsonl.gz"}, listDir(t, dir))
+	assert.Equal(t, `{"time":"2021-01-10T00:00:00Z","location":"skrindo",`+
+		`"dimensions":{"location":"skrindo","region":"hallingdal"},"values":{"air_temperature":0,"wind_speed":0}}`+"\n"+
+		`{"time":"2021-01-10T00:10:00Z","location":"skrindo",`+
+		`"dimensions":{"location":"skrindo","region":"hallingdal"},"values":{"air_temperature":-1,"wind_speed":0.5}}`+"\n",
+		readGzip(t, filepath.Join(dir, "observations-2021-01-10.jsonl.gz")))
+}
+
+func Test_InvalidFormat(t *testing.T) {
+	_, err := Open(Config{Dir: t.TempDir(), Format: "xml"})
+	assert.NotNil(t, err)
+}
+
+func Test_ReadFile(t *testing.T) {
+	records := testRecords(testStart, 4)
+	for _, format := range []string{FormatCSV, FormatJSONL} {
+		dir := t.TempDir()
+		s, err := Open(Config{Dir: dir, Format: format, Compress: true,
+			Variables: []string{"air_temperature", "snow_water_equivalent", "wind_speed"}})
+		assert.Nil(t, err)
+		assert.Nil(t, s.Write(records))
+		assert.Nil(t, s.Close())
+
+		read, err := ReadFile(filepath.Join(dir, "observations-2021-01-10."+format+".gz"))
+		assert.Nil(t, err)
+		assert.Len(t, read, 3)
+		read2, err := ReadFile(filepath.Join(dir, "observations-2021-01-11."+format))
+		assert.Nil(t, err)
+		read = append(read, read2...)
+		for i, r := range read {
+			assert.True(t, records[i].Time.Equal(r.Time))
+			assert.Equal(t, records[i].Location, r.Location)
+			assert.Equal(t, records[i].Values, r.Values)
+		}
+		if format == FormatJSONL {
+			assert.Equal(t, records[0].Dimensions, read[0].Dimensions)
+		}
+	}
+	_, err := ReadFile("observations.xml")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,212 @@
+package graphite
+
+/*
+  Sends the emitted observations to Graphite with the plaintext protocol, a line per
+  location and variable:
+
+    yrpoller.tryvannstua.air_temperature -3.4 1610280000
+
+  With Tags the dimensions of the location are added as Graphite tags, for Graphite 1.1
+  and later:
+
+    yrpoller.tryvannstua.air_temperature;lat=59.998;long=10.666;region=oslo -3.4 1610280000
+
+  The connection is made on the first write, and made again when it has been closed.
+  Lines that can't be sent are kept and sent on the next emit. Carbon keeps the last
+  value for a timestamp, so lines that are sent twice do no harm.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPrefix       = "yrpoller"
+	DefaultMaxPending   = 100000
+	DefaultTimeout      = 10 * time.Second
+	DefaultCarbonPort   = "2003"
+	maxLinesPerWrite    = 1000
+	deadConnectionProbe = time.Millisecond
+)
+
+type Config struct {
+	Address    string // host:port of carbon, the port is DefaultCarbonPort if not given
+	Prefix     string // First part of the metric paths. DefaultPrefix if empty.
+	MaxPending int    // Lines kept for retrying, the oldest are dropped. DefaultMaxPending if 0.
+	Timeout    time.Duration
+	Tags       bool // Add the dimensions, tags of the locations included, as Graphite tags.
+}
+
+type Sink struct {
+	config  Config
+	conn    net.Conn
+	pending [][]byte
+}
+
+func Open(config Config) (*Sink, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("no address given")
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		config.Address = net.JoinHostPort(config.Address, DefaultCarbonPort)
+	}
+	if config.Prefix == "" {
+		config.Prefix = DefaultPrefix
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = DefaultMaxPending
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &Sink{config: config}, nil
+}
+
+func (s *Sink) Name() string {
+	return "graphite"
+}
+
+// Component makes a location id or variable name safe as a part of a metric path.
+// Dots separate the parts and whitespace the fields of a line.
+func Component(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '\t', '\n', '\r', '/':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// Path is the metric path of a variable of a location.
+func Path(prefix string, location string, variable string) string {
+	return prefix + "." + Component(location) + "." + Component(variable)
+}
+
+// tagValue makes a dimension safe as a Graphite tag. Tags are separated by semicolons and
+// can't have empty values.
+func tagValue(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ';', '~', '!', '^', '=', ' ', '\t', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// tags are the dimensions of a record as Graphite tags, leaving out the location that is in the path.
+func tags(dims []sink.Dimension) string {
+	var b strings.Builder
+	for _, d := range dims {
+		if d.Name == "location" || d.Name == "" {
+			continue
+		}
+		b.WriteString(";" + tagValue(d.Name) + "=" + tagValue(d.Value))
+	}
+	return b.String()
+}
+
+func (s *Sink) Write(records []sink.Record) error {
+	for _, r := range records {
+		ts := strconv.FormatInt(r.Time.Unix(), 10)
+		suffix := ""
+		if s.config.Tags {
+			suffix = tags(r.Dimensions)
+		}
+		for _, v := range r.Values {
+			// Carbon has no way of storing these.
+			if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+				continue
+			}
+			line := Path(s.config.Prefix, r.Location, v.Name) + suffix + " " +
+				strconv.FormatFloat(v.Value, 'f', -1, 64) + " " + ts + "\n"
+			s.pending = append(s.pending, []byte(line))
+		}
+	}
+	if over := len(s.pending) - s.config.MaxPending; over > 0 {
+		log.Warnf("(graphite) more than %d lines waiting, dropping the oldest %d", s.config.MaxPending, over)
+		s.pending = s.pending[over:]
+	}
+	for len(s.pending) > 0 {
+		n := len(s.pending)
+		if n > maxLinesPerWrite {
+			n = maxLinesPerWrite
+		}
+		if err := s.send(bytes.Join(s.pending[:n], nil)); err != nil {
+			return fmt.Errorf("%d lines waiting: %s", len(s.pending), err.Error())
+		}
+		s.pending = s.pending[n:]
+	}
+	s.pending = nil
+	return nil
+}
+
+func (s *Sink) send(data []byte) error {
+	if s.conn != nil && !s.alive() {
+		log.Infof("(graphite) %s closed the connection, reconnecting", s.config.Address)
+		s.closeConn()
+	}
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.config.Address, s.config.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout)); err != nil {
+		s.closeConn()
+		return err
+	}
+	if _, err := s.conn.Write(data); err != nil {
+		s.closeConn()
+		return err
+	}
+	return nil
+}
+
+// alive tells if the connection is still open. Carbon never sends anything, so a read
+// that doesn't time out means it has closed the connection. Otherwise the first write
+// after that would seem to succeed, and the lines be lost.
+func (s *Sink) alive() bool {
+	if err := s.conn.SetReadDeadline(time.Now().Add(deadConnectionProbe)); err != nil {
+		return false
+	}
+	var buf [1]byte
+	_, err := s.conn.Read(buf[:])
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+func (s *Sink) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Pending is the number of lines waiting to be sent.
+func (s *Sink) Pending() int {
+	return len(s.pending)
+}
+
+func (s *Sink) Close() error {
+	if len(s.pending) > 0 {
+		log.Warnf("(graphite) closing with %d lines not sent", len(s.pending))
+	}
+	s.closeConn()
+	return nil
+}
@@ -0,0 +1,134 @@
+package graphite
+
+import (
+	"bufio"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// carbon accepts connections and passes on the lines it gets.
+type carbon struct {
+	listener net.Listener
+	lines    chan string
+	conns    chan net.Conn
+}
+
+func newCarbon(t *testing.T) *carbon {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	c := &carbon{listener: l, lines: make(chan string, 100), conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.conns <- conn
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return c
+}
+
+func (c *carbon) read(t *testing.T, n int) []string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		select {
+		case l := <-c.lines:
+			lines = append(lines, l)
+		case <-time.After(time.Second):
+			t.Fatalf("got %d lines, expected %d", len(lines), n)
+		}
+	}
+	return lines
+}
+
+func testRecord(location string, when time.Time, values ...sink.Value) sink.Record {
+	return sink.Record{Time: when, Location: location, Values: values}
+}
+
+func Test_Lines(t *testing.T) {
+	c := newCarbon(t)
+	s, err := Open(Config{Address: c.listener.Addr().String()})
+	assert.Nil(t, err)
+	defer s.Close()
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.Write([]sink.Record{
+		testRecord("tryvannstua", when, sink.Value{Name: "air_temperature", Value: -3.4},
+			sink.Value{Name: "wind_speed", Value: math.NaN()}),
+		testRecord("st. hanshaugen", when, sink.Value{Name: "air_temperature", Value: 1}),
+	}))
+	assert.Equal(t, []string{
+		"yrpoller.tryvannstua.air_temperature -3.4 1610280000",
+		"yrpoller.st__hanshaugen.air_temperature 1 1610280000",
+	}, c.read(t, 2))
+}
+
+func Test_Tags(t *testing.T) {
+	c := newCarbon(t)
+	s, err := Open(Config{Address: c.listener.Addr().String(), Tags: true})
+	assert.Nil(t, err)
+	defer s.Close()
+	r := testRecord("tryvannstua", time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC),
+		sink.Value{Name: "air_temperature", Value: -3.4})
+	r.Dimensions = []sink.Dimension{
+		{Name: "location", Value: "tryvannstua"},
+		{Name: "lat", Value: "59.998"},
+		{Name: "name", Value: "Tryvannstua; Oslo"},
+		{Name: "region", Value: ""},
+	}
+	assert.Nil(t, s.Write([]sink.Record{r}))
+	assert.Equal(t, []string{
+		"yrpoller.tryvannstua.air_temperature;lat=59.998;name=Tryvannstua__Oslo;region=_ -3.4 1610280000",
+	}, c.read(t, 1))
+}
+
+func Test_Reconnect(t *testing.T) {
+	c := newCarbon(t)
+	s, err := Open(Config{Address: c.listener.Addr().String(), Prefix: "weather"})
+	assert.Nil(t, err)
+	defer s.Close()
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", when, sink.Value{Name: "air_temperature", Value: 1})}))
+	c.read(t, 1)
+	(<-c.conns).Close()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", when.Add(time.Hour), sink.Value{Name: "air_temperature", Value: 2})}))
+	assert.Equal(t, []string{"weather.skrindo.air_temperature 2 1610283600"}, c.read(t, 1))
+}
+
+func Test_KeepsLinesWhileDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	s, err := Open(Config{Address: addr, MaxPending: 2, Timeout: time.Second})
+	assert.Nil(t, err)
+	defer s.Close()
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		err := s.Write([]sink.Record{testRecord("skrindo", when.Add(time.Duration(i)*time.Hour),
+			sink.Value{Name: "air_temperature", Value: float64(i)})})
+		assert.NotNil(t, err)
+	}
+	assert.Len(t, s.pending, 2)
+}
+
+func Test_Open(t *testing.T) {
+	s, err := Open(Config{Address: "carbon.example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "carbon.example.com:2003", s.config.Address)
+	_, err = Open(Config{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,382 @@
+package kafka
+
+/*
+  A single node Kafka broker in memory, speaking enough of the protocol for the sink:
+  ApiVersions, Metadata, InitProducerID and Produce. It checks the record batches like a broker does,
+  the CRC and the sequence numbers of idempotent producers, and can be told to fail.
+  Used in the tests here and in the yrsensor package.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// fakeRequests are the requests the FakeBroker answers, in all the versions kmsg knows.
+var fakeRequests = []int16{
+	kmsg.Produce.Int16(), kmsg.Metadata.Int16(), kmsg.ApiVersions.Int16(), kmsg.InitProducerID.Int16(),
+}
+
+// FakeMessage is a message stored by the FakeBroker.
+type FakeMessage struct {
+	Key   []byte
+	Value []byte
+	Time  time.Time
+}
+
+type producerPartition struct {
+	producerID int64
+	partition  int32
+}
+
+type FakeBroker struct {
+	mu         sync.Mutex
+	listener   net.Listener
+	conns      map[net.Conn]bool
+	partitions int32
+	// Messages by topic and partition.
+	messages       map[string][][]FakeMessage
+	nextProducerID int64
+	// The next sequence of the producers, and the first sequence of the last batch, by partition.
+	sequences  map[producerPartition]int32
+	lastBatch  map[producerPartition]int32
+	failures   []int16
+	failAll    int16
+	dropWrites int
+	omits      int
+}
+
+// NewFakeBroker starts a broker on a free port of localhost, with the given number of partitions per topic.
+func NewFakeBroker(partitions int) (*FakeBroker, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeBroker{
+		listener:       l,
+		conns:          make(map[net.Conn]bool),
+		partitions:     int32(partitions),
+		messages:       make(map[string][][]FakeMessage),
+		nextProducerID: 1000,
+		sequences:      make(map[producerPartition]int32),
+		lastBatch:      make(map[producerPartition]int32),
+	}
+	go f.accept()
+	return f, nil
+}
+
+func (f *FakeBroker) Addr() string {
+	return f.listener.Addr().String()
+}
+
+// FailProduce makes the next produce requests fail with the error codes, one per request.
+func (f *FakeBroker) FailProduce(codes ...int16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, codes...)
+}
+
+// FailAllProduce makes all produce requests fail with the error code, until it is called with 0.
+func (f *FakeBroker) FailAllProduce(code int16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failAll = code
+}
+
+// DropAfterWrite makes the next n produce requests be stored, and the connection closed
+// instead of answering them.
+func (f *FakeBroker) DropAfterWrite(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dropWrites += n
+}
+
+// OmitPartitions makes the next n produce requests be answered without their partitions,
+// storing nothing.
+func (f *FakeBroker) OmitPartitions(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.omits += n
+}
+
+// Messages returns the messages of a partition of a topic, in the order they were stored.
+func (f *FakeBroker) Messages(topic string, partition int) []FakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if partition >= len(f.messages[topic]) {
+		return nil
+	}
+	return append([]FakeMessage(nil), f.messages[topic][partition]...)
+}
+
+// AllMessages returns the messages of all partitions of a topic.
+func (f *FakeBroker) AllMessages(topic string) []FakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var all []FakeMessage
+	for _, messages := range f.messages[topic] {
+		all = append(all, messages...)
+	}
+	return all
+}
+
+// DropConnections closes the connections of the clients.
+func (f *FakeBroker) DropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.conns {
+		c.Close()
+		delete(f.conns, c)
+	}
+}
+
+func (f *FakeBroker) Close() error {
+	f.DropConnections()
+	return f.listener.Close()
+}
+
+func (f *FakeBroker) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.mu.Unlock()
+		go f.serve(conn)
+	}
+}
+
+func (f *FakeBroker) serve(conn net.Conn) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		resp, correlationID, err := f.handle(data)
+		if err != nil || resp == nil {
+			return
+		}
+		out := make([]byte, 8, 64)
+		binary.BigEndian.PutUint32(out[4:], uint32(correlationID))
+		// Flexible responses have tagged fields in the header, except ApiVersions.
+		if resp.IsFlexible() && resp.Key() != kmsg.ApiVersions.Int16() {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// skipTags returns what follows the tagged fields at the start of b, or nil if they are cut short.
+func skipTags(b []byte) []byte {
+	n, read := binary.Uvarint(b)
+	if read <= 0 {
+		return nil
+	}
+	b = b[read:]
+	for i := uint64(0); i < n; i++ {
+		_, read := binary.Uvarint(b) // the tag
+		if read <= 0 {
+			return nil
+		}
+		b = b[read:]
+		size, read := binary.Uvarint(b)
+		if read <= 0 || size > uint64(len(b)-read) {
+			return nil
+		}
+		b = b[read+int(size):]
+	}
+	return b
+}
+
+// handle parses a request and returns the response. A nil response closes the connection.
+func (f *FakeBroker) handle(data []byte) (kmsg.Response, int32, error) {
+	if len(data) < 10 {
+		return nil, 0, fmt.Errorf("short request")
+	}
+	key := int16(binary.BigEndian.Uint16(data))
+	version := int16(binary.BigEndian.Uint16(data[2:]))
+	correlationID := int32(binary.BigEndian.Uint32(data[4:]))
+	body := data[10:]
+	if n := int16(binary.BigEndian.Uint16(data[8:])); n > 0 {
+		body = body[n:]
+	}
+	req := kmsg.RequestForKey(key)
+	if req == nil || version > req.MaxVersion() {
+		return nil, 0, fmt.Errorf("unsupported request %d v%d", key, version)
+	}
+	req.SetVersion(version)
+	if req.IsFlexible() {
+		if body = skipTags(body); body == nil {
+			return nil, 0, fmt.Errorf("bad tagged fields in the header of request %d", key)
+		}
+	}
+	if err := req.ReadFrom(body); err != nil {
+		return nil, 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resp kmsg.Response
+	switch r := req.(type) {
+	case *kmsg.ApiVersionsRequest:
+		versions := kmsg.NewPtrApiVersionsResponse()
+		for _, k := range fakeRequests {
+			v := kmsg.NewApiVersionsResponseApiKey()
+			v.ApiKey, v.MaxVersion = k, kmsg.RequestForKey(k).MaxVersion()
+			versions.ApiKeys = append(versions.ApiKeys, v)
+		}
+		resp = versions
+	case *kmsg.MetadataRequest:
+		resp = f.metadata(r)
+	case *kmsg.InitProducerIDRequest:
+		resp = &kmsg.InitProducerIDResponse{ProducerID: f.nextProducerID}
+		f.nextProducerID++
+	case *kmsg.ProduceRequest:
+		resp = f.produce(r)
+		if f.dropWrites > 0 {
+			f.dropWrites--
+			return nil, 0, nil
+		}
+	default:
+		return nil, 0, fmt.Errorf("unsupported request %d", key)
+	}
+	resp.SetVersion(version)
+	return resp, correlationID, nil
+}
+
+func (f *FakeBroker) metadata(req *kmsg.MetadataRequest) *kmsg.MetadataResponse {
+	host, port, _ := net.SplitHostPort(f.Addr())
+	p, _ := strconv.Atoi(port)
+	resp := kmsg.NewPtrMetadataResponse()
+	resp.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: host, Port: int32(p)}}
+	resp.ControllerID = 0
+	for _, t := range req.Topics {
+		topic := kmsg.NewMetadataResponseTopic()
+		topic.Topic = t.Topic
+		if _, ok := f.messages[*t.Topic]; !ok {
+			f.messages[*t.Topic] = make([][]FakeMessage, f.partitions)
+		}
+		for i := int32(0); i < f.partitions; i++ {
+			p := kmsg.NewMetadataResponseTopicPartition()
+			p.Partition, p.Leader, p.Replicas, p.ISR = i, 0, []int32{0}, []int32{0}
+			topic.Partitions = append(topic.Partitions, p)
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	return resp
+}
+
+func (f *FakeBroker) produce(req *kmsg.ProduceRequest) *kmsg.ProduceResponse {
+	failure := f.failAll
+	if len(f.failures) > 0 {
+		failure, f.failures = f.failures[0], f.failures[1:]
+	}
+	resp := kmsg.NewPtrProduceResponse()
+	if f.omits > 0 {
+		f.omits--
+		return resp
+	}
+	for _, t := range req.Topics {
+		topic := kmsg.NewProduceResponseTopic()
+		topic.Topic = t.Topic
+		for _, p := range t.Partitions {
+			part := kmsg.NewProduceResponseTopicPartition()
+			part.Partition = p.Partition
+			part.ErrorCode = failure
+			if failure == 0 {
+				part.ErrorCode = f.append(t.Topic, p.Partition, p.Records)
+			}
+			topic.Partitions = append(topic.Partitions, part)
+		}
+		resp.Topics = append(resp.Topics, topic)
+	}
+	return resp
+}
+
+// append checks a record batch and stores its messages.
+func (f *FakeBroker) append(topic string, partition int32, data []byte) int16 {
+	partitions, ok := f.messages[topic]
+	if !ok || partition < 0 || int(partition) >= len(partitions) {
+		return kerr.UnknownTopicOrPartition.Code
+	}
+	var rb kmsg.RecordBatch
+	if len(data) < 21 || rb.ReadFrom(data) != nil || rb.Magic != 2 ||
+		int(rb.Length) != len(data)-12 || uint32(rb.CRC) != crc32.Checksum(data[21:], castagnoli) {
+		return kerr.CorruptMessage.Code
+	}
+	records := rb.Records
+	switch rb.Attributes & 7 {
+	case 0:
+	case 1:
+		zr, err := gzip.NewReader(bytes.NewReader(records))
+		if err != nil {
+			return kerr.CorruptMessage.Code
+		}
+		if records, err = ioutil.ReadAll(zr); err != nil {
+			return kerr.CorruptMessage.Code
+		}
+	default:
+		return kerr.CorruptMessage.Code
+	}
+	var messages []FakeMessage
+	for len(records) > 0 {
+		length, n := binary.Varint(records)
+		if n <= 0 || int(length) > len(records)-n {
+			return kerr.CorruptMessage.Code
+		}
+		var r kmsg.Record
+		if err := r.ReadFrom(records[:n+int(length)]); err != nil {
+			return kerr.CorruptMessage.Code
+		}
+		records = records[n+int(length):]
+		ms := rb.FirstTimestamp + r.TimestampDelta64
+		messages = append(messages, FakeMessage{Key: r.Key, Value: r.Value, Time: time.Unix(0, ms*int64(time.Millisecond))})
+	}
+	if len(messages) != int(rb.NumRecords) {
+		return kerr.CorruptMessage.Code
+	}
+	if rb.ProducerID >= 0 {
+		pp := producerPartition{producerID: rb.ProducerID, partition: partition}
+		if rb.ProducerID >= f.nextProducerID {
+			return kerr.UnknownProducerID.Code
+		}
+		if last, ok := f.lastBatch[pp]; ok && last == rb.FirstSequence {
+			return kerr.DuplicateSequenceNumber.Code
+		}
+		if rb.FirstSequence != f.sequences[pp] {
+			return kerr.OutOfOrderSequenceNumber.Code
+		}
+		f.lastBatch[pp] = rb.FirstSequence
+		f.sequences[pp] = rb.FirstSequence + rb.NumRecords
+	}
+	partitions[partition] = append(partitions[partition], messages...)
+	return 0
+}
@@ -0,0 +1,332 @@
+package kafka
+
+/*
+  Publishes the emitted observations to a Kafka topic, a message per location and tick keyed
+  by the location id. The partition is picked from the key like the Java client does it, so
+  the messages of a location stay in order.
+
+  The messages are produced with franz-go's kgo client, which finds the leaders, batches,
+  compresses and retries. With idempotent delivery the broker drops batches it already has,
+  so the retries of the client don't make duplicates. Messages the client gives up on are
+  kept here and produced again on the next emit, before the new ones.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJSON = "json"
+	FormatAvro = "avro"
+
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+
+	DefaultBatchSize  = 500
+	DefaultMaxPending = 100000
+	DefaultTimeout    = 10 * time.Second
+
+	// Producer error reasons that aren't Kafka error codes.
+	ReasonTimeout = "TIMEOUT" // the client couldn't deliver the message within the timeout
+	ReasonDropped = "DROPPED"
+)
+
+type Config struct {
+	Brokers     []string // host:port of the brokers to get the cluster metadata from
+	Topic       string
+	Format      string   // FormatJSON or FormatAvro
+	Variables   []string // the fields of the Avro schema
+	Compression string   // CompressionNone or CompressionGzip
+	BatchSize   int      // Messages produced at a time. DefaultBatchSize if 0.
+	Idempotent  bool
+	MaxPending  int           // Messages kept for retrying, the oldest are dropped. DefaultMaxPending if 0.
+	Timeout     time.Duration // Of connecting and of delivering a message. DefaultTimeout if 0.
+	ClientID    string
+	// OnError is told about producer errors, by Kafka error name or ReasonTimeout and ReasonDropped.
+	OnError func(reason string, count int, err error)
+}
+
+// jsonMessage is the value of a message in the JSON format.
+type jsonMessage struct {
+	Time       time.Time          `json:"time"`
+	Location   string             `json:"location"`
+	Dimensions map[string]string  `json:"dimensions"`
+	Values     map[string]float64 `json:"values"`
+}
+
+type message struct {
+	key   []byte
+	value []byte
+	time  time.Time
+}
+
+type Sink struct {
+	config  Config
+	codec   *goavro.Codec
+	client  *kgo.Client
+	pending []message // not delivered yet, the oldest first
+}
+
+func Open(config Config) (*Sink, error) {
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, fmt.Errorf("brokers and topic must be given")
+	}
+	if config.Compression == "" {
+		config.Compression = CompressionNone
+	}
+	if config.Compression != CompressionNone && config.Compression != CompressionGzip {
+		return nil, fmt.Errorf("unknown compression '%s', use %s or %s", config.Compression, CompressionNone, CompressionGzip)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = DefaultMaxPending
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.ClientID == "" {
+		config.ClientID = "yrpoller"
+	}
+	s := &Sink{config: config}
+	switch config.Format {
+	case FormatJSON:
+	case FormatAvro:
+		codec, err := goavro.NewCodec(AvroSchema(config.Variables))
+		if err != nil {
+			return nil, err
+		}
+		s.codec = codec
+	default:
+		return nil, fmt.Errorf("unknown format '%s', use %s or %s", config.Format, FormatJSON, FormatAvro)
+	}
+	compression := kgo.NoCompression()
+	if config.Compression == CompressionGzip {
+		compression = kgo.GzipCompression()
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ClientID(config.ClientID),
+		kgo.DefaultProduceTopic(config.Topic),
+		kgo.AllowAutoTopicCreation(),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.ProducerBatchCompression(compression),
+		kgo.DialTimeout(config.Timeout),
+		kgo.ProduceRequestTimeout(config.Timeout),
+		// The client retries after fresh metadata, which it gets at most this often.
+		kgo.MetadataMinAge(config.Timeout / 4),
+		kgo.WithLogger(logger{}),
+	}
+	if !config.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return "kafka"
+}
+
+// AvroSchema is the schema of the messages in the Avro format. The variables are nullable doubles.
+func AvroSchema(variables []string) string {
+	fields := []string{
+		`{"name": "time", "type": {"type": "long", "logicalType": "timestamp-millis"}}`,
+		`{"name": "location", "type": "string"}`,
+		`{"name": "dimensions", "type": {"type": "map", "values": "string"}}`,
+	}
+	for _, v := range variables {
+		fields = append(fields, fmt.Sprintf(`{"name": %q, "type": ["null", "double"], "default": null}`, v))
+	}
+	return `{"type": "record", "name": "Observation", "namespace": "yrpoller", "fields": [` +
+		strings.Join(fields, ", ") + `]}`
+}
+
+// encode makes the value of a message. Avro messages use the single object encoding, with the
+// fingerprint of the schema first.
+func (s *Sink) encode(r sink.Record) ([]byte, error) {
+	dims := make(map[string]string, len(r.Dimensions))
+	for _, d := range r.Dimensions {
+		dims[d.Name] = d.Value
+	}
+	if s.codec == nil {
+		m := jsonMessage{Time: r.Time.UTC(), Location: r.Location, Dimensions: dims, Values: make(map[string]float64)}
+		for _, v := range r.Values {
+			m.Values[v.Name] = v.Value
+		}
+		return json.Marshal(m)
+	}
+	native := map[string]interface{}{
+		"time":     r.Time.UTC(),
+		"location": r.Location,
+	}
+	avroDims := make(map[string]interface{}, len(dims))
+	for k, v := range dims {
+		avroDims[k] = v
+	}
+	native["dimensions"] = avroDims
+	for _, name := range s.config.Variables {
+		native[name] = nil
+	}
+	for _, v := range r.Values {
+		if _, ok := native[v.Name]; ok {
+			native[v.Name] = goavro.Union("double", v.Value)
+		}
+	}
+	return s.codec.SingleFromNative(nil, native)
+}
+
+func (s *Sink) Write(records []sink.Record) error {
+	for _, r := range records {
+		value, err := s.encode(r)
+		if err != nil {
+			return err
+		}
+		s.pending = append(s.pending, message{key: []byte(r.Location), value: value, time: r.Time})
+	}
+	s.trim()
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("%d messages waiting: %s", s.Pending(), err.Error())
+	}
+	return nil
+}
+
+func (s *Sink) report(reason string, count int, err error) {
+	log.Warnf("(kafka) %s: %s", reason, err.Error())
+	if s.config.OnError != nil {
+		s.config.OnError(reason, count, err)
+	}
+}
+
+// Pending is the number of messages waiting to be delivered.
+func (s *Sink) Pending() int {
+	return len(s.pending)
+}
+
+// trim drops the oldest messages beyond MaxPending.
+func (s *Sink) trim() {
+	over := len(s.pending) - s.config.MaxPending
+	if over <= 0 {
+		return
+	}
+	s.pending = s.pending[over:]
+	s.report(ReasonDropped, over, fmt.Errorf("more than %d messages waiting, dropped %d", s.config.MaxPending, over))
+}
+
+// flush produces the pending messages, BatchSize at a time. It stops after the first round
+// with messages that weren't delivered, so those are sent again before the newer messages.
+func (s *Sink) flush() error {
+	for len(s.pending) > 0 {
+		n := len(s.pending)
+		if n > s.config.BatchSize {
+			n = s.config.BatchSize
+		}
+		failed, err := s.produce(s.pending[:n])
+		if err != nil {
+			s.pending = append(failed, s.pending[n:]...)
+			return err
+		}
+		s.pending = s.pending[n:]
+	}
+	s.pending = nil
+	return nil
+}
+
+// produce sends the messages and waits for them. It returns the messages to try again, in the
+// order they were given, and the first error. The messages the broker refused for good are
+// reported and dropped.
+func (s *Sink) produce(messages []message) ([]message, error) {
+	index := make(map[*kgo.Record]int, len(messages))
+	records := make([]*kgo.Record, len(messages))
+	for i, m := range messages {
+		records[i] = &kgo.Record{Key: m.key, Value: m.value, Timestamp: m.time}
+		index[records[i]] = i
+	}
+	// The client's delivery timeout counts from the timestamp of the message, which is the time
+	// of the observation, so the context is the timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+	errs := make([]error, len(messages))
+	for _, result := range s.client.ProduceSync(ctx, records...) {
+		errs[index[result.Record]] = result.Err
+	}
+
+	var (
+		retry  []message
+		first  error
+		counts = make(map[string]int)
+		last   = make(map[string]error)
+		order  []string
+	)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		reason := ReasonTimeout
+		var kafkaErr *kerr.Error
+		if errors.As(err, &kafkaErr) {
+			reason = kafkaErr.Message
+		}
+		if reason == ReasonTimeout || kafkaErr.Retriable {
+			retry = append(retry, messages[i])
+		} else {
+			err = fmt.Errorf("dropped: %w", err)
+		}
+		if _, ok := counts[reason]; !ok {
+			order = append(order, reason)
+		}
+		counts[reason]++
+		last[reason] = err
+	}
+	for _, reason := range order {
+		s.report(reason, counts[reason], last[reason])
+	}
+	return retry, first
+}
+
+// Close drops the messages that are still waiting.
+func (s *Sink) Close() error {
+	if n := s.Pending(); n > 0 {
+		log.Warnf("(kafka) closing with %d messages not delivered", n)
+	}
+	s.client.Close()
+	return nil
+}
+
+// logger passes the warnings and errors of the client on.
+type logger struct{}
+
+func (logger) Level() kgo.LogLevel {
+	return kgo.LogLevelWarn
+}
+
+func (logger) Log(level kgo.LogLevel, msg string, keyvals ...interface{}) {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	if level == kgo.LogLevelError {
+		log.Errorf("(kafka) %s", b.String())
+		return
+	}
+	log.Warnf("(kafka) %s", b.String())
+}
@@ -0,0 +1,230 @@
+package kafka
+
+import (
+	"encoding/json"
+	"github.com/linkedin/goavro/v2"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"testing"
+	"time"
+)
+
+type producerError struct {
+	reason string
+	count  int
+}
+
+func testRecord(location string, when time.Time, temperature float64) sink.Record {
+	return sink.Record{
+		Time:       when,
+		Location:   location,
+		Dimensions: []sink.Dimension{{Name: "location", Value: location}},
+		Values:     []sink.Value{{Name: "air_temperature", Value: temperature}},
+	}
+}
+
+func openTest(t *testing.T, config Config) (*Sink, *FakeBroker, *[]producerError) {
+	f, err := NewFakeBroker(3)
+	assert.Nil(t, err)
+	t.Cleanup(func() { f.Close() })
+	var errs []producerError
+	config.Brokers = []string{f.Addr()}
+	config.Topic = "observations"
+	config.Timeout = time.Second
+	config.OnError = func(reason string, count int, err error) {
+		errs = append(errs, producerError{reason, count})
+	}
+	s, err := Open(config)
+	assert.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, f, &errs
+}
+
+func Test_JavaPartitions(t *testing.T) {
+	s, f, _ := openTest(t, Config{Format: FormatJSON})
+	// The murmur2 hashes of the keys, from the tests of the Java client. It takes the partition
+	// from the positive hash.
+	hashes := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	var records []sink.Record
+	for key := range hashes {
+		records = append(records, testRecord(key, time.Now(), 0))
+	}
+	assert.Nil(t, s.Write(records))
+	for key, hash := range hashes {
+		partition := int((hash & 0x7fffffff) % 3)
+		found := false
+		for _, m := range f.Messages("observations", partition) {
+			found = found || string(m.Key) == key
+		}
+		assert.True(t, found, "%s in partition %d", key, partition)
+	}
+}
+
+func Test_JSONKeyedMessages(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Compression: CompressionGzip, Idempotent: true})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		when := start.Add(time.Duration(i) * 10 * time.Minute)
+		assert.Nil(t, s.Write([]sink.Record{
+			testRecord("skrindo", when, float64(i)),
+			testRecord("tryvannstua", when, float64(-i)),
+		}))
+	}
+	assert.Empty(t, *errs)
+	for location, partition := range map[string]int{"skrindo": 0, "tryvannstua": 2} {
+		messages := f.Messages("observations", partition)
+		var mine []jsonMessage
+		for _, m := range messages {
+			if string(m.Key) == location {
+				var decoded jsonMessage
+				assert.Nil(t, json.Unmarshal(m.Value, &decoded))
+				assert.True(t, decoded.Time.Equal(m.Time))
+				mine = append(mine, decoded)
+			}
+		}
+		assert.Len(t, mine, 3, location)
+		for i, m := range mine {
+			assert.Equal(t, location, m.Location)
+			assert.Equal(t, map[string]string{"location": location}, m.Dimensions)
+			assert.True(t, m.Time.Equal(start.Add(time.Duration(i)*10*time.Minute)))
+		}
+	}
+}
+
+func Test_Avro(t *testing.T) {
+	s, f, _ := openTest(t, Config{Format: FormatAvro, Variables: []string{"air_temperature", "snow_water_equivalent"}})
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", when, -3.5)}))
+	messages := f.AllMessages("observations")
+	assert.Len(t, messages, 1)
+
+	codec, err := goavro.NewCodec(AvroSchema([]string{"air_temperature", "snow_water_equivalent"}))
+	assert.Nil(t, err)
+	native, _, err := codec.NativeFromSingle(messages[0].Value)
+	assert.Nil(t, err)
+	m := native.(map[string]interface{})
+	assert.Equal(t, "skrindo", m["location"])
+	assert.True(t, m["time"].(time.Time).Equal(when))
+	assert.Equal(t, map[string]interface{}{"location": "skrindo"}, m["dimensions"])
+	assert.Equal(t, map[string]interface{}{"double": -3.5}, m["air_temperature"])
+	assert.Nil(t, m["snow_water_equivalent"])
+}
+
+func Test_RetryKeepsOrder(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Idempotent: true})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	f.FailAllProduce(kerr.NotEnoughReplicas.Code)
+	assert.NotNil(t, s.Write([]sink.Record{testRecord("skrindo", start, 0)}))
+	assert.Equal(t, []producerError{{ReasonTimeout, 1}}, *errs)
+	assert.Empty(t, f.AllMessages("observations"))
+	assert.Equal(t, 1, s.Pending())
+
+	f.FailAllProduce(0)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start.Add(10*time.Minute), 1)}))
+	messages := f.AllMessages("observations")
+	assert.Len(t, messages, 2)
+	assert.True(t, messages[0].Time.Equal(start))
+	assert.True(t, messages[1].Time.Equal(start.Add(10*time.Minute)))
+	assert.Equal(t, 0, s.Pending())
+}
+
+func Test_RetriedByTheClient(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Idempotent: true})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	f.FailProduce(kerr.NotEnoughReplicas.Code)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start, 0)}), "a short failure is retried within the timeout")
+	assert.Empty(t, *errs)
+	assert.Len(t, f.AllMessages("observations"), 1)
+}
+
+func Test_Refused(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Idempotent: true})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	f.FailProduce(kerr.InvalidRecord.Code)
+	assert.NotNil(t, s.Write([]sink.Record{testRecord("skrindo", start, 0)}))
+	assert.Equal(t, []producerError{{"INVALID_RECORD", 1}}, *errs)
+	assert.Equal(t, 0, s.Pending(), "what the broker refuses is dropped")
+
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start.Add(10*time.Minute), 1)}))
+	assert.Len(t, f.AllMessages("observations"), 1)
+}
+
+func Test_NoDuplicatesAfterLostResponse(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Idempotent: true})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	f.DropAfterWrite(1)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start, 0)}))
+	assert.Empty(t, *errs)
+	assert.Len(t, f.AllMessages("observations"), 1, "the broker drops the batch it already has")
+
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start.Add(10*time.Minute), 1)}))
+	assert.Len(t, f.AllMessages("observations"), 2)
+}
+
+func Test_BrokerDown(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, MaxPending: 2})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start, 0)}))
+	f.Close()
+	for i := 1; i <= 3; i++ {
+		assert.NotNil(t, s.Write([]sink.Record{testRecord("skrindo", start.Add(time.Duration(i)*time.Minute), 0)}))
+	}
+	assert.Equal(t, ReasonTimeout, (*errs)[0].reason)
+	assert.Contains(t, *errs, producerError{ReasonDropped, 1})
+	assert.Equal(t, 2, s.Pending())
+}
+
+func Test_UnansweredPartition(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Idempotent: true})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	f.OmitPartitions(1)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start, 0)}))
+	assert.Empty(t, *errs)
+	assert.Len(t, f.AllMessages("observations"), 1)
+}
+
+func Test_BatchSize(t *testing.T) {
+	s, f, errs := openTest(t, Config{Format: FormatJSON, Idempotent: true, BatchSize: 2})
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	var records []sink.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, testRecord("skrindo", start.Add(time.Duration(i)*time.Minute), float64(i)))
+	}
+	f.FailProduce(0, kerr.InvalidRecord.Code)
+	assert.NotNil(t, s.Write(records))
+	assert.Equal(t, []producerError{{"INVALID_RECORD", 2}}, *errs)
+	assert.Equal(t, 1, s.Pending(), "the writing stops at the failed round")
+
+	assert.Nil(t, s.Write(nil))
+	messages := f.AllMessages("observations")
+	assert.Len(t, messages, 3)
+	assert.True(t, messages[2].Time.Equal(start.Add(4*time.Minute)))
+}
+
+func Test_trim(t *testing.T) {
+	var errs []producerError
+	s := &Sink{config: Config{MaxPending: 2, OnError: func(reason string, count int, err error) {
+		errs = append(errs, producerError{reason, count})
+	}}}
+	s.pending = []message{{key: []byte("oldest")}, {key: []byte("older")}, {key: []byte("newer")}, {key: []byte("newest")}}
+	s.trim()
+	assert.Equal(t, []message{{key: []byte("newer")}, {key: []byte("newest")}}, s.pending)
+	assert.Equal(t, []producerError{{ReasonDropped, 2}}, errs)
+}
+
+func Test_InvalidConfig(t *testing.T) {
+	_, err := Open(Config{Brokers: []string{"localhost:9092"}, Topic: "observations", Format: "xml"})
+	assert.NotNil(t, err)
+	_, err = Open(Config{Brokers: []string{"localhost:9092"}, Topic: "observations", Format: FormatJSON, Compression: "lz4"})
+	assert.NotNil(t, err)
+	_, err = Open(Config{Topic: "observations", Format: FormatJSON})
+	assert.NotNil(t, err)
+}
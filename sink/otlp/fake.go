@@ -0,0 +1,149 @@
+package otlp
+
+/*
+  A stand-in for an OpenTelemetry collector, taking OTLP/HTTP JSON on /v1/metrics.
+  It keeps the data points it gets and can be told to fail. Used in the tests here
+  and in the yrsensor package.
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FakePoint is a data point received by the FakeCollector, with the resource and metric it belongs to.
+type FakePoint struct {
+	Resource   map[string]string
+	Metric     string
+	Unit       string
+	Kind       Kind
+	Start      time.Time
+	Time       time.Time
+	Attributes map[string]string
+	Value      float64
+}
+
+type FakeCollector struct {
+	mu       sync.Mutex
+	server   *httptest.Server
+	points   []FakePoint
+	failures []int
+	// Headers of the last request.
+	headers http.Header
+}
+
+func NewFakeCollector() *FakeCollector {
+	f := &FakeCollector{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+// Endpoint is the URL to give in Config.Endpoint.
+func (f *FakeCollector) Endpoint() string {
+	return f.server.URL
+}
+
+// FailNext makes the next requests fail with the HTTP status codes, one per request.
+func (f *FakeCollector) FailNext(statusCodes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, statusCodes...)
+}
+
+// Points returns the data points received, in order.
+func (f *FakeCollector) Points() []FakePoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakePoint(nil), f.points...)
+}
+
+// Header returns a header of the last request.
+func (f *FakeCollector) Header(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headers.Get(name)
+}
+
+func (f *FakeCollector) Close() {
+	f.server.Close()
+}
+
+func fromAttributes(kvs []keyValue) map[string]string {
+	if len(kvs) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value.StringValue
+	}
+	return m
+}
+
+func fromUnixNano(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return time.Unix(0, n).UTC()
+}
+
+func (f *FakeCollector) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/metrics" || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.headers = r.Header
+	if len(f.failures) > 0 {
+		code := f.failures[0]
+		f.failures = f.failures[1:]
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, rm := range req.ResourceMetrics {
+		res := fromAttributes(rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				kind, dps := Gauge, []numberDataPoint(nil)
+				if m.Gauge != nil {
+					dps = m.Gauge.DataPoints
+				}
+				if m.Sum != nil {
+					if m.Sum.AggregationTemporality != temporalityCumulative || !m.Sum.IsMonotonic {
+						http.Error(w, "only cumulative monotonic sums are expected", http.StatusBadRequest)
+						return
+					}
+					kind, dps = Counter, m.Sum.DataPoints
+				}
+				for _, dp := range dps {
+					f.points = append(f.points, FakePoint{
+						Resource:   res,
+						Metric:     m.Name,
+						Unit:       m.Unit,
+						Kind:       kind,
+						Start:      fromUnixNano(dp.StartTimeUnixNano),
+						Time:       fromUnixNano(dp.TimeUnixNano),
+						Attributes: fromAttributes(dp.Attributes),
+						Value:      dp.AsDouble,
+					})
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
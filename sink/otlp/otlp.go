@@ -0,0 +1,346 @@
+package otlp
+
+/*
+  Exports metrics to an OpenTelemetry collector with OTLP/HTTP, in the JSON encoding:
+
+    POST <endpoint>/v1/metrics
+
+  As a sink it exports the emitted values as gauges, a resource per location with the
+  dimensions of the location as resource attributes. Export is used for the metrics of
+  the daemon itself.
+
+  Values that can't be exported because the collector is unavailable are kept and
+  exported with the next emit. gRPC isn't supported, collectors listen for OTLP/HTTP
+  on port 4318 by default.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultServiceName = "yrpoller"
+	DefaultMaxPending  = 10000
+	DefaultTimeout     = 10 * time.Second
+	// Weather values are exported as <prefix><variable>.
+	WeatherPrefix = "weather."
+
+	scopeName = "github.com/perbu/yrpoller"
+
+	temporalityCumulative = 2
+)
+
+type Config struct {
+	Endpoint    string            // Like "http://localhost:4318", /v1/metrics is added.
+	Headers     map[string]string // Added to every request, like an authorization header.
+	ServiceName string            // DefaultServiceName if empty.
+	MaxPending  int               // Resources kept for retrying, the oldest are dropped. DefaultMaxPending if 0.
+	Timeout     time.Duration
+}
+
+type Kind int
+
+const (
+	Gauge   Kind = iota
+	Counter      // A cumulative, monotonic sum.
+)
+
+type Point struct {
+	Time       time.Time // The time of the export if zero.
+	Attributes map[string]string
+	Value      float64
+}
+
+type Metric struct {
+	Name        string
+	Description string
+	Unit        string
+	Kind        Kind
+	Start       time.Time // When a Counter started counting.
+	Points      []Point
+}
+
+// Resource is what the metrics are about. The service name is added to the attributes.
+type Resource struct {
+	Attributes map[string]string
+	Metrics    []Metric
+}
+
+// LocationAttributes are the resource attributes of a location: the id as location.id
+// and the other dimensions as location.<name>.
+func LocationAttributes(dimensions []sink.Dimension) map[string]string {
+	attrs := make(map[string]string, len(dimensions))
+	for _, d := range dimensions {
+		if d.Name == "location" {
+			attrs["location.id"] = d.Value
+		} else {
+			attrs["location."+d.Name] = d.Value
+		}
+	}
+	return attrs
+}
+
+type Exporter struct {
+	config  Config
+	url     string
+	client  *http.Client
+	pending []Resource
+}
+
+func Open(config Config) (*Exporter, error) {
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return nil, fmt.Errorf("endpoint must be an http:// or https:// URL, got '%s'", config.Endpoint)
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = DefaultServiceName
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = DefaultMaxPending
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	return &Exporter{
+		config: config,
+		url:    strings.TrimSuffix(config.Endpoint, "/") + "/v1/metrics",
+		client: &http.Client{Timeout: config.Timeout},
+	}, nil
+}
+
+func (e *Exporter) Name() string {
+	return "otlp"
+}
+
+// Write exports the values of the records as gauges. The values are kept if the collector is unavailable.
+func (e *Exporter) Write(records []sink.Record) error {
+	for _, r := range records {
+		res := Resource{Attributes: LocationAttributes(r.Dimensions)}
+		for _, v := range r.Values {
+			res.Metrics = append(res.Metrics, Metric{
+				Name:   WeatherPrefix + v.Name,
+				Kind:   Gauge,
+				Points: []Point{{Time: r.Time, Value: v.Value}},
+			})
+		}
+		e.pending = append(e.pending, res)
+	}
+	if over := len(e.pending) - e.config.MaxPending; over > 0 {
+		log.Warnf("(otlp) more than %d locations waiting, dropping the oldest %d", e.config.MaxPending, over)
+		e.pending = e.pending[over:]
+	}
+	if len(e.pending) == 0 {
+		return nil
+	}
+	err := e.Export(e.pending)
+	if err != nil && isRetriable(err) {
+		return fmt.Errorf("%d locations waiting: %s", len(e.pending), err.Error())
+	}
+	e.pending = nil
+	return err
+}
+
+// ExportError is a response from the collector other than 200.
+type ExportError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ExportError) Error() string {
+	return fmt.Sprintf("collector responded %d: %s", e.StatusCode, e.Message)
+}
+
+// isRetriable tells if the export can succeed later, the status codes are those of the OTLP spec.
+func isRetriable(err error) bool {
+	ee, ok := err.(*ExportError)
+	if !ok {
+		return true // Couldn't connect, or timed out.
+	}
+	switch ee.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Export sends the metrics in one request.
+func (e *Exporter) Export(resources []Resource) error {
+	body, err := json.Marshal(e.request(resources, time.Now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return &ExportError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+	var result exportResponse
+	if json.Unmarshal(respBody, &result) == nil && result.PartialSuccess != nil {
+		if n, _ := strconv.ParseInt(string(result.PartialSuccess.RejectedDataPoints), 10, 64); n > 0 {
+			log.Warnf("(otlp) collector rejected %d data points: %s", n, result.PartialSuccess.ErrorMessage)
+		}
+	}
+	return nil
+}
+
+// Pending is the number of locations waiting to be exported.
+func (e *Exporter) Pending() int {
+	return len(e.pending)
+}
+
+func (e *Exporter) Close() error {
+	if len(e.pending) > 0 {
+		log.Warnf("(otlp) closing with %d locations not exported", len(e.pending))
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of ExportMetricsServiceRequest, see opentelemetry-proto.
+// 64 bit integers are strings.
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type numberDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string     `json:"timeUnixNano"`
+	AsDouble          float64    `json:"asDouble"`
+}
+
+type gauge struct {
+	DataPoints []numberDataPoint `json:"dataPoints"`
+}
+
+type sum struct {
+	DataPoints             []numberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type metric struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Gauge       *gauge `json:"gauge,omitempty"`
+	Sum         *sum   `json:"sum,omitempty"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type scopeMetrics struct {
+	Scope   scope    `json:"scope"`
+	Metrics []metric `json:"metrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+type exportRequest struct {
+	ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+}
+
+type exportResponse struct {
+	PartialSuccess *struct {
+		RejectedDataPoints json.Number `json:"rejectedDataPoints"`
+		ErrorMessage       string      `json:"errorMessage"`
+	} `json:"partialSuccess"`
+}
+
+// attributes sorts the attributes by key, so the requests are the same every time.
+func attributes(m map[string]string) []keyValue {
+	kvs := make([]keyValue, 0, len(m))
+	for k, v := range m {
+		kvs = append(kvs, keyValue{Key: k, Value: anyValue{StringValue: v}})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *Exporter) request(resources []Resource, now time.Time) exportRequest {
+	var req exportRequest
+	for _, r := range resources {
+		attrs := map[string]string{"service.name": e.config.ServiceName}
+		for k, v := range r.Attributes {
+			attrs[k] = v
+		}
+		sm := scopeMetrics{Scope: scope{Name: scopeName}}
+		for _, m := range r.Metrics {
+			var points []numberDataPoint
+			for _, p := range m.Points {
+				// JSON has no NaN or infinity.
+				if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+					continue
+				}
+				t := p.Time
+				if t.IsZero() {
+					t = now
+				}
+				dp := numberDataPoint{Attributes: attributes(p.Attributes), TimeUnixNano: unixNano(t), AsDouble: p.Value}
+				if m.Kind == Counter && !m.Start.IsZero() {
+					dp.StartTimeUnixNano = unixNano(m.Start)
+				}
+				points = append(points, dp)
+			}
+			if len(points) == 0 {
+				continue
+			}
+			om := metric{Name: m.Name, Description: m.Description, Unit: m.Unit}
+			if m.Kind == Counter {
+				om.Sum = &sum{DataPoints: points, AggregationTemporality: temporalityCumulative, IsMonotonic: true}
+			} else {
+				om.Gauge = &gauge{DataPoints: points}
+			}
+			sm.Metrics = append(sm.Metrics, om)
+		}
+		if len(sm.Metrics) == 0 {
+			continue
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, resourceMetrics{
+			Resource:     resource{Attributes: attributes(attrs)},
+			ScopeMetrics: []scopeMetrics{sm},
+		})
+	}
+	return req
+}
@@ -0,0 +1,104 @@
+package otlp
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testRecord(location string, when time.Time, temperature float64) sink.Record {
+	return sink.Record{
+		Time:     when,
+		Location: location,
+		Dimensions: []sink.Dimension{
+			{Name: "location", Value: location},
+			{Name: "region", Value: "oslo"},
+		},
+		Values: []sink.Value{
+			{Name: "air_temperature", Value: temperature},
+			{Name: "wind_speed", Value: math.NaN()},
+		},
+	}
+}
+
+func Test_WeatherGauges(t *testing.T) {
+	c := NewFakeCollector()
+	defer c.Close()
+	e, err := Open(Config{Endpoint: c.Endpoint(), Headers: map[string]string{"Authorization": "Bearer secret"}})
+	assert.Nil(t, err)
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, e.Write([]sink.Record{testRecord("tryvannstua", when, -3.4), testRecord("skrindo", when, 1)}))
+
+	assert.Equal(t, "Bearer secret", c.Header("Authorization"))
+	assert.Equal(t, []FakePoint{
+		{
+			Resource: map[string]string{"service.name": "yrpoller", "location.id": "tryvannstua", "location.region": "oslo"},
+			Metric:   "weather.air_temperature",
+			Kind:     Gauge,
+			Time:     when,
+			Value:    -3.4,
+		},
+		{
+			Resource: map[string]string{"service.name": "yrpoller", "location.id": "skrindo", "location.region": "oslo"},
+			Metric:   "weather.air_temperature",
+			Kind:     Gauge,
+			Time:     when,
+			Value:    1,
+		},
+	}, c.Points())
+}
+
+func Test_RetryWhenUnavailable(t *testing.T) {
+	c := NewFakeCollector()
+	defer c.Close()
+	e, err := Open(Config{Endpoint: c.Endpoint()})
+	assert.Nil(t, err)
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	c.FailNext(http.StatusServiceUnavailable)
+	assert.NotNil(t, e.Write([]sink.Record{testRecord("skrindo", when, 1)}))
+	assert.Empty(t, c.Points())
+	assert.Nil(t, e.Write([]sink.Record{testRecord("skrindo", when.Add(10*time.Minute), 2)}))
+	points := c.Points()
+	assert.Len(t, points, 2)
+	assert.Equal(t, when, points[0].Time)
+	assert.Equal(t, 2.0, points[1].Value)
+
+	// Not retried.
+	c.FailNext(http.StatusBadRequest)
+	assert.NotNil(t, e.Write([]sink.Record{testRecord("skrindo", when.Add(20*time.Minute), 3)}))
+	assert.Empty(t, e.pending)
+}
+
+func Test_Counters(t *testing.T) {
+	c := NewFakeCollector()
+	defer c.Close()
+	e, err := Open(Config{Endpoint: c.Endpoint(), ServiceName: "poller"})
+	assert.Nil(t, err)
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, e.Export([]Resource{{
+		Metrics: []Metric{{
+			Name:   "yrpoller.rejected_records",
+			Unit:   "{record}",
+			Kind:   Counter,
+			Start:  start,
+			Points: []Point{{Attributes: map[string]string{"reason": "too old"}, Value: 3}},
+		}},
+	}}))
+	points := c.Points()
+	assert.Len(t, points, 1)
+	assert.Equal(t, map[string]string{"service.name": "poller"}, points[0].Resource)
+	assert.Equal(t, Counter, points[0].Kind)
+	assert.Equal(t, start, points[0].Start)
+	assert.Equal(t, map[string]string{"reason": "too old"}, points[0].Attributes)
+	assert.Equal(t, "{record}", points[0].Unit)
+	assert.False(t, points[0].Time.IsZero())
+}
+
+func Test_InvalidEndpoint(t *testing.T) {
+	_, err := Open(Config{Endpoint: "localhost:4317"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,306 @@
+package parquet
+
+/*
+  Writes the emitted observations to Parquet files for analysis in Spark, DuckDB and the like,
+  partitioned Hive style by location and date:
+
+    <dir>/location=tryvannstua/date=2021-01-10/part-0.parquet
+
+  The rows of each location are kept until the hour is over and then written as a row group,
+  so a file holds a row group per hour of the day. A restart continues in a new part file.
+  A row group that can't be written is kept and tried again on the next write, in a part
+  file of its own.
+*/
+
+import (
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+
+	dateLayout = "2006-01-02"
+	// Rows of failed row groups kept beyond this are dropped, the oldest first.
+	maxFailedRows = sink.DefaultMaxQueuedRecords
+)
+
+type ColumnType int
+
+const (
+	Double    ColumnType = iota
+	Timestamp            // Seconds since the epoch in the records, stored as a timestamp.
+)
+
+// Column is a variable in the schema. The time of the row is always the first column.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+type Config struct {
+	Dir         string
+	Compression string // CompressionGzip or CompressionNone
+	Columns     []Column
+}
+
+type row struct {
+	time   time.Time
+	values map[string]float64
+}
+
+// partition is the file of a location and date, and the rows of the hour not written yet.
+type partition struct {
+	date string
+	hour time.Time
+	file *fileWriter
+	rows []row
+}
+
+// failedGroup is a row group that couldn't be written.
+type failedGroup struct {
+	location string
+	date     string
+	rows     []row
+}
+
+type Sink struct {
+	config     Config
+	codec      int32
+	columns    []schemaColumn
+	partitions map[string]*partition // by location
+	failed     []failedGroup         // tried again on the next write
+}
+
+func Open(config Config) (*Sink, error) {
+	s := &Sink{config: config, partitions: make(map[string]*partition)}
+	switch config.Compression {
+	case CompressionGzip:
+		s.codec = codecGzip
+	case CompressionNone, "":
+		s.codec = codecUncompressed
+	default:
+		return nil, fmt.Errorf("unknown compression '%s', use %s or %s", config.Compression, CompressionGzip, CompressionNone)
+	}
+	s.columns = []schemaColumn{{name: "time", physical: typeInt64, timestamp: true}}
+	for _, c := range config.Columns {
+		if c.Type == Timestamp {
+			s.columns = append(s.columns, schemaColumn{name: c.Name, physical: typeInt64, timestamp: true, optional: true})
+		} else {
+			s.columns = append(s.columns, schemaColumn{name: c.Name, physical: typeDouble, optional: true})
+		}
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return "parquet"
+}
+
+// Write buffers the records. The rows of an hour are written when a record from a later hour comes along.
+func (s *Sink) Write(records []sink.Record) error {
+	var latest time.Time
+	failed := s.retry()
+	for _, r := range records {
+		t := r.Time.UTC()
+		date, hour := t.Format(dateLayout), t.Truncate(time.Hour)
+		p := s.partitions[r.Location]
+		if p != nil && (p.date != date || !p.hour.Equal(hour)) {
+			if err := s.flush(r.Location, p); err != nil {
+				failed = append(failed, err)
+			}
+			if p.date != date {
+				s.closePartition(r.Location, p)
+				p = nil
+			}
+		}
+		if p == nil {
+			p = &partition{date: date}
+			s.partitions[r.Location] = p
+		}
+		p.hour = hour
+		values := make(map[string]float64, len(r.Values))
+		for _, v := range r.Values {
+			values[v.Name] = v.Value
+		}
+		p.rows = append(p.rows, row{time: t, values: values})
+		if hour.After(latest) {
+			latest = hour
+		}
+	}
+	// Locations that are no longer emitted.
+	for location, p := range s.partitions {
+		if p.hour.Before(latest) {
+			if err := s.flush(location, p); err != nil {
+				failed = append(failed, err)
+			}
+		}
+		if p.date < latest.Format(dateLayout) {
+			s.closePartition(location, p)
+		}
+	}
+	s.limitFailed()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d row groups could not be written and are kept for the next write, the first: %s",
+			len(failed), failed[0].Error())
+	}
+	return nil
+}
+
+// Pending is the number of rows in the row groups that couldn't be written.
+func (s *Sink) Pending() int {
+	n := 0
+	for _, g := range s.failed {
+		n += len(g.rows)
+	}
+	return n
+}
+
+// retry writes the row groups that failed before, each to a new part file.
+func (s *Sink) retry() []error {
+	var failed []error
+	groups := s.failed
+	s.failed = nil
+	for _, g := range groups {
+		p := &partition{date: g.date}
+		err := s.writeRows(g.location, p, g.rows)
+		if p.file != nil {
+			if err := p.file.close(); err != nil {
+				log.Errorf("(parquet) closing %s: %s", p.file.f.Name(), err.Error())
+			}
+		}
+		if err != nil {
+			failed = append(failed, err)
+			s.failed = append(s.failed, g)
+		}
+	}
+	return failed
+}
+
+// limitFailed drops the oldest failed row groups beyond maxFailedRows.
+func (s *Sink) limitFailed() {
+	dropped := 0
+	for len(s.failed) > 0 && s.Pending() > maxFailedRows {
+		dropped += len(s.failed[0].rows)
+		s.failed = s.failed[1:]
+	}
+	if dropped > 0 {
+		log.Warnf("(parquet) more than %d rows failed to be written, dropped the oldest %d", maxFailedRows, dropped)
+	}
+}
+
+// escape makes a location id safe as a partition directory, the way Hive does it.
+func escape(id string) string {
+	var b strings.Builder
+	for _, c := range []byte(id) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// create starts a new part file in the directory of the partition.
+func (s *Sink) create(location string, p *partition) error {
+	dir := filepath.Join(s.config.Dir, "location="+escape(location), "date="+p.date)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for part := 0; ; part++ {
+		w, err := createFile(filepath.Join(dir, fmt.Sprintf("part-%d.parquet", part)), s.columns, s.codec)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.file = w
+		return nil
+	}
+}
+
+// flush writes the rows of the partition as a row group. The rows are kept for a retry if it fails.
+func (s *Sink) flush(location string, p *partition) error {
+	if len(p.rows) == 0 {
+		return nil
+	}
+	rows := p.rows
+	p.rows = nil
+	if err := s.writeRows(location, p, rows); err != nil {
+		s.failed = append(s.failed, failedGroup{location: location, date: p.date, rows: rows})
+		return err
+	}
+	return nil
+}
+
+// writeRows writes the rows as a row group to the file of the partition, creating it if needed.
+func (s *Sink) writeRows(location string, p *partition, rows []row) error {
+	if p.file == nil {
+		if err := s.create(location, p); err != nil {
+			return err
+		}
+	}
+	chunks := make([]columnChunk, len(s.columns))
+	for _, r := range rows {
+		chunks[0].ints = append(chunks[0].ints, toMillis(r.time))
+	}
+	for i, col := range s.columns[1:] {
+		c := &chunks[i+1]
+		for _, r := range rows {
+			v, ok := r.values[col.name]
+			c.defs = append(c.defs, ok)
+			switch {
+			case !ok:
+			case col.timestamp:
+				c.ints = append(c.ints, int64(math.Round(v*1000)))
+			default:
+				c.doubles = append(c.doubles, v)
+			}
+		}
+	}
+	if err := p.file.writeRowGroup(chunks, len(rows)); err != nil {
+		return fmt.Errorf("%s: %s", p.file.f.Name(), err.Error())
+	}
+	log.Debugf("(parquet) wrote %d rows to %s", len(rows), p.file.f.Name())
+	return nil
+}
+
+func (s *Sink) closePartition(location string, p *partition) {
+	if p.file != nil {
+		if err := p.file.close(); err != nil {
+			log.Errorf("(parquet) closing %s: %s", p.file.f.Name(), err.Error())
+		}
+	}
+	delete(s.partitions, location)
+}
+
+// Close writes the rows of the current hour, and tries the failed row groups a last time.
+func (s *Sink) Close() error {
+	failed := s.retry()
+	for location, p := range s.partitions {
+		if err := s.flush(location, p); err != nil {
+			failed = append(failed, err)
+		}
+		s.closePartition(location, p)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d row groups could not be written, the first: %s", len(failed), failed[0].Error())
+	}
+	return nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
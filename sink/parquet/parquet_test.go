@@ -0,0 +1,348 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A Thrift compact protocol decoder, to read back the metadata we write.
+type tstruct map[int16]interface{}
+
+type compactReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *compactReader) byte() byte {
+	b := r.b[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *compactReader) varint() uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b := r.byte()
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+}
+
+func (r *compactReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) value(typ byte) interface{} {
+	switch typ {
+	case ctBooleanTrue:
+		return true
+	case ctBooleanFalse:
+		return false
+	case ctI32, ctI64:
+		return r.zigzag()
+	case ctBinary:
+		n := int(r.varint())
+		r.pos += n
+		return r.b[r.pos-n : r.pos]
+	case ctList:
+		h := r.byte()
+		n, elemType := int(h>>4), h&0x0f
+		if n == 15 {
+			n = int(r.varint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(elemType)
+		}
+		return list
+	case ctStruct:
+		return r.readStruct()
+	}
+	panic("unexpected type")
+}
+
+func (r *compactReader) readStruct() tstruct {
+	s := make(tstruct)
+	var id int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return s
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.zigzag())
+		}
+		s[id] = r.value(h & 0x0f)
+	}
+}
+
+// readParquet returns the FileMetaData and the values of every column, nil where there is none.
+func readParquet(t *testing.T, path string) (tstruct, map[string][]interface{}) {
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, magic, string(data[:4]))
+	assert.Equal(t, magic, string(data[len(data)-4:]))
+	n := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta := (&compactReader{b: data[len(data)-8-n : len(data)-8]}).readStruct()
+
+	schema := meta[2].([]interface{})[1:]
+	columns := make(map[string][]interface{})
+	for _, g := range meta[4].([]interface{}) {
+		for i, c := range g.(tstruct)[1].([]interface{}) {
+			elem := schema[i].(tstruct)
+			md := c.(tstruct)[3].(tstruct)
+			offset := int(md[9].(int64))
+			r := &compactReader{b: data[offset:]}
+			header := r.readStruct()
+			page := data[offset+r.pos : offset+r.pos+int(header[3].(int64))]
+			if md[4].(int64) == codecGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(page))
+				assert.Nil(t, err)
+				page, err = ioutil.ReadAll(zr)
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, int(header[2].(int64)), len(page))
+			numValues := int(header[5].(tstruct)[1].(int64))
+			defs := make([]bool, 0, numValues)
+			if elem[3].(int64) == repetitionOptional {
+				levels := &compactReader{b: page[4 : 4+binary.LittleEndian.Uint32(page)]}
+				for levels.pos < len(levels.b) {
+					run := int(levels.varint() >> 1)
+					value := levels.byte() == 1
+					for j := 0; j < run; j++ {
+						defs = append(defs, value)
+					}
+				}
+				page = page[4+len(levels.b):]
+			} else {
+				for j := 0; j < numValues; j++ {
+					defs = append(defs, true)
+				}
+			}
+			name := string(elem[4].([]byte))
+			for _, present := range defs {
+				if !present {
+					columns[name] = append(columns[name], nil)
+					continue
+				}
+				bits := binary.LittleEndian.Uint64(page)
+				page = page[8:]
+				if elem[1].(int64) == typeDouble {
+					columns[name] = append(columns[name], math.Float64frombits(bits))
+				} else {
+					columns[name] = append(columns[name], int64(bits))
+				}
+			}
+		}
+	}
+	return meta, columns
+}
+
+func testRecord(location string, when time.Time, temperature float64) sink.Record {
+	return sink.Record{
+		Time:       when,
+		Location:   location,
+		Dimensions: []sink.Dimension{{Name: "location", Value: location}},
+		Values: []sink.Value{
+			{Name: "air_temperature", Value: temperature},
+			{Name: "sunrise", Value: float64(time.Date(2021, 1, 10, 8, 53, 0, 0, time.UTC).Unix())},
+		},
+	}
+}
+
+var testColumns = []Column{
+	{Name: "air_temperature", Type: Double},
+	{Name: "snow_water_equivalent", Type: Double},
+	{Name: "sunrise", Type: Timestamp},
+}
+
+func Test_HourlyRowGroups(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Compression: CompressionGzip, Columns: testColumns})
+	assert.Nil(t, err)
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	// An emit every 10 minutes, skrindo stops after the first hour.
+	for i := 0; i < 13; i++ {
+		when := start.Add(time.Duration(i) * 10 * time.Minute)
+		records := []sink.Record{testRecord("tryvannstua", when, float64(-i))}
+		if i < 6 {
+			records = append(records, testRecord("skrindo", when, float64(i)))
+		}
+		assert.Nil(t, s.Write(records))
+	}
+	path := filepath.Join(dir, "location=tryvannstua", "date=2021-01-10", "part-0.parquet")
+	meta, _ := readParquet(t, path)
+	assert.Len(t, meta[4], 2, "the hour that isn't over should not be written")
+	assert.Equal(t, int64(12), meta[3])
+
+	meta, columns := readParquet(t, filepath.Join(dir, "location=skrindo", "date=2021-01-10", "part-0.parquet"))
+	assert.Equal(t, int64(6), meta[3], "a location no longer emitted should be written when the hour is over")
+	assert.Equal(t, []interface{}{0.0, 1.0, 2.0, 3.0, 4.0, 5.0}, columns["air_temperature"])
+
+	assert.Nil(t, s.Close())
+	meta, columns = readParquet(t, path)
+	assert.Len(t, meta[4], 3)
+	assert.Equal(t, int64(13), meta[3])
+	assert.Len(t, columns["time"], 13)
+	assert.Equal(t, toMillis(start), columns["time"][0])
+	assert.Equal(t, toMillis(start.Add(2*time.Hour)), columns["time"][12])
+	assert.Equal(t, -12.0, columns["air_temperature"][12])
+	assert.Equal(t, toMillis(time.Date(2021, 1, 10, 8, 53, 0, 0, time.UTC)), columns["sunrise"][0])
+	assert.Equal(t, make([]interface{}, 13), columns["snow_water_equivalent"])
+
+	// Schema and statistics.
+	schema := meta[2].([]interface{})
+	assert.Len(t, schema, 5)
+	assert.Equal(t, "time", string(schema[1].(tstruct)[4].([]byte)))
+	assert.Equal(t, int64(repetitionRequired), schema[1].(tstruct)[3])
+	assert.Equal(t, int64(convertedTimestampMillis), schema[4].(tstruct)[6])
+	chunks := meta[4].([]interface{})[0].(tstruct)[1].([]interface{})
+	stats := chunks[1].(tstruct)[3].(tstruct)[12].(tstruct)
+	assert.Equal(t, plainDouble(-5), stats[6])
+	assert.Equal(t, plainDouble(0), stats[5])
+	stats = chunks[2].(tstruct)[3].(tstruct)[12].(tstruct)
+	assert.Equal(t, int64(6), stats[3])
+	assert.Nil(t, stats[5])
+}
+
+// Test_IndependentReader reads the files back with parquet-go, so the tests don't only check
+// that the writer agrees with the decoder above.
+func Test_IndependentReader(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionNone} {
+		dir := t.TempDir()
+		s, err := Open(Config{Dir: dir, Compression: compression, Columns: testColumns})
+		assert.Nil(t, err)
+		start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+		for i := 0; i < 13; i++ {
+			assert.Nil(t, s.Write([]sink.Record{testRecord("tryvannstua", start.Add(time.Duration(i)*10*time.Minute), float64(-i))}))
+		}
+		assert.Nil(t, s.Close())
+
+		fr, err := local.NewLocalFileReader(filepath.Join(dir, "location=tryvannstua", "date=2021-01-10", "part-0.parquet"))
+		assert.Nil(t, err)
+		pr, err := reader.NewParquetColumnReader(fr, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(13), pr.GetNumRows())
+		assert.Len(t, pr.Footer.RowGroups, 3, compression)
+		codec := pr.Footer.RowGroups[0].Columns[0].MetaData.Codec
+		assert.Equal(t, map[string]string{CompressionGzip: "GZIP", CompressionNone: "UNCOMPRESSED"}[compression], codec.String())
+
+		// The reader names the columns the Go way, in the order of the schema.
+		paths := pr.SchemaHandler.ValueColumns
+		assert.Len(t, paths, 4)
+		columns := make([][]interface{}, len(paths))
+		for i, path := range paths {
+			columns[i], _, _, err = pr.ReadColumnByPath(path, 13)
+			assert.Nil(t, err, path)
+		}
+		assert.Equal(t, toMillis(start), columns[0][0])
+		assert.Equal(t, toMillis(start.Add(2*time.Hour)), columns[0][12])
+		assert.Equal(t, -12.0, columns[1][12])
+		assert.Equal(t, make([]interface{}, 13), columns[2], "missing values are null")
+		assert.Equal(t, toMillis(time.Date(2021, 1, 10, 8, 53, 0, 0, time.UTC)), columns[3][0])
+		fr.Close()
+	}
+}
+
+func Test_DailyPartitions(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Columns: testColumns})
+	assert.Nil(t, err)
+	midnight := time.Date(2021, 1, 11, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", midnight.Add(-10*time.Minute), -1)}))
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", midnight, -2)}))
+	assert.Nil(t, s.Close())
+
+	_, columns := readParquet(t, filepath.Join(dir, "location=skrindo", "date=2021-01-10", "part-0.parquet"))
+	assert.Equal(t, []interface{}{-1.0}, columns["air_temperature"])
+	_, columns = readParquet(t, filepath.Join(dir, "location=skrindo", "date=2021-01-11", "part-0.parquet"))
+	assert.Equal(t, []interface{}{-2.0}, columns["air_temperature"])
+
+	// A restart continues in a new file.
+	s, err = Open(Config{Dir: dir, Columns: testColumns})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", midnight.Add(10*time.Minute), -3)}))
+	assert.Nil(t, s.Close())
+	_, columns = readParquet(t, filepath.Join(dir, "location=skrindo", "date=2021-01-11", "part-1.parquet"))
+	assert.Equal(t, []interface{}{-3.0}, columns["air_temperature"])
+}
+
+func Test_FailedRowGroup(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Columns: testColumns})
+	assert.Nil(t, err)
+	// A file in the way of the partition directory.
+	blocker := filepath.Join(dir, "location=skrindo")
+	assert.Nil(t, ioutil.WriteFile(blocker, nil, 0o644))
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, s.Write([]sink.Record{testRecord("skrindo", start, -1)}))
+	assert.NotNil(t, s.Write([]sink.Record{testRecord("skrindo", start.Add(time.Hour), -2)}))
+	assert.Equal(t, 1, s.Pending())
+	assert.NotNil(t, s.Write(nil))
+	assert.Equal(t, 1, s.Pending())
+
+	assert.Nil(t, os.Remove(blocker))
+	assert.Nil(t, s.Write(nil))
+	assert.Equal(t, 0, s.Pending())
+	assert.Nil(t, s.Close())
+	_, columns := readParquet(t, filepath.Join(dir, "location=skrindo", "date=2021-01-10", "part-0.parquet"))
+	assert.Equal(t, []interface{}{-1.0}, columns["air_temperature"])
+	_, columns = readParquet(t, filepath.Join(dir, "location=skrindo", "date=2021-01-10", "part-1.parquet"))
+	assert.Equal(t, []interface{}{-2.0}, columns["air_temperature"], "the current hour isn't written twice")
+}
+
+func Test_QueueWritesOnce(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(Config{Dir: dir, Columns: testColumns})
+	assert.Nil(t, err)
+	blocker := filepath.Join(dir, "location=skrindo")
+	assert.Nil(t, ioutil.WriteFile(blocker, nil, 0o644))
+	q := sink.NewQueue(s, sink.QueueConfig{MinBackoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}, nil, nil)
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	q.Enqueue([]sink.Record{testRecord("skrindo", start, -1)})
+	q.Enqueue([]sink.Record{testRecord("skrindo", start.Add(time.Hour), -2)})
+	assert.Eventually(t, func() bool { return q.Status().ConsecutiveFailures >= 2 }, time.Second, time.Millisecond)
+
+	assert.Nil(t, os.Remove(blocker))
+	assert.Eventually(t, func() bool {
+		status := q.Status()
+		return status.ConsecutiveFailures == 0 && status.PendingInSink == 0
+	}, time.Second, time.Millisecond)
+	q.Enqueue([]sink.Record{testRecord("skrindo", start.Add(70*time.Minute), -3)})
+	assert.Nil(t, q.Close(time.Second))
+
+	files, err := filepath.Glob(filepath.Join(dir, "location=skrindo", "date=2021-01-10", "*.parquet"))
+	assert.Nil(t, err)
+	var temperatures []interface{}
+	for _, f := range files {
+		_, columns := readParquet(t, f)
+		temperatures = append(temperatures, columns["air_temperature"]...)
+	}
+	assert.ElementsMatch(t, []interface{}{-1.0, -2.0, -3.0}, temperatures, "every row once")
+}
+
+func Test_escape(t *testing.T) {
+	assert.Equal(t, "tryvannstua", escape("tryvannstua"))
+	assert.Equal(t, "a%3Db%2Fc%20d", escape("a=b/c d"))
+}
+
+func Test_InvalidCompression(t *testing.T) {
+	_, err := Open(Config{Dir: t.TempDir(), Compression: "zstd"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,116 @@
+package parquet
+
+/*
+  Just enough of the Thrift compact protocol to write the Parquet metadata.
+  See https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+*/
+
+import (
+	"bytes"
+)
+
+// Compact protocol field types.
+const (
+	ctBooleanTrue  = 1
+	ctBooleanFalse = 2
+	ctI32          = 5
+	ctI64          = 6
+	ctBinary       = 8
+	ctList         = 9
+	ctStruct       = 12
+)
+
+type compactWriter struct {
+	buf  bytes.Buffer
+	last []int16 // the last field id written, for each struct we are in
+}
+
+func (w *compactWriter) varint(v uint64) {
+	for v >= 0x80 {
+		w.buf.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	w.buf.WriteByte(byte(v))
+}
+
+func (w *compactWriter) zigzag(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *compactWriter) fieldHeader(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (w *compactWriter) beginStruct() {
+	w.last = append(w.last, 0)
+}
+
+func (w *compactWriter) endStruct() {
+	w.buf.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.fieldHeader(id, ctI32)
+	w.zigzag(int64(v))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.fieldHeader(id, ctI64)
+	w.zigzag(v)
+}
+
+func (w *compactWriter) boolean(id int16, v bool) {
+	if v {
+		w.fieldHeader(id, ctBooleanTrue)
+	} else {
+		w.fieldHeader(id, ctBooleanFalse)
+	}
+}
+
+func (w *compactWriter) binaryValue(v []byte) {
+	w.varint(uint64(len(v)))
+	w.buf.Write(v)
+}
+
+func (w *compactWriter) binary(id int16, v []byte) {
+	w.fieldHeader(id, ctBinary)
+	w.binaryValue(v)
+}
+
+func (w *compactWriter) str(id int16, v string) {
+	w.binary(id, []byte(v))
+}
+
+// structField writes a nested struct, with the fields written by fields.
+func (w *compactWriter) structField(id int16, fields func()) {
+	w.fieldHeader(id, ctStruct)
+	w.beginStruct()
+	fields()
+	w.endStruct()
+}
+
+// list starts a list of n elements of the given type, the elements are written after it.
+func (w *compactWriter) list(id int16, elemType byte, n int) {
+	w.fieldHeader(id, ctList)
+	if n < 15 {
+		w.buf.WriteByte(byte(n)<<4 | elemType)
+	} else {
+		w.buf.WriteByte(0xf0 | elemType)
+		w.varint(uint64(n))
+	}
+}
+
+// listStruct writes a struct as a list element.
+func (w *compactWriter) listStruct(fields func()) {
+	w.beginStruct()
+	fields()
+	w.endStruct()
+}
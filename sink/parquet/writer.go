@@ -0,0 +1,341 @@
+package parquet
+
+/*
+  A minimal Parquet writer, see https://github.com/apache/parquet-format. A flat schema of
+  INT64 and DOUBLE columns, one PLAIN encoded v1 data page per column chunk, optionally
+  gzipped. The footer is rewritten after every row group, so the file can be read as soon
+  as a row group is flushed.
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math"
+	"os"
+)
+
+// From parquet.thrift.
+const (
+	typeInt64  = 2
+	typeDouble = 5
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedTimestampMillis = 9
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	pageTypeData = 0
+)
+
+const magic = "PAR1"
+
+const createdBy = "yrpoller"
+
+// schemaColumn is a column as it is stored.
+type schemaColumn struct {
+	name      string
+	physical  int32 // typeInt64 or typeDouble
+	timestamp bool  // milliseconds since the epoch, UTC
+	optional  bool
+}
+
+// columnChunk is the data of a column in a row group. Only the values present are in
+// ints or doubles, defs tells which rows have them.
+type columnChunk struct {
+	ints    []int64
+	doubles []float64
+	defs    []bool // optional columns only
+}
+
+type chunkMeta struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+	nullCount    int64
+	min, max     []byte // PLAIN encoded, nil if there are no values
+}
+
+type rowGroupMeta struct {
+	numRows int64
+	chunks  []chunkMeta
+}
+
+type fileWriter struct {
+	f         *os.File
+	columns   []schemaColumn
+	codec     int32
+	end       int64 // where the next row group is written, the footer follows it
+	rowGroups []rowGroupMeta
+	numRows   int64
+}
+
+func createFile(path string, columns []schemaColumn, codec int32) (*fileWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(magic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileWriter{f: f, columns: columns, codec: codec, end: int64(len(magic))}, nil
+}
+
+// writeRowGroup replaces the footer with the row group and a new footer.
+func (w *fileWriter) writeRowGroup(chunks []columnChunk, numRows int) error {
+	var buf bytes.Buffer
+	group := rowGroupMeta{numRows: int64(numRows), chunks: make([]chunkMeta, len(chunks))}
+	for i, c := range chunks {
+		meta, err := w.writeChunk(&buf, w.columns[i], c, numRows)
+		if err != nil {
+			return err
+		}
+		meta.offset += w.end
+		group.chunks[i] = meta
+	}
+	groups := append(w.rowGroups[:len(w.rowGroups):len(w.rowGroups)], group)
+	end := w.end + int64(buf.Len())
+	footer := w.footer(groups, w.numRows+int64(numRows))
+	buf.Write(footer)
+	if err := w.f.Truncate(w.end); err != nil {
+		return err
+	}
+	if _, err := w.f.WriteAt(buf.Bytes(), w.end); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.rowGroups, w.end, w.numRows = groups, end, w.numRows+int64(numRows)
+	return nil
+}
+
+// writeChunk writes a column chunk as a single data page. The offset is relative to buf.
+func (w *fileWriter) writeChunk(buf *bytes.Buffer, col schemaColumn, c columnChunk, numRows int) (chunkMeta, error) {
+	var page bytes.Buffer
+	if col.optional {
+		levels := rleBools(c.defs)
+		binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+		page.Write(levels)
+	}
+	meta := chunkMeta{offset: int64(buf.Len()), nullCount: int64(numRows - len(c.ints) - len(c.doubles))}
+	if col.physical == typeInt64 {
+		for _, v := range c.ints {
+			binary.Write(&page, binary.LittleEndian, v)
+		}
+		meta.min, meta.max = int64Stats(c.ints)
+	} else {
+		for _, v := range c.doubles {
+			binary.Write(&page, binary.LittleEndian, v)
+		}
+		meta.min, meta.max = doubleStats(c.doubles)
+	}
+	data := page.Bytes()
+	if w.codec == codecGzip {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := zw.Write(data); err != nil {
+			return meta, err
+		}
+		if err := zw.Close(); err != nil {
+			return meta, err
+		}
+		data = zbuf.Bytes()
+	}
+	var header compactWriter
+	header.beginStruct()
+	header.i32(1, pageTypeData)
+	header.i32(2, int32(page.Len()))
+	header.i32(3, int32(len(data)))
+	header.structField(5, func() {
+		header.i32(1, int32(numRows))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+	})
+	header.endStruct()
+	buf.Write(header.buf.Bytes())
+	buf.Write(data)
+	meta.uncompressed = int64(header.buf.Len() + page.Len())
+	meta.compressed = int64(header.buf.Len() + len(data))
+	return meta, nil
+}
+
+// rleBools encodes definition levels of bit width 1 as runs of the RLE/bit-packing hybrid encoding.
+func rleBools(values []bool) []byte {
+	var w compactWriter
+	for i := 0; i < len(values); {
+		run := 1
+		for i+run < len(values) && values[i+run] == values[i] {
+			run++
+		}
+		w.varint(uint64(run) << 1)
+		if values[i] {
+			w.buf.WriteByte(1)
+		} else {
+			w.buf.WriteByte(0)
+		}
+		i += run
+	}
+	return w.buf.Bytes()
+}
+
+func plainInt64(v int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func plainDouble(v float64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+	return b
+}
+
+func int64Stats(values []int64) ([]byte, []byte) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return plainInt64(min), plainInt64(max)
+}
+
+// doubleStats skips NaN, and writes zero as -0.0 in min and +0.0 in max, as the spec says.
+func doubleStats(values []float64) ([]byte, []byte) {
+	min, max := math.Inf(1), math.Inf(-1)
+	found := false
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		found = true
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	if !found {
+		return nil, nil
+	}
+	if min == 0 {
+		min = math.Copysign(0, -1)
+	}
+	if max == 0 {
+		max = 0
+	}
+	return plainDouble(min), plainDouble(max)
+}
+
+// footer is the FileMetaData followed by its length and the magic.
+func (w *fileWriter) footer(groups []rowGroupMeta, numRows int64) []byte {
+	var t compactWriter
+	t.beginStruct()
+	t.i32(1, 1)
+	t.list(2, ctStruct, len(w.columns)+1)
+	t.listStruct(func() {
+		t.str(4, "schema")
+		t.i32(5, int32(len(w.columns)))
+	})
+	for _, col := range w.columns {
+		col := col
+		t.listStruct(func() {
+			t.i32(1, col.physical)
+			if col.optional {
+				t.i32(3, repetitionOptional)
+			} else {
+				t.i32(3, repetitionRequired)
+			}
+			t.str(4, col.name)
+			if col.timestamp {
+				t.i32(6, convertedTimestampMillis)
+				t.structField(10, func() {
+					t.structField(8, func() {
+						t.boolean(1, true)
+						t.structField(2, func() {
+							t.structField(1, func() {})
+						})
+					})
+				})
+			}
+		})
+	}
+	t.i64(3, numRows)
+	t.list(4, ctStruct, len(groups))
+	for _, g := range groups {
+		g := g
+		t.listStruct(func() {
+			var size, compressed int64
+			t.list(1, ctStruct, len(g.chunks))
+			for i, c := range g.chunks {
+				col, c := w.columns[i], c
+				size += c.uncompressed
+				compressed += c.compressed
+				t.listStruct(func() {
+					// The deprecated file_offset, the metadata is only in the footer.
+					t.i64(2, 0)
+					t.structField(3, func() {
+						t.i32(1, col.physical)
+						if col.optional {
+							t.list(2, ctI32, 2)
+							t.zigzag(encodingPlain)
+							t.zigzag(encodingRLE)
+						} else {
+							t.list(2, ctI32, 1)
+							t.zigzag(encodingPlain)
+						}
+						t.list(3, ctBinary, 1)
+						t.binaryValue([]byte(col.name))
+						t.i32(4, w.codec)
+						t.i64(5, g.numRows)
+						t.i64(6, c.uncompressed)
+						t.i64(7, c.compressed)
+						t.i64(9, c.offset)
+						t.structField(12, func() {
+							t.i64(3, c.nullCount)
+							if c.max != nil {
+								t.binary(5, c.max)
+								t.binary(6, c.min)
+							}
+						})
+					})
+				})
+			}
+			t.i64(2, size)
+			t.i64(3, g.numRows)
+			if len(g.chunks) > 0 {
+				t.i64(5, g.chunks[0].offset)
+			}
+			t.i64(6, compressed)
+		})
+	}
+	t.str(6, createdBy)
+	// min_value and max_value are only used when the column order is known.
+	t.list(7, ctStruct, len(w.columns))
+	for range w.columns {
+		t.listStruct(func() {
+			t.structField(1, func() {})
+		})
+	}
+	t.endStruct()
+
+	binary.Write(&t.buf, binary.LittleEndian, uint32(t.buf.Len()))
+	t.buf.WriteString(magic)
+	return t.buf.Bytes()
+}
+
+func (w *fileWriter) close() error {
+	return w.f.Close()
+}
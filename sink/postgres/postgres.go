@@ -0,0 +1,223 @@
+package postgres
+
+/*
+  Writes the emitted observations to PostgreSQL, as a hypertable if TimescaleDB is
+  installed. The locations table holds the dimensions of every location, the
+  observations table one row per time, location and variable.
+
+  Writes that fail, like when the database is down, are kept and retried on the next
+  emit. database/sql reconnects by itself, we just have to keep trying. The schema is
+  created on the first write that gets through, so the poller can start before the
+  database is up.
+*/
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// Rows per INSERT. Postgres allows at most 65535 parameters in a statement.
+const insertBatchRows = 1000
+
+// DefaultMaxPendingRows is how many rows are kept for retrying by default.
+const DefaultMaxPendingRows = 100000
+
+const schema = `
+CREATE TABLE IF NOT EXISTS locations (
+	id         TEXT PRIMARY KEY,
+	dimensions JSONB NOT NULL,
+	updated    TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS observations (
+	time     TIMESTAMPTZ NOT NULL,
+	location TEXT NOT NULL REFERENCES locations (id),
+	variable TEXT NOT NULL,
+	value    DOUBLE PRECISION NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS observations_location_variable_time ON observations (location, variable, time DESC);
+`
+
+type Config struct {
+	DSN            string // Like "postgres://yrpoller@localhost/weather?sslmode=disable".
+	MaxPendingRows int    // Rows kept for retrying when writes fail, the oldest are dropped. DefaultMaxPendingRows if 0.
+}
+
+type row struct {
+	time     time.Time
+	location string
+	variable string
+	value    float64
+}
+
+type location struct {
+	id         string
+	dimensions string // JSON
+}
+
+type Sink struct {
+	db        *sql.DB
+	config    Config
+	schemaOk  bool
+	pending   []row
+	locations map[string]string // dimensions of the locations written, as JSON
+	changed   map[string]location
+}
+
+func Open(config Config) (*Sink, error) {
+	if config.MaxPendingRows <= 0 {
+		config.MaxPendingRows = DefaultMaxPendingRows
+	}
+	// Doesn't connect, only checks the DSN.
+	db, err := sql.Open("postgres", config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	db.SetConnMaxLifetime(time.Hour)
+	s := &Sink{
+		db:        db,
+		config:    config,
+		locations: make(map[string]string),
+		changed:   make(map[string]location),
+	}
+	if err := s.ensureSchema(); err != nil {
+		log.Warnf("(postgres) could not create the schema, will try again on the first write: %s", err.Error())
+	}
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return "postgres"
+}
+
+// ensureSchema creates the tables, and makes observations a hypertable if TimescaleDB is installed.
+func (s *Sink) ensureSchema() error {
+	if s.schemaOk {
+		return nil
+	}
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	var timescale bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')").Scan(&timescale)
+	if err != nil {
+		return err
+	}
+	if timescale {
+		_, err = s.db.Exec("SELECT create_hypertable('observations', 'time', if_not_exists => TRUE)")
+		if err != nil {
+			return err
+		}
+		log.Info("(postgres) observations is a TimescaleDB hypertable")
+	} else {
+		log.Info("(postgres) TimescaleDB isn't installed, observations is a plain table")
+	}
+	s.schemaOk = true
+	return nil
+}
+
+// insertStatement is a multi-row insert of n observations. Rows we already have are skipped,
+// so a retried write that got through the first time doesn't fail.
+func insertStatement(n int) string {
+	values := make([]string, n)
+	for i := range values {
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d)", 4*i+1, 4*i+2, 4*i+3, 4*i+4)
+	}
+	return "INSERT INTO observations (time, location, variable, value) VALUES " + strings.Join(values, ", ") +
+		" ON CONFLICT DO NOTHING"
+}
+
+// queue adds the records to the pending rows, and notes the locations that are new or have changed.
+func (s *Sink) queue(records []sink.Record) error {
+	for _, r := range records {
+		dims := make(map[string]string, len(r.Dimensions))
+		for _, d := range r.Dimensions {
+			dims[d.Name] = d.Value
+		}
+		data, err := json.Marshal(dims)
+		if err != nil {
+			return err
+		}
+		if s.locations[r.Location] != string(data) {
+			s.changed[r.Location] = location{id: r.Location, dimensions: string(data)}
+		}
+		for _, v := range r.Values {
+			s.pending = append(s.pending, row{time: r.Time, location: r.Location, variable: v.Name, value: v.Value})
+		}
+	}
+	if over := len(s.pending) - s.config.MaxPendingRows; over > 0 {
+		log.Warnf("(postgres) more than %d rows waiting to be written, dropping the %d oldest", s.config.MaxPendingRows, over)
+		s.pending = s.pending[over:]
+	}
+	return nil
+}
+
+func (s *Sink) Write(records []sink.Record) error {
+	if err := s.queue(records); err != nil {
+		return err
+	}
+	if err := s.ensureSchema(); err != nil {
+		return fmt.Errorf("%d rows waiting: %s", len(s.pending), err.Error())
+	}
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("%d rows waiting: %s", len(s.pending), err.Error())
+	}
+	return nil
+}
+
+// flush writes the changed locations and the pending rows in a single transaction.
+func (s *Sink) flush() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, loc := range s.changed {
+		_, err := tx.Exec("INSERT INTO locations (id, dimensions, updated) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (id) DO UPDATE SET dimensions = EXCLUDED.dimensions, updated = EXCLUDED.updated",
+			loc.id, loc.dimensions, now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for start := 0; start < len(s.pending); start += insertBatchRows {
+		end := start + insertBatchRows
+		if end > len(s.pending) {
+			end = len(s.pending)
+		}
+		args := make([]interface{}, 0, 4*(end-start))
+		for _, r := range s.pending[start:end] {
+			args = append(args, r.time, r.location, r.variable, r.value)
+		}
+		if _, err := tx.Exec(insertStatement(end-start), args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Debugf("(postgres) wrote %d rows", len(s.pending))
+	for id, loc := range s.changed {
+		s.locations[id] = loc.dimensions
+	}
+	s.changed = make(map[string]location)
+	s.pending = nil
+	return nil
+}
+
+// Pending is the number of rows waiting to be written.
+func (s *Sink) Pending() int {
+	return len(s.pending)
+}
+
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,79 @@
+package postgres
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/sinktest"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// testRecords are observations from a location in a region.
+func testRecords(location string, region string, n int) []sink.Record {
+	return sinktest.Records(location, sinktest.Start, n, sink.Dimension{Name: "region", Value: region})
+}
+
+func Test_insertStatement(t *testing.T) {
+	assert.Equal(t, "INSERT INTO observations (time, location, variable, value) VALUES "+
+		"($1, $2, $3, $4), ($5, $6, $7, $8) ON CONFLICT DO NOTHING", insertStatement(2))
+}
+
+func Test_queue(t *testing.T) {
+	s := &Sink{
+		config:    Config{MaxPendingRows: 5},
+		locations: map[string]string{"skrindo": `{"location":"skrindo","region":"hallingdal"}`},
+		changed:   make(map[string]location),
+	}
+	assert.Nil(t, s.queue(testRecords("skrindo", "hallingdal", 2)))
+	assert.Len(t, s.pending, 4)
+	assert.Len(t, s.changed, 0, "skrindo hasn't changed")
+
+	assert.Nil(t, s.queue(testRecords("skrindo", "buskerud", 2)))
+	assert.Len(t, s.pending, 5, "the oldest rows are dropped")
+	assert.Equal(t, "wind_speed", s.pending[0].variable)
+	assert.Equal(t, `{"location":"skrindo","region":"buskerud"}`, s.changed["skrindo"].dimensions)
+}
+
+func Test_WriteDatabaseDown(t *testing.T) {
+	s, err := Open(Config{DSN: "postgres://yrpoller@127.0.0.1:1/yrpoller?sslmode=disable&connect_timeout=1"})
+	assert.Nil(t, err, "the poller should start without the database")
+	defer s.Close()
+	assert.NotNil(t, s.Write(testRecords("skrindo", "hallingdal", 3)))
+	assert.NotNil(t, s.Write(testRecords("skrindo", "hallingdal", 1)))
+	assert.Len(t, s.pending, 8, "the rows are kept for the next write")
+}
+
+// Runs against the database in YRPOLLER_TEST_POSTGRES, like
+// "postgres://postgres@localhost/yrpoller_test?sslmode=disable". The tables are dropped first.
+// CI has a database, so the test fails there instead of being skipped if it isn't set.
+func Test_Write(t *testing.T) {
+	dsn := os.Getenv("YRPOLLER_TEST_POSTGRES")
+	if dsn == "" && os.Getenv("CI") != "" {
+		t.Fatal("YRPOLLER_TEST_POSTGRES must be set in CI, the workflow has a database for it")
+	}
+	if dsn == "" {
+		t.Skip("YRPOLLER_TEST_POSTGRES isn't set")
+	}
+	s, err := Open(Config{DSN: dsn})
+	assert.Nil(t, err)
+	defer s.Close()
+	_, err = s.db.Exec("DROP TABLE IF EXISTS observations; DROP TABLE IF EXISTS locations")
+	assert.Nil(t, err)
+	s.schemaOk = false
+
+	assert.Nil(t, s.Write(testRecords("skrindo", "hallingdal", 6)))
+	// Writing the same again, like after a failure, is fine.
+	assert.Nil(t, s.Write(testRecords("skrindo", "buskerud", 6)))
+
+	var count int
+	assert.Nil(t, s.db.QueryRow("SELECT count(*) FROM observations WHERE location = 'skrindo'").Scan(&count))
+	assert.Equal(t, 12, count)
+	var region string
+	assert.Nil(t, s.db.QueryRow("SELECT dimensions->>'region' FROM locations WHERE id = 'skrindo'").Scan(&region))
+	assert.Equal(t, "buskerud", region)
+	var value float64
+	assert.Nil(t, s.db.QueryRow("SELECT value FROM observations WHERE location = 'skrindo' AND variable = 'air_temperature' "+
+		"AND time = $1", sinktest.Start.Add(20*time.Minute)).Scan(&value))
+	assert.Equal(t, -2.0, value)
+}
@@ -0,0 +1,349 @@
+package sink
+
+/*
+  Fan-out to the sinks. Every sink gets a queue with its own goroutine, so a sink that is
+  slow or down only delays itself. The emitter enqueues the records of an emit and goes on.
+
+  A sink that keeps what it couldn't write, and says so with Buffered, is handed the records
+  once and gets an empty write when the backoff after a failure has passed. For a sink that
+  is Retryable the records of a failed write go back to the front of the queue, and are
+  written again after the backoff. The other sinks may have stored some of a failed write,
+  so it is dropped rather than stored twice. Records that arrive in the meantime wait in the
+  queue, which drops the oldest when full.
+*/
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxQueuedRecords = 10000
+	DefaultMinBackoff       = 5 * time.Second
+	DefaultMaxBackoff       = 5 * time.Minute
+)
+
+// Buffered is implemented by the sinks that keep records they failed to write and retry
+// them on the next write.
+type Buffered interface {
+	// Pending is the number of records, rows or messages waiting. Called from the goroutine that writes.
+	Pending() int
+}
+
+// Retryable is implemented by the sinks that store all the records of a write or none of them,
+// so the records of a failed write can be handed to them again.
+type Retryable interface {
+	// RetrySafe is only there to mark the sink.
+	RetrySafe()
+}
+
+type QueueConfig struct {
+	MaxRecords    int           // Records waiting beyond this are dropped, the oldest first.
+	FlushInterval time.Duration // At least this long between writes, every emit is written at once if 0.
+	MinBackoff    time.Duration // Before the first retry after a failed write, doubled for each failure.
+	MaxBackoff    time.Duration
+}
+
+// QueueStatus is the state of a sink's queue, as shown in the status output.
+type QueueStatus struct {
+	QueuedRecords            int       `json:"queued_records"`
+	PendingInSink            int       `json:"pending_in_sink"` // Only for Buffered sinks.
+	FlushInterval            string    `json:"flush_interval"`
+	NoOfWrites               uint64    `json:"no_of_writes"`
+	NoOfWriteErrors          uint64    `json:"no_of_write_errors"`
+	NoOfDroppedRecords       uint64    `json:"no_of_dropped_records"`
+	ConsecutiveFailures      int       `json:"consecutive_failures"`
+	LastWrite                time.Time `json:"last_write"`
+	LastWriteDurationSeconds float64   `json:"last_write_duration_seconds"`
+	LastErrorMessage         string    `json:"last_error_message"`
+	LastErrorTime            time.Time `json:"last_error_time"`
+	NextRetry                time.Time `json:"next_retry"`
+}
+
+type Queue struct {
+	sink     Sink
+	config   QueueConfig
+	onStatus func(name string, status QueueStatus)
+	onError  func(name string, err error)
+
+	mu        sync.Mutex // protects the records and the status.
+	records   []Record
+	status    QueueStatus
+	lastWrite time.Time
+	retryAt   time.Time
+	backoff   time.Duration
+
+	wake    chan bool
+	stop    chan bool
+	stopped chan bool
+}
+
+// NewQueue starts a queue for the sink. onStatus is called when the status changes and
+// onError when a write fails, either may be nil.
+func NewQueue(s Sink, config QueueConfig, onStatus func(name string, status QueueStatus),
+	onError func(name string, err error)) *Queue {
+	if config.MaxRecords <= 0 {
+		config.MaxRecords = DefaultMaxQueuedRecords
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+	q := &Queue{
+		sink:     s,
+		config:   config,
+		onStatus: onStatus,
+		onError:  onError,
+		wake:     make(chan bool, 1),
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	q.status.FlushInterval = config.FlushInterval.String()
+	go q.run()
+	return q
+}
+
+func (q *Queue) Name() string {
+	return q.sink.Name()
+}
+
+// Status is a copy of the queue's status.
+func (q *Queue) Status() QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.status
+}
+
+// updated reports the status, with q.mu held so the reports come in order.
+func (q *Queue) updated() {
+	if q.onStatus != nil {
+		q.onStatus(q.sink.Name(), q.status)
+	}
+}
+
+// limit drops the oldest records beyond MaxRecords, with q.mu held. It returns how many.
+func (q *Queue) limit() int {
+	over := len(q.records) - q.config.MaxRecords
+	if over <= 0 {
+		return 0
+	}
+	q.records = append([]Record(nil), q.records[over:]...)
+	q.status.NoOfDroppedRecords += uint64(over)
+	return over
+}
+
+func (q *Queue) logDropped(over int) {
+	if over > 0 {
+		log.Warnf("(%s) more than %d records queued, dropped the oldest %d", q.sink.Name(), q.config.MaxRecords, over)
+	}
+}
+
+// Enqueue adds the records to the queue, dropping the oldest if it gets too long. It doesn't block.
+func (q *Queue) Enqueue(records []Record) {
+	q.mu.Lock()
+	q.records = append(q.records, records...)
+	over := q.limit()
+	q.status.QueuedRecords = len(q.records)
+	q.updated()
+	q.mu.Unlock()
+	q.logDropped(over)
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// due is how long until the next write, or false if there is nothing to write.
+func (q *Queue) due(now time.Time) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.records) == 0 && q.status.PendingInSink == 0 {
+		return 0, false
+	}
+	next := q.lastWrite.Add(q.config.FlushInterval)
+	if q.retryAt.After(next) {
+		next = q.retryAt
+	}
+	if next.Before(now) {
+		return 0, true
+	}
+	return next.Sub(now), true
+}
+
+func (q *Queue) run() {
+	defer close(q.stopped)
+	for {
+		wait, ok := q.due(time.Now())
+		if ok && wait == 0 {
+			q.write()
+			continue
+		}
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if ok {
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+		select {
+		case <-q.wake:
+		case <-fire:
+		case <-q.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// write hands the queued records to the sink and keeps track of how it went.
+func (q *Queue) write() error {
+	q.mu.Lock()
+	records := q.records
+	q.records = nil
+	q.status.QueuedRecords = 0
+	q.mu.Unlock()
+
+	start := time.Now()
+	err := q.sink.Write(records)
+	took := time.Since(start)
+	pending := 0
+	b, buffered := q.sink.(Buffered)
+	if buffered {
+		pending = b.Pending()
+	}
+
+	q.mu.Lock()
+	over := 0
+	if _, retryable := q.sink.(Retryable); err != nil && !buffered && retryable && len(records) > 0 {
+		// The sink doesn't keep them, so they are written again after the backoff.
+		q.records = append(records, q.records...)
+		over = q.limit()
+		q.status.QueuedRecords = len(q.records)
+	}
+	now := time.Now().UTC()
+	q.lastWrite = now
+	q.status.NoOfWrites++
+	q.status.LastWrite = now
+	q.status.LastWriteDurationSeconds = took.Seconds()
+	q.status.PendingInSink = pending
+	if err == nil {
+		q.status.ConsecutiveFailures = 0
+		q.status.NextRetry = time.Time{}
+		q.backoff = 0
+		q.retryAt = time.Time{}
+	} else {
+		q.status.NoOfWriteErrors++
+		q.status.ConsecutiveFailures++
+		q.status.LastErrorMessage = err.Error()
+		q.status.LastErrorTime = now
+		q.backoff *= 2
+		if q.backoff < q.config.MinBackoff {
+			q.backoff = q.config.MinBackoff
+		}
+		if q.backoff > q.config.MaxBackoff {
+			q.backoff = q.config.MaxBackoff
+		}
+		q.retryAt = now.Add(q.backoff)
+		q.status.NextRetry = q.retryAt
+	}
+	q.updated()
+	q.mu.Unlock()
+
+	q.logDropped(over)
+	if err != nil && q.onError != nil {
+		q.onError(q.sink.Name(), err)
+	}
+	return err
+}
+
+// Close stops the goroutine, makes a last write of what is queued and closes the sink.
+// It gives up after the timeout, leaving a hanging sink behind.
+func (q *Queue) Close(timeout time.Duration) error {
+	close(q.stop)
+	done := make(chan error, 1)
+	go func() {
+		<-q.stopped
+		q.mu.Lock()
+		left := len(q.records) > 0 || q.status.PendingInSink > 0
+		q.mu.Unlock()
+		if left {
+			if err := q.write(); err != nil {
+				log.Warnf("(%s) last write failed: %s", q.sink.Name(), err.Error())
+			}
+		}
+		done <- q.sink.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%s didn't close within %s", q.sink.Name(), timeout)
+	}
+}
+
+// FanOut hands the records of every emit to the queues of all the sinks.
+type FanOut struct {
+	queues []*Queue
+}
+
+func NewFanOut(queues ...*Queue) *FanOut {
+	return &FanOut{queues: queues}
+}
+
+func (f *FanOut) Write(records []Record) {
+	for _, q := range f.queues {
+		q.Enqueue(records)
+	}
+}
+
+// Close closes the queues in parallel, so the timeout applies to all of them together.
+func (f *FanOut) Close(timeout time.Duration) error {
+	errs := make(chan error, len(f.queues))
+	for _, q := range f.queues {
+		go func(q *Queue) {
+			errs <- q.Close(timeout)
+		}(q)
+	}
+	var failed []string
+	for range f.queues {
+		if err := <-errs; err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("closing the sinks: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// ParseFlushIntervals parses "sink:duration,sink:duration", like "postgres:5m,kafka:30s".
+func ParseFlushIntervals(spec string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	if strings.TrimSpace(spec) == "" {
+		return intervals, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid flush interval '%s', expected sink:duration", entry)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid flush interval '%s' for %s", parts[1], parts[0])
+		}
+		intervals[parts[0]] = d
+	}
+	return intervals, nil
+}
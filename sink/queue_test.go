@@ -0,0 +1,227 @@
+package sink
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink records the writes. A write blocks while block is set, and fails while failures are left.
+type testSink struct {
+	name     string
+	mu       sync.Mutex
+	writes   [][]Record
+	pending  int
+	failures int
+	block    chan bool
+	closed   bool
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) Write(records []Record) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes = append(s.writes, records)
+	s.pending += len(records)
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	s.pending = 0
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) written() [][]Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]Record(nil), s.writes...)
+}
+
+// bufferedSink keeps what it failed to write, like the postgres and kafka sinks.
+type bufferedSink struct {
+	testSink
+}
+
+func (s *bufferedSink) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// retryableSink stores all the records of a write or none of them, like the sqlite sink.
+type retryableSink struct {
+	testSink
+}
+
+func (s *retryableSink) RetrySafe() {}
+
+// flat is all the records written, however they were batched.
+func (s *testSink) flat() []Record {
+	var all []Record
+	for _, w := range s.written() {
+		all = append(all, w...)
+	}
+	return all
+}
+
+func records(locations ...string) []Record {
+	var r []Record
+	for _, l := range locations {
+		r = append(r, Record{Time: time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC), Location: l})
+	}
+	return r
+}
+
+func Test_SlowSinkDoesNotBlock(t *testing.T) {
+	slow := &testSink{name: "slow", block: make(chan bool)}
+	fast := &testSink{name: "fast"}
+	f := NewFanOut(NewQueue(slow, QueueConfig{}, nil, nil), NewQueue(fast, QueueConfig{}, nil, nil))
+	f.Write(records("skrindo"))
+	f.Write(records("tryvannstua"))
+	assert.Eventually(t, func() bool { return len(fast.flat()) == 2 }, time.Second, time.Millisecond)
+	assert.Empty(t, slow.written())
+
+	// The slow sink gets both emits, in one write or two depending on when it took the first.
+	close(slow.block)
+	assert.Nil(t, f.Close(time.Second))
+	assert.Equal(t, records("skrindo", "tryvannstua"), slow.flat())
+	assert.True(t, slow.closed)
+	assert.True(t, fast.closed)
+}
+
+func Test_QueueDropsOldest(t *testing.T) {
+	s := &testSink{name: "test"}
+	var statuses []QueueStatus
+	q := NewQueue(s, QueueConfig{MaxRecords: 3, FlushInterval: time.Hour}, func(name string, status QueueStatus) {
+		assert.Equal(t, "test", name)
+		statuses = append(statuses, status)
+	}, nil)
+	q.Enqueue(records("a"))
+	assert.Eventually(t, func() bool { return q.Status().NoOfWrites == 1 }, time.Second, time.Millisecond)
+
+	// Within the flush interval, so these wait in the queue.
+	q.Enqueue(records("b", "c"))
+	q.Enqueue(records("d", "e"))
+	status := q.Status()
+	assert.Equal(t, 3, status.QueuedRecords)
+	assert.Equal(t, uint64(1), status.NoOfDroppedRecords)
+	assert.Equal(t, "1h0m0s", status.FlushInterval)
+	assert.Len(t, s.written(), 1)
+
+	assert.Nil(t, q.Close(time.Second))
+	assert.Equal(t, records("c", "d", "e"), s.written()[1])
+	assert.Equal(t, 0, statuses[len(statuses)-1].QueuedRecords)
+	assert.Equal(t, uint64(2), statuses[len(statuses)-1].NoOfWrites)
+}
+
+func Test_QueueRetriesBufferedSink(t *testing.T) {
+	s := &bufferedSink{testSink{name: "buffered", failures: 2}}
+	var failed []string
+	var mu sync.Mutex
+	q := NewQueue(s, QueueConfig{MinBackoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond}, nil,
+		func(name string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed = append(failed, name+": "+err.Error())
+		})
+	q.Enqueue(records("skrindo"))
+	assert.Eventually(t, func() bool { return len(s.written()) == 3 }, time.Second, time.Millisecond)
+
+	// The records are handed over once, the retries are empty writes.
+	assert.Equal(t, [][]Record{records("skrindo"), nil, nil}, s.written())
+	assert.Eventually(t, func() bool { return q.Status().ConsecutiveFailures == 0 }, time.Second, time.Millisecond)
+	status := q.Status()
+	assert.Equal(t, uint64(2), status.NoOfWriteErrors)
+	assert.Equal(t, 0, status.PendingInSink)
+	assert.True(t, status.NextRetry.IsZero())
+	assert.Equal(t, "unavailable", status.LastErrorMessage)
+	mu.Lock()
+	assert.Equal(t, []string{"buffered: unavailable", "buffered: unavailable"}, failed)
+	mu.Unlock()
+	assert.Nil(t, q.Close(time.Second))
+	assert.Len(t, s.written(), 3, "nothing left to write when closing")
+}
+
+func Test_QueueBackoff(t *testing.T) {
+	s := &testSink{name: "down", failures: 100}
+	q := NewQueue(s, QueueConfig{MinBackoff: time.Hour, MaxBackoff: 2 * time.Hour}, nil, nil)
+	q.Enqueue(records("a"))
+	assert.Eventually(t, func() bool { return q.Status().ConsecutiveFailures == 1 }, time.Second, time.Millisecond)
+
+	// Not written before the backoff has passed, and not retried since the sink may have stored
+	// some of the failed write.
+	q.Enqueue(records("b"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(t, s.written(), 1)
+	status := q.Status()
+	assert.Equal(t, 1, status.QueuedRecords)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), status.NextRetry, time.Minute)
+
+	// Closing makes a last attempt.
+	assert.Nil(t, q.Close(time.Second))
+	assert.Equal(t, records("b"), s.written()[1])
+}
+
+func Test_QueueRetriesSink(t *testing.T) {
+	s := &retryableSink{testSink{name: "sqlite", failures: 2}}
+	q := NewQueue(s, QueueConfig{MinBackoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond}, nil, nil)
+	q.Enqueue(records("skrindo"))
+	assert.Eventually(t, func() bool { return len(s.written()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]Record{records("skrindo"), records("skrindo"), records("skrindo")}, s.written())
+	assert.Eventually(t, func() bool { return q.Status().ConsecutiveFailures == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, q.Status().QueuedRecords)
+	assert.Nil(t, q.Close(time.Second))
+	assert.Len(t, s.written(), 3, "nothing left to write when closing")
+
+	// The failed records count against the queue limit, the oldest are dropped.
+	s = &retryableSink{testSink{name: "sqlite", failures: 1, block: make(chan bool)}}
+	q = NewQueue(s, QueueConfig{MaxRecords: 2, MinBackoff: time.Hour, MaxBackoff: time.Hour}, nil, nil)
+	q.Enqueue(records("a"))
+	assert.Eventually(t, func() bool { return q.Status().QueuedRecords == 0 }, time.Second, time.Millisecond)
+	q.Enqueue(records("b", "c"))
+	close(s.block)
+	assert.Eventually(t, func() bool { return q.Status().ConsecutiveFailures == 1 }, time.Second, time.Millisecond)
+	status := q.Status()
+	assert.Equal(t, 2, status.QueuedRecords)
+	assert.Equal(t, uint64(1), status.NoOfDroppedRecords)
+	assert.Nil(t, q.Close(time.Second))
+	assert.Equal(t, records("b", "c"), s.written()[1])
+}
+
+func Test_QueueCloseTimeout(t *testing.T) {
+	s := &testSink{name: "stuck", block: make(chan bool)}
+	q := NewQueue(s, QueueConfig{}, nil, nil)
+	q.Enqueue(records("a"))
+	err := q.Close(10 * time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "stuck didn't close")
+	close(s.block)
+}
+
+func Test_ParseFlushIntervals(t *testing.T) {
+	intervals, err := ParseFlushIntervals("postgres:5m, kafka:30s")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]time.Duration{"postgres": 5 * time.Minute, "kafka": 30 * time.Second}, intervals)
+	intervals, err = ParseFlushIntervals("")
+	assert.Nil(t, err)
+	assert.Empty(t, intervals)
+	for _, spec := range []string{"postgres", "postgres:soon", ":5m", "postgres:-1m"} {
+		_, err := ParseFlushIntervals(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
@@ -0,0 +1,42 @@
+package sink
+
+/*
+  Outputs for the emitted observations. The emitter turns every observation into a
+  Record and hands the records of each emit to all the sinks.
+*/
+
+import "time"
+
+type Dimension struct {
+	Name  string
+	Value string
+}
+
+type Value struct {
+	Name  string
+	Value float64
+}
+
+// Record is an emitted observation of a location.
+type Record struct {
+	Time       time.Time
+	Location   string
+	Dimensions []Dimension // Describes the location, the id included as "location".
+	Values     []Value     // The output variables that have a value, in the order they are emitted.
+}
+
+type Sink interface {
+	// Name identifies the sink in the logs and the status output.
+	Name() string
+	// Write stores the records of an emit.
+	Write(records []Record) error
+	Close() error
+}
+
+// StoredValue is a value read back from a sink that can be queried.
+type StoredValue struct {
+	Time     time.Time `json:"time"`
+	Location string    `json:"location"`
+	Variable string    `json:"variable"`
+	Value    float64   `json:"value"`
+}
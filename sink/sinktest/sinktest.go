@@ -0,0 +1,29 @@
+// Package sinktest has the observations the sink tests write.
+package sinktest
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"time"
+)
+
+// Start is when the test observations start, unless a test needs another time.
+var Start = time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+
+// Records returns n observations from a location, ten minutes apart from start. The air temperature
+// falls a degree and the wind speed rises half a m/s per observation, from 0. The location is the
+// first dimension, followed by the dimensions given.
+func Records(location string, start time.Time, n int, dimensions ...sink.Dimension) []sink.Record {
+	records := make([]sink.Record, 0, n)
+	for i := 0; i < n; i++ {
+		records = append(records, sink.Record{
+			Time:       start.Add(time.Duration(i) * 10 * time.Minute),
+			Location:   location,
+			Dimensions: append([]sink.Dimension{{Name: "location", Value: location}}, dimensions...),
+			Values: []sink.Value{
+				{Name: "air_temperature", Value: float64(-i)},
+				{Name: "wind_speed", Value: float64(i) / 2},
+			},
+		})
+	}
+	return records
+}
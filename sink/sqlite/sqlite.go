@@ -0,0 +1,155 @@
+package sqlite
+
+/*
+  Local storage of the emitted observations in a SQLite database. One row per location,
+  variable and time, so a time range of a variable at a location is a range scan of the
+  primary key. Rows older than the retention are pruned as we go.
+*/
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// How often rows older than the retention are deleted.
+const pruneInterval = time.Hour
+
+// MaxQueryRows is the most rows Query returns.
+const MaxQueryRows = 100000
+
+const schema = `
+CREATE TABLE IF NOT EXISTS observations (
+	location TEXT NOT NULL,
+	variable TEXT NOT NULL,
+	time     INTEGER NOT NULL, -- unix milliseconds
+	value    REAL NOT NULL,
+	PRIMARY KEY (location, variable, time)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS observations_time ON observations (time);
+`
+
+type Config struct {
+	Path      string
+	Retention time.Duration // Rows older than this are deleted. Kept forever if 0.
+	Now       func() time.Time
+}
+
+type Sink struct {
+	db        *sql.DB
+	config    Config
+	lastPrune time.Time
+}
+
+func Open(config Config) (*Sink, error) {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	// WAL lets the status server read while the emitter writes.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000", config.Path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating schema in %s: %s", config.Path, err.Error())
+	}
+	return &Sink{db: db, config: config}, nil
+}
+
+func (s *Sink) Name() string {
+	return "sqlite"
+}
+
+// RetrySafe makes the sink Retryable, a write is a transaction.
+func (s *Sink) RetrySafe() {}
+
+func (s *Sink) Write(records []sink.Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO observations (location, variable, time, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		for _, v := range r.Values {
+			if _, err := stmt.Exec(r.Location, v.Name, toMillis(r.Time), v.Value); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if s.config.Retention > 0 && s.config.Now().Sub(s.lastPrune) > pruneInterval {
+		if err := s.prune(); err != nil {
+			log.Errorf("(sqlite) pruning old observations failed: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *Sink) prune() error {
+	now := s.config.Now()
+	res, err := s.db.Exec("DELETE FROM observations WHERE time < ?", toMillis(now.Add(-s.config.Retention)))
+	if err != nil {
+		return err
+	}
+	s.lastPrune = now
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Infof("(sqlite) pruned %d observations older than %s", n, s.config.Retention)
+	}
+	return nil
+}
+
+// Query returns the values of a location within [from, to), ordered by time and variable.
+// All variables if none are given. At most limit rows, or MaxQueryRows.
+func (s *Sink) Query(location string, variables []string, from time.Time, to time.Time, limit int) ([]sink.StoredValue, error) {
+	if limit <= 0 || limit > MaxQueryRows {
+		limit = MaxQueryRows
+	}
+	query := "SELECT variable, time, value FROM observations WHERE location = ? AND time >= ? AND time < ?"
+	args := []interface{}{location, toMillis(from), toMillis(to)}
+	if len(variables) > 0 {
+		query += " AND variable IN (?" + strings.Repeat(", ?", len(variables)-1) + ")"
+		for _, v := range variables {
+			args = append(args, v)
+		}
+	}
+	query += " ORDER BY time, variable LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]sink.StoredValue, 0)
+	for rows.Next() {
+		v := sink.StoredValue{Location: location}
+		var millis int64
+		if err := rows.Scan(&v.Variable, &millis, &v.Value); err != nil {
+			return nil, err
+		}
+		v.Time = time.Unix(0, millis*int64(time.Millisecond)).UTC()
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,59 @@
+package sqlite
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/sinktest"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_WriteAndQuery(t *testing.T) {
+	s, err := Open(Config{Path: filepath.Join(t.TempDir(), "yrpoller.db")})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Write(sinktest.Records("skrindo", sinktest.Start, 6)))
+	assert.Nil(t, s.Write(sinktest.Records("tryvannstua", sinktest.Start, 6)))
+	// Writing the same observation again replaces it.
+	assert.Nil(t, s.Write(sinktest.Records("skrindo", sinktest.Start, 1)))
+
+	values, err := s.Query("skrindo", nil, sinktest.Start, sinktest.Start.Add(time.Hour), 0)
+	assert.Nil(t, err)
+	assert.Len(t, values, 12)
+	assert.Equal(t, sink.StoredValue{Time: sinktest.Start.Add(10 * time.Minute), Location: "skrindo",
+		Variable: "air_temperature", Value: -1}, values[2])
+
+	values, err = s.Query("skrindo", []string{"wind_speed"}, sinktest.Start.Add(20*time.Minute), sinktest.Start.Add(40*time.Minute), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []sink.StoredValue{
+		{Time: sinktest.Start.Add(20 * time.Minute), Location: "skrindo", Variable: "wind_speed", Value: 1},
+		{Time: sinktest.Start.Add(30 * time.Minute), Location: "skrindo", Variable: "wind_speed", Value: 1.5},
+	}, values)
+
+	values, err = s.Query("skrindo", nil, sinktest.Start, sinktest.Start.Add(time.Hour), 3)
+	assert.Nil(t, err)
+	assert.Len(t, values, 3)
+}
+
+func Test_Retention(t *testing.T) {
+	now := sinktest.Start
+	s, err := Open(Config{
+		Path:      filepath.Join(t.TempDir(), "yrpoller.db"),
+		Retention: 24 * time.Hour,
+		Now:       func() time.Time { return now },
+	})
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Write(sinktest.Records("skrindo", sinktest.Start, 6)))
+	now = sinktest.Start.Add(24*time.Hour + 25*time.Minute)
+	assert.Nil(t, s.Write(sinktest.Records("skrindo", now, 1)))
+
+	values, err := s.Query("skrindo", []string{"air_temperature"}, sinktest.Start, now.Add(time.Hour), 0)
+	assert.Nil(t, err)
+	// 00:00, 00:10 and 00:20 are older than the retention.
+	assert.Len(t, values, 4)
+	assert.Equal(t, sinktest.Start.Add(30*time.Minute), values[0].Time)
+}
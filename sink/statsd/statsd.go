@@ -0,0 +1,118 @@
+package statsd
+
+/*
+  Sends the emitted observations to StatsD as gauges over UDP, like
+
+    yrpoller.tryvannstua.air_temperature:-3.4|g
+
+  The lines are packed into as few packets as fit the MTU. Nothing is kept or retried,
+  the next emit sets the gauges anyway.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/graphite"
+	"math"
+	"net"
+	"strconv"
+)
+
+const (
+	DefaultPrefix = "yrpoller"
+	DefaultPort   = "8125"
+	// Fits in a packet on an ethernet without fragmenting, the usual StatsD client default.
+	DefaultMaxPacketSize = 1432
+)
+
+type Config struct {
+	Address       string // host:port of StatsD, the port is DefaultPort if not given
+	Prefix        string // DefaultPrefix if empty
+	MaxPacketSize int    // DefaultMaxPacketSize if 0
+}
+
+type Sink struct {
+	config Config
+	conn   net.Conn
+}
+
+func Open(config Config) (*Sink, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("no address given")
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		config.Address = net.JoinHostPort(config.Address, DefaultPort)
+	}
+	if config.Prefix == "" {
+		config.Prefix = DefaultPrefix
+	}
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = DefaultMaxPacketSize
+	}
+	// Only resolves the address, UDP has no connection to make.
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{config: config, conn: conn}, nil
+}
+
+func (s *Sink) Name() string {
+	return "statsd"
+}
+
+// gaugeLines are the lines setting a gauge. A sign in front of the value makes it a change
+// of the gauge, so a negative value is set by setting the gauge to 0 first.
+func gaugeLines(path string, value float64) []string {
+	v := strconv.FormatFloat(value, 'f', -1, 64)
+	if value < 0 {
+		return []string{path + ":0|g", path + ":" + v + "|g"}
+	}
+	return []string{path + ":" + v + "|g"}
+}
+
+func (s *Sink) Write(records []sink.Record) error {
+	var packet bytes.Buffer
+	var failed []error
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			failed = append(failed, err)
+		}
+		packet.Reset()
+	}
+	for _, r := range records {
+		for _, v := range r.Values {
+			if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+				continue
+			}
+			// Both lines of a negative value go in the same packet, so they arrive in order.
+			lines := gaugeLines(graphite.Path(s.config.Prefix, r.Location, v.Name), v.Value)
+			size := len(lines) - 1
+			for _, l := range lines {
+				size += len(l)
+			}
+			if packet.Len() > 0 && packet.Len()+1+size > s.config.MaxPacketSize {
+				send()
+			}
+			for _, l := range lines {
+				if packet.Len() > 0 {
+					packet.WriteByte('\n')
+				}
+				packet.WriteString(l)
+			}
+		}
+	}
+	send()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d packets could not be sent, the first: %s", len(failed), failed[0].Error())
+	}
+	return nil
+}
+
+func (s *Sink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,67 @@
+package statsd
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func receive(t *testing.T, pc net.PacketConn) string {
+	buf := make([]byte, 65536)
+	assert.Nil(t, pc.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := pc.ReadFrom(buf)
+	assert.Nil(t, err)
+	return string(buf[:n])
+}
+
+func Test_Gauges(t *testing.T) {
+	pc := listen(t)
+	s, err := Open(Config{Address: pc.LocalAddr().String()})
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Nil(t, s.Write([]sink.Record{{
+		Time:     time.Now(),
+		Location: "tryvannstua",
+		Values:   []sink.Value{{Name: "air_temperature", Value: -3.4}, {Name: "wind_speed", Value: 2.5}},
+	}}))
+	assert.Equal(t, "yrpoller.tryvannstua.air_temperature:0|g\n"+
+		"yrpoller.tryvannstua.air_temperature:-3.4|g\n"+
+		"yrpoller.tryvannstua.wind_speed:2.5|g", receive(t, pc))
+}
+
+func Test_PacketSize(t *testing.T) {
+	pc := listen(t)
+	s, err := Open(Config{Address: pc.LocalAddr().String(), Prefix: "w", MaxPacketSize: 60})
+	assert.Nil(t, err)
+	defer s.Close()
+	var records []sink.Record
+	for _, location := range []string{"a", "b", "c"} {
+		records = append(records, sink.Record{
+			Time:     time.Now(),
+			Location: location,
+			Values:   []sink.Value{{Name: "air_temperature", Value: -1}},
+		})
+	}
+	assert.Nil(t, s.Write(records))
+	var lines []string
+	for i := 0; i < 3; i++ {
+		packet := receive(t, pc)
+		assert.True(t, len(packet) <= 60, packet)
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	assert.Equal(t, []string{
+		"w.a.air_temperature:0|g", "w.a.air_temperature:-1|g",
+		"w.b.air_temperature:0|g", "w.b.air_temperature:-1|g",
+		"w.c.air_temperature:0|g", "w.c.air_temperature:-1|g",
+	}, lines)
+}
@@ -0,0 +1,387 @@
+package webhook
+
+/*
+  POSTs the emitted observations to URLs, for integrations that don't deserve a sink of
+  their own. The body is made with a text/template, a request per observation or one per
+  emit with all of them. A hook can add headers and sign the body with HMAC-SHA256.
+
+  Requests that fail with a network error, 429 or 5xx are retried a few times with a
+  backoff. After that the hook keeps the body and the ones after it, and sends them first
+  on the next write, so the hooks that got a write don't get it again. Bodies a hook refuses
+  with another status are dropped.
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	ModeObservation = "observation" // A request per observation.
+	ModeBatch       = "batch"       // A request per emit.
+
+	DefaultSignatureHeader = "X-Yrpoller-Signature"
+	DefaultMaxRetries      = 3
+	DefaultBackoff         = time.Second
+	DefaultTimeout         = 10 * time.Second
+	DefaultMaxPending      = 1000 // Bodies a hook keeps for the next write, the oldest are dropped beyond it.
+	defaultContentType     = "application/json"
+)
+
+// HookConfig is a webhook in the config file.
+type HookConfig struct {
+	Name            string            `json:"name"`
+	Url             string            `json:"url"`
+	Mode            string            `json:"mode"`          // ModeObservation or ModeBatch, ModeObservation if empty.
+	Template        string            `json:"template"`      // The body, JSON of the observation or batch if empty.
+	TemplateFile    string            `json:"template_file"` // Instead of template, relative to the config file.
+	ContentType     string            `json:"content_type"`  // application/json if empty.
+	Headers         map[string]string `json:"headers"`
+	Secret          string            `json:"secret"`           // Signs the body with HMAC-SHA256 if given.
+	SignatureHeader string            `json:"signature_header"` // DefaultSignatureHeader if empty.
+	Locations       []string          `json:"locations"`        // All locations if empty.
+	MaxRetries      *int              `json:"max_retries"`      // DefaultMaxRetries if not given.
+	Backoff         string            `json:"backoff"`          // Before the first retry, doubled for each. Like "1s".
+	Timeout         string            `json:"timeout"`          // Of every request, like "10s".
+}
+
+type Config struct {
+	Hooks []HookConfig `json:"webhooks"`
+}
+
+// Observation is the data of the template in ModeObservation.
+type Observation struct {
+	Time       time.Time          `json:"time"`
+	Location   string             `json:"location"`
+	Dimensions map[string]string  `json:"dimensions"`
+	Values     map[string]float64 `json:"values"`
+}
+
+// Batch is the data of the template in ModeBatch.
+type Batch struct {
+	Time         time.Time     `json:"time"`
+	Observations []Observation `json:"observations"`
+}
+
+var funcs = template.FuncMap{
+	// json marshals a value, like {{json .Values}}.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// round rounds a value to a number of decimals, like {{round (index .Values "air_temperature") 1}}.
+	"round": func(v float64, decimals int) float64 {
+		p := math.Pow(10, float64(decimals))
+		return math.Round(v*p) / p
+	},
+}
+
+type hook struct {
+	config     HookConfig
+	template   *template.Template
+	locations  map[string]bool
+	maxRetries int
+	backoff    time.Duration
+	client     *http.Client
+	pending    [][]byte // Not delivered yet, sent first on the next write.
+}
+
+type Sink struct {
+	hooks []*hook
+	// sleep waits between retries, replaced in the tests.
+	sleep func(time.Duration)
+}
+
+// ReadConfig reads the webhooks from a JSON file. Template files are read relative to it.
+func ReadConfig(path string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	for i, h := range config.Hooks {
+		if h.TemplateFile == "" {
+			continue
+		}
+		if h.Template != "" {
+			return config, fmt.Errorf("webhook %s has both a template and a template_file", h.Name)
+		}
+		file := h.TemplateFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		t, err := ioutil.ReadFile(file)
+		if err != nil {
+			return config, fmt.Errorf("webhook %s: %s", h.Name, err.Error())
+		}
+		config.Hooks[i].Template = string(t)
+	}
+	return config, nil
+}
+
+func Open(config Config) (*Sink, error) {
+	if len(config.Hooks) == 0 {
+		return nil, fmt.Errorf("no webhooks configured")
+	}
+	s := &Sink{sleep: time.Sleep}
+	names := make(map[string]bool)
+	for _, c := range config.Hooks {
+		h, err := newHook(c)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %s", c.Name, err.Error())
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("webhook %s is configured twice", c.Name)
+		}
+		names[c.Name] = true
+		s.hooks = append(s.hooks, h)
+	}
+	return s, nil
+}
+
+func newHook(c HookConfig) (*hook, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("needs a name")
+	}
+	if !strings.HasPrefix(c.Url, "http://") && !strings.HasPrefix(c.Url, "https://") {
+		return nil, fmt.Errorf("url must be http:// or https://, got '%s'", c.Url)
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = ModeObservation
+	case ModeObservation, ModeBatch:
+	default:
+		return nil, fmt.Errorf("unknown mode '%s', use %s or %s", c.Mode, ModeObservation, ModeBatch)
+	}
+	if c.Template == "" {
+		c.Template = "{{json .}}"
+	}
+	if c.ContentType == "" {
+		c.ContentType = defaultContentType
+	}
+	if c.SignatureHeader == "" {
+		c.SignatureHeader = DefaultSignatureHeader
+	}
+	t, err := template.New(c.Name).Funcs(funcs).Parse(c.Template)
+	if err != nil {
+		return nil, err
+	}
+	h := &hook{
+		config:     c,
+		template:   t,
+		maxRetries: DefaultMaxRetries,
+		backoff:    DefaultBackoff,
+		client:     &http.Client{Timeout: DefaultTimeout},
+	}
+	if c.MaxRetries != nil {
+		if *c.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries can't be negative")
+		}
+		h.maxRetries = *c.MaxRetries
+	}
+	if c.Backoff != "" {
+		if h.backoff, err = time.ParseDuration(c.Backoff); err != nil {
+			return nil, fmt.Errorf("backoff: %s", err.Error())
+		}
+	}
+	if c.Timeout != "" {
+		if h.client.Timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, fmt.Errorf("timeout: %s", err.Error())
+		}
+	}
+	if len(c.Locations) > 0 {
+		h.locations = make(map[string]bool)
+		for _, l := range c.Locations {
+			h.locations[l] = true
+		}
+	}
+	return h, nil
+}
+
+func (s *Sink) Name() string {
+	return "webhook"
+}
+
+func observation(r sink.Record) Observation {
+	o := Observation{
+		Time:       r.Time.UTC(),
+		Location:   r.Location,
+		Dimensions: make(map[string]string, len(r.Dimensions)),
+		Values:     make(map[string]float64, len(r.Values)),
+	}
+	for _, d := range r.Dimensions {
+		o.Dimensions[d.Name] = d.Value
+	}
+	for _, v := range r.Values {
+		o.Values[v.Name] = v.Value
+	}
+	return o
+}
+
+// payloads renders the bodies of the requests for the records.
+func (h *hook) payloads(records []sink.Record) ([][]byte, error) {
+	var observations []Observation
+	for _, r := range records {
+		if h.locations == nil || h.locations[r.Location] {
+			observations = append(observations, observation(r))
+		}
+	}
+	if len(observations) == 0 {
+		return nil, nil
+	}
+	var data []interface{}
+	if h.config.Mode == ModeBatch {
+		data = append(data, Batch{Time: observations[0].Time, Observations: observations})
+	} else {
+		for _, o := range observations {
+			data = append(data, o)
+		}
+	}
+	var bodies [][]byte
+	for _, d := range data {
+		var buf bytes.Buffer
+		if err := h.template.Execute(&buf, d); err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, buf.Bytes())
+	}
+	return bodies, nil
+}
+
+// Sign is the value of the signature header: "sha256=" and the hex HMAC-SHA256 of the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retriableError is a failure that may go away if the request is made again.
+type retriableError struct {
+	err error
+}
+
+func (e *retriableError) Error() string {
+	return e.err.Error()
+}
+
+func (h *hook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", h.config.ContentType)
+	req.Header.Set("User-Agent", "yrpoller")
+	for k, v := range h.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if h.config.Secret != "" {
+		req.Header.Set(h.config.SignatureHeader, Sign(h.config.Secret, body))
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return &retriableError{err}
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+	err = fmt.Errorf("%s returned status %d", h.config.Url, res.StatusCode)
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+		return &retriableError{err}
+	}
+	return err
+}
+
+func (s *Sink) send(h *hook, body []byte) error {
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		err := h.post(body)
+		if _, ok := err.(*retriableError); !ok || attempt == h.maxRetries {
+			return err
+		}
+		log.Debugf("(webhook) %s: %s, retrying in %s", h.config.Name, err.Error(), backoff)
+		s.sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Write sends the bodies of the records to every hook, after what it hasn't delivered yet.
+func (s *Sink) Write(records []sink.Record) error {
+	var failed []error
+	requests := 0
+	for _, h := range s.hooks {
+		bodies, err := h.payloads(records)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %s", h.config.Name, err.Error()))
+		}
+		h.pending = append(h.pending, bodies...)
+		if over := len(h.pending) - DefaultMaxPending; over > 0 {
+			log.Warnf("(webhook) %s: more than %d requests waiting, dropped the oldest %d", h.config.Name, DefaultMaxPending, over)
+			h.pending = h.pending[over:]
+		}
+		for len(h.pending) > 0 {
+			requests++
+			err := s.send(h, h.pending[0])
+			if err == nil {
+				h.pending = h.pending[1:]
+				continue
+			}
+			failed = append(failed, fmt.Errorf("%s: %s", h.config.Name, err.Error()))
+			if _, ok := err.(*retriableError); ok {
+				// The hook is down, the rest waits for the next write.
+				break
+			}
+			h.pending = h.pending[1:]
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d requests failed, the first: %s", len(failed), requests, failed[0].Error())
+	}
+	return nil
+}
+
+// Pending is the number of requests the hooks haven't delivered yet.
+func (s *Sink) Pending() int {
+	n := 0
+	for _, h := range s.hooks {
+		n += len(h.pending)
+	}
+	return n
+}
+
+func (s *Sink) Close() error {
+	return nil
+}
+
+// Check renders the templates with an example observation, to find errors at startup
+// rather than on the first emit.
+func (s *Sink) Check(example sink.Record) error {
+	for _, h := range s.hooks {
+		saved := h.locations
+		h.locations = nil
+		_, err := h.payloads([]sink.Record{example})
+		h.locations = saved
+		if err != nil {
+			return fmt.Errorf("webhook %s: %s", h.config.Name, err.Error())
+		}
+	}
+	return nil
+}
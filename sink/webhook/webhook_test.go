@@ -0,0 +1,186 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/sinktest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type request struct {
+	header http.Header
+	body   string
+}
+
+// receiver records the requests, answering with the status codes given and 200 after them.
+func receiver(t *testing.T, statusCodes ...int) (*httptest.Server, *[]request) {
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, request{header: r.Header, body: string(body)})
+		if len(statusCodes) > 0 {
+			w.WriteHeader(statusCodes[0])
+			statusCodes = statusCodes[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// testRecords are the first observation from tryvannstua and the third from skrindo.
+func testRecords() []sink.Record {
+	return append(sinktest.Records("tryvannstua", sinktest.Start, 1), sinktest.Records("skrindo", sinktest.Start, 3)[2])
+}
+
+func open(t *testing.T, hooks ...HookConfig) *Sink {
+	s, err := Open(Config{Hooks: hooks})
+	assert.Nil(t, err)
+	s.sleep = func(time.Duration) {}
+	return s
+}
+
+func Test_ObservationTemplate(t *testing.T) {
+	server, requests := receiver(t)
+	s := open(t, HookConfig{
+		Name:        "display",
+		Url:         server.URL,
+		Template:    `{{.Location}}: {{round (index .Values "air_temperature") 1}} °C at {{.Time.Format "15:04"}}`,
+		ContentType: "text/plain",
+		Headers:     map[string]string{"X-Display": "kitchen"},
+		Locations:   []string{"tryvannstua"},
+	})
+	assert.Nil(t, s.Write(testRecords()))
+	assert.Len(t, *requests, 1)
+	r := (*requests)[0]
+	assert.Equal(t, "tryvannstua: 0 °C at 00:00", r.body)
+	assert.Equal(t, "text/plain", r.header.Get("Content-Type"))
+	assert.Equal(t, "kitchen", r.header.Get("X-Display"))
+	assert.Equal(t, "", r.header.Get(DefaultSignatureHeader))
+}
+
+func Test_BatchDefaultTemplate(t *testing.T) {
+	server, requests := receiver(t)
+	s := open(t, HookConfig{Name: "archive", Url: server.URL, Mode: ModeBatch, Secret: "s3cret"})
+	assert.Nil(t, s.Write(testRecords()))
+	assert.Len(t, *requests, 1)
+	r := (*requests)[0]
+	var batch Batch
+	assert.Nil(t, json.Unmarshal([]byte(r.body), &batch))
+	assert.Len(t, batch.Observations, 2)
+	assert.Equal(t, "skrindo", batch.Observations[1].Location)
+	assert.Equal(t, -2.0, batch.Observations[1].Values["air_temperature"])
+	assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+	assert.Equal(t, Sign("s3cret", []byte(r.body)), r.header.Get(DefaultSignatureHeader))
+}
+
+func Test_Sign(t *testing.T) {
+	// From the GitHub docs on validating webhook deliveries.
+	assert.Equal(t, "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+		Sign("It's a Secret to Everybody", []byte("Hello, World!")))
+}
+
+func Test_Retries(t *testing.T) {
+	server, requests := receiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	var slept []time.Duration
+	s := open(t, HookConfig{Name: "slack", Url: server.URL, Backoff: "2s", Locations: []string{"skrindo"}})
+	s.sleep = func(d time.Duration) { slept = append(slept, d) }
+	assert.Nil(t, s.Write(testRecords()))
+	assert.Len(t, *requests, 3)
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second}, slept)
+
+	// Not retried.
+	server, requests = receiver(t, http.StatusBadRequest)
+	s = open(t, HookConfig{Name: "slack", Url: server.URL, Locations: []string{"skrindo"}})
+	assert.NotNil(t, s.Write(testRecords()))
+	assert.Len(t, *requests, 1)
+	assert.Equal(t, 0, s.Pending(), "refused, so it is dropped")
+
+	// Given up on, and kept for the next write.
+	zero := 0
+	server, requests = receiver(t, http.StatusBadGateway)
+	s = open(t, HookConfig{Name: "slack", Url: server.URL, MaxRetries: &zero, Locations: []string{"skrindo"}})
+	assert.NotNil(t, s.Write(testRecords()))
+	assert.Len(t, *requests, 1)
+	assert.Equal(t, 1, s.Pending())
+	assert.Nil(t, s.Write(nil))
+	assert.Len(t, *requests, 2)
+	assert.Equal(t, (*requests)[0].body, (*requests)[1].body)
+	assert.Equal(t, 0, s.Pending())
+}
+
+func Test_PendingPerHook(t *testing.T) {
+	zero := 0
+	up, upRequests := receiver(t)
+	down, downRequests := receiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	s := open(t, HookConfig{Name: "up", Url: up.URL}, HookConfig{Name: "down", Url: down.URL, MaxRetries: &zero})
+
+	// The first request to down fails, so the second waits for the next write.
+	assert.NotNil(t, s.Write(testRecords()))
+	assert.Len(t, *upRequests, 2)
+	assert.Len(t, *downRequests, 1)
+	assert.Equal(t, 2, s.Pending())
+	assert.NotNil(t, s.Write(nil))
+	assert.Len(t, *downRequests, 2)
+
+	assert.Nil(t, s.Write(nil))
+	assert.Len(t, *upRequests, 2, "up isn't sent the same again")
+	assert.Len(t, *downRequests, 4)
+	assert.Equal(t, (*upRequests)[0].body, (*downRequests)[2].body)
+	assert.Equal(t, (*upRequests)[1].body, (*downRequests)[3].body)
+	assert.Equal(t, 0, s.Pending())
+}
+
+func Test_QueueDeliversOnce(t *testing.T) {
+	zero := 0
+	up, upRequests := receiver(t)
+	down, downRequests := receiver(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	s := open(t, HookConfig{Name: "up", Url: up.URL}, HookConfig{Name: "down", Url: down.URL, MaxRetries: &zero})
+	q := sink.NewQueue(s, sink.QueueConfig{MinBackoff: 5 * time.Millisecond, MaxBackoff: 10 * time.Millisecond}, nil, nil)
+	q.Enqueue(testRecords())
+	assert.Eventually(t, func() bool {
+		status := q.Status()
+		return status.NoOfWriteErrors == 2 && status.ConsecutiveFailures == 0 && status.PendingInSink == 0
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, q.Close(time.Second))
+
+	assert.Len(t, *upRequests, 2, "every observation once")
+	assert.Len(t, *downRequests, 4)
+	assert.Equal(t, (*upRequests)[0].body, (*downRequests)[2].body)
+	assert.Equal(t, (*upRequests)[1].body, (*downRequests)[3].body)
+}
+
+func Test_ReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "slack.tmpl"), []byte(`{"text": "{{.Location}}"}`), 0o644))
+	path := filepath.Join(dir, "webhooks.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"webhooks": [
+		{"name": "slack", "url": "https://hooks.slack.com/services/x", "template_file": "slack.tmpl", "max_retries": 1}
+	]}`), 0o644))
+	config, err := ReadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"text": "{{.Location}}"}`, config.Hooks[0].Template)
+	assert.Equal(t, 1, *config.Hooks[0].MaxRetries)
+	_, err = Open(config)
+	assert.Nil(t, err)
+}
+
+func Test_InvalidConfig(t *testing.T) {
+	for _, c := range []HookConfig{
+		{Url: "http://localhost"},
+		{Name: "a", Url: "localhost"},
+		{Name: "a", Url: "http://localhost", Mode: "stream"},
+		{Name: "a", Url: "http://localhost", Template: "{{.Location"},
+		{Name: "a", Url: "http://localhost", Backoff: "soon"},
+	} {
+		_, err := Open(Config{Hooks: []HookConfig{c}})
+		assert.NotNil(t, err, c)
+	}
+	s := open(t, HookConfig{Name: "a", Url: "http://localhost", Template: "{{.Temperature}}"})
+	assert.NotNil(t, s.Check(testRecords()[0]))
+}
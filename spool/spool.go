@@ -0,0 +1,412 @@
+package spool
+
+/*
+  A durable, append-only spool of byte entries kept in a directory of segment files.
+  Entries are read back in the order they were appended and removed once they are
+  acknowledged. The read position is kept in a cursor file, so a restart picks up
+  where we left off. The spool is bounded in size and age, the oldest entries are
+  dropped when it grows beyond the limits.
+
+  Every entry is a header (length, crc32 of the data, unix nanos) followed by the data.
+  A torn entry at the end of a segment, from a crash in the middle of a write, is
+  truncated away when the spool is opened.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix       = ".seg"
+	cursorFileName      = "cursor"
+	headerSize          = 16
+	DefaultSegmentBytes = 4 << 20
+)
+
+// ErrEmpty is returned from Peek when there is nothing to read.
+var ErrEmpty = errors.New("spool is empty")
+
+type Config struct {
+	Dir          string
+	SegmentBytes int64         // Start a new segment when the current one is this big. DefaultSegmentBytes if 0.
+	MaxBytes     int64         // Drop the oldest segments when the spool is bigger than this. No limit if 0.
+	MaxAge       time.Duration // Drop entries older than this. No limit if 0.
+	Now          func() time.Time
+}
+
+type Entry struct {
+	Time time.Time
+	Data []byte
+	seq  uint64 // where the entry is, so Ack can tell if it is still the next one.
+	pos  int64
+}
+
+type Stats struct {
+	Entries int       // waiting to be read
+	Bytes   int64     // on disk
+	Oldest  time.Time // of the entries waiting, zero if none
+	Dropped uint64    // entries dropped because of the limits since the spool was opened
+}
+
+type entryRef struct {
+	pos  int64
+	time time.Time
+}
+
+type segment struct {
+	seq     uint64
+	path    string
+	size    int64
+	entries []entryRef
+}
+
+type Spool struct {
+	mu       sync.Mutex
+	config   Config
+	segments []*segment // oldest first, the last one is appended to
+	active   *os.File   // open for appending to the last segment, nil if none
+	next     int        // the next entry to read in the first segment
+	lastSeq  uint64     // sequence numbers are never reused, or a stale cursor could remove new segments
+	dropped  uint64
+}
+
+func Open(config Config) (*Spool, error) {
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = DefaultSegmentBytes
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Spool{config: config}
+	files, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := scanSegment(seq, filepath.Join(config.Dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+		if seq > s.lastSeq {
+			s.lastSeq = seq
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if err := s.readCursor(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// scanSegment indexes the entries of a segment file and truncates it after the last valid entry.
+func scanSegment(seq uint64, path string) (*segment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{seq: seq, path: path}
+	for pos := int64(0); pos+headerSize <= int64(len(data)); {
+		length := int64(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + headerSize + length
+		if end > int64(len(data)) || crc32.ChecksumIEEE(data[pos+headerSize:end]) != binary.BigEndian.Uint32(data[pos+4:]) {
+			break
+		}
+		nanos := int64(binary.BigEndian.Uint64(data[pos+8:]))
+		seg.entries = append(seg.entries, entryRef{pos: pos, time: time.Unix(0, nanos).UTC()})
+		pos = end
+		seg.size = end
+	}
+	if seg.size < int64(len(data)) {
+		log.Warnf("(spool) truncating %d bytes of torn or corrupt data from %s", int64(len(data))-seg.size, path)
+		if err := os.Truncate(path, seg.size); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// readCursor restores the read position. Segments before the cursor have been read and are removed.
+func (s *Spool) readCursor() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.config.Dir, cursorFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	var pos int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &pos); err != nil {
+		return fmt.Errorf("invalid spool cursor: %s", err.Error())
+	}
+	if seq > s.lastSeq {
+		s.lastSeq = seq
+	}
+	for len(s.segments) > 0 && s.segments[0].seq < seq {
+		if err := os.Remove(s.segments[0].path); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == seq {
+		for s.next < len(s.segments[0].entries) && s.segments[0].entries[s.next].pos < pos {
+			s.next++
+		}
+	}
+	return nil
+}
+
+// writeCursor stores the read position. The file is replaced atomically.
+func (s *Spool) writeCursor() error {
+	var seq uint64
+	var pos int64
+	if len(s.segments) > 0 {
+		seq = s.segments[0].seq
+		pos = s.segments[0].size
+		if s.next < len(s.segments[0].entries) {
+			pos = s.segments[0].entries[s.next].pos
+		}
+	}
+	path := filepath.Join(s.config.Dir, cursorFileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seq, pos)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Spool) rotate() error {
+	s.lastSeq++
+	seq := s.lastSeq
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+		s.active = nil
+	}
+	path := s.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, &segment{seq: seq, path: path})
+	return nil
+}
+
+// Append writes an entry to the spool. It is synced to disk before Append returns.
+func (s *Spool) Append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Segments left from an earlier run are never appended to.
+	if s.active == nil || s.segments[len(s.segments)-1].size >= s.config.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	now := s.config.Now()
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(data))
+	binary.BigEndian.PutUint64(buf[8:], uint64(now.UnixNano()))
+	copy(buf[headerSize:], data)
+
+	seg := s.segments[len(s.segments)-1]
+	_, err := s.active.Write(buf)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		// Don't leave half an entry behind.
+		s.active.Truncate(seg.size)
+		return err
+	}
+	seg.entries = append(seg.entries, entryRef{pos: seg.size, time: now.UTC()})
+	seg.size += int64(len(buf))
+	return s.enforceLimits()
+}
+
+// dropFirst removes the oldest segment, counting the entries in it that haven't been read.
+func (s *Spool) dropFirst() error {
+	seg := s.segments[0]
+	s.dropped += uint64(len(seg.entries) - s.next)
+	if len(s.segments) == 1 && s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+		s.active = nil
+	}
+	s.segments = s.segments[1:]
+	s.next = 0
+	if err := os.Remove(seg.path); err != nil {
+		return err
+	}
+	return s.writeCursor()
+}
+
+func (s *Spool) totalBytes() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+func (s *Spool) enforceLimits() error {
+	for s.config.MaxBytes > 0 && len(s.segments) > 1 && s.totalBytes() > s.config.MaxBytes {
+		log.Warnf("(spool) spool is larger than %d bytes, dropping the oldest segment", s.config.MaxBytes)
+		if err := s.dropFirst(); err != nil {
+			return err
+		}
+	}
+	var cutoff time.Time
+	if s.config.MaxAge > 0 {
+		cutoff = s.config.Now().Add(-s.config.MaxAge)
+	}
+	expired := 0
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if s.next >= len(seg.entries) {
+			// Read, expired or empty.
+			if err := s.dropFirst(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !seg.entries[s.next].time.Before(cutoff) {
+			break
+		}
+		s.next++
+		s.dropped++
+		expired++
+	}
+	if expired > 0 {
+		log.Warnf("(spool) dropped %d entries older than %s", expired, s.config.MaxAge)
+		return s.writeCursor()
+	}
+	return nil
+}
+
+// Peek returns the oldest entry without removing it. ErrEmpty if there is none.
+func (s *Spool) Peek() (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enforceLimits(); err != nil {
+		return Entry{}, err
+	}
+	if len(s.segments) == 0 || s.next >= len(s.segments[0].entries) {
+		return Entry{}, ErrEmpty
+	}
+	seg := s.segments[0]
+	ref := seg.entries[s.next]
+	end := seg.size
+	if s.next+1 < len(seg.entries) {
+		end = seg.entries[s.next+1].pos
+	}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+	data := make([]byte, end-ref.pos-headerSize)
+	if _, err := f.ReadAt(data, ref.pos+headerSize); err != nil {
+		return Entry{}, err
+	}
+	return Entry{Time: ref.time, Data: data, seq: seg.seq, pos: ref.pos}, nil
+}
+
+// Ack removes an entry returned by Peek. Entries that have been dropped in the meantime are ignored.
+func (s *Spool) Ack(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 || s.segments[0].seq != e.seq ||
+		s.next >= len(s.segments[0].entries) || s.segments[0].entries[s.next].pos != e.pos {
+		return nil
+	}
+	s.next++
+	if s.next < len(s.segments[0].entries) {
+		return s.writeCursor()
+	}
+	// The segment has been read, remove it. If it is the one we append to, the next
+	// Append starts a new one.
+	return s.dropFirst()
+}
+
+// Drain calls replay for the entries in order, removing them as replay succeeds. It stops at
+// the first error from replay and returns it with the number of entries replayed.
+func (s *Spool) Drain(replay func(Entry) error) (int, error) {
+	replayed := 0
+	for {
+		e, err := s.Peek()
+		if err == ErrEmpty {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		if err := replay(e); err != nil {
+			return replayed, err
+		}
+		if err := s.Ack(e); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := Stats{Bytes: s.totalBytes(), Dropped: s.dropped}
+	for i, seg := range s.segments {
+		first := 0
+		if i == 0 {
+			first = s.next
+		}
+		if first < len(seg.entries) {
+			if stats.Entries == 0 {
+				stats.Oldest = seg.entries[first].time
+			}
+			stats.Entries += len(seg.entries) - first
+		}
+	}
+	return stats
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
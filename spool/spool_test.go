@@ -0,0 +1,139 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSpool(t *testing.T, config Config) (*Spool, *time.Time) {
+	now := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+	config.Now = func() time.Time { return now }
+	s, err := Open(config)
+	assert.Nil(t, err)
+	return s, &now
+}
+
+func appendEntries(t *testing.T, s *Spool, from int, to int) {
+	for i := from; i < to; i++ {
+		assert.Nil(t, s.Append([]byte(fmt.Sprintf("entry %d", i))))
+	}
+}
+
+func drainAll(t *testing.T, s *Spool) []string {
+	entries := make([]string, 0)
+	_, err := s.Drain(func(e Entry) error {
+		entries = append(entries, string(e.Data))
+		return nil
+	})
+	assert.Nil(t, err)
+	return entries
+}
+
+func Test_AppendAndDrain(t *testing.T) {
+	s, _ := testSpool(t, Config{SegmentBytes: 64})
+	_, err := s.Peek()
+	assert.Equal(t, ErrEmpty, err)
+
+	appendEntries(t, s, 0, 10)
+	assert.Equal(t, 10, s.Stats().Entries)
+	assert.True(t, len(s.segments) > 1, "small segments should rotate")
+
+	// Stop at the first failure and carry on from there.
+	failAt := 4
+	replayed, err := s.Drain(func(e Entry) error {
+		if string(e.Data) == fmt.Sprintf("entry %d", failAt) {
+			return errors.New("sink down")
+		}
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, replayed)
+	assert.Equal(t, 6, s.Stats().Entries)
+
+	assert.Equal(t, []string{"entry 4", "entry 5", "entry 6", "entry 7", "entry 8", "entry 9"}, drainAll(t, s))
+	assert.Equal(t, 0, s.Stats().Entries)
+	assert.Equal(t, int64(0), s.Stats().Bytes, "read segments should be removed")
+
+	// Appending after the spool has been emptied starts a new segment.
+	appendEntries(t, s, 10, 11)
+	assert.Equal(t, []string{"entry 10"}, drainAll(t, s))
+}
+
+func Test_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := testSpool(t, Config{Dir: dir, SegmentBytes: 64})
+	appendEntries(t, s, 0, 6)
+	e, err := s.Peek()
+	assert.Nil(t, err)
+	assert.Nil(t, s.Ack(e))
+	assert.Nil(t, s.Close())
+
+	s, _ = testSpool(t, Config{Dir: dir, SegmentBytes: 64})
+	assert.Equal(t, 5, s.Stats().Entries)
+	appendEntries(t, s, 6, 7)
+	assert.Equal(t, []string{"entry 1", "entry 2", "entry 3", "entry 4", "entry 5", "entry 6"}, drainAll(t, s))
+	assert.Nil(t, s.Close())
+
+	s, _ = testSpool(t, Config{Dir: dir, SegmentBytes: 64})
+	assert.Equal(t, 0, s.Stats().Entries)
+}
+
+func Test_TornEntry(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := testSpool(t, Config{Dir: dir})
+	appendEntries(t, s, 0, 2)
+	assert.Nil(t, s.Close())
+
+	// Simulate a crash in the middle of a write.
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentSuffix))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, data[:len(data)-3], 0o644))
+
+	s, _ = testSpool(t, Config{Dir: dir})
+	assert.Equal(t, 1, s.Stats().Entries)
+	appendEntries(t, s, 2, 3)
+	assert.Equal(t, []string{"entry 0", "entry 2"}, drainAll(t, s))
+}
+
+func Test_MaxBytes(t *testing.T) {
+	s, _ := testSpool(t, Config{SegmentBytes: 64, MaxBytes: 128})
+	appendEntries(t, s, 0, 20)
+	stats := s.Stats()
+	assert.True(t, stats.Bytes <= 128)
+	assert.Equal(t, 20, stats.Entries+int(stats.Dropped))
+	entries := drainAll(t, s)
+	assert.Equal(t, "entry 19", entries[len(entries)-1], "the newest entries should be kept")
+}
+
+func Test_MaxAge(t *testing.T) {
+	s, now := testSpool(t, Config{MaxAge: time.Hour})
+	appendEntries(t, s, 0, 2)
+	*now = now.Add(30 * time.Minute)
+	appendEntries(t, s, 2, 3)
+	assert.Equal(t, now.Add(-30*time.Minute), s.Stats().Oldest)
+
+	*now = now.Add(45 * time.Minute)
+	assert.Equal(t, []string{"entry 2"}, drainAll(t, s))
+	assert.Equal(t, uint64(2), s.Stats().Dropped)
+}
+
+func Test_AckDropped(t *testing.T) {
+	s, now := testSpool(t, Config{MaxAge: time.Hour})
+	appendEntries(t, s, 0, 1)
+	e, err := s.Peek()
+	assert.Nil(t, err)
+	// The entry expires while it is being replayed, acking it must not remove the next one.
+	*now = now.Add(2 * time.Hour)
+	appendEntries(t, s, 1, 2)
+	assert.Nil(t, s.Ack(e))
+	assert.Equal(t, []string{"entry 1"}, drainAll(t, s))
+}
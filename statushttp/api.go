@@ -0,0 +1,138 @@
+package statushttp
+
+import (
+	"crypto/subtle"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrLocationNotFound is returned from a LocationAPI for ids it doesn't have.
+	ErrLocationNotFound = errors.New("no such location")
+	// ErrLocationExists is returned from LocationAPI.Create for ids that are taken.
+	ErrLocationExists = errors.New("the location already exists")
+	// ErrInvalidLocation is what errors from a LocationAPI wrap if the location sent is wrong.
+	// The lines after the first are the problems, sent back as a JSON list.
+	ErrInvalidLocation = errors.New("invalid location")
+)
+
+// Big enough for any location.
+const maxLocationBody = 1 << 20
+
+// authorized checks the bearer token of a request, in constant time.
+func authorized(r *http.Request, token string) bool {
+	given, ok := cutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// cutPrefix returns s without prefix, and whether it had it.
+func cutPrefix(s string, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// writeAPIError sends an error from the location API with the status it calls for.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrLocationNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrLocationExists):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidLocation):
+		status = http.StatusBadRequest
+	default:
+		log.Errorf("(api) %s", err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := struct {
+		Error    string   `json:"error"`
+		Problems []string `json:"problems,omitempty"`
+	}{Error: err.Error()}
+	if status == http.StatusBadRequest {
+		lines := strings.Split(err.Error(), "\n")
+		body.Error = lines[0]
+		if len(lines) > 1 {
+			body.Problems = lines[1:]
+		}
+	}
+	writeJSON(w, body)
+}
+
+// locationAPIHandler serves GET and POST on /api/locations, and GET, PUT and DELETE on
+// /api/locations/<id>.
+func (ds *DaemonStatus) locationAPIHandler(w http.ResponseWriter, r *http.Request) {
+	ds.mu.Lock()
+	config := *ds.locationAPI
+	ds.mu.Unlock()
+	if config.api == nil {
+		http.Error(w, "the location API is not enabled", http.StatusNotFound)
+		return
+	}
+	if !authorized(r, config.token) {
+		log.Warnf("(api) unauthorized %s %s from %v", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="yrpoller"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/locations"), "/")
+	allowed := []string{"GET", "POST"}
+	if id != "" {
+		allowed = []string{"GET", "PUT", "DELETE"}
+	}
+	ok := false
+	for _, method := range allowed {
+		ok = ok || r.Method == method
+	}
+	if !ok {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var body []byte
+	if r.Method == "POST" || r.Method == "PUT" {
+		var err error
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLocationBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var result interface{}
+	var err error
+	switch {
+	case r.Method == "GET" && id == "":
+		result = config.api.List()
+	case r.Method == "GET":
+		result, err = config.api.Get(id)
+	case r.Method == "POST":
+		result, err = config.api.Create(body)
+	case r.Method == "PUT":
+		result, err = config.api.Update(id, body)
+	case r.Method == "DELETE":
+		err = config.api.Delete(id)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		log.Infof("(api) location %s removed", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "POST":
+		log.Info("(api) location added")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	case "PUT":
+		log.Infof("(api) location %s changed", id)
+	}
+	writeJSON(w, result)
+}
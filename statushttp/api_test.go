@@ -0,0 +1,155 @@
+package statushttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiStub records the calls and answers with err if it is set.
+type apiStub struct {
+	calls []string
+	err   error
+}
+
+func (a *apiStub) List() interface{} {
+	a.calls = append(a.calls, "list")
+	return []string{"met"}
+}
+
+func (a *apiStub) Get(id string) (interface{}, error) {
+	a.calls = append(a.calls, "get "+id)
+	return id, a.err
+}
+
+func (a *apiStub) Create(body []byte) (interface{}, error) {
+	a.calls = append(a.calls, "create "+string(body))
+	return "created", a.err
+}
+
+func (a *apiStub) Update(id string, body []byte) (interface{}, error) {
+	a.calls = append(a.calls, "update "+id+" "+string(body))
+	return "updated", a.err
+}
+
+func (a *apiStub) Delete(id string) error {
+	a.calls = append(a.calls, "delete "+id)
+	return a.err
+}
+
+func serveAPI(ds *DaemonStatus, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ds.locationAPIHandler(w, r)
+	return w
+}
+
+func Test_locationAPIHandlerAuth(t *testing.T) {
+	ds := NewDaemonStatus()
+	assert.Equal(t, http.StatusNotFound, serveAPI(&ds, "GET", "/api/locations", "s3cret", "").Code,
+		"the API is off without a token")
+
+	api := &apiStub{}
+	ds.SetLocationAPI(api, "s3cret")
+	w := serveAPI(&ds, "GET", "/api/locations", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="yrpoller"`, w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, http.StatusUnauthorized, serveAPI(&ds, "GET", "/api/locations", "s3cre", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, serveAPI(&ds, "DELETE", "/api/locations/met", "s3cret2", "").Code)
+
+	r := httptest.NewRequest("GET", "/api/locations", nil)
+	r.Header.Set("Authorization", "s3cret")
+	w = httptest.NewRecorder()
+	ds.locationAPIHandler(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "it must be a bearer token")
+	assert.Empty(t, api.calls)
+
+	assert.Equal(t, http.StatusOK, serveAPI(&ds, "GET", "/api/locations", "s3cret", "").Code)
+	assert.Equal(t, []string{"list"}, api.calls)
+}
+
+func Test_locationAPIHandlerRouting(t *testing.T) {
+	ds := NewDaemonStatus()
+	api := &apiStub{}
+	ds.SetLocationAPI(api, "s3cret")
+
+	w := serveAPI(&ds, "GET", "/api/locations", "s3cret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `["met"]`, w.Body.String())
+	w = serveAPI(&ds, "GET", "/api/locations/met", "s3cret", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `"met"`, w.Body.String())
+	w = serveAPI(&ds, "POST", "/api/locations", "s3cret", `{"id": "met"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	w = serveAPI(&ds, "PUT", "/api/locations/met/", "s3cret", `{"lat": 59.9}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveAPI(&ds, "DELETE", "/api/locations/met", "s3cret", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, []string{"list", "get met", `create {"id": "met"}`, `update met {"lat": 59.9}`, "delete met"}, api.calls)
+
+	api.calls = nil
+	w = serveAPI(&ds, "PUT", "/api/locations", "s3cret", `{"id": "met"}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, POST", w.Header().Get("Allow"))
+	w = serveAPI(&ds, "POST", "/api/locations/met", "s3cret", `{"id": "met"}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET, PUT, DELETE", w.Header().Get("Allow"))
+	assert.Equal(t, http.StatusMethodNotAllowed, serveAPI(&ds, "PATCH", "/api/locations/met", "s3cret", "").Code)
+	assert.Empty(t, api.calls)
+}
+
+func Test_locationAPIHandlerBodyLimit(t *testing.T) {
+	ds := NewDaemonStatus()
+	api := &apiStub{}
+	ds.SetLocationAPI(api, "s3cret")
+
+	w := serveAPI(&ds, "POST", "/api/locations", "s3cret", strings.Repeat(" ", maxLocationBody+1))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, api.calls, "too big a body isn't handed on")
+
+	w = serveAPI(&ds, "PUT", "/api/locations/met", "s3cret", strings.Repeat(" ", maxLocationBody))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, api.calls, 1)
+}
+
+func Test_locationAPIHandlerErrors(t *testing.T) {
+	ds := NewDaemonStatus()
+	api := &apiStub{}
+	ds.SetLocationAPI(api, "s3cret")
+	var body struct {
+		Error    string   `json:"error"`
+		Problems []string `json:"problems"`
+	}
+
+	api.err = fmt.Errorf("vikersund: %w", ErrLocationNotFound)
+	w := serveAPI(&ds, "GET", "/api/locations/vikersund", "s3cret", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "vikersund: no such location", body.Error)
+
+	api.err = fmt.Errorf("met: %w", ErrLocationExists)
+	assert.Equal(t, http.StatusConflict, serveAPI(&ds, "POST", "/api/locations", "s3cret", "{}").Code)
+
+	api.err = fmt.Errorf("%w: 2 problems\n1:1: id is missing\n1:12: lat is missing", ErrInvalidLocation)
+	w = serveAPI(&ds, "PUT", "/api/locations/met", "s3cret", "{}")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "invalid location: 2 problems", body.Error)
+	assert.Equal(t, []string{"1:1: id is missing", "1:12: lat is missing"}, body.Problems)
+
+	api.err = errors.New("could not write the locations to locations.json: disk full")
+	w = serveAPI(&ds, "DELETE", "/api/locations/met", "s3cret", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "disk full")
+}
@@ -1,9 +1,14 @@
 package statushttp
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (ds *DaemonStatus) statsHandler(w http.ResponseWriter, r *http.Request) {
@@ -12,11 +17,232 @@ func (ds *DaemonStatus) statsHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	ds.updateMemoryUsage()
-	// bla bla
-	jsonBytes, err := json.MarshalIndent(ds, "", "  ")
+	// Written from a copy, so a slow client doesn't hold up the ones updating the status.
+	status := ds.Snapshot()
+	jsonBytes, err := json.MarshalIndent(status, "", "  ")
 	if err != nil {
 		log.Fatal("Brain damage! Can't marshal internal structure to JSON.")
 	}
 	w.Write(jsonBytes)
 }
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jsonBytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal("Brain damage! Can't marshal internal structure to JSON.")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+// ErrUnknownVariable is returned from a HistoryFunc for variables that aren't emitted.
+var ErrUnknownVariable = errors.New("unknown variable")
+
+const (
+	defaultHistorySince = 6 * time.Hour
+	defaultHistoryLimit = 100
+)
+
+// historyHandler serves /locations/<id>/history?var=<variable>&since=<duration>&n=<points>
+func (ds *DaemonStatus) historyHandler(w http.ResponseWriter, r *http.Request, id string) {
+	ds.mu.Lock()
+	history := *ds.history
+	ds.mu.Unlock()
+	if history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	variable := query.Get("var")
+	if variable == "" {
+		http.Error(w, "var is required", http.StatusBadRequest)
+		return
+	}
+	since := defaultHistorySince
+	if query.Get("since") != "" {
+		var err error
+		since, err = time.ParseDuration(query.Get("since"))
+		if err != nil || since <= 0 {
+			http.Error(w, "invalid since, use a duration like 6h", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultHistoryLimit
+	if query.Get("n") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("n"))
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid n, use a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	status, err := history(id, variable, since, limit)
+	if errors.Is(err, ErrUnknownVariable) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("reading history of %s at %s failed: %s", variable, id, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, status)
+}
+
+const (
+	defaultObservationsRange = 24 * time.Hour
+	defaultObservationsLimit = 10000
+)
+
+// parseTimeParam parses a time as RFC3339, or as a duration back from now, like "6h".
+func parseTimeParam(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// observationsHandler serves /locations/<id>/observations?from=<time>&to=<time>&var=<a,b>&n=<rows>&format=<json|csv>
+func (ds *DaemonStatus) observationsHandler(w http.ResponseWriter, r *http.Request, id string) {
+	ds.mu.Lock()
+	observations := *ds.observations
+	ds.mu.Unlock()
+	if observations == nil {
+		http.Error(w, "no stored observations, enable the sqlite sink", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	now := time.Now().UTC()
+	from, to := now.Add(-defaultObservationsRange), now
+	var err error
+	if query.Get("from") != "" {
+		if from, err = parseTimeParam(query.Get("from"), now); err != nil {
+			http.Error(w, "invalid from, use RFC3339 or a duration like 6h", http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("to") != "" {
+		if to, err = parseTimeParam(query.Get("to"), now); err != nil {
+			http.Error(w, "invalid to, use RFC3339 or a duration like 6h", http.StatusBadRequest)
+			return
+		}
+	}
+	var variables []string
+	if query.Get("var") != "" {
+		variables = strings.Split(query.Get("var"), ",")
+	}
+	limit := defaultObservationsLimit
+	if query.Get("n") != "" {
+		if limit, err = strconv.Atoi(query.Get("n")); err != nil || limit <= 0 {
+			http.Error(w, "invalid n, use a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "invalid format, use json or csv", http.StatusBadRequest)
+		return
+	}
+	values, err := observations(id, variables, from, to, limit)
+	if err != nil {
+		log.Errorf("reading observations of %s failed: %s", id, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format != "csv" {
+		writeJSON(w, values)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "location", "variable", "value"})
+	for _, v := range values {
+		cw.Write([]string{v.Time.Format(time.RFC3339), v.Location, v.Variable, strconv.FormatFloat(v.Value, 'f', -1, 64)})
+	}
+	cw.Flush()
+}
+
+// skiConditions is a copy of the ski conditions of a location, or nil. Called with ds.mu held.
+func (ds *DaemonStatus) skiConditions(id string) *SkiConditionStatus {
+	ski := ds.Ski[id]
+	if ski == nil {
+		return nil
+	}
+	c := *ski
+	return &c
+}
+
+// locationHandler serves /locations/<id> and /locations/<id>/<what>
+func (ds *DaemonStatus) locationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Errorf("invalid method for %s from %v", r.URL.String(), r.RemoteAddr)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/locations/"), "/"), "/")
+	id := parts[0]
+	ds.mu.Lock()
+	_, ok := ds.Pollers[id]
+	ds.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		ds.mu.Lock()
+		alerts := make([]*AlertStatus, 0)
+		for _, alert := range ds.Alerts {
+			if alert.Location == id {
+				c := *alert
+				alerts = append(alerts, &c)
+			}
+		}
+		var info *LocationInfo
+		if l := ds.Locations[id]; l != nil {
+			c := *l
+			info = &c
+		}
+		p := ds.Pollers[id]
+		if p == nil {
+			// Removed by the location API since the check.
+			ds.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		poller := *p
+		ski := ds.skiConditions(id)
+		ds.mu.Unlock()
+		localTime := ""
+		if info != nil && info.Timezone != "" {
+			if tz, err := time.LoadLocation(info.Timezone); err == nil {
+				localTime = time.Now().In(tz).Format(time.RFC3339)
+			}
+		}
+		writeJSON(w, struct {
+			Id        string              `json:"id"`
+			Location  *LocationInfo       `json:"location"`
+			LocalTime string              `json:"local_time,omitempty"`
+			Poller    *PollerStatus       `json:"poller"`
+			Ski       *SkiConditionStatus `json:"ski_conditions,omitempty"`
+			Alerts    []*AlertStatus      `json:"alerts"`
+		}{id, info, localTime, &poller, ski, alerts})
+		return
+	}
+	switch parts[1] {
+	case "wax":
+		ds.mu.Lock()
+		ski := ds.skiConditions(id)
+		ds.mu.Unlock()
+		if ski == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, ski)
+	case "history":
+		ds.historyHandler(w, r, id)
+	case "observations":
+		ds.observationsHandler(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
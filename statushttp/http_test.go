@@ -0,0 +1,76 @@
+package statushttp
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stalledWriter is a client that doesn't read the response until it is released.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan bool
+	release chan bool
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	w.writing <- true
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func Test_handlersDontHoldTheLock(t *testing.T) {
+	ds := NewDaemonStatus()
+	ds.AddLocation("skrindo", LocationInfo{Name: "Skrindo", Timezone: "Europe/Oslo"})
+	ds.SetSkiConditions("skrindo", SkiConditionStatus{Wax: "violet"})
+	ds.AddAlert("cold/skrindo", AlertStatus{Rule: "cold", Location: "skrindo", State: "ok"})
+
+	for _, path := range []string{"/", "/locations/skrindo", "/locations/skrindo/wax"} {
+		w := &stalledWriter{ResponseRecorder: httptest.NewRecorder(), writing: make(chan bool), release: make(chan bool)}
+		handler := ds.statsHandler
+		if path != "/" {
+			handler = ds.locationHandler
+		}
+		served := make(chan bool)
+		go func() {
+			handler(w, httptest.NewRequest("GET", path, nil))
+			served <- true
+		}()
+		<-w.writing
+
+		updated := make(chan bool)
+		go func() {
+			ds.IncEmit()
+			ds.SetSkiConditions("skrindo", SkiConditionStatus{Wax: "blue"})
+			ds.SetAlertState("cold/skrindo", "firing", -12, time.Now())
+			updated <- true
+		}()
+		select {
+		case <-updated:
+		case <-time.After(time.Second):
+			t.Errorf("%s holds the lock while the client reads", path)
+		}
+		close(w.release)
+		<-served
+		if t.Failed() {
+			<-updated
+		}
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+}
+
+func Test_statsHandlerSpoolAge(t *testing.T) {
+	ds := NewDaemonStatus()
+	ds.SetSpool(3, 1024, time.Now().Add(-time.Minute), 0)
+	w := httptest.NewRecorder()
+	ds.statsHandler(w, httptest.NewRequest("GET", "/", nil))
+	var status struct {
+		Spool SpoolStatus `json:"spool"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.InDelta(t, 60, status.Spool.OldestEntryAgeSeconds, 5)
+	assert.Equal(t, 0.0, ds.Spool.OldestEntryAgeSeconds, "computed on the copy")
+}
@@ -1,34 +1,258 @@
 package statushttp
 
 import (
+	"github.com/perbu/yrpoller/sink"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 )
 
+// Polls of locations that have been removed while they were polled are ignored.
 func (ds *DaemonStatus) IncPoll(location string) {
-	ds.Pollers[location].LastPollTime = time.Now().UTC()
-	ds.Pollers[location].NoOfPolls++
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	p := ds.Pollers[location]
+	if p == nil {
+		return
+	}
+	p.LastPollTime = time.Now().UTC()
+	p.NoOfPolls++
 }
 func (ds *DaemonStatus) IncPollError(location string, errMsg string) {
-	ds.Pollers[location].LastPollErrorTime = time.Now().UTC()
-	ds.Pollers[location].LastPollErrorMessage = errMsg
-	ds.Pollers[location].NoOfPollErrors++
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	p := ds.Pollers[location]
+	if p == nil {
+		return
+	}
+	p.LastPollErrorTime = time.Now().UTC()
+	p.LastPollErrorMessage = errMsg
+	p.NoOfPollErrors++
+}
+
+func (ds *DaemonStatus) SetPollDuration(location string, d time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if p := ds.Pollers[location]; p != nil {
+		p.LastPollDurationSeconds = d.Seconds()
+	}
 }
 
 func (ds *DaemonStatus) IncEmitError(errMsg string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 	ds.Emitter.LastEmitErrorTime = time.Now().UTC()
 	ds.Emitter.LastEmitErrorMessage = errMsg
 	ds.Emitter.NoOfEmitErrors++
 }
+func (ds *DaemonStatus) IncRejectedRecords(reason string, count int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Emitter.NoOfRejectedRecords += uint64(count)
+	ds.Emitter.RejectedRecords[reason] += uint64(count)
+}
+func (ds *DaemonStatus) IncProducerError(reason string, count int, errMsg string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Emitter.NoOfProducerErrors += uint64(count)
+	ds.Emitter.ProducerErrors[reason] += uint64(count)
+	ds.Emitter.LastProducerErrorMessage = errMsg
+	ds.Emitter.LastProducerErrorTime = time.Now().UTC()
+}
+
+// SetSpool updates the spool depth. The age of the oldest entry is computed when the status is served.
+func (ds *DaemonStatus) SetSpool(entries int, bytes int64, oldest time.Time, dropped uint64) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Spool.Enabled = true
+	ds.Spool.Entries = uint64(entries)
+	ds.Spool.Bytes = bytes
+	ds.Spool.OldestEntry = oldest
+	ds.Spool.NoOfDropped = dropped
+}
+
+func (ds *DaemonStatus) IncSpoolReplayError(errMsg string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Spool.LastReplayErrorTime = time.Now().UTC()
+	ds.Spool.LastReplayErrorMessage = errMsg
+	ds.Spool.NoOfReplayErrors++
+}
+
 func (ds *DaemonStatus) IncEmit() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 	ds.Emitter.LastEmitTime = time.Now().UTC()
 	ds.Emitter.NoOfEmits++
 }
 
-func (ds *DaemonStatus) AddLocation(location string) {
-	ds.Pollers[location] = new(PollerStatus)
+// SetSinkStatus updates the status of a sink's queue.
+func (ds *DaemonStatus) SetSinkStatus(name string, status sink.QueueStatus) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.Sinks[name] == nil {
+		ds.Sinks[name] = new(sink.QueueStatus)
+	}
+	*ds.Sinks[name] = status
+}
+
+func (ds *DaemonStatus) SetSkiConditions(location string, status SkiConditionStatus) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.Ski[location] == nil {
+		ds.Ski[location] = new(SkiConditionStatus)
+	}
+	*ds.Ski[location] = status
+}
+
+// RemoveSkiConditions is for locations that are no longer emitted.
+func (ds *DaemonStatus) RemoveSkiConditions(location string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.Ski, location)
+}
+
+// AddAlert registers an alert rule for a location. The key is "rule/location".
+func (ds *DaemonStatus) AddAlert(key string, status AlertStatus) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Alerts[key] = &status
+}
+
+// SetAlertState records the state and the latest value of an alert after an evaluation.
+func (ds *DaemonStatus) SetAlertState(key string, state string, value float64, since time.Time) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if a := ds.Alerts[key]; a != nil {
+		a.State = state
+		a.Value = value
+		a.Since = since
+	}
+}
+
+// RecordAlertNotification counts a notification about an alert, or the error sending it failed with.
+func (ds *DaemonStatus) RecordAlertNotification(key string, at time.Time, err error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	a := ds.Alerts[key]
+	if a == nil {
+		return
+	}
+	if err != nil {
+		a.NoOfNotifyErrors++
+		a.LastNotifyErrorMessage = err.Error()
+		return
+	}
+	a.NoOfNotifications++
+	a.LastNotified = at
+}
+
+// RemoveAlerts removes the alerts of a location that is no longer emitted.
+func (ds *DaemonStatus) RemoveAlerts(location string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for key, alert := range ds.Alerts {
+		if alert.Location == location {
+			delete(ds.Alerts, key)
+		}
+	}
+}
+
+// SetHistory enables /locations/<id>/history.
+func (ds *DaemonStatus) SetHistory(f HistoryFunc) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	*ds.history = f
+}
+
+// SetObservations enables /locations/<id>/observations.
+func (ds *DaemonStatus) SetObservations(f ObservationsFunc) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	*ds.observations = f
+}
+
+// SetLocationAPI enables /api/locations, for requests with the token as a bearer token.
+func (ds *DaemonStatus) SetLocationAPI(api LocationAPI, token string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	*ds.locationAPI = locationAPIConfig{api: api, token: token}
+}
+
+// AddLocation adds a location, or updates what is known about it. The poller status is kept
+// if the location is already there.
+func (ds *DaemonStatus) AddLocation(location string, info LocationInfo) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Locations[location] = &info
+	if ds.Pollers[location] == nil {
+		ds.Pollers[location] = new(PollerStatus)
+	}
+}
+
+// RemoveLocation removes a location that is no longer polled.
+func (ds *DaemonStatus) RemoveLocation(location string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.Locations, location)
+	delete(ds.Pollers, location)
+}
+
+// Snapshot copies the status, for reading it while it changes. The memory usage and the age
+// of the oldest spool entry are brought up to date first.
+func (ds *DaemonStatus) Snapshot() DaemonStatus {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.updateMemoryUsage()
+	s := DaemonStatus{
+		Status:       ds.Status,
+		Locations:    make(map[string]*LocationInfo, len(ds.Locations)),
+		Pollers:      make(map[string]*PollerStatus, len(ds.Pollers)),
+		Emitter:      new(EmitterStatus),
+		Spool:        new(SpoolStatus),
+		Sinks:        make(map[string]*sink.QueueStatus, len(ds.Sinks)),
+		Ski:          make(map[string]*SkiConditionStatus, len(ds.Ski)),
+		Alerts:       make(map[string]*AlertStatus, len(ds.Alerts)),
+		RunningSince: ds.RunningSince,
+		MemoryStats:  ds.MemoryStats,
+	}
+	for id, info := range ds.Locations {
+		c := *info
+		s.Locations[id] = &c
+	}
+	for id, p := range ds.Pollers {
+		c := *p
+		s.Pollers[id] = &c
+	}
+	*s.Emitter = *ds.Emitter
+	s.Emitter.RejectedRecords = make(map[string]uint64, len(ds.Emitter.RejectedRecords))
+	for k, v := range ds.Emitter.RejectedRecords {
+		s.Emitter.RejectedRecords[k] = v
+	}
+	s.Emitter.ProducerErrors = make(map[string]uint64, len(ds.Emitter.ProducerErrors))
+	for k, v := range ds.Emitter.ProducerErrors {
+		s.Emitter.ProducerErrors[k] = v
+	}
+	for name, q := range ds.Sinks {
+		c := *q
+		s.Sinks[name] = &c
+	}
+	for id, ski := range ds.Ski {
+		c := *ski
+		s.Ski[id] = &c
+	}
+	for key, a := range ds.Alerts {
+		c := *a
+		s.Alerts[key] = &c
+	}
+	*s.Spool = *ds.Spool
+	s.Spool.OldestEntryAgeSeconds = 0
+	if s.Spool.Entries > 0 {
+		s.Spool.OldestEntryAgeSeconds = time.Since(s.Spool.OldestEntry).Seconds()
+	}
+	return s
 }
 
 func (ds *DaemonStatus) updateMemoryUsage() {
@@ -46,14 +270,34 @@ func (ds *DaemonStatus) updateMemoryUsage() {
 
 }
 
-func Run(addr string) (stats DaemonStatus) {
+// NewDaemonStatus returns an empty status, for Run and for tests that don't need the server.
+func NewDaemonStatus() (stats DaemonStatus) {
+	stats.mu = new(sync.Mutex)
+	stats.history = new(HistoryFunc)
+	stats.observations = new(ObservationsFunc)
+	stats.locationAPI = new(locationAPIConfig)
 	stats.RunningSince = time.Now().UTC()
 	stats.Status = "running"
+	stats.Locations = make(map[string]*LocationInfo)
 	stats.Pollers = make(map[string]*PollerStatus)
 	stats.Emitter = new(EmitterStatus)
+	stats.Emitter.RejectedRecords = make(map[string]uint64)
+	stats.Emitter.ProducerErrors = make(map[string]uint64)
+	stats.Spool = new(SpoolStatus)
+	stats.Sinks = make(map[string]*sink.QueueStatus)
+	stats.Ski = make(map[string]*SkiConditionStatus)
+	stats.Alerts = make(map[string]*AlertStatus)
+	return stats
+}
+
+func Run(addr string) (stats DaemonStatus) {
+	stats = NewDaemonStatus()
 	handler := stats.statsHandler
 	// This is a very neat way of injecting state into a handler:
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/locations/", stats.locationHandler)
+	http.HandleFunc("/api/locations", stats.locationAPIHandler)
+	http.HandleFunc("/api/locations/", stats.locationAPIHandler)
 	log.Infof("starting stats server on %s", addr)
 	go func() {
 		log.Fatal(http.ListenAndServe(addr, nil))
@@ -1,6 +1,8 @@
 package statushttp
 
 import (
+	"github.com/perbu/yrpoller/sink"
+	"sync"
 	"time"
 )
 
@@ -10,14 +12,113 @@ type PollerStatus struct {
 	NoOfPollErrors       uint64    `json:"no_of_poll_errors"`
 	LastPollErrorMessage string    `json:"last_poll_error_message"`
 	LastPollErrorTime    time.Time `json:"last_poll_error_time"`
+	// How long the last request to the API took.
+	LastPollDurationSeconds float64 `json:"last_poll_duration_seconds"`
+}
+
+// LocationInfo is what the location file says about a location.
+type LocationInfo struct {
+	Name     string            `json:"name"`
+	Lat      float64           `json:"lat"`
+	Long     float64           `json:"long"`
+	Altitude *float64          `json:"altitude,omitempty"`
+	Timezone string            `json:"timezone,omitempty"`
+	Provider string            `json:"provider,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
 }
 
 type EmitterStatus struct {
-	NoOfEmits            uint64    `json:"no_of_emits"`
-	NoOfEmitErrors       uint64    `json:"no_of_emit_errors"`
-	LastEmitTime         time.Time `json:"last_emit"`
-	LastEmitErrorMessage string    `json:"last_emit_error_message"`
-	LastEmitErrorTime    time.Time `json:"last_emit_error_time"`
+	NoOfEmits            uint64            `json:"no_of_emits"`
+	NoOfEmitErrors       uint64            `json:"no_of_emit_errors"`
+	LastEmitTime         time.Time         `json:"last_emit"`
+	LastEmitErrorMessage string            `json:"last_emit_error_message"`
+	LastEmitErrorTime    time.Time         `json:"last_emit_error_time"`
+	NoOfRejectedRecords  uint64            `json:"no_of_rejected_records"`
+	RejectedRecords      map[string]uint64 `json:"rejected_records_by_reason"`
+	// Messages the Kafka producer failed to deliver, by Kafka error name.
+	NoOfProducerErrors       uint64            `json:"no_of_producer_errors"`
+	ProducerErrors           map[string]uint64 `json:"producer_errors_by_reason"`
+	LastProducerErrorMessage string            `json:"last_producer_error_message,omitempty"`
+	LastProducerErrorTime    time.Time         `json:"last_producer_error_time"`
+}
+
+type SpoolStatus struct {
+	Enabled                bool      `json:"enabled"`
+	Entries                uint64    `json:"entries"`
+	Bytes                  int64     `json:"bytes"`
+	OldestEntry            time.Time `json:"oldest_entry"`
+	OldestEntryAgeSeconds  float64   `json:"oldest_entry_age_seconds"`
+	NoOfDropped            uint64    `json:"no_of_dropped"`
+	NoOfReplayErrors       uint64    `json:"no_of_replay_errors"`
+	LastReplayErrorMessage string    `json:"last_replay_error_message"`
+	LastReplayErrorTime    time.Time `json:"last_replay_error_time"`
+}
+
+type SkiConditionStatus struct {
+	Time              time.Time          `json:"time"`
+	SnowCondition     string             `json:"snow_condition"`
+	Wax               string             `json:"wax"`
+	WaxTemperatureMin float64            `json:"wax_temperature_min"`
+	WaxTemperatureMax float64            `json:"wax_temperature_max"`
+	Inputs            map[string]float64 `json:"inputs"`
+}
+
+type AlertStatus struct {
+	Rule                   string    `json:"rule"`
+	Location               string    `json:"location"`
+	State                  string    `json:"state"`
+	Variable               string    `json:"variable"`
+	Value                  float64   `json:"value"`
+	Threshold              float64   `json:"threshold"`
+	Since                  time.Time `json:"since"`
+	LastNotified           time.Time `json:"last_notified"`
+	NoOfNotifications      uint64    `json:"no_of_notifications"`
+	NoOfNotifyErrors       uint64    `json:"no_of_notify_errors"`
+	LastNotifyErrorMessage string    `json:"last_notify_error_message"`
+}
+
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// HistoryGap is a stretch where points were expected from the emit schedule but none are stored.
+type HistoryGap struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Missing int       `json:"missing"`
+}
+
+type HistoryStatus struct {
+	Location string         `json:"location"`
+	Variable string         `json:"variable"`
+	Since    time.Time      `json:"since"`
+	Interval string         `json:"interval"`
+	Points   []HistoryPoint `json:"points"`
+	Gaps     []HistoryGap   `json:"gaps"`
+}
+
+// HistoryFunc reads back the stored values of a variable at a location, at most limit of them.
+type HistoryFunc func(location string, variable string, since time.Duration, limit int) (*HistoryStatus, error)
+
+// ObservationsFunc reads back stored values of a location within [from, to), at most limit of them.
+// All variables if none are given.
+type ObservationsFunc func(location string, variables []string, from time.Time, to time.Time, limit int) ([]sink.StoredValue, error)
+
+// LocationAPI adds, changes and removes the locations of the running daemon, for /api/locations.
+// The locations are whatever the daemon has, as JSON. Create and Update get the request body.
+type LocationAPI interface {
+	List() interface{}
+	Get(id string) (interface{}, error)
+	Create(body []byte) (interface{}, error)
+	Update(id string, body []byte) (interface{}, error)
+	Delete(id string) error
+}
+
+// locationAPIConfig is the location API and the bearer token it needs.
+type locationAPIConfig struct {
+	api   LocationAPI
+	token string
 }
 
 type MemStats struct {
@@ -28,9 +129,18 @@ type MemStats struct {
 }
 
 type DaemonStatus struct {
-	Status       string                   `json:"status"`
-	Pollers      map[string]*PollerStatus `json:"poller"`
-	Emitter      *EmitterStatus           `json:"emitter"`
-	RunningSince time.Time                `json:"running_since"`
-	MemoryStats  MemStats                 `json:"memory_stats"`
+	mu           *sync.Mutex  // protects the maps that change at runtime.
+	history      *HistoryFunc // shared with the copy Run returns, like mu.
+	observations *ObservationsFunc
+	locationAPI  *locationAPIConfig
+	Status       string                         `json:"status"`
+	Locations    map[string]*LocationInfo       `json:"locations"`
+	Pollers      map[string]*PollerStatus       `json:"poller"`
+	Emitter      *EmitterStatus                 `json:"emitter"`
+	Spool        *SpoolStatus                   `json:"spool"`
+	Sinks        map[string]*sink.QueueStatus   `json:"sinks"`
+	Ski          map[string]*SkiConditionStatus `json:"ski_conditions,omitempty"`
+	Alerts       map[string]*AlertStatus        `json:"alerts,omitempty"`
+	RunningSince time.Time                      `json:"running_since"`
+	MemoryStats  MemStats                       `json:"memory_stats"`
 }
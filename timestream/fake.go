@@ -0,0 +1,352 @@
+package timestream
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+  A local stand-in for the Timestream write API. It keeps tables and records in
+  memory, enforces the validation rules of the service that matter to us and can
+  be told to fail. Used in tests here and in the yrsensor package.
+*/
+
+type FakeWriteAPI struct {
+	mu sync.Mutex
+	// Tables per database. Databases must exist before tables can be created in them.
+	Tables map[string]map[string][]*timestreamwrite.Record
+	// Retention of the tables, keyed by "db/table".
+	Retention map[string]*timestreamwrite.RetentionProperties
+	// Writes holds every accepted WriteRecords call, in order.
+	Writes []*timestreamwrite.WriteRecordsInput
+	// Now is used to check the memory store retention. time.Now() if nil.
+	Now func() time.Time
+	// MemoryStoreRetention is how far back records are accepted.
+	MemoryStoreRetention time.Duration
+	// Errors to return from the next calls, per operation, like "WriteRecords".
+	errors map[string][]error
+}
+
+func NewFakeWriteAPI(databases ...string) *FakeWriteAPI {
+	f := &FakeWriteAPI{
+		Tables:               make(map[string]map[string][]*timestreamwrite.Record),
+		Retention:            make(map[string]*timestreamwrite.RetentionProperties),
+		MemoryStoreRetention: 6 * time.Hour,
+		errors:               make(map[string][]error),
+	}
+	for _, db := range databases {
+		f.Tables[db] = make(map[string][]*timestreamwrite.Record)
+	}
+	return f
+}
+
+// FailNext makes the next call to the operation return err.
+func (f *FakeWriteAPI) FailNext(operation string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[operation] = append(f.errors[operation], err)
+}
+
+// Records returns the records written to a table, with the common attributes merged in.
+func (f *FakeWriteAPI) Records(db string, table string) []*timestreamwrite.Record {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Tables[db][table]
+}
+
+func (f *FakeWriteAPI) injectedError(operation string) error {
+	if len(f.errors[operation]) == 0 {
+		return nil
+	}
+	err := f.errors[operation][0]
+	f.errors[operation] = f.errors[operation][1:]
+	return err
+}
+
+func (f *FakeWriteAPI) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &timestreamwrite.ResourceNotFoundException{Message_: aws.String(fmt.Sprintf(format, args...))}
+}
+
+func validationError(format string, args ...interface{}) error {
+	return &timestreamwrite.ValidationException{Message_: aws.String(fmt.Sprintf(format, args...))}
+}
+
+func (f *FakeWriteAPI) ListTables(input *timestreamwrite.ListTablesInput) (*timestreamwrite.ListTablesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injectedError("ListTables"); err != nil {
+		return nil, err
+	}
+	tables, ok := f.Tables[aws.StringValue(input.DatabaseName)]
+	if !ok {
+		return nil, notFound("database %s does not exist", aws.StringValue(input.DatabaseName))
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Paginate like the service does, the token is just the offset.
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	end := len(names)
+	if input.MaxResults != nil && start+int(*input.MaxResults) < end {
+		end = start + int(*input.MaxResults)
+	}
+	output := &timestreamwrite.ListTablesOutput{}
+	for _, name := range names[start:end] {
+		output.Tables = append(output.Tables, &timestreamwrite.Table{
+			DatabaseName:        input.DatabaseName,
+			TableName:           aws.String(name),
+			RetentionProperties: f.Retention[aws.StringValue(input.DatabaseName)+"/"+name],
+		})
+	}
+	if end < len(names) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return output, nil
+}
+
+func (f *FakeWriteAPI) CreateTable(input *timestreamwrite.CreateTableInput) (*timestreamwrite.CreateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injectedError("CreateTable"); err != nil {
+		return nil, err
+	}
+	db, table := aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName)
+	tables, ok := f.Tables[db]
+	if !ok {
+		return nil, notFound("database %s does not exist", db)
+	}
+	if _, exists := tables[table]; exists {
+		return nil, &timestreamwrite.ConflictException{Message_: aws.String("table " + table + " already exists")}
+	}
+	tables[table] = make([]*timestreamwrite.Record, 0)
+	retention := input.RetentionProperties
+	if retention == nil {
+		retention = &timestreamwrite.RetentionProperties{
+			MemoryStoreRetentionPeriodInHours:  aws.Int64(defaultMemoryStoreHours),
+			MagneticStoreRetentionPeriodInDays: aws.Int64(defaultMagneticStoreDays),
+		}
+	}
+	f.Retention[db+"/"+table] = retention
+	return &timestreamwrite.CreateTableOutput{
+		Table: &timestreamwrite.Table{DatabaseName: input.DatabaseName, TableName: input.TableName},
+	}, nil
+}
+
+func (f *FakeWriteAPI) UpdateTable(input *timestreamwrite.UpdateTableInput) (*timestreamwrite.UpdateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injectedError("UpdateTable"); err != nil {
+		return nil, err
+	}
+	db, table := aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName)
+	if _, ok := f.Tables[db][table]; !ok {
+		return nil, notFound("table %s does not exist", table)
+	}
+	if input.RetentionProperties != nil {
+		if input.RetentionProperties.MemoryStoreRetentionPeriodInHours == nil ||
+			input.RetentionProperties.MagneticStoreRetentionPeriodInDays == nil {
+			return nil, validationError("both retention periods must be set")
+		}
+		f.Retention[db+"/"+table] = input.RetentionProperties
+	}
+	return &timestreamwrite.UpdateTableOutput{}, nil
+}
+
+func (f *FakeWriteAPI) DescribeDatabase(input *timestreamwrite.DescribeDatabaseInput) (*timestreamwrite.DescribeDatabaseOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injectedError("DescribeDatabase"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Tables[aws.StringValue(input.DatabaseName)]; !ok {
+		return nil, notFound("database %s does not exist", aws.StringValue(input.DatabaseName))
+	}
+	return &timestreamwrite.DescribeDatabaseOutput{
+		Database: &timestreamwrite.Database{DatabaseName: input.DatabaseName},
+	}, nil
+}
+
+func (f *FakeWriteAPI) CreateDatabase(input *timestreamwrite.CreateDatabaseInput) (*timestreamwrite.CreateDatabaseOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injectedError("CreateDatabase"); err != nil {
+		return nil, err
+	}
+	db := aws.StringValue(input.DatabaseName)
+	if _, ok := f.Tables[db]; ok {
+		return nil, &timestreamwrite.ConflictException{Message_: aws.String("database " + db + " already exists")}
+	}
+	f.Tables[db] = make(map[string][]*timestreamwrite.Record)
+	return &timestreamwrite.CreateDatabaseOutput{
+		Database: &timestreamwrite.Database{DatabaseName: input.DatabaseName},
+	}, nil
+}
+
+// mergeRecord applies the common attributes to a record, like the service does.
+func mergeRecord(common *timestreamwrite.Record, r *timestreamwrite.Record) *timestreamwrite.Record {
+	merged := *r
+	if common == nil {
+		return &merged
+	}
+	if merged.Time == nil {
+		merged.Time = common.Time
+	}
+	if merged.TimeUnit == nil {
+		merged.TimeUnit = common.TimeUnit
+	}
+	if merged.MeasureName == nil {
+		merged.MeasureName = common.MeasureName
+	}
+	if merged.MeasureValueType == nil {
+		merged.MeasureValueType = common.MeasureValueType
+	}
+	if merged.MeasureValue == nil {
+		merged.MeasureValue = common.MeasureValue
+	}
+	merged.Dimensions = append(append([]*timestreamwrite.Dimension{}, common.Dimensions...), r.Dimensions...)
+	return &merged
+}
+
+func recordTime(r *timestreamwrite.Record) (time.Time, error) {
+	value, err := strconv.ParseInt(aws.StringValue(r.Time), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch aws.StringValue(r.TimeUnit) {
+	case "SECONDS":
+		return time.Unix(value, 0), nil
+	case "MILLISECONDS", "":
+		return time.Unix(0, value*int64(time.Millisecond)), nil
+	case "MICROSECONDS":
+		return time.Unix(0, value*int64(time.Microsecond)), nil
+	case "NANOSECONDS":
+		return time.Unix(0, value), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time unit %s", aws.StringValue(r.TimeUnit))
+}
+
+// validateRecord returns the reason for rejecting a record, or an empty string if it is fine.
+func validateRecord(r *timestreamwrite.Record) string {
+	if aws.StringValue(r.MeasureName) == "" {
+		return "Measure name must be set"
+	}
+	if len(r.Dimensions) > 128 {
+		return "Too many dimensions"
+	}
+	for _, d := range r.Dimensions {
+		if aws.StringValue(d.Name) == "" || aws.StringValue(d.Value) == "" {
+			return "Dimension names and values can't be empty"
+		}
+	}
+	switch aws.StringValue(r.MeasureValueType) {
+	case "DOUBLE":
+		if _, err := strconv.ParseFloat(aws.StringValue(r.MeasureValue), 64); err != nil {
+			return "Invalid measure value for type DOUBLE"
+		}
+	case "MULTI":
+		if r.MeasureValue != nil || len(r.MeasureValues) == 0 {
+			return "MULTI records need MeasureValues and no MeasureValue"
+		}
+		for _, mv := range r.MeasureValues {
+			if aws.StringValue(mv.Name) == "" {
+				return "Measure value names can't be empty"
+			}
+		}
+	case "BIGINT", "VARCHAR", "BOOLEAN", "TIMESTAMP":
+	default:
+		return "Invalid measure value type"
+	}
+	return ""
+}
+
+func sameSeries(a *timestreamwrite.Record, b *timestreamwrite.Record) bool {
+	if aws.StringValue(a.Time) != aws.StringValue(b.Time) || aws.StringValue(a.MeasureName) != aws.StringValue(b.MeasureName) {
+		return false
+	}
+	if len(a.Dimensions) != len(b.Dimensions) {
+		return false
+	}
+	for i := range a.Dimensions {
+		if aws.StringValue(a.Dimensions[i].Name) != aws.StringValue(b.Dimensions[i].Name) ||
+			aws.StringValue(a.Dimensions[i].Value) != aws.StringValue(b.Dimensions[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteRecords accepts the valid records and rejects the rest with a RejectedRecordsException, like the service.
+func (f *FakeWriteAPI) WriteRecords(input *timestreamwrite.WriteRecordsInput) (*timestreamwrite.WriteRecordsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.injectedError("WriteRecords"); err != nil {
+		return nil, err
+	}
+	db, table := aws.StringValue(input.DatabaseName), aws.StringValue(input.TableName)
+	if _, ok := f.Tables[db]; !ok {
+		return nil, notFound("database %s does not exist", db)
+	}
+	if _, ok := f.Tables[db][table]; !ok {
+		return nil, notFound("table %s does not exist", table)
+	}
+	if len(input.Records) == 0 || len(input.Records) > MaxRecordsPerWrite {
+		return nil, validationError("a write must have between 1 and %d records", MaxRecordsPerWrite)
+	}
+	f.Writes = append(f.Writes, input)
+
+	rejected := make([]*timestreamwrite.RejectedRecord, 0)
+	oldest := f.now().Add(-f.MemoryStoreRetention)
+	for i, r := range input.Records {
+		rec := mergeRecord(input.CommonAttributes, r)
+		reason := validateRecord(rec)
+		if reason == "" {
+			t, err := recordTime(rec)
+			if err != nil {
+				reason = "Invalid time"
+			} else if t.Before(oldest) || t.After(f.now().Add(15*time.Minute)) {
+				reason = fmt.Sprintf("The record timestamp is outside the time range [%s, %s) of the memory store.",
+					oldest.UTC().Format(time.RFC3339), f.now().Add(15*time.Minute).UTC().Format(time.RFC3339))
+			}
+		}
+		if reason == "" {
+			for _, existing := range f.Tables[db][table] {
+				if sameSeries(existing, rec) && existing.String() != rec.String() {
+					reason = "A record already exists with the same time, dimensions, measure name, and record version."
+				}
+			}
+		}
+		if reason != "" {
+			rejected = append(rejected, &timestreamwrite.RejectedRecord{
+				RecordIndex: aws.Int64(int64(i)),
+				Reason:      aws.String(reason),
+			})
+			continue
+		}
+		f.Tables[db][table] = append(f.Tables[db][table], rec)
+	}
+	if len(rejected) > 0 {
+		return nil, &timestreamwrite.RejectedRecordsException{
+			Message_:        aws.String("One or more records have been rejected."),
+			RejectedRecords: rejected,
+		}
+	}
+	return &timestreamwrite.WriteRecordsOutput{}, nil
+}
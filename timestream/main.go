@@ -7,28 +7,37 @@ package timestream
 import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/timestreamquery"
 	"github.com/aws/aws-sdk-go/service/timestreamwrite"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/http2"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func Factory(awsRegion string, awsTimestreamDbname string) TimestreamState {
+func Factory(config Config) TimestreamState {
 
 	transport, err := createTimestreamTransport()
 	if err != nil {
 		panic(err.Error())
 	}
 	state := TimestreamState{
-		AwsRegion:           awsRegion,
-		AwsTimestreamDbname: awsTimestreamDbname,
+		AwsRegion:           config.AwsRegion,
+		AwsTimestreamDbname: config.AwsTimestreamDbname,
+		MultiMeasureTable:   config.MultiMeasureTable,
+		Retention:           config.Retention,
+		TableRetention:      config.TableRetention,
+		Spool:               config.Spool,
 		Transport:           transport,
-		WriteSession:        createTimestreamWriteSession(awsRegion, transport),
+		WriteSession:        createTimestreamWriteSession(config.AwsRegion, transport),
 		WriteBuffer:         make(map[string][]*timestreamwrite.Record, 100),
 	}
+	if config.Query {
+		state.QuerySession = createTimestreamQuerySession(config.AwsRegion, transport)
+	}
 	return state
 }
 
@@ -63,56 +72,124 @@ func createTimestreamWriteSession(awsRegion string, tr *http.Transport) *timestr
 	return writeSvc
 }
 
-// helper to check if a table exists in the supplied tableOutput
-func tableExists(table string, tableOutput *timestreamwrite.ListTablesOutput) bool {
-	for _, b := range tableOutput.Tables {
-		if *b.TableName == table {
-			return true
-		}
+func createTimestreamQuerySession(awsRegion string, tr *http.Transport) *timestreamquery.TimestreamQuery {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(awsRegion),
+		MaxRetries: aws.Int(3),
+		HTTPClient: &http.Client{Transport: tr}})
+	if err != nil {
+		log.Fatalf("could not establish query session to AWS: %s", err.Error())
 	}
-	return false
+	return timestreamquery.New(sess)
 }
 
-// get a list of the tables in the database and create the ones we need if they don't exist.
-func (c *TimestreamState) CheckAndCreateTables(tables []string) error {
-	var maxTables int64 = 20
-	var err error
+// ensureDatabase creates the database if it doesn't exist.
+func (c *TimestreamState) ensureDatabase() error {
+	_, err := c.WriteSession.DescribeDatabase(&timestreamwrite.DescribeDatabaseInput{
+		DatabaseName: aws.String(c.AwsTimestreamDbname),
+	})
+	if _, ok := err.(*timestreamwrite.ResourceNotFoundException); ok {
+		log.Infof("(timestream) creating database %s", c.AwsTimestreamDbname)
+		_, err = c.WriteSession.CreateDatabase(&timestreamwrite.CreateDatabaseInput{
+			DatabaseName: aws.String(c.AwsTimestreamDbname),
+		})
+	}
+	return err
+}
 
-	listTablesInput := &timestreamwrite.ListTablesInput{
+// listTables returns all the tables in the database, following the pagination.
+func (c *TimestreamState) listTables() (map[string]*timestreamwrite.Table, error) {
+	tables := make(map[string]*timestreamwrite.Table)
+	input := &timestreamwrite.ListTablesInput{
 		DatabaseName: aws.String(c.AwsTimestreamDbname),
-		MaxResults:   &maxTables,
+		MaxResults:   aws.Int64(20),
+	}
+	for {
+		output, err := c.WriteSession.ListTables(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range output.Tables {
+			tables[aws.StringValue(t.TableName)] = t
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			return tables, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+func sameRetention(a *timestreamwrite.RetentionProperties, b *timestreamwrite.RetentionProperties) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return aws.Int64Value(a.MemoryStoreRetentionPeriodInHours) == aws.Int64Value(b.MemoryStoreRetentionPeriodInHours) &&
+		aws.Int64Value(a.MagneticStoreRetentionPeriodInDays) == aws.Int64Value(b.MagneticStoreRetentionPeriodInDays)
+}
+
+// CheckAndCreateTables makes sure the database and the tables we need exist, and that the
+// tables have the configured retention.
+func (c *TimestreamState) CheckAndCreateTables(tables []string) error {
+	err := c.ensureDatabase()
+	if err != nil {
+		return err
 	}
-	listTablesOutput, err := c.WriteSession.ListTables(listTablesInput)
+	existing, err := c.listTables()
 	if err != nil {
 		return err
 	}
 
 	for _, table := range tables {
 		log.Debugf("(timestream) checking table %s", table)
-		if !tableExists(table, listTablesOutput) {
+		current, ok := existing[table]
+		if !ok {
 			createTableInput := &timestreamwrite.CreateTableInput{
-				DatabaseName: aws.String(c.AwsTimestreamDbname),
-				TableName:    aws.String(table),
+				DatabaseName:        aws.String(c.AwsTimestreamDbname),
+				TableName:           aws.String(table),
+				RetentionProperties: c.retentionFor(table, nil),
 			}
 			_, err := c.WriteSession.CreateTable(createTableInput)
 			if err != nil {
 				return err
 			}
+			continue
+		}
+		want := c.retentionFor(table, current.RetentionProperties)
+		if want != nil && !sameRetention(want, current.RetentionProperties) {
+			log.Infof("(timestream) updating retention of %s to %d hours in memory, %d days magnetic", table,
+				*want.MemoryStoreRetentionPeriodInHours, *want.MagneticStoreRetentionPeriodInDays)
+			_, err := c.WriteSession.UpdateTable(&timestreamwrite.UpdateTableInput{
+				DatabaseName:        aws.String(c.AwsTimestreamDbname),
+				TableName:           aws.String(table),
+				RetentionProperties: want,
+			})
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	return err
+	return nil
+}
+
+// Timestream doesn't accept empty dimension values, so those are left out.
+func makeDimensions(dimensions []TimestreamDimension) []*timestreamwrite.Dimension {
+	dims := make([]*timestreamwrite.Dimension, 0, len(dimensions))
+	for _, d := range dimensions {
+		if d.Value == "" {
+			continue
+		}
+		dims = append(dims, &timestreamwrite.Dimension{
+			Name:  aws.String(d.Name),
+			Value: aws.String(d.Value),
+		})
+	}
+	return dims
 }
 
 func (c *TimestreamState) MakeEntry(entry TimestreamEntry) {
 	rec := timestreamwrite.Record{
-		Dimensions: []*timestreamwrite.Dimension{
-			{
-				Name:  aws.String("sensor"),
-				Value: aws.String(entry.SensorId),
-			},
-		},
-		MeasureName:      aws.String(entry.SensorId),
+		Dimensions:       makeDimensions(entry.Dimensions),
+		MeasureName:      aws.String(entry.MeasureName),
 		MeasureValue:     aws.String(entry.Value),
 		MeasureValueType: aws.String("DOUBLE"),
 		Time:             aws.String(strconv.FormatInt(entry.Time.Unix(), 10)),
@@ -121,21 +198,194 @@ func (c *TimestreamState) MakeEntry(entry TimestreamEntry) {
 	c.WriteBuffer[entry.TableName] = append(c.WriteBuffer[entry.TableName], &rec)
 }
 
+// MultiMeasureName is the measure name of the multi-measure records.
+const MultiMeasureName = "observation"
+
+func (c *TimestreamState) MakeMultiEntry(entry TimestreamMultiEntry) {
+	values := make([]*timestreamwrite.MeasureValue, 0, len(entry.Measures))
+	for _, m := range entry.Measures {
+		values = append(values, &timestreamwrite.MeasureValue{
+			Name:  aws.String(m.Name),
+			Value: aws.String(m.Value),
+			Type:  aws.String("DOUBLE"),
+		})
+	}
+	rec := timestreamwrite.Record{
+		Dimensions:       makeDimensions(entry.Dimensions),
+		MeasureName:      aws.String(MultiMeasureName),
+		MeasureValues:    values,
+		MeasureValueType: aws.String("MULTI"),
+		Time:             aws.String(strconv.FormatInt(entry.Time.Unix(), 10)),
+		TimeUnit:         aws.String("SECONDS"),
+	}
+	c.WriteBuffer[entry.TableName] = append(c.WriteBuffer[entry.TableName], &rec)
+}
+
+// commonAttributes moves what all the records share into a common record, which makes the request smaller.
+// The records are copied, so the ones in the buffer are left intact.
+func commonAttributes(records []*timestreamwrite.Record) (*timestreamwrite.Record, []*timestreamwrite.Record) {
+	common := &timestreamwrite.Record{}
+	stripped := make([]*timestreamwrite.Record, len(records))
+	for i, r := range records {
+		rec := *r
+		stripped[i] = &rec
+	}
+	first := records[0]
+	same := func(get func(r *timestreamwrite.Record) *string) bool {
+		for _, r := range records {
+			if get(r) == nil || get(first) == nil || *get(r) != *get(first) {
+				return false
+			}
+		}
+		return true
+	}
+	if same(func(r *timestreamwrite.Record) *string { return r.TimeUnit }) {
+		common.TimeUnit = first.TimeUnit
+		for _, r := range stripped {
+			r.TimeUnit = nil
+		}
+	}
+	if same(func(r *timestreamwrite.Record) *string { return r.Time }) {
+		common.Time = first.Time
+		for _, r := range stripped {
+			r.Time = nil
+		}
+	}
+	if same(func(r *timestreamwrite.Record) *string { return r.MeasureName }) {
+		common.MeasureName = first.MeasureName
+		for _, r := range stripped {
+			r.MeasureName = nil
+		}
+	}
+	if same(func(r *timestreamwrite.Record) *string { return r.MeasureValueType }) {
+		common.MeasureValueType = first.MeasureValueType
+		for _, r := range stripped {
+			r.MeasureValueType = nil
+		}
+	}
+	// Dimensions that are identical in every record.
+	for _, d := range first.Dimensions {
+		shared := true
+		for _, r := range records {
+			if !hasDimension(r, d) {
+				shared = false
+				break
+			}
+		}
+		if !shared {
+			continue
+		}
+		common.Dimensions = append(common.Dimensions, d)
+		for _, r := range stripped {
+			r.Dimensions = withoutDimension(r.Dimensions, d)
+		}
+	}
+	return common, stripped
+}
+
+func hasDimension(r *timestreamwrite.Record, d *timestreamwrite.Dimension) bool {
+	for _, rd := range r.Dimensions {
+		if *rd.Name == *d.Name && *rd.Value == *d.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutDimension(dims []*timestreamwrite.Dimension, d *timestreamwrite.Dimension) []*timestreamwrite.Dimension {
+	res := make([]*timestreamwrite.Dimension, 0, len(dims))
+	for _, rd := range dims {
+		if *rd.Name != *d.Name {
+			res = append(res, rd)
+		}
+	}
+	return res
+}
+
+// rejectReason shortens the reason Timestream gives for rejecting a record so it can be used
+// as a counter. The reasons include details like time ranges, we cut those off.
+func rejectReason(reason *string) string {
+	if reason == nil {
+		return "unknown"
+	}
+	r := *reason
+	if i := strings.IndexAny(r, ".[:"); i > 0 {
+		r = r[:i]
+	}
+	return strings.TrimSpace(r)
+}
+
+// writeChunk writes up to MaxRecordsPerWrite records. Rejected records are returned as a RejectedRecordsError.
+// Timestream writes the records in the request that it doesn't reject.
+func (c *TimestreamState) writeChunk(table string, records []*timestreamwrite.Record) error {
+	common, stripped := commonAttributes(records)
+	write := &timestreamwrite.WriteRecordsInput{
+		DatabaseName:     aws.String(c.AwsTimestreamDbname),
+		TableName:        aws.String(table),
+		CommonAttributes: common,
+		Records:          stripped,
+	}
+	_, err := c.WriteSession.WriteRecords(write)
+	if err == nil {
+		return nil
+	}
+	rejected, ok := err.(*timestreamwrite.RejectedRecordsException)
+	if !ok {
+		return err
+	}
+	rejErr := &RejectedRecordsError{
+		Table:   table,
+		Reasons: make(map[string]int),
+	}
+	for _, rr := range rejected.RejectedRecords {
+		reason := rejectReason(rr.Reason)
+		rejErr.Reasons[reason]++
+		rejErr.Rejected++
+		if rr.RecordIndex != nil && int(*rr.RecordIndex) < len(records) {
+			log.Warnf("(timestream) record %d for %s rejected: %s (%s)",
+				*rr.RecordIndex, table, aws.StringValue(rr.Reason), records[*rr.RecordIndex].String())
+		} else {
+			log.Warnf("(timestream) record for %s rejected: %s", table, aws.StringValue(rr.Reason))
+		}
+	}
+	return rejErr
+}
+
+// FlushAwsTimestreamWrites writes the buffers in chunks of at most MaxRecordsPerWrite records. Chunks that fail
+// go to the spool, or stay in the buffer for the next flush if there is no spool. Records Timestream rejects
+// would be rejected again, so they are dropped and returned as a RejectedRecordsError.
 func (c *TimestreamState) FlushAwsTimestreamWrites() []error {
 	var errs = make([]error, 0)
 	for table, buffer := range c.WriteBuffer {
-		// construct a write
-		write := &timestreamwrite.WriteRecordsInput{
-			DatabaseName: aws.String(c.AwsTimestreamDbname),
-			TableName:    aws.String(table),
-			Records:      buffer,
-		}
-		_, err := c.WriteSession.WriteRecords(write)
-		if err != nil {
+		remaining := make([]*timestreamwrite.Record, 0)
+		for start := 0; start < len(buffer); start += MaxRecordsPerWrite {
+			end := start + MaxRecordsPerWrite
+			if end > len(buffer) {
+				end = len(buffer)
+			}
+			chunk := buffer[start:end]
+			err := c.writeChunk(table, chunk)
+			if err == nil {
+				log.Debugf("(timestream) pushed %d records to timestream table %s", len(chunk), table)
+				continue
+			}
 			errs = append(errs, err)
+			if _, ok := err.(*RejectedRecordsError); ok {
+				continue
+			}
+			if c.Spool != nil {
+				spoolErr := c.spoolChunk(table, chunk)
+				if spoolErr == nil {
+					log.Warnf("(timestream) spooled %d records for %s after: %s", len(chunk), table, err.Error())
+					continue
+				}
+				log.Errorf("(timestream) could not spool records for %s, keeping them in memory: %s", table, spoolErr.Error())
+			}
+			remaining = append(remaining, chunk...)
+		}
+		if len(remaining) > 0 {
+			c.WriteBuffer[table] = remaining
 		} else {
-			log.Debugf("(timestream) pushed %d records to timestream table %s, flushing buffer",
-				len(buffer), table)
 			c.WriteBuffer[table] = nil
 		}
 	}
@@ -0,0 +1,250 @@
+package timestream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"github.com/perbu/yrpoller/spool"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2021, 1, 10, 1, 0, 0, 0, time.UTC)
+
+func generateTestState() TimestreamState {
+	fake := NewFakeWriteAPI("testdb")
+	fake.Now = func() time.Time { return testNow }
+	return TimestreamState{
+		AwsTimestreamDbname: "testdb",
+		WriteSession:        fake,
+		WriteBuffer:         make(map[string][]*timestreamwrite.Record),
+	}
+}
+
+func generateTestEntry(location string, value string) TimestreamEntry {
+	return TimestreamEntry{
+		Time: time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC),
+		Dimensions: []TimestreamDimension{
+			{Name: "location", Value: location},
+			{Name: "provider", Value: "met.no"},
+		},
+		TableName:   "air_temperature",
+		MeasureName: "air_temperature",
+		Value:       value,
+	}
+}
+
+func Test_commonAttributes(t *testing.T) {
+	state := generateTestState()
+	state.MakeEntry(generateTestEntry("skrindo", "-5"))
+	state.MakeEntry(generateTestEntry("bjornholt", "-3"))
+	records := state.WriteBuffer["air_temperature"]
+
+	common, stripped := commonAttributes(records)
+	assert.Equal(t, "air_temperature", *common.MeasureName)
+	assert.Equal(t, "DOUBLE", *common.MeasureValueType)
+	assert.Equal(t, "SECONDS", *common.TimeUnit)
+	assert.Equal(t, "1610236800", *common.Time)
+	assert.Len(t, common.Dimensions, 1)
+	assert.Equal(t, "provider", *common.Dimensions[0].Name)
+
+	assert.Nil(t, stripped[0].MeasureName)
+	assert.Len(t, stripped[0].Dimensions, 1)
+	assert.Equal(t, "skrindo", *stripped[0].Dimensions[0].Value)
+	// The buffer is left alone, in case the write has to be retried.
+	assert.Len(t, records[0].Dimensions, 2)
+	assert.NotNil(t, records[0].MeasureName)
+}
+
+func Test_rejectReason(t *testing.T) {
+	assert.Equal(t, "The record timestamp is outside the time range",
+		rejectReason(aws.String("The record timestamp is outside the time range [2021-01-10T00:00:00Z, 2021-01-11T00:00:00Z) of the memory store.")))
+	assert.Equal(t, "A record already exists with the same time, dimensions, measure name, and record version",
+		rejectReason(aws.String("A record already exists with the same time, dimensions, measure name, and record version. A higher record version must be specified in order to update the measure value.")))
+	assert.Equal(t, "unknown", rejectReason(nil))
+}
+
+func Test_CheckAndCreateTables(t *testing.T) {
+	state := generateTestState()
+	fake := state.WriteSession.(*FakeWriteAPI)
+	_, err := fake.CreateTable(&timestreamwrite.CreateTableInput{
+		DatabaseName: aws.String("testdb"),
+		TableName:    aws.String("air_temperature"),
+	})
+	assert.Nil(t, err)
+
+	err = state.CheckAndCreateTables([]string{"air_temperature", "wind_speed"})
+	assert.Nil(t, err)
+	assert.Len(t, fake.Tables["testdb"], 2)
+	assert.Contains(t, fake.Tables["testdb"], "wind_speed")
+
+	fake.FailNext("ListTables", errors.New("no network"))
+	assert.NotNil(t, state.CheckAndCreateTables([]string{"air_temperature"}))
+}
+
+func Test_CheckAndCreateTablesPaginated(t *testing.T) {
+	state := generateTestState()
+	fake := state.WriteSession.(*FakeWriteAPI)
+	// A shared database with more tables than fit on a page.
+	for i := 0; i < 45; i++ {
+		_, err := fake.CreateTable(&timestreamwrite.CreateTableInput{
+			DatabaseName: aws.String("testdb"),
+			TableName:    aws.String(fmt.Sprintf("other%02d", i)),
+		})
+		assert.Nil(t, err)
+	}
+	_, err := fake.CreateTable(&timestreamwrite.CreateTableInput{
+		DatabaseName: aws.String("testdb"),
+		TableName:    aws.String("wind_speed"),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, state.CheckAndCreateTables([]string{"wind_speed"}), "wind_speed is on the third page")
+}
+
+func Test_CheckAndCreateTablesRetention(t *testing.T) {
+	state := generateTestState()
+	fake := NewFakeWriteAPI() // no database
+	state.WriteSession = fake
+	state.Retention = Retention{MemoryStoreHours: 24, MagneticStoreDays: 365}
+	state.TableRetention = map[string]Retention{"wind_speed": {MemoryStoreHours: 12}}
+
+	assert.Nil(t, state.CheckAndCreateTables([]string{"air_temperature", "wind_speed"}))
+	assert.Contains(t, fake.Tables, "testdb", "the database should be created")
+	assert.Equal(t, int64(24), *fake.Retention["testdb/air_temperature"].MemoryStoreRetentionPeriodInHours)
+	assert.Equal(t, int64(365), *fake.Retention["testdb/air_temperature"].MagneticStoreRetentionPeriodInDays)
+	assert.Equal(t, int64(12), *fake.Retention["testdb/wind_speed"].MemoryStoreRetentionPeriodInHours)
+	assert.Equal(t, int64(defaultMagneticStoreDays), *fake.Retention["testdb/wind_speed"].MagneticStoreRetentionPeriodInDays)
+
+	// Changing the config updates the existing tables.
+	state.Retention = Retention{MemoryStoreHours: 48}
+	assert.Nil(t, state.CheckAndCreateTables([]string{"air_temperature", "wind_speed"}))
+	assert.Equal(t, int64(48), *fake.Retention["testdb/air_temperature"].MemoryStoreRetentionPeriodInHours)
+	assert.Equal(t, int64(365), *fake.Retention["testdb/air_temperature"].MagneticStoreRetentionPeriodInDays)
+	assert.Equal(t, int64(12), *fake.Retention["testdb/wind_speed"].MemoryStoreRetentionPeriodInHours)
+}
+
+func Test_ParseTableRetention(t *testing.T) {
+	r, err := ParseTableRetention("air_temperature:24:365, wind_speed:12:0")
+	assert.Nil(t, err)
+	assert.Equal(t, Retention{MemoryStoreHours: 24, MagneticStoreDays: 365}, r["air_temperature"])
+	assert.Equal(t, Retention{MemoryStoreHours: 12}, r["wind_speed"])
+
+	_, err = ParseTableRetention("air_temperature:24")
+	assert.NotNil(t, err)
+	_, err = ParseTableRetention("air_temperature:9000:1")
+	assert.EqualError(t, err, "invalid memory store retention 9000, must be 1-8766 hours for air_temperature")
+	_, err = ParseTableRetention("air_temperature:24:-1")
+	assert.NotNil(t, err)
+}
+
+func Test_RetentionValidate(t *testing.T) {
+	assert.Nil(t, Retention{}.Validate())
+	assert.Nil(t, Retention{MemoryStoreHours: 8766, MagneticStoreDays: 73000}.Validate())
+	assert.NotNil(t, Retention{MemoryStoreHours: 8767}.Validate())
+	assert.NotNil(t, Retention{MagneticStoreDays: -1}.Validate())
+}
+
+func Test_FlushAwsTimestreamWrites(t *testing.T) {
+	state := generateTestState()
+	fake := state.WriteSession.(*FakeWriteAPI)
+	assert.Nil(t, state.CheckAndCreateTables([]string{"air_temperature"}))
+
+	for i := 0; i < 250; i++ {
+		state.MakeEntry(generateTestEntry(fmt.Sprintf("location%d", i), "-5"))
+	}
+	// The first attempt fails and the records stay in the buffer.
+	fake.FailNext("WriteRecords", errors.New("throttled"))
+	errs := state.FlushAwsTimestreamWrites()
+	assert.Len(t, errs, 1)
+	assert.Len(t, state.WriteBuffer["air_temperature"], 100)
+
+	// That one chunk should be retried. The other two were written.
+	errs = state.FlushAwsTimestreamWrites()
+	assert.Len(t, errs, 0)
+	assert.Len(t, state.WriteBuffer["air_temperature"], 0)
+	assert.Len(t, fake.Writes, 3)
+	assert.Len(t, fake.Records("testdb", "air_temperature"), 250)
+	for _, w := range fake.Writes {
+		assert.True(t, len(w.Records) <= MaxRecordsPerWrite)
+		assert.Equal(t, "air_temperature", *w.CommonAttributes.MeasureName)
+	}
+}
+
+func Test_FlushRejectedRecords(t *testing.T) {
+	state := generateTestState()
+	fake := state.WriteSession.(*FakeWriteAPI)
+	assert.Nil(t, state.CheckAndCreateTables([]string{"air_temperature"}))
+
+	state.MakeEntry(generateTestEntry("skrindo", "-5"))
+	tooOld := generateTestEntry("bjornholt", "-5")
+	tooOld.Time = testNow.Add(-24 * time.Hour)
+	state.MakeEntry(tooOld)
+	// Empty dimensions would be rejected, MakeEntry leaves them out.
+	noRegion := generateTestEntry("met", "-5")
+	noRegion.Dimensions = append(noRegion.Dimensions, TimestreamDimension{Name: "region", Value: ""})
+	state.MakeEntry(noRegion)
+
+	errs := state.FlushAwsTimestreamWrites()
+	assert.Len(t, errs, 1)
+	rejected, ok := errs[0].(*RejectedRecordsError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, rejected.Rejected)
+	assert.Equal(t, 1, rejected.Reasons["The record timestamp is outside the time range"])
+	// The rejected record is dropped, the others are written.
+	assert.Len(t, state.WriteBuffer["air_temperature"], 0)
+	assert.Len(t, fake.Records("testdb", "air_temperature"), 2)
+}
+
+func Test_FlushToSpool(t *testing.T) {
+	state := generateTestState()
+	fake := state.WriteSession.(*FakeWriteAPI)
+	assert.Nil(t, state.CheckAndCreateTables([]string{"air_temperature"}))
+	sp, err := spool.Open(spool.Config{Dir: t.TempDir()})
+	assert.Nil(t, err)
+	state.Spool = sp
+
+	for i := 0; i < 150; i++ {
+		state.MakeEntry(generateTestEntry(fmt.Sprintf("location%d", i), "-5"))
+	}
+	// Both chunks fail and are spooled instead of kept in memory.
+	fake.FailNext("WriteRecords", errors.New("throttled"))
+	fake.FailNext("WriteRecords", errors.New("throttled"))
+	errs := state.FlushAwsTimestreamWrites()
+	assert.Len(t, errs, 2)
+	assert.Len(t, state.WriteBuffer["air_temperature"], 0)
+	assert.Equal(t, 2, sp.Stats().Entries)
+
+	// The drain stops at the first failure.
+	fake.FailNext("WriteRecords", errors.New("still throttled"))
+	errs = state.DrainSpool()
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 2, sp.Stats().Entries)
+
+	errs = state.DrainSpool()
+	assert.Len(t, errs, 0)
+	assert.Equal(t, 0, sp.Stats().Entries)
+	assert.Len(t, fake.Records("testdb", "air_temperature"), 150)
+	for _, r := range fake.Records("testdb", "air_temperature") {
+		assert.Equal(t, "air_temperature", *r.MeasureName, "records should survive the round trip through the spool")
+		assert.Equal(t, "-5", *r.MeasureValue)
+	}
+}
+
+func Test_FakeWriteAPIValidation(t *testing.T) {
+	fake := NewFakeWriteAPI("testdb")
+	_, err := fake.WriteRecords(&timestreamwrite.WriteRecordsInput{
+		DatabaseName: aws.String("testdb"),
+		TableName:    aws.String("missing"),
+		Records:      []*timestreamwrite.Record{{}},
+	})
+	_, ok := err.(*timestreamwrite.ResourceNotFoundException)
+	assert.True(t, ok, "writing to a missing table should fail")
+
+	_, err = fake.CreateTable(&timestreamwrite.CreateTableInput{
+		DatabaseName: aws.String("otherdb"),
+		TableName:    aws.String("t"),
+	})
+	assert.NotNil(t, err, "the database must exist")
+}
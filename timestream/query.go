@@ -0,0 +1,98 @@
+package timestream
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamquery"
+	"github.com/perbu/yrpoller/statushttp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+  Reading back what we have written, to check the data end to end.
+*/
+
+// Timestream returns timestamps like "2021-01-10 00:00:00.000000000", in UTC.
+const queryTimeLayout = "2006-01-02 15:04:05.999999999"
+
+// MaxHistoryPoints is the most points History returns.
+const MaxHistoryPoints = 1000
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// historyQuery builds the query for the latest values of a variable at a location, newest first.
+func (c *TimestreamState) historyQuery(location string, variable string, since time.Time, limit int) string {
+	table := variable
+	measureName := variable
+	column := "measure_value::double"
+	if c.MultiMeasureTable != "" {
+		table = c.MultiMeasureTable
+		measureName = MultiMeasureName
+		column = quoteIdentifier(variable)
+	}
+	return fmt.Sprintf("SELECT time, %s FROM %s.%s WHERE location = %s AND measure_name = %s "+
+		"AND time >= from_iso8601_timestamp(%s) AND %s IS NOT NULL ORDER BY time DESC LIMIT %d",
+		column, quoteIdentifier(c.AwsTimestreamDbname), quoteIdentifier(table), quoteLiteral(location),
+		quoteLiteral(measureName), quoteLiteral(since.UTC().Format(time.RFC3339)), column, limit)
+}
+
+func parseHistoryRow(row *timestreamquery.Row) (statushttp.HistoryPoint, error) {
+	var point statushttp.HistoryPoint
+	if len(row.Data) != 2 || row.Data[0].ScalarValue == nil || row.Data[1].ScalarValue == nil {
+		return point, fmt.Errorf("unexpected row: %s", row.String())
+	}
+	t, err := time.Parse(queryTimeLayout, *row.Data[0].ScalarValue)
+	if err != nil {
+		return point, err
+	}
+	value, err := strconv.ParseFloat(*row.Data[1].ScalarValue, 64)
+	if err != nil {
+		return point, err
+	}
+	return statushttp.HistoryPoint{Time: t.UTC(), Value: value}, nil
+}
+
+// History reads back the latest values, at most limit of them, of a variable at a location since the given time.
+// The points are returned oldest first.
+func (c *TimestreamState) History(location string, variable string, since time.Time, limit int) ([]statushttp.HistoryPoint, error) {
+	if c.QuerySession == nil {
+		return nil, fmt.Errorf("timestream queries are not enabled")
+	}
+	if limit <= 0 || limit > MaxHistoryPoints {
+		limit = MaxHistoryPoints
+	}
+	input := &timestreamquery.QueryInput{
+		QueryString: aws.String(c.historyQuery(location, variable, since, limit)),
+	}
+	points := make([]statushttp.HistoryPoint, 0)
+	for {
+		output, err := c.QuerySession.Query(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range output.Rows {
+			point, err := parseHistoryRow(row)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, point)
+		}
+		// Pages can be empty while the query runs, only the missing token means we're done.
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points, nil
+}
@@ -0,0 +1,69 @@
+package timestream
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamquery"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// queryStub returns the pages in order and records the queries.
+type queryStub struct {
+	pages   []*timestreamquery.QueryOutput
+	queries []*timestreamquery.QueryInput
+}
+
+func (q *queryStub) Query(input *timestreamquery.QueryInput) (*timestreamquery.QueryOutput, error) {
+	copied := *input
+	q.queries = append(q.queries, &copied)
+	page := q.pages[0]
+	q.pages = q.pages[1:]
+	return page, nil
+}
+
+func historyRow(t string, value string) *timestreamquery.Row {
+	return &timestreamquery.Row{Data: []*timestreamquery.Datum{
+		{ScalarValue: aws.String(t)},
+		{ScalarValue: aws.String(value)},
+	}}
+}
+
+func Test_historyQuery(t *testing.T) {
+	state := generateTestState()
+	since := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, `SELECT time, measure_value::double FROM "testdb"."air_temperature" `+
+		`WHERE location = 'o''hare' AND measure_name = 'air_temperature' `+
+		`AND time >= from_iso8601_timestamp('2021-01-10T00:00:00Z') AND measure_value::double IS NOT NULL `+
+		`ORDER BY time DESC LIMIT 10`,
+		state.historyQuery("o'hare", "air_temperature", since, 10))
+
+	state.MultiMeasureTable = "observations"
+	assert.Equal(t, `SELECT time, "air_temperature" FROM "testdb"."observations" `+
+		`WHERE location = 'skrindo' AND measure_name = 'observation' `+
+		`AND time >= from_iso8601_timestamp('2021-01-10T00:00:00Z') AND "air_temperature" IS NOT NULL `+
+		`ORDER BY time DESC LIMIT 10`,
+		state.historyQuery("skrindo", "air_temperature", since, 10))
+}
+
+func Test_History(t *testing.T) {
+	state := generateTestState()
+	_, err := state.History("skrindo", "air_temperature", testNow.Add(-time.Hour), 10)
+	assert.NotNil(t, err, "queries aren't enabled")
+
+	stub := &queryStub{pages: []*timestreamquery.QueryOutput{
+		{NextToken: aws.String("1")}, // still running
+		{Rows: []*timestreamquery.Row{historyRow("2021-01-10 00:50:00.000000000", "-4.5")}, NextToken: aws.String("2")},
+		{Rows: []*timestreamquery.Row{historyRow("2021-01-10 00:40:00.000000000", "-5")}},
+	}}
+	state.QuerySession = stub
+	points, err := state.History("skrindo", "air_temperature", testNow.Add(-time.Hour), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []statushttp.HistoryPoint{
+		{Time: time.Date(2021, 1, 10, 0, 40, 0, 0, time.UTC), Value: -5},
+		{Time: time.Date(2021, 1, 10, 0, 50, 0, 0, time.UTC), Value: -4.5},
+	}, points)
+	assert.Len(t, stub.queries, 3)
+	assert.Equal(t, "2", *stub.queries[2].NextToken)
+}
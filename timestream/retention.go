@@ -0,0 +1,88 @@
+package timestream
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"strconv"
+	"strings"
+)
+
+// What Timestream uses if a table is created without retention properties.
+const (
+	defaultMemoryStoreHours  = 6
+	defaultMagneticStoreDays = 73000
+)
+
+// The longest retention Timestream allows.
+const (
+	maxMemoryStoreHours  = 8766
+	maxMagneticStoreDays = 73000
+)
+
+// Validate checks that the retention is within what Timestream allows, 0 meaning not set.
+func (r Retention) Validate() error {
+	if r.MemoryStoreHours < 0 || r.MemoryStoreHours > maxMemoryStoreHours {
+		return fmt.Errorf("invalid memory store retention %d, must be 1-%d hours", r.MemoryStoreHours, maxMemoryStoreHours)
+	}
+	if r.MagneticStoreDays < 0 || r.MagneticStoreDays > maxMagneticStoreDays {
+		return fmt.Errorf("invalid magnetic store retention %d, must be 1-%d days", r.MagneticStoreDays, maxMagneticStoreDays)
+	}
+	return nil
+}
+
+// retentionFor returns the retention properties a table should have, or nil if nothing is configured.
+// Values that aren't configured are taken from current, the properties of the existing table.
+func (c *TimestreamState) retentionFor(table string, current *timestreamwrite.RetentionProperties) *timestreamwrite.RetentionProperties {
+	r, ok := c.TableRetention[table]
+	if !ok {
+		r = c.Retention
+	}
+	if r.MemoryStoreHours == 0 && r.MagneticStoreDays == 0 {
+		return nil
+	}
+	props := &timestreamwrite.RetentionProperties{
+		MemoryStoreRetentionPeriodInHours:  aws.Int64(defaultMemoryStoreHours),
+		MagneticStoreRetentionPeriodInDays: aws.Int64(defaultMagneticStoreDays),
+	}
+	if current != nil {
+		props.MemoryStoreRetentionPeriodInHours = current.MemoryStoreRetentionPeriodInHours
+		props.MagneticStoreRetentionPeriodInDays = current.MagneticStoreRetentionPeriodInDays
+	}
+	if r.MemoryStoreHours != 0 {
+		props.MemoryStoreRetentionPeriodInHours = aws.Int64(r.MemoryStoreHours)
+	}
+	if r.MagneticStoreDays != 0 {
+		props.MagneticStoreRetentionPeriodInDays = aws.Int64(r.MagneticStoreDays)
+	}
+	return props
+}
+
+// ParseTableRetention parses per table retention on the form "table:memoryhours:magneticdays,...".
+// Use 0 to leave a value as it is.
+func ParseTableRetention(spec string) (map[string]Retention, error) {
+	retention := make(map[string]Retention)
+	if strings.TrimSpace(spec) == "" {
+		return retention, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid table retention '%s', expected table:memoryhours:magneticdays", entry)
+		}
+		memory, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory store retention '%s' for %s, must be 1-%d hours", parts[1], parts[0], maxMemoryStoreHours)
+		}
+		magnetic, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnetic store retention '%s' for %s, must be 1-%d days", parts[2], parts[0], maxMagneticStoreDays)
+		}
+		r := Retention{MemoryStoreHours: memory, MagneticStoreDays: magnetic}
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("%s for %s", err.Error(), parts[0])
+		}
+		retention[parts[0]] = r
+	}
+	return retention, nil
+}
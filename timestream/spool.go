@@ -0,0 +1,52 @@
+package timestream
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"github.com/perbu/yrpoller/spool"
+	log "github.com/sirupsen/logrus"
+)
+
+// spooledBatch is a chunk of records that couldn't be written, as kept in the spool.
+type spooledBatch struct {
+	Table   string                    `json:"table"`
+	Records []*timestreamwrite.Record `json:"records"`
+}
+
+func (c *TimestreamState) spoolChunk(table string, records []*timestreamwrite.Record) error {
+	data, err := json.Marshal(spooledBatch{Table: table, Records: records})
+	if err != nil {
+		return err
+	}
+	return c.Spool.Append(data)
+}
+
+// DrainSpool replays the spooled chunks in order until the spool is empty or a write fails.
+// Rejected records are dropped like in FlushAwsTimestreamWrites and returned as RejectedRecordsErrors,
+// before the error that stopped the replay, if any.
+func (c *TimestreamState) DrainSpool() []error {
+	errs := make([]error, 0)
+	if c.Spool == nil {
+		return errs
+	}
+	replayed, err := c.Spool.Drain(func(e spool.Entry) error {
+		var batch spooledBatch
+		if err := json.Unmarshal(e.Data, &batch); err != nil {
+			log.Errorf("(timestream) dropping spooled chunk from %s that can't be decoded: %s", e.Time, err.Error())
+			return nil
+		}
+		err := c.writeChunk(batch.Table, batch.Records)
+		if rejected, ok := err.(*RejectedRecordsError); ok {
+			errs = append(errs, rejected)
+			return nil
+		}
+		return err
+	})
+	if replayed > 0 {
+		log.Infof("(timestream) replayed %d spooled chunks", replayed)
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -1,22 +1,95 @@
 package timestream
 
 import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/timestreamquery"
 	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"github.com/perbu/yrpoller/spool"
 	"net/http"
 	"time"
 )
 
+// WriteAPI is the part of the Timestream write API we use. It is satisfied by
+// *timestreamwrite.TimestreamWrite and by FakeWriteAPI.
+type WriteAPI interface {
+	ListTables(*timestreamwrite.ListTablesInput) (*timestreamwrite.ListTablesOutput, error)
+	CreateTable(*timestreamwrite.CreateTableInput) (*timestreamwrite.CreateTableOutput, error)
+	UpdateTable(*timestreamwrite.UpdateTableInput) (*timestreamwrite.UpdateTableOutput, error)
+	DescribeDatabase(*timestreamwrite.DescribeDatabaseInput) (*timestreamwrite.DescribeDatabaseOutput, error)
+	CreateDatabase(*timestreamwrite.CreateDatabaseInput) (*timestreamwrite.CreateDatabaseOutput, error)
+	WriteRecords(*timestreamwrite.WriteRecordsInput) (*timestreamwrite.WriteRecordsOutput, error)
+}
+
+// QueryAPI is the part of the Timestream query API we use.
+type QueryAPI interface {
+	Query(*timestreamquery.QueryInput) (*timestreamquery.QueryOutput, error)
+}
+
+// Retention of a table. Zero values are left as they are, or the service defaults for new tables.
+type Retention struct {
+	MemoryStoreHours  int64
+	MagneticStoreDays int64
+}
+
+type Config struct {
+	AwsRegion           string
+	AwsTimestreamDbname string
+	MultiMeasureTable   string               // If set, observations are written as multi-measure records to this table.
+	Retention           Retention            // For all tables.
+	TableRetention      map[string]Retention // Overrides Retention per table.
+	Spool               *spool.Spool         // Failed writes are spooled here if set, and kept in memory if not.
+	Query               bool                 // Set up a query session to read back what has been written.
+}
+
 type TimestreamState struct {
 	AwsRegion           string
 	AwsTimestreamDbname string
-	WriteSession        *timestreamwrite.TimestreamWrite
+	MultiMeasureTable   string // If set, observations are written as multi-measure records to this table.
+	Retention           Retention
+	TableRetention      map[string]Retention
+	Spool               *spool.Spool
+	WriteSession        WriteAPI
+	QuerySession        QueryAPI                             // nil if queries aren't enabled.
 	WriteBuffer         map[string][]*timestreamwrite.Record // a hash with table name as key.
 	Transport           *http.Transport
 }
 
+// MaxRecordsPerWrite is the most records Timestream accepts in one WriteRecords call.
+const MaxRecordsPerWrite = 100
+
+// RejectedRecordsError is returned from the flush when Timestream rejects some of the records.
+type RejectedRecordsError struct {
+	Table    string
+	Rejected int
+	Reasons  map[string]int // number of records per reason
+}
+
+func (e *RejectedRecordsError) Error() string {
+	return fmt.Sprintf("%d records rejected by timestream table %s", e.Rejected, e.Table)
+}
+
+type TimestreamDimension struct {
+	Name  string
+	Value string
+}
+
 type TimestreamEntry struct {
-	Time      time.Time
-	SensorId  string
-	TableName string
-	Value     string
+	Time        time.Time
+	Dimensions  []TimestreamDimension // Describes the location.
+	TableName   string
+	MeasureName string // The variable.
+	Value       string
+}
+
+type TimestreamMeasure struct {
+	Name  string
+	Value string
+}
+
+// TimestreamMultiEntry becomes a single multi-measure record.
+type TimestreamMultiEntry struct {
+	Time       time.Time
+	Dimensions []TimestreamDimension
+	TableName  string
+	Measures   []TimestreamMeasure
 }
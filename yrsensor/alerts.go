@@ -0,0 +1,408 @@
+package yrsensor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/perbu/yrpoller/notify"
+	"github.com/perbu/yrpoller/statushttp"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+  Threshold alerting. Rules are evaluated for every location on every emit. A rule
+  looks at one of the output variables, either the current value or the forecast
+  for the next hours, and fires when it is above, below or crosses a threshold.
+  A firing rule resolves once the value is back on the right side of the threshold
+  by at least the hysteresis. The cooldown limits how often a rule notifies.
+  Notifications are sent from a goroutine of their own, so a slow mail server or
+  webhook doesn't hold up the emits.
+*/
+
+const (
+	alertAbove   = "above"
+	alertBelow   = "below"
+	alertCrosses = "crosses"
+
+	alertStateOk     = "ok"
+	alertStateFiring = "firing"
+	alertResolved    = "resolved"
+
+	// Notifications beyond this many waiting to be sent are dropped.
+	alertOutboxSize = 100
+)
+
+type AlertNotifierConfig struct {
+	Type     string            `json:"type"` // "webhook" or "smtp"
+	Url      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Addr     string            `json:"addr"`
+	From     string            `json:"from"`
+	To       []string          `json:"to"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+}
+
+type AlertRule struct {
+	Name       string   `json:"name"`
+	Location   string   `json:"location"` // All locations if empty.
+	Variable   string   `json:"variable"`
+	Condition  string   `json:"condition"` // "above", "below" or "crosses"
+	Threshold  float64  `json:"threshold"`
+	Hysteresis float64  `json:"hysteresis"`
+	Forecast   string   `json:"forecast"` // How far into the forecast to look, like "6h". Current value only if empty.
+	Cooldown   string   `json:"cooldown"` // Minimum time between notifications, like "1h".
+	Notify     []string `json:"notify"`   // Names of notifiers.
+}
+
+type AlertConfig struct {
+	Notifiers map[string]AlertNotifierConfig `json:"notifiers"`
+	Rules     []AlertRule                    `json:"rules"`
+}
+
+type alertRule struct {
+	AlertRule
+	variable outputVariable
+	forecast time.Duration
+	cooldown time.Duration
+}
+
+type alertState struct {
+	firing       bool
+	since        time.Time // when it last fired or resolved.
+	notified     bool      // if the current firing has been notified.
+	lastNotified time.Time
+}
+
+// alertNotification is a notification waiting to be sent.
+type alertNotification struct {
+	rule         *alertRule
+	notification notify.Notification
+	key          string
+}
+
+type alertEngine struct {
+	rules     []alertRule
+	notifiers map[string]notify.Notifier
+	states    map[string]*alertState
+	ds        *statushttp.DaemonStatus // the status is kept here, if set.
+	outbox    chan alertNotification
+	pending   sync.WaitGroup // notifications queued and not yet sent
+}
+
+func alertKey(rule string, location string) string {
+	return rule + "/" + location
+}
+
+func parseOptionalDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(d)
+}
+
+func readAlertConfig(configFile io.Reader) (AlertConfig, error) {
+	var config AlertConfig
+	decoder := json.NewDecoder(configFile)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	return config, err
+}
+
+func readAlertConfigFromPath(configFilePath string) (AlertConfig, error) {
+	configFile, err := os.Open(configFilePath)
+	if err != nil {
+		return AlertConfig{}, err
+	}
+	defer configFile.Close()
+	return readAlertConfig(configFile)
+}
+
+func makeNotifier(c AlertNotifierConfig) (notify.Notifier, error) {
+	switch c.Type {
+	case "webhook":
+		if c.Url == "" {
+			return nil, fmt.Errorf("webhook needs an url")
+		}
+		return notify.NewWebhookNotifier(c.Url, c.Headers), nil
+	case "smtp":
+		if c.Addr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp needs addr, from and to")
+		}
+		return &notify.SmtpNotifier{
+			Addr:     c.Addr,
+			From:     c.From,
+			To:       c.To,
+			Username: c.Username,
+			Password: c.Password,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type '%s'", c.Type)
+}
+
+// newAlertEngine validates the config and sets up the notifiers. Notifiers can be
+// passed in for testing, those will override the ones in the config.
+func newAlertEngine(config AlertConfig, notifiers map[string]notify.Notifier) (*alertEngine, error) {
+	e := &alertEngine{
+		rules:     make([]alertRule, 0, len(config.Rules)),
+		notifiers: make(map[string]notify.Notifier),
+		states:    make(map[string]*alertState),
+		outbox:    make(chan alertNotification, alertOutboxSize),
+	}
+	for name, nc := range config.Notifiers {
+		n, err := makeNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %s", name, err.Error())
+		}
+		e.notifiers[name] = n
+	}
+	for name, n := range notifiers {
+		e.notifiers[name] = n
+	}
+	for i, r := range config.Rules {
+		rule := alertRule{AlertRule: r}
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		vars, err := selectOutputVariables(r.Variable)
+		if err != nil || len(vars) != 1 {
+			return nil, fmt.Errorf("rule %s: invalid variable '%s'", r.Name, r.Variable)
+		}
+		rule.variable = vars[0]
+		if r.Condition != alertAbove && r.Condition != alertBelow && r.Condition != alertCrosses {
+			return nil, fmt.Errorf("rule %s: unknown condition '%s'", r.Name, r.Condition)
+		}
+		if rule.forecast, err = parseOptionalDuration(r.Forecast); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.Name, err.Error())
+		}
+		// A single value can't cross anything.
+		if r.Condition == alertCrosses && rule.forecast <= 0 {
+			return nil, fmt.Errorf("rule %s: crosses needs a forecast to look for the crossing in", r.Name)
+		}
+		if rule.cooldown, err = parseOptionalDuration(r.Cooldown); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.Name, err.Error())
+		}
+		for _, n := range r.Notify {
+			if _, ok := e.notifiers[n]; !ok {
+				return nil, fmt.Errorf("rule %s: unknown notifier '%s'", r.Name, n)
+			}
+		}
+		e.rules = append(e.rules, rule)
+	}
+	go e.sendNotifications()
+	return e, nil
+}
+
+func (r *alertRule) appliesTo(loc Location) bool {
+	return r.Location == "" || r.Location == loc.Id
+}
+
+// check decides if the rule should fire or resolve given the values. If neither, the
+// state stays as it is. It also returns the value worth reporting.
+func (r *alertRule) check(values []float64) (fire bool, resolve bool, value float64) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	switch r.Condition {
+	case alertAbove:
+		return max > r.Threshold, max < r.Threshold-r.Hysteresis, max
+	case alertBelow:
+		return min < r.Threshold, min > r.Threshold+r.Hysteresis, min
+	default: // crosses
+		return min < r.Threshold && max > r.Threshold,
+			min > r.Threshold+r.Hysteresis || max < r.Threshold-r.Hysteresis, values[0]
+	}
+}
+
+// values returns the current value followed by the forecast values within the rule's horizon.
+func (r *alertRule) values(obs Observation, timeseries *ObservationTimeSeries) []float64 {
+	values := make([]float64, 0)
+	if v, ok := r.variable.Value(&obs); ok {
+		values = append(values, v)
+	}
+	if r.forecast == 0 {
+		return values
+	}
+	end := obs.Time.Add(r.forecast)
+	for i := range timeseries.ts {
+		o := timeseries.ts[i]
+		if o.Time.After(obs.Time) && !o.Time.After(end) {
+			if v, ok := r.variable.Value(&o); ok {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// initStatus sets the daemon status the alerts are reported to, and creates the entries for
+// all rules and locations. It is called before the emitter starts.
+func (e *alertEngine) initStatus(ds *statushttp.DaemonStatus, locs Locations) {
+	e.ds = ds
+	for _, loc := range locs.Locations {
+		e.addLocation(loc)
+	}
+}
+
+// addLocation creates the status entries of the rules for a location.
+func (e *alertEngine) addLocation(loc Location) {
+	if e.ds == nil {
+		return
+	}
+	for _, rule := range e.rules {
+		if !rule.appliesTo(loc) {
+			continue
+		}
+		e.ds.AddAlert(alertKey(rule.Name, loc.Id), statushttp.AlertStatus{
+			Rule:      rule.Name,
+			Location:  loc.Id,
+			State:     alertStateOk,
+			Variable:  rule.Variable,
+			Threshold: rule.Threshold,
+		})
+	}
+}
+
+// removeLocation forgets the state of the rules for a location that is no longer emitted.
+func (e *alertEngine) removeLocation(id string) {
+	for _, rule := range e.rules {
+		delete(e.states, alertKey(rule.Name, id))
+	}
+	if e.ds != nil {
+		e.ds.RemoveAlerts(id)
+	}
+}
+
+// notify queues a notification. It is dropped if too many are waiting already.
+func (e *alertEngine) notify(rule *alertRule, n notify.Notification, key string) {
+	e.pending.Add(1)
+	select {
+	case e.outbox <- alertNotification{rule: rule, notification: n, key: key}:
+	default:
+		e.pending.Done()
+		log.Errorf("(alerts) too many notifications waiting, dropping %s/%s", n.Rule, n.Location)
+	}
+}
+
+// sendNotifications sends the queued notifications, in order, until the outbox is closed.
+func (e *alertEngine) sendNotifications() {
+	for queued := range e.outbox {
+		e.send(queued.rule, queued.notification, queued.key)
+		e.pending.Done()
+	}
+}
+
+// wait waits until the queued notifications are sent.
+func (e *alertEngine) wait() {
+	e.pending.Wait()
+}
+
+// close sends the notifications that are queued and stops the sender.
+func (e *alertEngine) close() {
+	close(e.outbox)
+	e.wait()
+}
+
+func (e *alertEngine) send(rule *alertRule, n notify.Notification, key string) {
+	for _, name := range rule.Notify {
+		err := e.notifiers[name].Notify(n)
+		if err != nil {
+			log.Errorf("(alerts) notifying %s about %s/%s failed: %s", name, n.Rule, n.Location, err.Error())
+		}
+		if e.ds != nil {
+			e.ds.RecordAlertNotification(key, n.Time, err)
+		}
+	}
+}
+
+// evaluate runs the rules for a location against the emitted observation and the forecast.
+func (e *alertEngine) evaluate(loc Location, obs Observation, timeseries *ObservationTimeSeries) {
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if !rule.appliesTo(loc) {
+			continue
+		}
+		values := rule.values(obs, timeseries)
+		if len(values) == 0 {
+			continue
+		}
+		key := alertKey(rule.Name, loc.Id)
+		state := e.states[key]
+		if state == nil {
+			state = &alertState{}
+			e.states[key] = state
+		}
+		fire, resolve, value := rule.check(values)
+		fired, resolved := fire && !state.firing, resolve && state.firing
+		if fired || resolved {
+			state.firing = fired
+			state.since = obs.Time
+		}
+		if e.ds != nil {
+			current := alertStateOk
+			if state.firing {
+				current = alertStateFiring
+			}
+			e.ds.SetAlertState(key, current, value, state.since)
+		}
+
+		n := notify.Notification{
+			Rule:      rule.Name,
+			Location:  loc.Id,
+			Variable:  rule.Variable,
+			Value:     value,
+			Threshold: rule.Threshold,
+			Time:      obs.Time,
+		}
+		switch {
+		case fired:
+			state.notified = false
+			if obs.Time.Sub(state.lastNotified) < rule.cooldown {
+				log.Infof("(alerts) %s fired for %s, in cooldown", rule.Name, loc.Id)
+				continue
+			}
+			log.Infof("(alerts) %s fired for %s", rule.Name, loc.Id)
+			n.State = alertStateFiring
+			n.Message = fmt.Sprintf("%s at %s is %s %v", rule.Variable, loc.Id, rule.Condition, rule.Threshold)
+			if rule.forecast > 0 {
+				n.Message += fmt.Sprintf(" within the next %s", rule.forecast)
+			}
+			state.notified = true
+			state.lastNotified = obs.Time
+			e.notify(rule, n, key)
+		case resolved:
+			log.Infof("(alerts) %s resolved for %s", rule.Name, loc.Id)
+			if !state.notified {
+				continue
+			}
+			n.State = alertResolved
+			n.Message = fmt.Sprintf("%s at %s is no longer %s %v", rule.Variable, loc.Id, rule.Condition, rule.Threshold)
+			e.notify(rule, n, key)
+		}
+	}
+}
+
+func alertConfigExample() string {
+	return `
+{
+  "notifiers": {
+    "ops": { "type": "webhook", "url": "https://example.com/hooks/weather" },
+    "mail": { "type": "smtp", "addr": "localhost:25", "from": "poller@example.com", "to": ["ops@example.com"] }
+  },
+  "rules": [
+    { "name": "cold", "location": "tryvannstua", "variable": "air_temperature", "condition": "below",
+      "threshold": -10, "hysteresis": 1, "cooldown": "1h", "notify": ["ops", "mail"] },
+    { "name": "gusts", "variable": "wind_speed_of_gust", "condition": "above",
+      "threshold": 20, "hysteresis": 2, "cooldown": "3h", "notify": ["ops"] },
+    { "name": "zero-crossing", "variable": "air_temperature", "condition": "crosses",
+      "threshold": 0, "hysteresis": 0.5, "forecast": "6h", "cooldown": "6h", "notify": ["mail"] }
+  ]
+}
+`
+}
@@ -0,0 +1,150 @@
+package yrsensor
+
+import (
+	"errors"
+	"github.com/perbu/yrpoller/notify"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+type notifierMock struct {
+	notifications []notify.Notification
+}
+
+func (n *notifierMock) Notify(notification notify.Notification) error {
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func Test_readAlertConfig(t *testing.T) {
+	config, err := readAlertConfig(strings.NewReader(alertConfigExample()))
+	assert.Nil(t, err)
+	_, err = newAlertEngine(config, nil)
+	assert.Nil(t, err)
+
+	config.Rules[0].Variable = "air_temprature"
+	_, err = newAlertEngine(config, nil)
+	assert.NotNil(t, err)
+
+	config.Rules[0].Variable = "air_temperature"
+	config.Rules[2].Forecast = ""
+	_, err = newAlertEngine(config, nil)
+	assert.EqualError(t, err, "rule zero-crossing: crosses needs a forecast to look for the crossing in")
+}
+
+func Test_alertEngine(t *testing.T) {
+	mock := &notifierMock{}
+	config := AlertConfig{
+		Rules: []AlertRule{
+			{Name: "cold", Variable: "air_temperature", Condition: "below", Threshold: -10,
+				Hysteresis: 1, Cooldown: "6h", Notify: []string{"mock"}},
+		},
+	}
+	engine, err := newAlertEngine(config, map[string]notify.Notifier{"mock": mock})
+	assert.Nil(t, err)
+	locs := generateTestLocations("tryvannstua")
+	loc := locs.Locations[0]
+	ds := statushttp.NewDaemonStatus()
+	engine.initStatus(&ds, *locs)
+	empty := &ObservationTimeSeries{}
+
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	temps := []float64{-8, -11, -9.5, -12, -8.5, -11}
+	for i, temp := range temps {
+		obs := Observation{Id: loc.Id, Time: start.Add(time.Duration(i) * time.Hour), AirTemperature: temp}
+		engine.evaluate(loc, obs, empty)
+	}
+	engine.wait()
+	// -11 fires. -9.5 is within the hysteresis. -8.5 resolves. The second -11 is within
+	// the cooldown of the first notification, so it isn't notified.
+	assert.Len(t, mock.notifications, 2)
+	assert.Equal(t, "firing", mock.notifications[0].State)
+	assert.Equal(t, -11.0, mock.notifications[0].Value)
+	assert.Equal(t, "resolved", mock.notifications[1].State)
+
+	status := ds.Snapshot().Alerts[alertKey("cold", loc.Id)]
+	assert.Equal(t, "firing", status.State)
+	assert.Equal(t, -11.0, status.Value)
+	assert.Equal(t, start.Add(5*time.Hour), status.Since)
+	assert.Equal(t, uint64(2), status.NoOfNotifications)
+	assert.Equal(t, start.Add(4*time.Hour), status.LastNotified)
+}
+
+// failingNotifier fails every notification, slowly.
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(notification notify.Notification) error {
+	time.Sleep(time.Millisecond)
+	return errors.New("smtp: connection refused")
+}
+
+// The notifications are sent from a goroutine of their own, while the status is read.
+func Test_alertEngineStatusRace(t *testing.T) {
+	config := AlertConfig{
+		Rules: []AlertRule{
+			{Name: "cold", Variable: "air_temperature", Condition: "below", Threshold: -10,
+				Notify: []string{"mock", "mail"}},
+		},
+	}
+	engine, err := newAlertEngine(config, map[string]notify.Notifier{"mock": &notifierMock{}, "mail": failingNotifier{}})
+	assert.Nil(t, err)
+	locs := generateTestLocations("tryvannstua")
+	ds := statushttp.NewDaemonStatus()
+	engine.initStatus(&ds, *locs)
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				ds.Snapshot()
+			}
+		}
+	}()
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		obs := Observation{Time: start.Add(time.Duration(i) * time.Hour), AirTemperature: float64(-5 - 10*(i%2))}
+		engine.evaluate(locs.Locations[0], obs, &ObservationTimeSeries{})
+	}
+	engine.wait()
+	close(done)
+	status := ds.Snapshot().Alerts[alertKey("cold", "tryvannstua")]
+	// Fired and resolved every hour after the first.
+	assert.Equal(t, uint64(19), status.NoOfNotifications)
+	assert.Equal(t, uint64(19), status.NoOfNotifyErrors)
+	assert.Equal(t, "smtp: connection refused", status.LastNotifyErrorMessage)
+}
+
+func Test_alertEngineForecast(t *testing.T) {
+	mock := &notifierMock{}
+	config := AlertConfig{
+		Rules: []AlertRule{
+			{Name: "zero", Location: "skrindo", Variable: "air_temperature", Condition: "crosses",
+				Threshold: 0, Forecast: "6h", Notify: []string{"mock"}},
+		},
+	}
+	engine, err := newAlertEngine(config, map[string]notify.Notifier{"mock": mock})
+	assert.Nil(t, err)
+	locs := &Locations{Locations: []Location{generateOneTestLocation("skrindo"), generateOneTestLocation("met")}}
+	engine.initStatus(nil, *locs)
+
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	ts := ObservationTimeSeries{ts: generateHourlyObservations(start, []float64{-3, -2, -1, -0.5, 0.5, 1, 2, 3, 4}, 0)}
+	for _, loc := range locs.Locations {
+		engine.evaluate(loc, ts.ts[0], &ts)
+	}
+	engine.wait()
+	assert.Len(t, mock.notifications, 1, "only skrindo has the rule")
+	assert.Equal(t, "skrindo", mock.notifications[0].Location)
+
+	// Looking 6h ahead from 3 am, it is above zero all the way.
+	engine.evaluate(locs.Locations[0], ts.ts[4], &ts)
+	engine.wait()
+	assert.Len(t, mock.notifications, 2)
+	assert.Equal(t, "resolved", mock.notifications[1].State)
+}
@@ -12,7 +12,7 @@ func generateTestForecast() LocationForecast {
 		{
 			Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339),
 			Data: TimestepData{
-				InstantData{
+				Instant: InstantData{
 					Details: ForecastTimeInstant{
 						AirTemperature:        -5.0,
 						AirPressureAtSeaLevel: 1023.3,
@@ -26,7 +26,7 @@ func generateTestForecast() LocationForecast {
 		{
 			Time: time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC).Format(time.RFC3339),
 			Data: TimestepData{
-				InstantData{
+				Instant: InstantData{
 					Details: ForecastTimeInstant{
 						AirTemperature:        -7.5,
 						AirPressureAtSeaLevel: 1110.5,
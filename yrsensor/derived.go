@@ -0,0 +1,93 @@
+package yrsensor
+
+import "math"
+
+/*
+  Derived meteorological variables. These are computed by the emitter from the
+  interpolated observation. Temperatures are in °C, humidity in % and wind in m/s,
+  same as what we get from api.met.no.
+*/
+
+// Magnus coefficients, Alduchov & Eskridge (1996).
+const (
+	magnusA = 17.625
+	magnusB = 243.04
+)
+
+// saturationVaporPressure returns the saturation vapor pressure over water in hPa.
+func saturationVaporPressure(temp float64) float64 {
+	return 6.1094 * math.Exp(magnusA*temp/(magnusB+temp))
+}
+
+// dewPoint uses the Magnus formula. It is undefined for a dry atmosphere.
+func dewPoint(temp float64, humidity float64) (float64, bool) {
+	if humidity <= 0 {
+		return 0, false
+	}
+	gamma := math.Log(humidity/100) + magnusA*temp/(magnusB+temp)
+	return magnusB * gamma / (magnusA - gamma), true
+}
+
+// absoluteHumidity returns the mass of water vapour in the air in g/m³.
+func absoluteHumidity(temp float64, humidity float64) float64 {
+	vaporPressure := saturationVaporPressure(temp) * humidity / 100 // hPa
+	return 216.7 * vaporPressure / (273.15 + temp)
+}
+
+// windChill is the JAG/TI index used by Environment Canada and the Norwegian
+// Meteorological Institute. It is only defined for temperatures at or below 10°C
+// and wind above 4.8 km/h, outside that range the air temperature is returned.
+func windChill(temp float64, windSpeed float64) float64 {
+	kmh := windSpeed * 3.6
+	if temp > 10 || kmh <= 4.8 {
+		return temp
+	}
+	v := math.Pow(kmh, 0.16)
+	return 13.12 + 0.6215*temp - 11.37*v + 0.3965*temp*v
+}
+
+// heatIndex implements the NWS algorithm (Rothfusz regression with Steadman's
+// formula for low values), done in Fahrenheit as the coefficients are.
+func heatIndex(temp float64, humidity float64) float64 {
+	t := temp*9/5 + 32
+	rh := humidity
+	hi := 0.5 * (t + 61.0 + (t-68.0)*1.2 + rh*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+			0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+			0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+		if rh < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if rh > 85 && t >= 80 && t <= 87 {
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// apparentTemperature is Steadman's non-radiation apparent temperature, as used by the
+// Australian Bureau of Meteorology.
+func apparentTemperature(temp float64, humidity float64, windSpeed float64) float64 {
+	vaporPressure := humidity / 100 * 6.105 * math.Exp(17.27*temp/(237.7+temp))
+	return temp + 0.33*vaporPressure - 0.70*windSpeed - 4.00
+}
+
+// wetBulbTemperature uses the empirical fit by Stull (2011), valid for humidity
+// between 5% and 99% and temperatures between -20°C and 50°C.
+func wetBulbTemperature(temp float64, humidity float64) float64 {
+	return temp*math.Atan(0.151977*math.Sqrt(humidity+8.313659)) +
+		math.Atan(temp+humidity) - math.Atan(humidity-1.676331) +
+		0.00391838*math.Pow(humidity, 1.5)*math.Atan(0.023101*humidity) - 4.686035
+}
+
+// feelsLike picks wind chill in the cold, the heat index in the heat and the air
+// temperature in between.
+func feelsLike(temp float64, humidity float64, windSpeed float64) float64 {
+	switch {
+	case temp <= 10:
+		return windChill(temp, windSpeed)
+	case temp >= 26.7:
+		return heatIndex(temp, humidity)
+	}
+	return temp
+}
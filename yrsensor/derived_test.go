@@ -0,0 +1,50 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_dewPoint(t *testing.T) {
+	td, ok := dewPoint(20, 50)
+	assert.True(t, ok)
+	assert.InDelta(t, 9.3, td, 0.1)
+	td, ok = dewPoint(-5, 100)
+	assert.True(t, ok)
+	assert.InDelta(t, -5, td, 0.01)
+	_, ok = dewPoint(10, 0)
+	assert.False(t, ok)
+}
+
+func Test_absoluteHumidity(t *testing.T) {
+	assert.InDelta(t, 8.6, absoluteHumidity(20, 50), 0.1)
+}
+
+func Test_windChill(t *testing.T) {
+	// -10°C with 20 km/h wind is -17.9 according to the Environment Canada table.
+	assert.InDelta(t, -17.9, windChill(-10, 20/3.6), 0.1)
+	assert.Equal(t, 15.0, windChill(15, 10), "not defined above 10°C")
+	assert.Equal(t, -10.0, windChill(-10, 1), "not defined in calm air")
+}
+
+func Test_heatIndex(t *testing.T) {
+	// 90°F and 70% humidity is 106°F in the NWS table.
+	assert.InDelta(t, (106.0-32)*5/9, heatIndex((90.0-32)*5/9, 70), 0.5)
+	assert.InDelta(t, 20, heatIndex(20, 50), 1)
+}
+
+func Test_apparentTemperature(t *testing.T) {
+	assert.InDelta(t, 19.85, apparentTemperature(20, 50, 0), 0.01)
+	assert.InDelta(t, 16.35, apparentTemperature(20, 50, 5), 0.01)
+}
+
+func Test_wetBulbTemperature(t *testing.T) {
+	// The reference value from Stull (2011).
+	assert.InDelta(t, 13.7, wetBulbTemperature(20, 50), 0.1)
+}
+
+func Test_feelsLike(t *testing.T) {
+	assert.Equal(t, windChill(-10, 5), feelsLike(-10, 80, 5))
+	assert.Equal(t, 18.0, feelsLike(18, 80, 5))
+	assert.Equal(t, heatIndex(30, 60), feelsLike(30, 60, 5))
+}
@@ -2,11 +2,18 @@ package yrsensor
 
 import (
 	"fmt"
-	"github.com/perbu/yrpoller/timestream"
+	"github.com/perbu/yrpoller/sink"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"time"
 )
 
+// The provider dimension if a location doesn't have one.
+const defaultProvider = "met.no"
+
+// How long the sinks get to write what is queued when the daemon stops.
+const sinkCloseTimeout = 30 * time.Second
+
 func interpolateObservations(first *Observation, last *Observation, when time.Time) Observation {
 	var obs Observation
 	timeDelta := last.Time.Sub(first.Time).Seconds() // Typically 60mins
@@ -19,12 +26,13 @@ func interpolateObservations(first *Observation, last *Observation, when time.Ti
 	obs.RelativeHumidity = last.RelativeHumidity*factor + first.RelativeHumidity*(1.0-factor)
 	obs.WindSpeed = last.WindSpeed*factor + first.WindSpeed*(1.0-factor)
 	obs.WindFromDirection = last.WindFromDirection*factor + first.WindFromDirection*(1.0-factor)
+	obs.WindSpeedOfGust = last.WindSpeedOfGust*factor + first.WindSpeedOfGust*(1.0-factor)
+	obs.PrecipitationRate = last.PrecipitationRate*factor + first.PrecipitationRate*(1.0-factor)
 	return obs
 }
 
-// Emit data
-func emitLocation(tsconfig timestream.TimestreamState, location Location,
-	timeseries *ObservationTimeSeries, when time.Time) {
+// observationAt interpolates the time series of a location to get the observation at a given time.
+func observationAt(location Location, timeseries *ObservationTimeSeries, when time.Time) Observation {
 	var obs Observation
 	firstAfter := 0
 
@@ -43,6 +51,8 @@ func emitLocation(tsconfig timestream.TimestreamState, location Location,
 		obs.RelativeHumidity = timeseries.ts[0].RelativeHumidity
 		obs.WindSpeed = timeseries.ts[0].WindSpeed
 		obs.WindFromDirection = timeseries.ts[0].WindFromDirection
+		obs.WindSpeedOfGust = timeseries.ts[0].WindSpeedOfGust
+		obs.PrecipitationRate = timeseries.ts[0].PrecipitationRate
 	} else {
 		// Interpolate the two relevant measurements
 		last := timeseries.ts[firstAfter]
@@ -52,39 +62,67 @@ func emitLocation(tsconfig timestream.TimestreamState, location Location,
 	// add the Id (place)
 	obs.Id = location.Id
 
-	// jsonData, err := json.MarshalIndent(obs, "TS: ", "  ")
-	tsconfig.MakeEntry(timestream.TimestreamEntry{
-		Time:      obs.Time,
-		SensorId:  obs.Id,
-		TableName: "air_temperature",
-		Value:     fmt.Sprintf("%v", obs.AirTemperature),
-	})
-	tsconfig.MakeEntry(timestream.TimestreamEntry{
-		Time:      obs.Time,
-		SensorId:  obs.Id,
-		TableName: "air_pressure_at_sealevel",
-		Value:     fmt.Sprintf("%v", obs.AirPressureAtSeaLevel),
-	})
-	tsconfig.MakeEntry(timestream.TimestreamEntry{
-		Time:      obs.Time,
-		SensorId:  obs.Id,
-		TableName: "relative_humidity",
-		Value:     fmt.Sprintf("%v", obs.RelativeHumidity),
-	})
-	tsconfig.MakeEntry(timestream.TimestreamEntry{
-		Time:      obs.Time,
-		SensorId:  obs.Id,
-		TableName: "wind_speed",
-		Value:     fmt.Sprintf("%v", obs.WindSpeed),
-	})
-	tsconfig.MakeEntry(timestream.TimestreamEntry{
-		Time:      obs.Time,
-		SensorId:  obs.Id,
-		TableName: "wind_from_direction",
-		Value:     fmt.Sprintf("%v", obs.WindFromDirection),
-	})
-
-	return
+	obs.Solar = solarConditions(location, obs.Time)
+	return obs
+}
+
+// The dimensions describing a location. User defined tags can't override the built in ones.
+func locationDimensions(loc Location) []sink.Dimension {
+	dims := []sink.Dimension{
+		{Name: "location", Value: loc.Id},
+		{Name: "lat", Value: fmt.Sprintf("%v", loc.Lat)},
+		{Name: "long", Value: fmt.Sprintf("%v", loc.Long)},
+	}
+	if loc.Altitude != nil {
+		dims = append(dims, sink.Dimension{Name: "altitude", Value: fmt.Sprintf("%v", *loc.Altitude)})
+	}
+	if loc.Name != "" {
+		dims = append(dims, sink.Dimension{Name: "name", Value: loc.Name})
+	}
+	if loc.Timezone != "" {
+		dims = append(dims, sink.Dimension{Name: "timezone", Value: loc.Timezone})
+	}
+	provider := loc.Provider
+	if provider == "" {
+		provider = defaultProvider
+	}
+	dims = append(dims, sink.Dimension{Name: "provider", Value: provider})
+
+	tags := make([]string, 0, len(loc.Tags))
+	for k := range loc.Tags {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		reserved := false
+		for _, d := range dims {
+			if d.Name == k {
+				reserved = true
+			}
+		}
+		if reserved {
+			log.Warnf("(emitter) tag '%s' on %s clashes with a built in dimension, ignoring it", k, loc.Id)
+			continue
+		}
+		dims = append(dims, sink.Dimension{Name: k, Value: loc.Tags[k]})
+	}
+	return dims
+}
+
+// makeRecord turns an observation into what the sinks store: the values of the output variables.
+func makeRecord(loc Location, obs Observation, vars []outputVariable) sink.Record {
+	record := sink.Record{
+		Time:       obs.Time,
+		Location:   loc.Id,
+		Dimensions: locationDimensions(loc),
+		Values:     make([]sink.Value, 0, len(vars)),
+	}
+	for _, v := range vars {
+		if value, ok := v.Value(&obs); ok {
+			record.Values = append(record.Values, sink.Value{Name: v.Name, Value: value})
+		}
+	}
+	return record
 }
 
 // waits for observations to arrive. Returns true or false
@@ -105,20 +143,51 @@ func waitForObservations(fc *ObservationCache, locs *Locations) bool {
 	return false
 }
 
+// updateEmitterLocations switches to the locations from the location API, dropping the
+// state of the ones that are gone and starting it for the new ones.
+func updateEmitterLocations(config *EmitterConfig, locs Locations) {
+	ds := config.DaemonStatusPtr
+	updated := make(map[string]bool, len(locs.Locations))
+	for _, loc := range locs.Locations {
+		updated[loc.Id] = true
+	}
+	current := make(map[string]bool, len(config.Locations.Locations))
+	for _, loc := range config.Locations.Locations {
+		current[loc.Id] = true
+		if updated[loc.Id] {
+			continue
+		}
+		if config.Alerts != nil {
+			config.Alerts.removeLocation(loc.Id)
+		}
+		if config.SkiWax != nil {
+			config.SkiWax.removeLocation(loc.Id)
+		}
+		if config.Snowpack != nil {
+			config.Snowpack.removeLocation(loc.Id)
+		}
+		if ds != nil {
+			ds.RemoveSkiConditions(loc.Id)
+		}
+	}
+	for _, loc := range locs.Locations {
+		if !current[loc.Id] && config.Alerts != nil {
+			config.Alerts.addLocation(loc)
+		}
+	}
+	config.Locations = locs
+}
+
 func emitter(config *EmitterConfig) {
 	var previousEmit time.Time
 	log.Info("Starting emitter")
 
-	tsconfig := timestream.Factory(config.AwsRegion, config.AwsTimestreamDbname)
-
-	err := tsconfig.CheckAndCreateTables([]string{
-		"air_temperature", "air_pressure_at_sealevel", "relative_humidity",
-		"wind_speed", "wind_from_direction"})
-	if err != nil {
-		panic(err.Error())
-	}
 	for waitForObservations(config.ObservationCachePtr, &config.Locations) == false {
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case locs := <-config.LocationUpdates:
+			updateEmitterLocations(config, locs)
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 
 	// run until until the channel closes.
@@ -128,6 +197,7 @@ func emitter(config *EmitterConfig) {
 			emitNeeded := time.Now().UTC().Sub(previousEmit) > config.EmitterInterval
 			if emitNeeded {
 				log.Debug("(emitter) Emit triggered")
+				records := make([]sink.Record, 0, len(config.Locations.Locations))
 				for _, loc := range config.Locations.Locations {
 					log.Debugf("(emitter) Requesting obs for loc %s", loc.Id)
 					resCh := make(chan ObservationTimeSeries)
@@ -136,22 +206,35 @@ func emitter(config *EmitterConfig) {
 						ResponseChannel: resCh,
 					}
 					resTimeSeries := <-resCh
-					emitLocation(tsconfig, loc, &resTimeSeries, time.Now().UTC())
-				}
-				errs := tsconfig.FlushAwsTimestreamWrites()
-				if len(errs) > 0 {
-					for _, err := range errs {
-						if err != nil {
-							if config.DaemonStatusPtr != nil {
-								config.DaemonStatusPtr.IncEmitError(err.Error())
-							}
-						}
+					if len(resTimeSeries.ts) == 0 {
+						// Added by the location API and not polled yet, or the poll failed.
+						log.Infof("(emitter) no forecast for %s yet, skipping it", loc.Id)
+						continue
+					}
+					obs := observationAt(loc, &resTimeSeries, time.Now().UTC())
+					if config.Snowpack != nil {
+						obs.Snowpack = config.Snowpack.update(obs)
+					}
+					records = append(records, makeRecord(loc, obs, config.OutputVariables))
+					if config.SkiWax != nil && config.DaemonStatusPtr != nil {
+						config.DaemonStatusPtr.SetSkiConditions(loc.Id,
+							config.SkiWax.evaluate(loc, obs, &resTimeSeries))
 					}
-				} else {
-					if config.DaemonStatusPtr != nil {
-						config.DaemonStatusPtr.IncEmit()
+					if config.Alerts != nil {
+						config.Alerts.evaluate(loc, obs, &resTimeSeries)
 					}
 				}
+				if config.Snowpack != nil {
+					err := config.Snowpack.save()
+					if err != nil {
+						log.Errorf("(emitter) could not save snowpack state: %s", err.Error())
+					}
+				}
+				// The sinks write in their own goroutines, failures are reported from there.
+				config.Sinks.Write(records)
+				if config.DaemonStatusPtr != nil {
+					config.DaemonStatusPtr.IncEmit()
+				}
 				previousEmit = time.Now().UTC()
 				log.Debugf("(emitter) Emit done at %s", previousEmit)
 			} else {
@@ -159,8 +242,17 @@ func emitter(config *EmitterConfig) {
 					previousEmit.Format(time.RFC3339))
 				time.Sleep(5 * time.Second)
 			}
+		case locs := <-config.LocationUpdates:
+			log.Infof("(emitter) got %d locations from the location API", len(locs.Locations))
+			updateEmitterLocations(config, locs)
 		case <-config.Finished:
 			log.Info("Emitter ending.")
+			if config.Alerts != nil {
+				config.Alerts.close()
+			}
+			if err := config.Sinks.Close(sinkCloseTimeout); err != nil {
+				log.Errorf("(emitter) %s", err.Error())
+			}
 			config.Finished <- true
 			return
 		}
@@ -2,6 +2,7 @@ package yrsensor
 
 import (
 	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"github.com/perbu/yrpoller/sink"
 	"github.com/perbu/yrpoller/timestream"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -45,7 +46,87 @@ func Test_emit(t *testing.T) {
 		WriteBuffer: make(map[string][]*timestreamwrite.Record),
 	}
 	locTimeseries := fc.observations[loc.Id]
-	emitLocation(tsState, loc, &locTimeseries, when)
+	obs := observationAt(loc, &locTimeseries, when)
+	ts := timestreamSink{state: tsState}
+	ts.addRecord(makeRecord(loc, obs, outputVariables))
 	assert.Equal(t, "-15", *tsState.WriteBuffer["air_temperature"][0].MeasureValue)
 	assert.Equal(t, "1050", *tsState.WriteBuffer["air_pressure_at_sealevel"][0].MeasureValue)
+	assert.Equal(t, "air_temperature", *tsState.WriteBuffer["air_temperature"][0].MeasureName)
+	assert.Equal(t, "location", *tsState.WriteBuffer["air_temperature"][0].Dimensions[0].Name)
+	assert.Equal(t, ID, *tsState.WriteBuffer["air_temperature"][0].Dimensions[0].Value)
+}
+
+func Test_locationDimensions(t *testing.T) {
+	altitude := 529.0
+	loc := Location{
+		Id:       "tryvannstua",
+		Lat:      59.9981,
+		Long:     10.6661,
+		Altitude: &altitude,
+		Name:     "Tryvannstua",
+		Timezone: "Europe/Oslo",
+		Tags:     map[string]string{"region": "oslo", "lat": "bogus", "club": "ski"},
+	}
+	dims := locationDimensions(loc)
+	assert.Equal(t, []sink.Dimension{
+		{Name: "location", Value: "tryvannstua"},
+		{Name: "lat", Value: "59.9981"},
+		{Name: "long", Value: "10.6661"},
+		{Name: "altitude", Value: "529"},
+		{Name: "name", Value: "Tryvannstua"},
+		{Name: "timezone", Value: "Europe/Oslo"},
+		{Name: "provider", Value: "met.no"},
+		{Name: "club", Value: "ski"},
+		{Name: "region", Value: "oslo"},
+	}, dims)
+}
+
+func Test_emitMultiMeasure(t *testing.T) {
+	const ID = "tryvannstua"
+
+	when := time.Date(2020, 1, 1, 0, 30, 0, 0, time.UTC)
+	fc := generateTestObservationCache(ID, 0)
+	loc := generateOneTestLocation(ID)
+
+	tsState := timestream.TimestreamState{
+		MultiMeasureTable: "observations",
+		WriteBuffer:       make(map[string][]*timestreamwrite.Record),
+	}
+	locTimeseries := fc.observations[loc.Id]
+	obs := observationAt(loc, &locTimeseries, when)
+	vars, err := selectOutputVariables("air_temperature,air_pressure_at_sealevel")
+	assert.Nil(t, err)
+	ts := timestreamSink{state: tsState}
+	ts.addRecord(makeRecord(loc, obs, vars))
+
+	assert.Len(t, tsState.WriteBuffer, 1)
+	assert.Len(t, tsState.WriteBuffer["observations"], 1)
+	rec := tsState.WriteBuffer["observations"][0]
+	assert.Equal(t, "MULTI", *rec.MeasureValueType)
+	assert.Len(t, rec.MeasureValues, 2)
+	assert.Equal(t, "air_temperature", *rec.MeasureValues[0].Name)
+	assert.Equal(t, "-15", *rec.MeasureValues[0].Value)
+	assert.Equal(t, "1050", *rec.MeasureValues[1].Value)
+}
+
+func Test_makeRecord(t *testing.T) {
+	const ID = "tryvannstua"
+
+	when := time.Date(2020, 1, 1, 0, 30, 0, 0, time.UTC)
+	fc := generateTestObservationCache(ID, 0)
+	loc := generateOneTestLocation(ID)
+	locTimeseries := fc.observations[loc.Id]
+	obs := observationAt(loc, &locTimeseries, when)
+	vars, err := selectOutputVariables("air_temperature,snow_water_equivalent,air_pressure_at_sealevel")
+	assert.Nil(t, err)
+
+	record := makeRecord(loc, obs, vars)
+	assert.Equal(t, when, record.Time)
+	assert.Equal(t, ID, record.Location)
+	assert.Equal(t, sink.Dimension{Name: "location", Value: ID}, record.Dimensions[0])
+	// There is no snowpack model running, so no snow water equivalent.
+	assert.Equal(t, []sink.Value{
+		{Name: "air_temperature", Value: -15},
+		{Name: "air_pressure_at_sealevel", Value: 1050},
+	}, record.Values)
 }
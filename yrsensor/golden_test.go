@@ -0,0 +1,50 @@
+package yrsensor
+
+import (
+	"flag"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/file"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Rewrite the golden files with: go test ./yrsensor -run Test_emitGolden -update
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// Test_emitGolden writes what the emitter makes of the test observations with the file sink,
+// and compares it with testdata/emitter.<format>.golden.
+func Test_emitGolden(t *testing.T) {
+	const ID = "tryvannstua"
+
+	fc := generateTestObservationCache(ID, 0)
+	loc := generateOneTestLocation(ID)
+	locTimeseries := fc.observations[loc.Id]
+	records := make([]sink.Record, 0)
+	// Every 15 minutes between the two test observations.
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for when := start; when.Before(start.Add(time.Hour)); when = when.Add(15 * time.Minute) {
+		obs := observationAt(loc, &locTimeseries, when)
+		records = append(records, makeRecord(loc, obs, outputVariables))
+	}
+
+	for _, format := range []string{file.FormatCSV, file.FormatJSONL} {
+		dir := t.TempDir()
+		fs, err := file.Open(file.Config{Dir: dir, Format: format, Variables: outputVariableNames(outputVariables)})
+		assert.Nil(t, err)
+		assert.Nil(t, fs.Write(records))
+		assert.Nil(t, fs.Close())
+		got, err := ioutil.ReadFile(filepath.Join(dir, "observations-2020-01-01."+format))
+		assert.Nil(t, err)
+
+		golden := filepath.Join("testdata", "emitter."+format+".golden")
+		if *updateGolden {
+			assert.Nil(t, ioutil.WriteFile(golden, got, 0o644))
+		}
+		want, err := ioutil.ReadFile(golden)
+		assert.Nil(t, err)
+		assert.Equal(t, string(want), string(got), "output differs from %s", golden)
+	}
+}
@@ -0,0 +1,69 @@
+package yrsensor
+
+import (
+	"fmt"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/perbu/yrpoller/timestream"
+	"time"
+)
+
+/*
+  Reading back what has been stored in Timestream and comparing it with the emit schedule.
+*/
+
+// historyGaps finds the stretches between since and until where a point was expected every interval
+// but none are stored. Half an interval of slack is allowed for when the emits happen.
+func historyGaps(points []statushttp.HistoryPoint, since time.Time, until time.Time, interval time.Duration) []statushttp.HistoryGap {
+	gaps := make([]statushttp.HistoryGap, 0)
+	times := make([]time.Time, 0, len(points)+2)
+	times = append(times, since)
+	for _, p := range points {
+		times = append(times, p.Time)
+	}
+	times = append(times, until)
+	for i := 1; i < len(times); i++ {
+		missing := int((times[i].Sub(times[i-1]) - interval/2) / interval)
+		if missing > 0 {
+			gaps = append(gaps, statushttp.HistoryGap{From: times[i-1], To: times[i], Missing: missing})
+		}
+	}
+	return gaps
+}
+
+// makeHistoryFunc gives the status server access to the stored values of the emitted variables.
+func makeHistoryFunc(tsconfig timestream.TimestreamState, vars []outputVariable, interval time.Duration) statushttp.HistoryFunc {
+	return func(location string, variable string, since time.Duration, limit int) (*statushttp.HistoryStatus, error) {
+		known := false
+		for _, v := range vars {
+			if v.Name == variable {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("%w '%s'", statushttp.ErrUnknownVariable, variable)
+		}
+		if limit > timestream.MaxHistoryPoints {
+			limit = timestream.MaxHistoryPoints
+		}
+		until := time.Now().UTC()
+		from := until.Add(-since)
+		points, err := tsconfig.History(location, variable, from, limit)
+		if err != nil {
+			return nil, err
+		}
+		status := &statushttp.HistoryStatus{
+			Location: location,
+			Variable: variable,
+			Since:    from,
+			Interval: interval.String(),
+			Points:   points,
+		}
+		// If we got as many points as we asked for, older points may be stored but not returned.
+		covered := from
+		if len(points) == limit {
+			covered = points[0].Time
+		}
+		status.Gaps = historyGaps(status.Points, covered, until, interval)
+		return status, nil
+	}
+}
@@ -0,0 +1,45 @@
+package yrsensor
+
+import (
+	"errors"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/perbu/yrpoller/timestream"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_historyGaps(t *testing.T) {
+	since := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) statushttp.HistoryPoint {
+		return statushttp.HistoryPoint{Time: since.Add(time.Duration(minutes) * time.Minute)}
+	}
+	interval := 10 * time.Minute
+
+	// On schedule, with some jitter.
+	points := []statushttp.HistoryPoint{at(5), at(15), at(26), at(35), at(45), at(55)}
+	assert.Len(t, historyGaps(points, since, since.Add(time.Hour), interval), 0)
+
+	// Two emits missing in the middle and nothing for the last 20 minutes.
+	points = []statushttp.HistoryPoint{at(5), at(15), at(45)}
+	gaps := historyGaps(points, since, since.Add(time.Hour+5*time.Minute), interval)
+	assert.Equal(t, []statushttp.HistoryGap{
+		{From: at(15).Time, To: at(45).Time, Missing: 2},
+		{From: at(45).Time, To: since.Add(time.Hour + 5*time.Minute), Missing: 1},
+	}, gaps)
+
+	// Nothing stored at all.
+	gaps = historyGaps(nil, since, since.Add(time.Hour), interval)
+	assert.Equal(t, []statushttp.HistoryGap{{From: since, To: since.Add(time.Hour), Missing: 5}}, gaps)
+}
+
+func Test_makeHistoryFunc(t *testing.T) {
+	vars, err := selectOutputVariables("air_temperature")
+	assert.Nil(t, err)
+	history := makeHistoryFunc(timestream.TimestreamState{AwsTimestreamDbname: "testdb"}, vars, 10*time.Minute)
+
+	_, err = history("skrindo", "wind_speed", time.Hour, 10)
+	assert.True(t, errors.Is(err, statushttp.ErrUnknownVariable), "wind_speed isn't emitted")
+	_, err = history("skrindo", "air_temperature", time.Hour, 10)
+	assert.NotNil(t, err, "queries aren't enabled")
+}
@@ -0,0 +1,196 @@
+package yrsensor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/perbu/yrpoller/statushttp"
+	"reflect"
+	"sync"
+)
+
+// locationAPI adds, changes and removes locations for /api/locations on the status server.
+// It has all the locations of the location file, the disabled ones too, and is the only one
+// changing them. The poller and the emitter get the enabled ones over their channels.
+type locationAPI struct {
+	mu        sync.Mutex
+	locations []Location
+	path      string // the location file, written back to if set
+	ds        *statushttp.DaemonStatus
+	skiWax    bool
+	updates   []chan Locations
+}
+
+func newLocationAPI(locs []Location, path string, ds *statushttp.DaemonStatus, skiWax bool,
+	updates ...chan Locations) *locationAPI {
+	return &locationAPI{
+		locations: append([]Location{}, locs...),
+		path:      path,
+		ds:        ds,
+		skiWax:    skiWax,
+		updates:   updates,
+	}
+}
+
+// offer hands the locations to a goroutine, replacing what it hasn't picked up yet. Only the
+// location API sends, holding its lock, so there is room once the channel is emptied.
+func offer(ch chan Locations, locs Locations) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- locs
+}
+
+// parseLocationBody reads a location sent to the API, checking it like the location file.
+// The error is statushttp.ErrInvalidLocation followed by the problems, a line each, with the
+// line and column in the body. The id is taken from the path if it isn't in the body.
+func parseLocationBody(body []byte, id string) (Location, error) {
+	loc, problems := checkLocationBody(body, id)
+	if problems != nil {
+		found := fmt.Sprintf("%d problems", len(problems))
+		if len(problems) == 1 {
+			found = "1 problem"
+		}
+		return Location{}, fmt.Errorf("%w: %s\n%s", statushttp.ErrInvalidLocation, found, problems.Error())
+	}
+	return loc, nil
+}
+
+func checkLocationBody(body []byte, id string) (Location, LocationProblems) {
+	s := &jsonScanner{raw: body}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		s.addError(err, 0)
+		return Location{}, s.problems
+	}
+	start := s.skip(0)
+	e := s.location(start, body[start:])
+	if e == nil {
+		return Location{}, s.problems
+	}
+	if _, given := e.fields["id"]; id != "" && !given {
+		e.loc.Id = id
+		e.fields["id"] = e.at
+	} else if id != "" && e.loc.Id != id {
+		s.problems.add(e.where("id"), e.loc.Id, "id must be %s, as in the path", id)
+	}
+	if problems := append(s.problems, checkEntries([]*locationEntry{e})...).sorted(); problems != nil {
+		return Location{}, problems
+	}
+	return e.loc, nil
+}
+
+func (a *locationAPI) find(id string) int {
+	for i, loc := range a.locations {
+		if loc.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// apply switches to the locations, after writing them to the location file if it is kept.
+func (a *locationAPI) apply(locs []Location) error {
+	if a.path != "" {
+		if err := writeLocationFile(a.path, locs); err != nil {
+			return fmt.Errorf("could not write the locations to %s: %w", a.path, err)
+		}
+	}
+	enabled := make([]Location, 0, len(locs))
+	isEnabled := make(map[string]bool)
+	for _, loc := range locs {
+		if loc.enabled() {
+			enabled = append(enabled, loc)
+			isEnabled[loc.Id] = true
+		}
+	}
+	if a.ds != nil {
+		// Only new and changed locations start over, the others keep their ski conditions.
+		was := make(map[string]Location)
+		for _, loc := range a.locations {
+			if !loc.enabled() {
+				continue
+			}
+			was[loc.Id] = loc
+			if !isEnabled[loc.Id] {
+				a.ds.RemoveLocation(loc.Id)
+			}
+		}
+		for _, loc := range enabled {
+			if prev, ok := was[loc.Id]; !ok || !reflect.DeepEqual(prev, loc) {
+				addLocationToStatus(a.ds, loc, a.skiWax)
+			}
+		}
+	}
+	a.locations = locs
+	for _, ch := range a.updates {
+		offer(ch, Locations{Locations: enabled})
+	}
+	return nil
+}
+
+// List is all the locations, the disabled ones too.
+func (a *locationAPI) List() interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Location{}, a.locations...)
+}
+
+func (a *locationAPI) Get(id string) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := a.find(id)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: %w", id, statushttp.ErrLocationNotFound)
+	}
+	return a.locations[i], nil
+}
+
+// Create adds a location. It is polled right away and emitted from the next emit.
+func (a *locationAPI) Create(body []byte) (interface{}, error) {
+	loc, err := parseLocationBody(body, "")
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.find(loc.Id) >= 0 {
+		return nil, fmt.Errorf("%s: %w", loc.Id, statushttp.ErrLocationExists)
+	}
+	locs := append(append([]Location{}, a.locations...), loc)
+	if err := a.apply(locs); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+// Update replaces a location. It is polled again if it has changed.
+func (a *locationAPI) Update(id string, body []byte) (interface{}, error) {
+	loc, err := parseLocationBody(body, id)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := a.find(id)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: %w", id, statushttp.ErrLocationNotFound)
+	}
+	locs := append([]Location{}, a.locations...)
+	locs[i] = loc
+	if err := a.apply(locs); err != nil {
+		return nil, err
+	}
+	return loc, nil
+}
+
+func (a *locationAPI) Delete(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := a.find(id)
+	if i < 0 {
+		return fmt.Errorf("%s: %w", id, statushttp.ErrLocationNotFound)
+	}
+	locs := append(append([]Location{}, a.locations[:i]...), a.locations[i+1:]...)
+	return a.apply(locs)
+}
@@ -0,0 +1,198 @@
+package yrsensor
+
+import (
+	"errors"
+	"github.com/perbu/yrpoller/notify"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_locationAPI(t *testing.T) {
+	updates := make(chan Locations, 1)
+	api := newLocationAPI([]Location{generateOneTestLocation("tryvannstua")}, "", nil, false, updates)
+
+	loc, err := api.Create([]byte(`{"id": "holmenkollen", "lat": 59.9633, "long": 10.6672, "tags": {"event": "world-cup"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "world-cup", loc.(Location).Tags["event"])
+	assert.Equal(t, []string{"tryvannstua", "holmenkollen"}, locationIds((<-updates).Locations))
+
+	_, err = api.Create([]byte(`{"id": "holmenkollen", "lat": 59.9633, "long": 10.6672}`))
+	assert.True(t, errors.Is(err, statushttp.ErrLocationExists))
+
+	_, err = api.Create([]byte("{\n  \"id\": \"Holmenkollen\",\n  \"lat\": 59.96331, \"long\": 10.6672\n}"))
+	assert.True(t, errors.Is(err, statushttp.ErrInvalidLocation))
+	assert.Equal(t, "invalid location: 1 problem\n"+
+		"2:3: Holmenkollen: id must be lowercase letters, digits, - and _, starting with a letter or digit", err.Error())
+	_, err = api.Create([]byte(`{"id": "met", `))
+	assert.True(t, errors.Is(err, statushttp.ErrInvalidLocation))
+
+	// The id is taken from the path, and disabled locations aren't polled.
+	loc, err = api.Update("holmenkollen", []byte(`{"lat": 59.9633, "long": 10.6672, "enabled": false}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "holmenkollen", loc.(Location).Id)
+	assert.Equal(t, []string{"tryvannstua"}, locationIds((<-updates).Locations))
+	assert.Len(t, api.List(), 2)
+	_, err = api.Update("holmenkollen", []byte(`{"id": "vikersund", "lat": 59.9633, "long": 10.6672}`))
+	assert.True(t, errors.Is(err, statushttp.ErrInvalidLocation))
+	_, err = api.Update("vikersund", []byte(`{"lat": 59.9633, "long": 10.6672}`))
+	assert.True(t, errors.Is(err, statushttp.ErrLocationNotFound))
+
+	assert.Nil(t, api.Delete("tryvannstua"))
+	assert.Empty(t, (<-updates).Locations)
+	assert.True(t, errors.Is(api.Delete("tryvannstua"), statushttp.ErrLocationNotFound))
+	_, err = api.Get("tryvannstua")
+	assert.True(t, errors.Is(err, statushttp.ErrLocationNotFound))
+	loc, err = api.Get("holmenkollen")
+	assert.Nil(t, err)
+	assert.False(t, loc.(Location).enabled())
+}
+
+func Test_locationAPIStatus(t *testing.T) {
+	ds := statushttp.NewDaemonStatus()
+	locs := []Location{generateOneTestLocation("tryvannstua"), generateOneTestLocation("skrindo")}
+	addLocationsToStatus(&ds, Locations{Locations: locs}, true)
+	api := newLocationAPI(locs, "", &ds, true)
+	ds.SetSkiConditions("tryvannstua", statushttp.SkiConditionStatus{Wax: "blue"})
+	ds.SetSkiConditions("skrindo", statushttp.SkiConditionStatus{Wax: "violet"})
+
+	_, err := api.Create([]byte(`{"id": "holmenkollen", "lat": 59.9633, "long": 10.6672}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "blue", ds.Ski["tryvannstua"].Wax, "unchanged locations keep their ski conditions")
+	assert.Equal(t, "violet", ds.Ski["skrindo"].Wax)
+	assert.Equal(t, statushttp.SkiConditionStatus{}, *ds.Ski["holmenkollen"])
+
+	_, err = api.Update("skrindo", []byte(`{"name": "Skrindo", "lat": 60.6606, "long": 8.5741}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "blue", ds.Ski["tryvannstua"].Wax)
+	assert.Empty(t, ds.Ski["skrindo"].Wax, "a changed location starts over")
+	assert.Equal(t, "Skrindo", ds.Locations["skrindo"].Name)
+
+	assert.Nil(t, api.Delete("holmenkollen"))
+	assert.Nil(t, ds.Locations["holmenkollen"])
+	assert.Equal(t, "blue", ds.Ski["tryvannstua"].Wax)
+}
+
+func Test_locationAPIOffer(t *testing.T) {
+	updates := make(chan Locations, 1)
+	api := newLocationAPI(nil, "", nil, false, updates)
+	_, err := api.Create([]byte(`{"id": "met", "lat": 59.9427, "long": 10.7207}`))
+	assert.Nil(t, err)
+	_, err = api.Create([]byte(`{"id": "skrindo", "lat": 60.6606, "long": 8.5741}`))
+	assert.Nil(t, err)
+	// Only the latest locations are waiting, the sends don't block.
+	assert.Equal(t, []string{"met", "skrindo"}, locationIds((<-updates).Locations))
+	assert.Len(t, updates, 0)
+}
+
+func Test_locationAPIWriteBack(t *testing.T) {
+	for _, name := range []string{"locations.json", "locations.yaml", "locations.csv", "locations.geojson"} {
+		path := filepath.Join(t.TempDir(), name)
+		assert.Nil(t, writeLocationFile(path, []Location{generateOneTestLocation("tryvannstua")}))
+		locs, err := readLocationsFromPath(path)
+		assert.Nil(t, err, name)
+		api := newLocationAPI(locs, path, nil, false)
+
+		_, err = api.Create([]byte(`{"id": "holmenkollen", "lat": 59.9633, "long": 10.6672, "tags": {"event": "world-cup"}}`))
+		assert.Nil(t, err, name)
+		assert.Nil(t, api.Delete("tryvannstua"), name)
+		locs, err = readLocationsFromPath(path)
+		assert.Nil(t, err, name)
+		assert.Equal(t, []string{"holmenkollen"}, locationIds(locs), name)
+		assert.Equal(t, "world-cup", locs[0].Tags["event"], name)
+		files, _ := ioutil.ReadDir(filepath.Dir(path))
+		assert.Len(t, files, 1, "the temporary file is renamed")
+	}
+
+	// Nothing changes if the file can't be written.
+	api := newLocationAPI(nil, filepath.Join(t.TempDir(), "gone", "locations.json"), nil, false)
+	_, err := api.Create([]byte(`{"id": "met", "lat": 59.9427, "long": 10.7207}`))
+	assert.NotNil(t, err)
+	assert.Empty(t, api.List())
+}
+
+func Test_updateLocations(t *testing.T) {
+	fc := generateTestObservationCache("tryvannstua", 0)
+	fc.observations["met"] = fc.observations["tryvannstua"]
+	fc.observations["skrindo"] = fc.observations["tryvannstua"]
+	config := &PollerConfig{
+		Locations: Locations{Locations: []Location{generateOneTestLocation("tryvannstua"),
+			generateOneTestLocation("met"), generateOneTestLocation("skrindo")}},
+		ObservationCachePtr: fc,
+	}
+	moved := generateOneTestLocation("met")
+	moved.Lat = 59.9427
+	updateLocations(config, Locations{Locations: []Location{generateOneTestLocation("tryvannstua"), moved}})
+	assert.Contains(t, fc.observations, "tryvannstua")
+	assert.NotContains(t, fc.observations, "met", "it has moved and is polled again")
+	assert.NotContains(t, fc.observations, "skrindo")
+	assert.Len(t, config.Locations.Locations, 2)
+}
+
+func Test_updateEmitterLocations(t *testing.T) {
+	config := AlertConfig{
+		Rules: []AlertRule{
+			{Name: "cold", Variable: "air_temperature", Condition: "below", Threshold: -10,
+				Notify: []string{"mock"}},
+		},
+	}
+	engine, err := newAlertEngine(config, map[string]notify.Notifier{"mock": &notifierMock{}})
+	assert.Nil(t, err)
+	ds := statushttp.NewDaemonStatus()
+	ec := &EmitterConfig{Locations: *generateTestLocations("tryvannstua"), Alerts: engine, DaemonStatusPtr: &ds}
+	engine.initStatus(&ds, ec.Locations)
+
+	updateEmitterLocations(ec, Locations{Locations: []Location{generateOneTestLocation("holmenkollen")}})
+	assert.Contains(t, ds.Alerts, alertKey("cold", "holmenkollen"))
+	assert.NotContains(t, ds.Alerts, alertKey("cold", "tryvannstua"))
+	assert.Equal(t, "holmenkollen", ec.Locations.Locations[0].Id)
+}
+
+func Test_updateEmitterLocationsReAdd(t *testing.T) {
+	rules, err := readSkiWaxRules(strings.NewReader(skiWaxRulesExample()))
+	assert.Nil(t, err)
+	dir, err := ioutil.TempDir("", "snowpack")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	snowpack, err := newSnowpackModel(testSnowpackParams, filepath.Join(dir, "snowpack.json"))
+	assert.Nil(t, err)
+	ds := statushttp.NewDaemonStatus()
+	ec := &EmitterConfig{Locations: *generateTestLocations("tryvannstua"), SkiWax: newSkiWaxEngine(rules),
+		Snowpack: snowpack, DaemonStatusPtr: &ds}
+	loc := ec.Locations.Locations[0]
+
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	ts := ObservationTimeSeries{ts: generateHourlyObservations(start, []float64{-9, -9, -9}, 1.0)}
+	for i := range ts.ts {
+		ts.ts[i].Id = loc.Id
+		ec.SkiWax.evaluate(loc, ts.ts[i], &ts)
+		ec.Snowpack.update(ts.ts[i])
+	}
+	assert.Len(t, ec.SkiWax.history[loc.Id], 3)
+	assert.NotNil(t, ec.Snowpack.states[loc.Id])
+
+	updateEmitterLocations(ec, Locations{})
+	assert.NotContains(t, ec.SkiWax.history, loc.Id)
+	assert.NotContains(t, ec.Snowpack.states, loc.Id)
+
+	// Added again a day later, it starts over instead of carrying on from the old state.
+	updateEmitterLocations(ec, *generateTestLocations("tryvannstua"))
+	later := start.Add(24 * time.Hour)
+	obs := Observation{Id: loc.Id, Time: later, AirTemperature: -5, PrecipitationRate: 1}
+	ec.SkiWax.evaluate(loc, obs, &ObservationTimeSeries{ts: []Observation{obs}})
+	assert.Len(t, ec.SkiWax.history[loc.Id], 1)
+	assert.Equal(t, 0.0, ec.Snowpack.update(obs).AccumulatedSnowfall)
+}
+
+func locationIds(locs []Location) []string {
+	ids := make([]string, 0, len(locs))
+	for _, loc := range locs {
+		ids = append(ids, loc.Id)
+	}
+	return ids
+}
@@ -0,0 +1,409 @@
+package yrsensor
+
+/*
+  Validation of the location file. Each format is read into entries that know where every
+  location and field is in the file, so all the problems can be reported with a line and
+  column instead of stopping at the first one. The checks of the locations themselves are
+  the same for all formats.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// api.met.no wants coordinates with at most 4 decimals, about 10 meters. More are rounded.
+const maxCoordinateDecimals = 4
+
+const (
+	minAltitude = -500.0
+	maxAltitude = 9000.0
+)
+
+var validId = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// LocationProblem is something wrong in the location file.
+type LocationProblem struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Id      string `json:"id,omitempty"` // Of the location, if it is known.
+	Message string `json:"message"`
+}
+
+func (p LocationProblem) String() string {
+	if p.Id != "" {
+		return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Column, p.Id, p.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s", p.Line, p.Column, p.Message)
+}
+
+// LocationProblems is the error for a location file with problems, all of them.
+type LocationProblems []LocationProblem
+
+func (p LocationProblems) Error() string {
+	lines := make([]string, len(p))
+	for i, problem := range p {
+		lines[i] = problem.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *LocationProblems) add(at position, id string, format string, args ...interface{}) {
+	*p = append(*p, LocationProblem{Line: at.line, Column: at.column, Id: id, Message: fmt.Sprintf(format, args...)})
+}
+
+// sorted is the problems in the order they are in the file, nil if there are none.
+func (p LocationProblems) sorted() LocationProblems {
+	if len(p) == 0 {
+		return nil
+	}
+	sort.SliceStable(p, func(i, j int) bool {
+		return p[i].Line < p[j].Line || (p[i].Line == p[j].Line && p[i].Column < p[j].Column)
+	})
+	return p
+}
+
+// position is a line and column in a file, counting from 1.
+type position struct {
+	line   int
+	column int
+}
+
+// locationEntry is a location as read from a file, with where it and its fields are.
+type locationEntry struct {
+	loc     Location
+	at      position
+	fields  map[string]position
+	numbers map[string]string // The lat and long as written, to count the decimals.
+}
+
+func newLocationEntry(at position) *locationEntry {
+	return &locationEntry{at: at, fields: make(map[string]position), numbers: make(map[string]string)}
+}
+
+func (e *locationEntry) where(field string) position {
+	if at, ok := e.fields[field]; ok {
+		return at
+	}
+	return e.at
+}
+
+// locationField is what a field of a location file sets, nil for unknown fields.
+func locationField(loc *Location, name string) interface{} {
+	switch name {
+	case "id":
+		return &loc.Id
+	case "name":
+		return &loc.Name
+	case "lat":
+		return &loc.Lat
+	case "long":
+		return &loc.Long
+	case "altitude":
+		return &loc.Altitude
+	case "timezone":
+		return &loc.Timezone
+	case "provider":
+		return &loc.Provider
+	case "enabled":
+		return &loc.Enabled
+	case "tags":
+		return &loc.Tags
+	}
+	return nil
+}
+
+// typeName is what a field has to be, in the words of the file formats.
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Map:
+		return "map of strings"
+	}
+	return t.Kind().String()
+}
+
+// checkEntries checks the locations, the same way for all the formats. Coordinates with more
+// decimals than api.met.no wants are rounded, with a warning.
+func checkEntries(entries []*locationEntry) LocationProblems {
+	var problems LocationProblems
+	ids := make(map[string]position)
+	for _, e := range entries {
+		loc := e.loc
+		id := loc.Id
+		switch _, given := e.fields["id"]; {
+		case !given:
+			problems.add(e.at, "", "id is missing")
+		case loc.Id == "":
+			problems.add(e.where("id"), "", "id is empty")
+		case !validId.MatchString(loc.Id):
+			problems.add(e.where("id"), id, "id must be lowercase letters, digits, - and _, starting with a letter or digit")
+		}
+		if loc.Id != "" {
+			if first, seen := ids[loc.Id]; seen {
+				problems.add(e.where("id"), id, "duplicate id, also used on line %d", first.line)
+			} else {
+				ids[loc.Id] = e.where("id")
+			}
+		}
+
+		coordinate := func(field string, value *float64, limit float64) {
+			if _, given := e.fields[field]; !given {
+				problems.add(e.at, id, "%s is missing", field)
+				return
+			}
+			if *value < -limit || *value > limit {
+				problems.add(e.where(field), id, "%s must be between %v and %v, not %v", field, -limit, limit, *value)
+			}
+			if d := decimals(e.numbers[field]); d > maxCoordinateDecimals {
+				rounded := roundCoordinate(*value)
+				at := e.where(field)
+				log.Warnf("(locations) %d:%d: %s: %s has %d decimals, rounded to %v as api.met.no wants at most %d",
+					at.line, at.column, id, field, d, rounded, maxCoordinateDecimals)
+				*value = rounded
+			}
+		}
+		coordinate("lat", &e.loc.Lat, 90)
+		coordinate("long", &e.loc.Long, 180)
+		if loc.Altitude != nil && (*loc.Altitude < minAltitude || *loc.Altitude > maxAltitude) {
+			problems.add(e.where("altitude"), id, "altitude must be between %v and %v meters, not %v", minAltitude, maxAltitude, *loc.Altitude)
+		}
+		if loc.Timezone != "" {
+			if _, err := time.LoadLocation(loc.Timezone); err != nil {
+				problems.add(e.where("timezone"), id, "unknown timezone '%s'", loc.Timezone)
+			}
+		}
+		for k := range loc.Tags {
+			if strings.TrimSpace(k) == "" {
+				problems.add(e.where("tags"), id, "tag names can't be empty")
+			}
+		}
+	}
+	return problems
+}
+
+func roundCoordinate(v float64) float64 {
+	scale := math.Pow10(maxCoordinateDecimals)
+	return math.Round(v*scale) / scale
+}
+
+// decimals is the number of decimals written in a number.
+func decimals(literal string) int {
+	literal = strings.ToLower(literal)
+	if strings.Contains(literal, "e") {
+		// Rare enough to not care about, the value is checked anyway.
+		return 0
+	}
+	dot := strings.IndexByte(literal, '.')
+	if dot < 0 {
+		return 0
+	}
+	return len(literal) - dot - 1
+}
+
+// jsonScanner reads JSON token by token, to know where things are.
+type jsonScanner struct {
+	raw      []byte
+	problems LocationProblems
+}
+
+// position is the line and column of an offset in the file.
+func (s *jsonScanner) position(offset int) position {
+	if offset > len(s.raw) {
+		offset = len(s.raw)
+	}
+	before := s.raw[:offset]
+	return position{
+		line:   bytes.Count(before, []byte("\n")) + 1,
+		column: offset - bytes.LastIndexByte(before, '\n'),
+	}
+}
+
+// skip moves an offset past whitespace and the separators the decoder has yet to read.
+func (s *jsonScanner) skip(offset int) int {
+	for offset < len(s.raw) {
+		switch s.raw[offset] {
+		case ' ', '\t', '\n', '\r', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// addError reports a decoding error where it happened, if the error says.
+func (s *jsonScanner) addError(err error, fallback int) {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// The offset is after the byte that is wrong.
+		s.problems.add(s.position(int(e.Offset)-1), "", "%s", e.Error())
+	default:
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			s.problems.add(s.position(len(s.raw)), "", "unexpected end of JSON input")
+			return
+		}
+		s.problems.add(s.position(fallback), "", "%s", err.Error())
+	}
+}
+
+// array calls element with the offset and raw JSON of every element of the array the
+// decoder is at. base is the offset of what the decoder reads in the file, and notArray
+// the problem if it isn't an array.
+func (s *jsonScanner) array(decoder *json.Decoder, base int, notArray string, element func(offset int, raw json.RawMessage)) bool {
+	start := s.skip(base + int(decoder.InputOffset()))
+	token, err := decoder.Token()
+	if err != nil {
+		s.addError(err, start)
+		return false
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		s.problems.add(s.position(start), "", "%s", notArray)
+		return false
+	}
+	for decoder.More() {
+		offset := s.skip(base + int(decoder.InputOffset()))
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			s.addError(err, offset)
+			return false
+		}
+		element(offset, raw)
+	}
+	if _, err := decoder.Token(); err != nil {
+		s.addError(err, len(s.raw))
+		return false
+	}
+	return true
+}
+
+// object calls field with the name, the offsets of the name and the value, and the raw
+// JSON of every field of the object at the offset. It is false if it isn't an object.
+func (s *jsonScanner) object(raw json.RawMessage, base int, field func(name string, offset int, valueOffset int, value json.RawMessage)) bool {
+	if len(raw) == 0 || raw[0] != '{' {
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.Token()
+	seen := make(map[string]bool)
+	for decoder.More() {
+		offset := s.skip(base + int(decoder.InputOffset()))
+		token, err := decoder.Token()
+		if err != nil {
+			return true
+		}
+		name, _ := token.(string)
+		valueOffset := s.skip(base + int(decoder.InputOffset()))
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return true
+		}
+		if seen[name] {
+			s.problems.add(s.position(offset), "", "%s is given twice", name)
+		}
+		seen[name] = true
+		field(name, offset, valueOffset, value)
+	}
+	return true
+}
+
+// set decodes a field of a location, telling what is wrong if it can't.
+func (s *jsonScanner) set(e *locationEntry, name string, offset int, value json.RawMessage) {
+	target := locationField(&e.loc, name)
+	if target == nil {
+		s.problems.add(s.position(offset), e.loc.Id, "unknown field \"%s\"", name)
+		return
+	}
+	e.fields[name] = s.position(offset)
+	if err := json.Unmarshal(value, target); err != nil {
+		s.problems.add(s.position(offset), e.loc.Id, "%s must be a %s, not %s", name,
+			typeName(reflect.TypeOf(target)), jsonKind(value))
+		return
+	}
+	if jsonKind(value) == "number" {
+		e.numbers[name] = string(value)
+	}
+}
+
+// jsonKind is the kind of a JSON value, like "string".
+func jsonKind(value json.RawMessage) string {
+	switch {
+	case len(value) == 0:
+		return "nothing"
+	case value[0] == '"':
+		return "string"
+	case value[0] == '{':
+		return "object"
+	case value[0] == '[':
+		return "array"
+	case value[0] == 't' || value[0] == 'f':
+		return "boolean"
+	case value[0] == 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// location reads a location from an element of the array.
+func (s *jsonScanner) location(offset int, raw json.RawMessage) *locationEntry {
+	e := newLocationEntry(s.position(offset))
+	// The id first, so the other problems can tell which location they are about.
+	var id struct {
+		Id string `json:"id"`
+	}
+	json.Unmarshal(raw, &id)
+	e.loc.Id = id.Id
+	if !s.object(raw, offset, func(name string, offset int, _ int, value json.RawMessage) {
+		s.set(e, name, offset, value)
+	}) {
+		s.problems.add(e.at, "", "a location must be a JSON object")
+		return nil
+	}
+	return e
+}
+
+// parseJSONLocations reads a JSON array of locations.
+func parseJSONLocations(raw []byte) ([]*locationEntry, LocationProblems) {
+	s := &jsonScanner{raw: raw}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	var entries []*locationEntry
+	ok := s.array(decoder, 0, "the file must be a JSON array of locations", func(offset int, element json.RawMessage) {
+		if e := s.location(offset, element); e != nil {
+			entries = append(entries, e)
+		}
+	})
+	if ok {
+		if _, err := decoder.Token(); err != io.EOF {
+			s.problems.add(s.position(s.skip(int(decoder.InputOffset()))), "", "unexpected data after the array of locations")
+		}
+	}
+	return entries, s.problems
+}
+
+// checkLocations finds all the problems in a JSON location file, nil if there are none.
+func checkLocations(raw []byte) LocationProblems {
+	entries, problems := parseJSONLocations(raw)
+	return append(problems, checkEntries(entries)...).sorted()
+}
+
+// ValidateLocationFile checks a location file, returning the number of locations in it.
+// The error is LocationProblems if the file could be read but has problems.
+func ValidateLocationFile(path string) (int, error) {
+	locs, err := readLocationsFromPath(path)
+	return len(locs), err
+}
@@ -0,0 +1,74 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_checkLocations(t *testing.T) {
+	const file = `[
+  { "id": "tryvannstua", "lat": 59.9981, "long": 10.6661 },
+  { "id": "Skrindo Hemsedal", "lat": 60.6605926, "long": 8.5741 },
+  { "id": "tryvannstua", "lat": 95, "long": 10.6661, "altitude": 12000 },
+  { "id": "", "lat": 60.1, "long": 10.1, "timezone": "Europe/Hemsedal" },
+  { "lat": 60.1, "long": "10.1", "colour": "red" },
+  { "id": "met", "lat": 59.9427 }
+]`
+	problems := checkLocations([]byte(file))
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	assert.Equal(t, []string{
+		"3:5: Skrindo Hemsedal: id must be lowercase letters, digits, - and _, starting with a letter or digit",
+		"4:5: tryvannstua: duplicate id, also used on line 2",
+		"4:26: tryvannstua: lat must be between -90 and 90, not 95",
+		"4:54: tryvannstua: altitude must be between -500 and 9000 meters, not 12000",
+		"5:5: id is empty",
+		"5:42: unknown timezone 'Europe/Hemsedal'",
+		"6:3: id is missing",
+		"6:18: long must be a number, not string",
+		"6:34: unknown field \"colour\"",
+		"7:3: met: long is missing",
+	}, got)
+	assert.Equal(t, LocationProblem{Line: 6, Column: 3, Message: "id is missing"}, problems[6])
+	assert.Nil(t, checkLocations([]byte(locationFileExample())))
+}
+
+func Test_checkEntriesRounds(t *testing.T) {
+	entries, problems := parseJSONLocations([]byte(`[{ "id": "tryvannstua", "lat": 59.9981362, "long": 10.6660856 }]`))
+	assert.Nil(t, problems)
+	assert.Nil(t, checkEntries(entries), "more decimals than api.met.no wants is only a warning")
+	assert.Equal(t, 59.9981, entries[0].loc.Lat)
+	assert.Equal(t, 10.6661, entries[0].loc.Long)
+}
+
+func Test_checkLocationsSyntax(t *testing.T) {
+	problems := checkLocations([]byte("[\n  { \"id\": \"met\" \"lat\": 59.9 }\n]"))
+	assert.Len(t, problems, 1)
+	assert.Equal(t, 2, problems[0].Line)
+	assert.Contains(t, problems[0].Message, "invalid character")
+
+	problems = checkLocations([]byte(`{"id": "met"}`))
+	assert.Equal(t, "1:1: the file must be a JSON array of locations", problems[0].String())
+
+	problems = checkLocations([]byte("[\n  {\"id\": \"met\", \"lat\": 59.9, \"long\": 10.7}\n"))
+	assert.Equal(t, "unexpected end of JSON input", problems[0].Message)
+}
+
+func Test_ValidateLocationFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locations.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(locationFileExample()), 0o644))
+	n, err := ValidateLocationFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(strings.Replace(locationFileExample(), "skrindo", "tryvannstua", 1)), 0o644))
+	_, err = ValidateLocationFile(path)
+	problems, ok := err.(LocationProblems)
+	assert.True(t, ok)
+	assert.Len(t, problems, 1)
+}
@@ -1,49 +1,111 @@
 package yrsensor
 
 import (
-	"encoding/json"
 	log "github.com/sirupsen/logrus"
-	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
-func readLocations(locationsFile io.Reader) ([]Location, error) {
-	var data []Location
-	decoder := json.NewDecoder(locationsFile)
-	decoder.DisallowUnknownFields() // force errors on unknown fields.
-	err := decoder.Decode(&data)
-	return data, err
+// enabled is false for locations that are set to "enabled": false.
+func (loc Location) enabled() bool {
+	return loc.Enabled == nil || *loc.Enabled
+}
+
+// enabledLocations leaves out the locations that are disabled.
+func enabledLocations(locs []Location) []Location {
+	enabled := make([]Location, 0, len(locs))
+	for _, loc := range locs {
+		if loc.enabled() {
+			enabled = append(enabled, loc)
+		} else {
+			log.Infof("location %s is disabled, not polling it", loc.Id)
+		}
+	}
+	return enabled
+}
+
+// displayName is the name of a location, or its id if it hasn't got one.
+func (loc Location) displayName() string {
+	if loc.Name != "" {
+		return loc.Name
+	}
+	return loc.Id
 }
 
+// readLocationsFromPath reads a location file in the format of its extension: .yaml or .yml,
+// .csv, .geojson or else JSON.
 func readLocationsFromPath(locationFilePath string) ([]Location, error) {
 	var data []Location
 	locationsFile, err := os.Open(locationFilePath)
 	if err != nil {
 		return data, err
 	}
-	data, err = readLocations(locationsFile)
+	defer func() {
+		if err := locationsFile.Close(); err != nil {
+			log.Panicf("closing file: %v", err.Error())
+		}
+	}()
+	raw, err := ioutil.ReadAll(locationsFile)
 	if err != nil {
 		return nil, err
 	}
-	err = locationsFile.Close()
-	if err != nil {
-		log.Panicf("closing file: %v", err.Error())
+	entries, problems := parseLocations(filepath.Ext(locationFilePath), raw)
+	problems = append(problems, checkEntries(entries)...).sorted()
+	for _, e := range entries {
+		data = append(data, e.loc)
+	}
+	if problems != nil {
+		return data, problems
 	}
 	return data, nil
 }
 
+// writeLocationFile writes the locations to the location file, in its format. The file is
+// replaced atomically so the daemon can be restarted with it at any time.
+func writeLocationFile(locationFilePath string, locs []Location) error {
+	data, err := encodeLocations(filepath.Ext(locationFilePath), locs)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(locationFilePath), filepath.Base(locationFilePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if info, err := os.Stat(locationFilePath); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	return os.Rename(tmp.Name(), locationFilePath)
+}
+
 func locationFileExample() string {
 	return `
 [
   {
     "id": "tryvannstua",
-    "lat": 59.9981362,
-    "long": 10.6660856
+    "lat": 59.9981,
+    "long": 10.6661
   },
   {
     "id": "skrindo",
-    "lat": 60.6605926,
-    "long": 8.5740604
+    "name": "Skrindo, Hemsedal",
+    "lat": 60.6606,
+    "long": 8.5741,
+    "altitude": 920,
+    "timezone": "Europe/Oslo",
+    "tags": { "region": "hallingdal" }
   }
 ]
 `
@@ -2,13 +2,21 @@ package yrsensor
 
 import (
 	"fmt"
-	"io"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
-	"strings"
 	"testing"
 )
 
-func Test_readLocations(t *testing.T) {
+// readTestLocations reads a JSON location file with the content given.
+func readTestLocations(t *testing.T, content string) ([]Location, error) {
+	path := filepath.Join(t.TempDir(), "locations.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0o644))
+	return readLocationsFromPath(path)
+}
+
+func Test_readLocationsFromPath(t *testing.T) {
 
 	const norm = `[
   {
@@ -49,62 +57,95 @@ func Test_readLocations(t *testing.T) {
 
 	tests := []struct {
 		name    string
-		args    io.Reader
+		args    string
 		want    []Location
 		wantErr bool
 	}{
 		{
 			name: "normal",
-			args: strings.NewReader(norm),
+			args: norm,
 			want: []Location{
 				{
 					Id:   "tryvannstua",
-					Lat:  59.9981362,
-					Long: 10.6660856,
+					Lat:  59.9981,
+					Long: 10.6661,
 				},
 				{
 					Id:   "skrindo",
-					Lat:  60.6605926,
-					Long: 8.5740604,
+					Lat:  60.6606,
+					Long: 8.5741,
 				},
 			},
 			wantErr: false,
 		},
 		{
 			name: "invalid field",
-			args: strings.NewReader(invalidField),
+			args: invalidField,
 			want: []Location{
 				{
-					Lat:  59.9981362,
-					Long: 10.6660856,
+					Lat:  59.9981,
+					Long: 10.6661,
 				},
 				{
 					Id:   "skrindo",
-					Lat:  60.6605926,
-					Long: 8.5740604,
+					Lat:  60.6606,
+					Long: 8.5741,
 				},
 			},
 			wantErr: true,
 		}, {
 			name:    "invalid JSON syntax",
-			args:    strings.NewReader(invalidSyntax),
+			args:    invalidSyntax,
 			want:    nil,
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := readLocations(tt.args)
+			got, err := readTestLocations(t, tt.args)
 			if err != nil {
-				fmt.Printf("Error (handled) from readLocations: %v\n", err.Error())
+				fmt.Printf("Error (handled) from readLocationsFromPath: %v\n", err.Error())
 			}
 			if (err != nil) != tt.wantErr {
-				t.Errorf("readLocations() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("readLocationsFromPath() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("readLocations() got = %v, want %v", got, tt.want)
+				t.Errorf("readLocationsFromPath() got = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_readLocationsMetadata(t *testing.T) {
+	const metadata = `[
+  {
+    "id": "skrindo",
+    "name": "Skrindo, Hemsedal",
+    "lat": 60.6605926,
+    "long": 8.5740604,
+    "altitude": 920,
+    "timezone": "Europe/Oslo",
+    "tags": { "region": "hallingdal" }
+  },
+  {
+    "id": "tryvannstua",
+    "lat": 59.9981362,
+    "long": 10.6660856,
+    "enabled": false
+  }
+]`
+	locs, err := readTestLocations(t, metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, "Skrindo, Hemsedal", locs[0].displayName())
+	assert.Equal(t, 920.0, *locs[0].Altitude)
+	assert.Equal(t, "Europe/Oslo", locs[0].Timezone)
+	assert.Equal(t, "hallingdal", locs[0].Tags["region"])
+	assert.Equal(t, "tryvannstua", locs[1].displayName())
+	enabled := enabledLocations(locs)
+	assert.Len(t, enabled, 1)
+	assert.Equal(t, "skrindo", enabled[0].Id)
+
+	_, err = readTestLocations(t, `[{"id": "skrindo", "lat": 60.6, "long": 8.5, "timezone": "Europe/Hemsedal"}]`)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,492 @@
+package yrsensor
+
+/*
+  The location file in other formats than a JSON array, chosen by the extension:
+
+    .yaml, .yml  A list of locations with the same fields as the JSON file.
+    .csv         A header with the field names, tags as "tag:<name>" columns.
+    .geojson     A FeatureCollection of Points, like QGIS exports it. The id and the other
+                 fields are properties, the properties that aren't fields become tags.
+
+  They are read into the same entries as the JSON file, and checked the same way, and written
+  back in the same format when the location API changes them.
+*/
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// csvTagPrefix starts the name of a CSV column that is a tag.
+const csvTagPrefix = "tag:"
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// yamlKind is the kind of a YAML value, like "string".
+func yamlKind(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "mapping"
+	case yaml.SequenceNode:
+		return "list"
+	}
+	switch n.ShortTag() {
+	case "!!str":
+		return "string"
+	case "!!int", "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	case "!!null":
+		return "null"
+	}
+	return strings.TrimPrefix(n.ShortTag(), "!!")
+}
+
+// parseYAMLLocations reads a YAML list of locations.
+func parseYAMLLocations(raw []byte) ([]*locationEntry, LocationProblems) {
+	var problems LocationProblems
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		line := 1
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		problems.add(position{line: line, column: 1}, "", "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+		return nil, problems
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.SequenceNode {
+		problems.add(position{root.Line, root.Column}, "", "the file must be a YAML list of locations")
+		return nil, problems
+	}
+	var entries []*locationEntry
+	for _, item := range root.Content {
+		e := newLocationEntry(position{item.Line, item.Column})
+		if item.Kind != yaml.MappingNode {
+			problems.add(e.at, "", "a location must be a mapping")
+			continue
+		}
+		// The id first, so the other problems can tell which location they are about.
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if item.Content[i].Value == "id" {
+				item.Content[i+1].Decode(&e.loc.Id)
+			}
+		}
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			key, value := item.Content[i], item.Content[i+1]
+			at := position{key.Line, key.Column}
+			target := locationField(&e.loc, key.Value)
+			if target == nil {
+				problems.add(at, e.loc.Id, "unknown field \"%s\"", key.Value)
+				continue
+			}
+			if _, seen := e.fields[key.Value]; seen {
+				problems.add(at, e.loc.Id, "%s is given twice", key.Value)
+			}
+			e.fields[key.Value] = at
+			if err := value.Decode(target); err != nil {
+				problems.add(at, e.loc.Id, "%s must be a %s, not %s", key.Value, typeName(reflect.TypeOf(target)), yamlKind(value))
+				continue
+			}
+			if yamlKind(value) == "number" {
+				e.numbers[key.Value] = value.Value
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, problems
+}
+
+// setText sets a field of a location from text, telling what is wrong if it can't.
+func setText(e *locationEntry, name string, text string) error {
+	switch target := locationField(&e.loc, name).(type) {
+	case *string:
+		*target = text
+	case *float64:
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, not '%s'", name, text)
+		}
+		*target = v
+		e.numbers[name] = text
+	case **float64:
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a number, not '%s'", name, text)
+		}
+		*target = &v
+	case **bool:
+		v, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, not '%s'", name, text)
+		}
+		*target = &v
+	default:
+		return fmt.Errorf("%s can't be a column", name)
+	}
+	return nil
+}
+
+// parseCSVLocations reads locations from CSV with a header. Empty cells aren't given,
+// except the id.
+func parseCSVLocations(raw []byte) ([]*locationEntry, LocationProblems) {
+	var problems LocationProblems
+	addError := func(err error) {
+		if e, ok := err.(*csv.ParseError); ok {
+			problems.add(position{e.Line, e.Column}, "", "%s", e.Err.Error())
+			return
+		}
+		problems.add(position{1, 1}, "", "%s", err.Error())
+	}
+	r := csv.NewReader(bytes.NewReader(raw))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		addError(err)
+		return nil, problems
+	}
+	columns := make([]string, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		columns[i] = name
+		line, column := r.FieldPos(i)
+		if strings.HasPrefix(name, csvTagPrefix) && len(name) > len(csvTagPrefix) {
+			continue
+		}
+		if name == "tags" || locationField(&Location{}, name) == nil {
+			problems.add(position{line, column}, "", "unknown column \"%s\", tags are columns named %s<name>", name, csvTagPrefix)
+			columns[i] = ""
+		}
+	}
+	var entries []*locationEntry
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			addError(err)
+			break
+		}
+		line, column := r.FieldPos(0)
+		e := newLocationEntry(position{line, column})
+		for i, name := range columns {
+			if name == "id" && i < len(record) {
+				e.loc.Id = strings.TrimSpace(record[i])
+			}
+		}
+		if len(record) != len(columns) {
+			problems.add(e.at, e.loc.Id, "has %d columns, the header has %d", len(record), len(columns))
+		}
+		for i, value := range record {
+			if i >= len(columns) || columns[i] == "" {
+				continue
+			}
+			name := columns[i]
+			value = strings.TrimSpace(value)
+			line, column := r.FieldPos(i)
+			at := position{line, column}
+			if value == "" && name != "id" {
+				continue
+			}
+			if strings.HasPrefix(name, csvTagPrefix) {
+				if e.loc.Tags == nil {
+					e.loc.Tags = make(map[string]string)
+					e.fields["tags"] = at
+				}
+				e.loc.Tags[strings.TrimPrefix(name, csvTagPrefix)] = value
+				continue
+			}
+			e.fields[name] = at
+			if err := setText(e, name, value); err != nil {
+				problems.add(at, e.loc.Id, "%s", err.Error())
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, problems
+}
+
+// geoJSONTag turns a property that isn't a field into a tag value.
+func geoJSONTag(value json.RawMessage) (string, bool) {
+	switch jsonKind(value) {
+	case "string":
+		var s string
+		json.Unmarshal(value, &s)
+		return s, true
+	case "number", "boolean":
+		return string(value), true
+	}
+	return "", false
+}
+
+// feature reads a location from a GeoJSON Feature with a Point.
+func (s *jsonScanner) feature(offset int, raw json.RawMessage) *locationEntry {
+	e := newLocationEntry(s.position(offset))
+	var coordinates []json.Number
+	var coordinatesAt int
+	var properties json.RawMessage
+	var propertiesAt int
+	if !s.object(raw, offset, func(name string, offset int, valueOffset int, value json.RawMessage) {
+		switch name {
+		case "type":
+			var t string
+			json.Unmarshal(value, &t)
+			if t != "Feature" {
+				s.problems.add(s.position(offset), "", "type must be Feature, not %s", string(value))
+			}
+		case "properties":
+			properties, propertiesAt = value, valueOffset
+		case "geometry":
+			var geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			}
+			if err := json.Unmarshal(value, &geometry); err != nil {
+				s.problems.add(s.position(offset), "", "geometry must be a JSON object")
+				return
+			}
+			if geometry.Type != "Point" {
+				s.problems.add(s.position(offset), "", "only Point geometries are supported, not %s", geometry.Type)
+				return
+			}
+			decoder := json.NewDecoder(bytes.NewReader(geometry.Coordinates))
+			decoder.UseNumber()
+			if err := decoder.Decode(&coordinates); err != nil || coordinates == nil {
+				s.problems.add(s.position(offset), "", "a Point must have [long, lat] coordinates")
+				return
+			}
+			coordinatesAt = offset
+		}
+	}) {
+		s.problems.add(e.at, "", "a feature must be a JSON object")
+		return nil
+	}
+
+	// The id first, so the other problems can tell which location they are about.
+	var id struct {
+		Id string `json:"id"`
+	}
+	json.Unmarshal(properties, &id)
+	e.loc.Id = id.Id
+	if properties != nil && !s.object(properties, propertiesAt, func(name string, offset int, _ int, value json.RawMessage) {
+		if name == "lat" || name == "long" {
+			s.problems.add(s.position(offset), e.loc.Id, "%s is taken from the geometry, not the properties", name)
+			return
+		}
+		if locationField(&e.loc, name) != nil {
+			s.set(e, name, offset, value)
+			return
+		}
+		tag, ok := geoJSONTag(value)
+		if !ok {
+			if jsonKind(value) != "null" {
+				s.problems.add(s.position(offset), e.loc.Id, "property %s can't be a tag, only strings, numbers and booleans can", name)
+			}
+			return
+		}
+		if e.loc.Tags == nil {
+			e.loc.Tags = make(map[string]string)
+			e.fields["tags"] = s.position(offset)
+		}
+		e.loc.Tags[name] = tag
+	}) {
+		s.problems.add(s.position(propertiesAt), e.loc.Id, "properties must be a JSON object")
+	}
+
+	if coordinates != nil {
+		at := s.position(coordinatesAt)
+		if len(coordinates) < 2 || len(coordinates) > 3 {
+			s.problems.add(at, e.loc.Id, "a Point has [long, lat] or [long, lat, altitude] coordinates, not %d", len(coordinates))
+			return e
+		}
+		names := []string{"long", "lat", "altitude"}
+		for i, c := range coordinates {
+			if names[i] == "altitude" && e.loc.Altitude != nil {
+				continue // The altitude property wins.
+			}
+			e.fields[names[i]] = at
+			if err := setText(e, names[i], c.String()); err != nil {
+				s.problems.add(at, e.loc.Id, "%s", err.Error())
+			}
+		}
+	}
+	return e
+}
+
+// parseGeoJSONLocations reads a GeoJSON FeatureCollection of Points.
+func parseGeoJSONLocations(raw []byte) ([]*locationEntry, LocationProblems) {
+	s := &jsonScanner{raw: raw}
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		s.addError(err, 0)
+		return nil, s.problems
+	}
+	var entries []*locationEntry
+	isCollection := false
+	if !s.object(raw, 0, func(name string, offset int, valueOffset int, value json.RawMessage) {
+		switch name {
+		case "type":
+			var t string
+			json.Unmarshal(value, &t)
+			isCollection = t == "FeatureCollection"
+		case "features":
+			decoder := json.NewDecoder(bytes.NewReader(value))
+			s.array(decoder, valueOffset, "features must be a JSON array", func(offset int, feature json.RawMessage) {
+				if e := s.feature(offset, feature); e != nil {
+					entries = append(entries, e)
+				}
+			})
+		}
+	}) || !isCollection {
+		s.problems.add(s.position(s.skip(0)), "", "the file must be a GeoJSON FeatureCollection")
+	}
+	return entries, s.problems
+}
+
+// parseLocations reads a location file in the format of its extension, JSON if it is
+// none of the others.
+func parseLocations(extension string, raw []byte) ([]*locationEntry, LocationProblems) {
+	switch strings.ToLower(extension) {
+	case ".yaml", ".yml":
+		return parseYAMLLocations(raw)
+	case ".csv":
+		return parseCSVLocations(raw)
+	case ".geojson":
+		return parseGeoJSONLocations(raw)
+	}
+	return parseJSONLocations(raw)
+}
+
+// csvColumns are the columns of a CSV location file, before the tags.
+var csvColumns = []string{"id", "name", "lat", "long", "altitude", "timezone", "provider", "enabled"}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// encodeCSVLocations writes the locations as CSV, with a column for every tag.
+func encodeCSVLocations(locs []Location) ([]byte, error) {
+	tagSet := make(map[string]bool)
+	for _, loc := range locs {
+		for k := range loc.Tags {
+			tagSet[k] = true
+		}
+	}
+	tags := make([]string, 0, len(tagSet))
+	for k := range tagSet {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	header := append([]string{}, csvColumns...)
+	for _, k := range tags {
+		header = append(header, csvTagPrefix+k)
+	}
+	w.Write(header)
+	for _, loc := range locs {
+		record := []string{loc.Id, loc.Name, formatFloat(loc.Lat), formatFloat(loc.Long), "", loc.Timezone, loc.Provider, ""}
+		if loc.Altitude != nil {
+			record[4] = formatFloat(*loc.Altitude)
+		}
+		if loc.Enabled != nil {
+			record[7] = strconv.FormatBool(*loc.Enabled)
+		}
+		for _, k := range tags {
+			record = append(record, loc.Tags[k])
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// encodeGeoJSONLocations writes the locations as a FeatureCollection of Points. The tags are
+// properties, so they can't have the name of a field.
+func encodeGeoJSONLocations(locs []Location) ([]byte, error) {
+	type point struct {
+		Type        string    `json:"type"`
+		Coordinates []float64 `json:"coordinates"`
+	}
+	type feature struct {
+		Type       string                 `json:"type"`
+		Geometry   point                  `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	collection := struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}{Type: "FeatureCollection", Features: make([]feature, 0, len(locs))}
+	for _, loc := range locs {
+		f := feature{
+			Type:       "Feature",
+			Geometry:   point{Type: "Point", Coordinates: []float64{loc.Long, loc.Lat}},
+			Properties: map[string]interface{}{"id": loc.Id},
+		}
+		if loc.Altitude != nil {
+			f.Geometry.Coordinates = append(f.Geometry.Coordinates, *loc.Altitude)
+		}
+		for k, v := range loc.Tags {
+			if locationField(&Location{}, k) != nil {
+				return nil, fmt.Errorf("%s: the tag %s can't be written to GeoJSON, it is the name of a field", loc.Id, k)
+			}
+			f.Properties[k] = v
+		}
+		if loc.Name != "" {
+			f.Properties["name"] = loc.Name
+		}
+		if loc.Timezone != "" {
+			f.Properties["timezone"] = loc.Timezone
+		}
+		if loc.Provider != "" {
+			f.Properties["provider"] = loc.Provider
+		}
+		if loc.Enabled != nil {
+			f.Properties["enabled"] = *loc.Enabled
+		}
+		collection.Features = append(collection.Features, f)
+	}
+	data, err := json.MarshalIndent(collection, "", "  ")
+	return append(data, '\n'), err
+}
+
+// encodeLocations writes the locations in the format of the extension, JSON if it is none of
+// the others. Comments and the order of the fields in the file aren't kept.
+func encodeLocations(extension string, locs []Location) ([]byte, error) {
+	switch strings.ToLower(extension) {
+	case ".yaml", ".yml":
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(locs); err != nil {
+			return nil, err
+		}
+		err := encoder.Close()
+		return buf.Bytes(), err
+	case ".csv":
+		return encodeCSVLocations(locs)
+	case ".geojson":
+		return encodeGeoJSONLocations(locs)
+	}
+	data, err := json.MarshalIndent(locs, "", "  ")
+	return append(data, '\n'), err
+}
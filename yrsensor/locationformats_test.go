@@ -0,0 +1,162 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// formatProblems checks a location file in a format the way readLocationsFromPath does.
+func formatProblems(extension string, file string) ([]Location, []string) {
+	entries, problems := parseLocations(extension, []byte(file))
+	problems = append(problems, checkEntries(entries)...).sorted()
+	var locs []Location
+	for _, e := range entries {
+		locs = append(locs, e.loc)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	return locs, got
+}
+
+func Test_parseYAMLLocations(t *testing.T) {
+	locs, problems := formatProblems(".yaml", `
+- id: tryvannstua
+  lat: 59.9981
+  long: 10.6661
+- id: skrindo
+  name: Skrindo, Hemsedal
+  lat: 60.6606
+  long: 8.5741
+  altitude: 920
+  enabled: false
+  tags:
+    region: hallingdal
+    lift: 3
+`)
+	assert.Nil(t, problems)
+	assert.Len(t, locs, 2)
+	assert.Equal(t, 8.5741, locs[1].Long)
+	assert.Equal(t, 920.0, *locs[1].Altitude)
+	assert.False(t, locs[1].enabled())
+	assert.Equal(t, map[string]string{"region": "hallingdal", "lift": "3"}, locs[1].Tags)
+
+	_, problems = formatProblems(".yml", `
+- id: tryvannstua
+  lat: 59.99812
+  long: "10.6661"
+  colour: red
+- id: tryvannstua
+  lat: 95
+`)
+	assert.Equal(t, []string{
+		"4:3: tryvannstua: long must be a number, not string",
+		"5:3: tryvannstua: unknown field \"colour\"",
+		"6:3: tryvannstua: duplicate id, also used on line 2",
+		"6:3: tryvannstua: long is missing",
+		"7:3: tryvannstua: lat must be between -90 and 90, not 95",
+	}, problems)
+
+	_, problems = formatProblems(".yaml", "id: tryvannstua\n")
+	assert.Equal(t, []string{"1:1: the file must be a YAML list of locations"}, problems)
+	_, problems = formatProblems(".yaml", "- id: [tryvannstua\n")
+	assert.Len(t, problems, 1)
+}
+
+func Test_parseCSVLocations(t *testing.T) {
+	locs, problems := formatProblems(".csv", `# The ski resorts.
+id,name,lat,long,altitude,tag:region
+tryvannstua,,59.9981,10.6661,,oslo
+skrindo,"Skrindo, Hemsedal",60.6606,8.5741,920,hallingdal
+`)
+	assert.Nil(t, problems)
+	assert.Len(t, locs, 2)
+	assert.Nil(t, locs[0].Altitude)
+	assert.Equal(t, "Skrindo, Hemsedal", locs[1].Name)
+	assert.Equal(t, 60.6606, locs[1].Lat)
+	assert.Equal(t, map[string]string{"region": "hallingdal"}, locs[1].Tags)
+
+	_, problems = formatProblems(".csv", `id,lat,long,colour,enabled
+tryvannstua,59.99812,ten,red,yes
+,60.1,10.1,,
+met,59.9
+`)
+	assert.Equal(t, []string{
+		"1:13: unknown column \"colour\", tags are columns named tag:<name>",
+		"2:22: tryvannstua: long must be a number, not 'ten'",
+		"2:30: tryvannstua: enabled must be true or false, not 'yes'",
+		"3:1: id is empty",
+		"4:1: met: has 2 columns, the header has 5",
+		"4:1: met: long is missing",
+	}, problems)
+}
+
+func Test_parseGeoJSONLocations(t *testing.T) {
+	locs, problems := formatProblems(".geojson", `{
+  "type": "FeatureCollection",
+  "features": [
+    { "type": "Feature",
+      "geometry": { "type": "Point", "coordinates": [10.6661, 59.9981, 529] },
+      "properties": { "id": "tryvannstua", "region": "oslo", "lifts": 4, "lit": true, "note": null } },
+    { "type": "Feature",
+      "geometry": { "type": "Point", "coordinates": [8.5741, 60.6606, 600] },
+      "properties": { "id": "skrindo", "name": "Skrindo, Hemsedal", "altitude": 920 } }
+  ]
+}`)
+	assert.Nil(t, problems)
+	assert.Len(t, locs, 2)
+	assert.Equal(t, 59.9981, locs[0].Lat)
+	assert.Equal(t, 10.6661, locs[0].Long)
+	assert.Equal(t, 529.0, *locs[0].Altitude)
+	assert.Equal(t, map[string]string{"region": "oslo", "lifts": "4", "lit": "true"}, locs[0].Tags)
+	assert.Equal(t, 920.0, *locs[1].Altitude, "the altitude property wins")
+
+	_, problems = formatProblems(".geojson", `{
+  "type": "FeatureCollection",
+  "features": [
+    { "type": "Feature",
+      "geometry": { "type": "Point", "coordinates": [10.66612, 95] },
+      "properties": { "id": "tryvannstua", "lat": 59.9, "lifts": [1, 2] } },
+    { "type": "Feature",
+      "geometry": { "type": "LineString", "coordinates": [[8.5, 60.6], [8.6, 60.7]] },
+      "properties": { "id": "skrindo" } }
+  ]
+}`)
+	assert.Equal(t, []string{
+		"5:7: tryvannstua: lat must be between -90 and 90, not 95",
+		"6:44: tryvannstua: lat is taken from the geometry, not the properties",
+		"6:57: tryvannstua: property lifts can't be a tag, only strings, numbers and booleans can",
+		"7:5: skrindo: lat is missing",
+		"7:5: skrindo: long is missing",
+		"8:7: only Point geometries are supported, not LineString",
+	}, problems)
+
+	_, problems = formatProblems(".geojson", `[{"id": "met"}]`)
+	assert.Equal(t, []string{"1:1: the file must be a GeoJSON FeatureCollection"}, problems)
+}
+
+func Test_readLocationsFromPathFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"locations.json":    locationFileExample(),
+		"locations.YAML":    "- {id: met, lat: 59.9427, long: 10.7207}\n",
+		"locations.csv":     "id,lat,long\nmet,59.9427,10.7207\n",
+		"locations.geojson": `{"type": "FeatureCollection", "features": [{"type": "Feature", "geometry": {"type": "Point", "coordinates": [10.7207, 59.9427]}, "properties": {"id": "met"}}]}`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0o644))
+		locs, err := readLocationsFromPath(path)
+		assert.Nil(t, err, name)
+		assert.NotEmpty(t, locs, name)
+	}
+
+	path := filepath.Join(dir, "bad.csv")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("id,lat,long\nmet,59.9427\n"), 0o644))
+	_, err := readLocationsFromPath(path)
+	_, ok := err.(LocationProblems)
+	assert.True(t, ok)
+}
@@ -0,0 +1,113 @@
+package yrsensor
+
+import (
+	"github.com/perbu/yrpoller/sink/otlp"
+	"github.com/perbu/yrpoller/statushttp"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// daemonMetrics turns the daemon status into OTLP metrics. The pollers are a resource per
+// location, with the same attributes as the weather values. The rest is about the daemon.
+func daemonMetrics(status statushttp.DaemonStatus, locations Locations, now time.Time) []otlp.Resource {
+	start := status.RunningSince
+	counter := func(name, unit, description string, value uint64) otlp.Metric {
+		return otlp.Metric{Name: name, Unit: unit, Description: description, Kind: otlp.Counter, Start: start,
+			Points: []otlp.Point{{Time: now, Value: float64(value)}}}
+	}
+	gauge := func(name, unit, description string, value float64) otlp.Metric {
+		return otlp.Metric{Name: name, Unit: unit, Description: description, Kind: otlp.Gauge,
+			Points: []otlp.Point{{Time: now, Value: value}}}
+	}
+	byReason := func(name, unit, description string, counts map[string]uint64) otlp.Metric {
+		m := otlp.Metric{Name: name, Unit: unit, Description: description, Kind: otlp.Counter, Start: start}
+		for reason, n := range counts {
+			m.Points = append(m.Points, otlp.Point{Time: now, Attributes: map[string]string{"reason": reason}, Value: float64(n)})
+		}
+		return m
+	}
+
+	var resources []otlp.Resource
+	for _, loc := range locations.Locations {
+		p, ok := status.Pollers[loc.Id]
+		if !ok {
+			continue
+		}
+		metrics := []otlp.Metric{
+			counter("yrpoller.polls", "{request}", "Requests to the forecast API", p.NoOfPolls),
+			counter("yrpoller.poll.errors", "{request}", "Failed requests to the forecast API", p.NoOfPollErrors),
+		}
+		if !p.LastPollTime.IsZero() {
+			metrics = append(metrics,
+				gauge("yrpoller.poll.duration", "s", "Duration of the last request to the forecast API", p.LastPollDurationSeconds),
+				gauge("yrpoller.cache.age", "s", "Time since the cached forecast was replaced", now.Sub(p.LastPollTime).Seconds()))
+		}
+		resources = append(resources, otlp.Resource{
+			Attributes: otlp.LocationAttributes(locationDimensions(loc)),
+			Metrics:    metrics,
+		})
+	}
+
+	e := status.Emitter
+	daemon := []otlp.Metric{
+		gauge("yrpoller.uptime", "s", "Time since the daemon started", now.Sub(start).Seconds()),
+		counter("yrpoller.emits", "{emit}", "Emits handed to the sinks", e.NoOfEmits),
+		counter("yrpoller.emit.errors", "{error}", "Failed writes to a sink", e.NoOfEmitErrors),
+		byReason("yrpoller.rejected_records", "{record}", "Records rejected by Timestream", e.RejectedRecords),
+		byReason("yrpoller.producer_errors", "{message}", "Messages the Kafka producer failed to deliver", e.ProducerErrors),
+		gauge("yrpoller.memory.allocated", "By", "Bytes of allocated heap objects", float64(status.MemoryStats.MemAlloc)),
+		gauge("yrpoller.memory.system", "By", "Bytes of memory obtained from the OS", float64(status.MemoryStats.MemSys)),
+		counter("yrpoller.gc", "{gc}", "Completed GC cycles", uint64(status.MemoryStats.MemGC)),
+	}
+	if len(status.Sinks) > 0 {
+		queued := otlp.Metric{Name: "yrpoller.sink.queued", Unit: "{record}", Description: "Records queued for a sink", Kind: otlp.Gauge}
+		writeErrors := otlp.Metric{Name: "yrpoller.sink.write_errors", Unit: "{error}", Description: "Failed writes to a sink", Kind: otlp.Counter, Start: start}
+		dropped := otlp.Metric{Name: "yrpoller.sink.dropped", Unit: "{record}", Description: "Records dropped from a full sink queue", Kind: otlp.Counter, Start: start}
+		for name, q := range status.Sinks {
+			attributes := map[string]string{"sink": name}
+			queued.Points = append(queued.Points, otlp.Point{Time: now, Attributes: attributes, Value: float64(q.QueuedRecords + q.PendingInSink)})
+			writeErrors.Points = append(writeErrors.Points, otlp.Point{Time: now, Attributes: attributes, Value: float64(q.NoOfWriteErrors)})
+			dropped.Points = append(dropped.Points, otlp.Point{Time: now, Attributes: attributes, Value: float64(q.NoOfDroppedRecords)})
+		}
+		daemon = append(daemon, queued, writeErrors, dropped)
+	}
+	if s := status.Spool; s.Enabled {
+		age := 0.0
+		if s.Entries > 0 {
+			age = now.Sub(s.OldestEntry).Seconds()
+		}
+		daemon = append(daemon,
+			gauge("yrpoller.spool.entries", "{write}", "Writes waiting in the spool", float64(s.Entries)),
+			gauge("yrpoller.spool.size", "By", "Size of the spool", float64(s.Bytes)),
+			gauge("yrpoller.spool.oldest_age", "s", "Age of the oldest write in the spool", age),
+			counter("yrpoller.spool.dropped", "{write}", "Writes dropped from the full spool", s.NoOfDropped),
+			counter("yrpoller.spool.replay_errors", "{error}", "Failed replays of the spool", s.NoOfReplayErrors))
+	}
+	return append(resources, otlp.Resource{Metrics: daemon})
+}
+
+// exportDaemonMetrics exports the daemon metrics every interval, and a last time when it is
+// told to finish. Failed exports aren't retried, the next one has the counters anyway. The
+// locations are replaced by the ones from updates, which is nil without the location API.
+func exportDaemonMetrics(exporter *otlp.Exporter, ds *statushttp.DaemonStatus, locations Locations, interval time.Duration,
+	updates chan Locations, finished chan bool) {
+	export := func(now time.Time) {
+		if err := exporter.Export(daemonMetrics(ds.Snapshot(), locations, now.UTC())); err != nil {
+			log.Warnf("(otlp) exporting the daemon metrics failed: %s", err.Error())
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			export(now)
+		case locations = <-updates:
+		case <-finished:
+			log.Info("Daemon metrics exporter ending.")
+			export(time.Now())
+			finished <- true
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package yrsensor
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/otlp"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_daemonMetrics(t *testing.T) {
+	c := otlp.NewFakeCollector()
+	defer c.Close()
+	exporter, err := otlp.Open(otlp.Config{Endpoint: c.Endpoint()})
+	assert.Nil(t, err)
+
+	start := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	now := start.Add(time.Hour)
+	status := statushttp.DaemonStatus{
+		RunningSince: start,
+		Pollers: map[string]*statushttp.PollerStatus{
+			"skrindo": {
+				LastPollTime:            now.Add(-5 * time.Minute),
+				NoOfPolls:               12,
+				NoOfPollErrors:          1,
+				LastPollDurationSeconds: 0.25,
+			},
+			"tryvannstua": {},
+		},
+		Emitter: &statushttp.EmitterStatus{
+			NoOfEmits:       6,
+			RejectedRecords: map[string]uint64{"too old": 3},
+		},
+		Spool: &statushttp.SpoolStatus{},
+		Sinks: map[string]*sink.QueueStatus{
+			"postgres": {QueuedRecords: 2, PendingInSink: 40, NoOfWriteErrors: 3},
+		},
+	}
+	locations := Locations{Locations: []Location{
+		{Id: "skrindo", Lat: 60.7, Long: 8.9},
+		{Id: "tryvannstua", Lat: 59.98, Long: 10.67, Tags: map[string]string{"region": "oslo"}},
+	}}
+	assert.Nil(t, exporter.Export(daemonMetrics(status, locations, now)))
+
+	byMetric := make(map[string][]otlp.FakePoint)
+	for _, p := range c.Points() {
+		byMetric[p.Metric] = append(byMetric[p.Metric], p)
+	}
+	polls := byMetric["yrpoller.polls"]
+	assert.Len(t, polls, 2)
+	assert.Equal(t, "skrindo", polls[0].Resource["location.id"])
+	assert.Equal(t, "60.7", polls[0].Resource["location.lat"])
+	assert.Equal(t, "oslo", polls[1].Resource["location.region"])
+	assert.Equal(t, 12.0, polls[0].Value)
+	assert.Equal(t, otlp.Counter, polls[0].Kind)
+	assert.Equal(t, start, polls[0].Start)
+
+	assert.Len(t, byMetric["yrpoller.poll.duration"], 1, "no duration before the first poll")
+	assert.Equal(t, 0.25, byMetric["yrpoller.poll.duration"][0].Value)
+	assert.Equal(t, 300.0, byMetric["yrpoller.cache.age"][0].Value)
+
+	assert.Equal(t, map[string]string{"service.name": "yrpoller"}, byMetric["yrpoller.emits"][0].Resource)
+	assert.Equal(t, 6.0, byMetric["yrpoller.emits"][0].Value)
+	assert.Equal(t, 3600.0, byMetric["yrpoller.uptime"][0].Value)
+	assert.Equal(t, map[string]string{"reason": "too old"}, byMetric["yrpoller.rejected_records"][0].Attributes)
+	assert.Empty(t, byMetric["yrpoller.producer_errors"])
+	assert.Equal(t, map[string]string{"sink": "postgres"}, byMetric["yrpoller.sink.queued"][0].Attributes)
+	assert.Equal(t, 42.0, byMetric["yrpoller.sink.queued"][0].Value)
+	assert.Equal(t, 3.0, byMetric["yrpoller.sink.write_errors"][0].Value)
+	assert.Empty(t, byMetric["yrpoller.spool.entries"], "the spool isn't enabled")
+}
+
+func Test_exportDaemonMetricsFinished(t *testing.T) {
+	c := otlp.NewFakeCollector()
+	defer c.Close()
+	exporter, err := otlp.Open(otlp.Config{Endpoint: c.Endpoint()})
+	assert.Nil(t, err)
+	ds := statushttp.NewDaemonStatus()
+	ds.IncEmit()
+
+	finished := make(chan bool)
+	go exportDaemonMetrics(exporter, &ds, Locations{}, time.Hour, nil, finished)
+	finished <- true
+	<-finished
+	var emits []otlp.FakePoint
+	for _, p := range c.Points() {
+		if p.Metric == "yrpoller.emits" {
+			emits = append(emits, p)
+		}
+	}
+	assert.Len(t, emits, 1, "exported once more when finishing, long before the interval")
+	assert.Equal(t, 1.0, emits[0].Value)
+}
+
+func Test_exportDaemonMetricsUpdates(t *testing.T) {
+	c := otlp.NewFakeCollector()
+	defer c.Close()
+	exporter, err := otlp.Open(otlp.Config{Endpoint: c.Endpoint()})
+	assert.Nil(t, err)
+	ds := statushttp.NewDaemonStatus()
+	skrindo := Location{Id: "skrindo", Lat: 60.6606, Long: 8.5741}
+	holmenkollen := Location{Id: "holmenkollen", Lat: 59.9633, Long: 10.6672, Tags: map[string]string{"event": "world-cup"}}
+	addLocationToStatus(&ds, skrindo, false)
+
+	updates := make(chan Locations)
+	finished := make(chan bool)
+	go exportDaemonMetrics(exporter, &ds, Locations{Locations: []Location{skrindo}}, time.Hour, updates, finished)
+	// As the location API does it: the status first, then the update.
+	ds.RemoveLocation("skrindo")
+	addLocationToStatus(&ds, holmenkollen, false)
+	updates <- Locations{Locations: []Location{holmenkollen}}
+	finished <- true
+	<-finished
+	var polls []otlp.FakePoint
+	for _, p := range c.Points() {
+		if p.Metric == "yrpoller.polls" {
+			polls = append(polls, p)
+		}
+	}
+	assert.Len(t, polls, 1, "the removed location is gone")
+	assert.Equal(t, "holmenkollen", polls[0].Resource["location.id"])
+	assert.Equal(t, "world-cup", polls[0].Resource["location.event"])
+}
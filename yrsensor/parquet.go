@@ -0,0 +1,53 @@
+package yrsensor
+
+/*
+  The Parquet schema of the emitted variables, and conversion of the CSV and JSON Lines
+  archives of the file sink to Parquet.
+*/
+
+import (
+	"fmt"
+	"github.com/perbu/yrpoller/sink/file"
+	"github.com/perbu/yrpoller/sink/parquet"
+	log "github.com/sirupsen/logrus"
+)
+
+// parquetColumns has a column per variable, times as timestamps and the rest as doubles.
+func parquetColumns(vars []outputVariable) []parquet.Column {
+	columns := make([]parquet.Column, 0, len(vars))
+	for _, v := range vars {
+		column := parquet.Column{Name: v.Name, Type: parquet.Double}
+		if timeVariables[v.Name] {
+			column.Type = parquet.Timestamp
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// ExportParquet converts files written by the file sink to Parquet, with the schema the Parquet
+// sink has for the variables. Values of other variables are left out.
+func ExportParquet(files []string, config parquet.Config, variables string) error {
+	vars, err := selectOutputVariables(variables)
+	if err != nil {
+		return err
+	}
+	config.Columns = parquetColumns(vars)
+	ps, err := parquet.Open(config)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		records, err := file.ReadFile(path)
+		if err != nil {
+			ps.Close()
+			return err
+		}
+		if err := ps.Write(records); err != nil {
+			ps.Close()
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		log.Infof("Converted %d records from %s", len(records), path)
+	}
+	return ps.Close()
+}
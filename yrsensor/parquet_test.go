@@ -0,0 +1,45 @@
+package yrsensor
+
+import (
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/file"
+	"github.com/perbu/yrpoller/sink/parquet"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_parquetColumns(t *testing.T) {
+	vars, err := selectOutputVariables("air_temperature,sunrise")
+	assert.Nil(t, err)
+	assert.Equal(t, []parquet.Column{
+		{Name: "air_temperature", Type: parquet.Double},
+		{Name: "sunrise", Type: parquet.Timestamp},
+	}, parquetColumns(vars))
+}
+
+func Test_ExportParquet(t *testing.T) {
+	archive, out := t.TempDir(), t.TempDir()
+	fs, err := file.Open(file.Config{Dir: archive, Format: file.FormatJSONL})
+	assert.Nil(t, err)
+	when := time.Date(2021, 1, 10, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, fs.Write([]sink.Record{
+		{Time: when, Location: "skrindo", Values: []sink.Value{{Name: "air_temperature", Value: -5}}},
+		{Time: when, Location: "tryvannstua", Values: []sink.Value{{Name: "air_temperature", Value: -2}}},
+	}))
+	assert.Nil(t, fs.Close())
+
+	err = ExportParquet([]string{filepath.Join(archive, "observations-2021-01-10.jsonl")},
+		parquet.Config{Dir: out, Compression: parquet.CompressionGzip}, "air_temperature,wind_speed")
+	assert.Nil(t, err)
+	for _, id := range []string{"skrindo", "tryvannstua"} {
+		info, err := os.Stat(filepath.Join(out, "location="+id, "date=2021-01-10", "part-0.parquet"))
+		assert.Nil(t, err)
+		assert.True(t, info.Size() > 0)
+	}
+
+	err = ExportParquet([]string{filepath.Join(archive, "missing.csv")}, parquet.Config{Dir: out}, "")
+	assert.NotNil(t, err)
+}
@@ -6,6 +6,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"time"
 )
 
@@ -52,6 +53,10 @@ func getNewForecast(loc Location, apiUrl string, userAgent string) (LocationFore
 		"lat": fmt.Sprintf("%f", loc.Lat),
 		"lon": fmt.Sprintf("%f", loc.Long),
 	}
+	// The API corrects the temperature for the altitude, in whole meters.
+	if loc.Altitude != nil {
+		params["altitude"] = fmt.Sprintf("%.0f", *loc.Altitude)
+	}
 	res, err := request(apiUrl, params, userAgent)
 
 	if err != nil {
@@ -91,7 +96,13 @@ func transformForecast(forecast LocationForecast) *ObservationTimeSeries {
 		obs.AirPressureAtSeaLevel = ts[i].Data.Instant.Details.AirPressureAtSeaLevel
 		obs.WindFromDirection = ts[i].Data.Instant.Details.WindFromDirection
 		obs.WindSpeed = ts[i].Data.Instant.Details.WindSpeed
+		obs.WindSpeedOfGust = ts[i].Data.Instant.Details.WindSpeedOfGust
 		obs.RelativeHumidity = ts[i].Data.Instant.Details.RelativeHumidity
+		// Nowcast gives us a rate, locationforecast gives the amount for the next hour.
+		obs.PrecipitationRate = ts[i].Data.Instant.Details.PrecipitationRate
+		if obs.PrecipitationRate == 0 {
+			obs.PrecipitationRate = ts[i].Data.Next1Hours.Details.PrecipitationAmount
+		}
 		obs.Time, err = time.Parse(time.RFC3339, ts[i].Time)
 		m.ts = append(m.ts, obs)
 		if err != nil {
@@ -112,26 +123,66 @@ func refreshData(config *PollerConfig) {
 			// locking needed?
 			log.Debugf("(poller) Current data has expiry %v", config.ObservationCachePtr.observations[loc.Id].expires)
 			// No data or invalid data. Refresh the dataset we have.
-			forecast, err := getNewForecast(loc, config.ApiUrl, config.UserAgent)
-			if err != nil {
+			if err := pollLocation(config, loc); err != nil {
 				log.Errorf("Got error on forecast: %s. Sleeping 10 sec.", err.Error())
-				if config.DaemonStatusPtr != nil {
-					config.DaemonStatusPtr.IncPollError(loc.Id, err.Error())
-				}
 				time.Sleep(10 * time.Second)
 				log.Info("(poller) got an error. sleeping a bit.")
 			}
-			config.ObservationCachePtr.observations[loc.Id] = *transformForecast(forecast)
-			if config.DaemonStatusPtr != nil {
-				config.DaemonStatusPtr.IncPoll(loc.Id)
-			}
-			log.Info("(poller) Observation cache update with new data")
 		} else {
 			log.Debugf("(poller) %s - current data is up to date.", loc.Id)
 		}
 	}
 }
 
+// pollLocation gets a new forecast for a location and puts it in the cache. If the request
+// fails the forecast is empty, and expired, so it is polled again on the next refresh.
+func pollLocation(config *PollerConfig, loc Location) error {
+	started := time.Now()
+	forecast, err := getNewForecast(loc, config.ApiUrl, config.UserAgent)
+	if config.DaemonStatusPtr != nil {
+		config.DaemonStatusPtr.SetPollDuration(loc.Id, time.Since(started))
+	}
+	if err != nil && config.DaemonStatusPtr != nil {
+		config.DaemonStatusPtr.IncPollError(loc.Id, err.Error())
+	}
+	config.ObservationCachePtr.observations[loc.Id] = *transformForecast(forecast)
+	if config.DaemonStatusPtr != nil {
+		config.DaemonStatusPtr.IncPoll(loc.Id)
+	}
+	log.Info("(poller) Observation cache update with new data")
+	return err
+}
+
+// pollNewLocations polls the locations without a forecast, the ones the location API has added
+// or changed. It doesn't sleep on errors like refreshData, the poller keeps answering the
+// emitter and the next refresh tries again.
+func pollNewLocations(config *PollerConfig) {
+	for _, loc := range config.Locations.Locations {
+		if _, ok := config.ObservationCachePtr.observations[loc.Id]; ok {
+			continue
+		}
+		if err := pollLocation(config, loc); err != nil {
+			log.Errorf("(poller) got error on the forecast of %s: %s", loc.Id, err.Error())
+		}
+	}
+}
+
+// updateLocations switches to the locations from the location API. The forecasts of locations
+// that are gone or have changed are dropped, so the changed ones are polled again.
+func updateLocations(config *PollerConfig, locs Locations) {
+	updated := make(map[string]Location, len(locs.Locations))
+	for _, loc := range locs.Locations {
+		updated[loc.Id] = loc
+	}
+	for _, loc := range config.Locations.Locations {
+		if newLoc, ok := updated[loc.Id]; !ok || !reflect.DeepEqual(loc, newLoc) {
+			log.Infof("(poller) dropping the forecast of %s", loc.Id)
+			delete(config.ObservationCachePtr.observations, loc.Id)
+		}
+	}
+	config.Locations = locs
+}
+
 // Go routine that polls until *control goes false.
 func poller(config *PollerConfig) {
 	log.Info("Starting poller...")
@@ -153,6 +204,11 @@ func poller(config *PollerConfig) {
 			case req := <-config.TsRequestChannel:
 				log.Debugf("(poller) got internal req for ts(%s)", req.Location)
 				req.ResponseChannel <- config.ObservationCachePtr.observations[req.Location]
+			case locs := <-config.LocationUpdates:
+				log.Infof("(poller) got %d locations from the location API", len(locs.Locations))
+				updateLocations(config, locs)
+				// Poll the new ones right away, they are emitted from the next emit.
+				pollNewLocations(config)
 			case <-time.After(1 * time.Second):
 				log.Debug("(poller) main loop is idle [OK]")
 			}
@@ -2,8 +2,12 @@ package yrsensor
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/perbu/yrpoller/statushttp"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 )
@@ -58,6 +62,16 @@ func Test_getNewForecast(t *testing.T) {
 
 	assert.Equal(t, len(generatedForecast.Properties.Timeseries), len(forecast.Properties.Timeseries))
 
+	// The altitude is passed on, rounded to whole meters.
+	altitude := 919.6
+	loc.Altitude = &altitude
+	Client = &ClientMock{
+		response: map[string][]byte{
+			URL + "?altitude=920&lat=10.000000&lon=20.000000": forecastBody,
+		},
+	}
+	_, err = getNewForecast(loc, URL, USERAGENT)
+	assert.Nil(t, err)
 }
 
 func Test_transformForecast(t *testing.T) {
@@ -101,3 +115,52 @@ func Test_refreshData(t *testing.T) {
 	// Todo. We should inspect the data structures here and see there are new datapoints.
 
 }
+
+// refusingClient fails the requests for the latitude, and passes on the others.
+type refusingClient struct {
+	httpClient
+	lat string
+}
+
+func (c refusingClient) Do(req *http.Request) (*http.Response, error) {
+	if strings.Contains(req.URL.RawQuery, "lat="+c.lat) {
+		return nil, errors.New("connection refused")
+	}
+	return c.httpClient.Do(req)
+}
+
+func Test_pollNewLocations(t *testing.T) {
+	const URL = "test://api.met.no/weatherapi/locationforecast/2.0/classic"
+	forecastBody, err := json.Marshal(generateTestForecast())
+	assert.Nil(t, err, "can't marshall forecast.")
+	Client = refusingClient{
+		httpClient: &ClientMock{
+			response: map[string][]byte{
+				URL + "?lat=10.000000&lon=20.000000": forecastBody,
+			},
+		},
+		lat: "11.000000",
+	}
+	ds := statushttp.NewDaemonStatus()
+	// An expired forecast is left for the next refresh.
+	obsCache := generateTestObservationCache("tryvannstua", -2*time.Hour)
+	broken := generateOneTestLocation("broken")
+	broken.Lat = 11
+	pc := PollerConfig{
+		ApiUrl:              URL,
+		UserAgent:           "myuseragent",
+		Locations:           Locations{Locations: []Location{generateOneTestLocation("tryvannstua"), generateOneTestLocation("met"), broken}},
+		ObservationCachePtr: obsCache,
+		DaemonStatusPtr:     &ds,
+	}
+	addLocationsToStatus(&ds, pc.Locations, false)
+	started := time.Now()
+	pollNewLocations(&pc)
+	assert.Less(t, time.Since(started).Seconds(), 5.0, "no sleeping on errors")
+	assert.NotEmpty(t, obsCache.observations["met"].ts)
+	assert.Contains(t, obsCache.observations, "broken")
+	assert.Empty(t, obsCache.observations["broken"].ts)
+	assert.Equal(t, uint64(1), ds.Pollers["broken"].NoOfPollErrors)
+	assert.Equal(t, uint64(1), ds.Pollers["met"].NoOfPolls)
+	assert.Equal(t, uint64(0), ds.Pollers["tryvannstua"].NoOfPolls, "it wasn't polled")
+}
@@ -0,0 +1,277 @@
+package yrsensor
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/perbu/yrpoller/statushttp"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+  Rule based snow condition classification and wax recommendation.
+
+  The rules are evaluated top to bottom and the first matching rule wins. A rule
+  matches if all the inputs in "when" are within their min/max bounds. Missing
+  bounds are open.
+*/
+
+// The inputs available to the rules.
+const (
+	skiInputTemperature          = "temperature"            // °C, interpolated
+	skiInputHumidity             = "relative_humidity"      // %
+	skiInputPrecipitationPast    = "precipitation_past"     // mm over the history window
+	skiInputPrecipitationNext    = "precipitation_next"     // mm over the forecast window
+	skiInputMaxTemperaturePast   = "max_temperature_past"   // °C over the history window
+	skiInputTemperatureTrendPast = "temperature_trend_past" // °C/h over the history window
+	skiInputTemperatureTrendNext = "temperature_trend_next" // °C/h over the forecast window
+)
+
+var skiInputs = []string{skiInputTemperature, skiInputHumidity, skiInputPrecipitationPast,
+	skiInputPrecipitationNext, skiInputMaxTemperaturePast, skiInputTemperatureTrendPast,
+	skiInputTemperatureTrendNext}
+
+type SkiRuleBounds struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+type SnowConditionRule struct {
+	Condition string                   `json:"condition"`
+	When      map[string]SkiRuleBounds `json:"when"`
+}
+
+type WaxRule struct {
+	Condition      string                   `json:"condition"` // The snow condition the rule applies to.
+	When           map[string]SkiRuleBounds `json:"when"`
+	Wax            string                   `json:"wax"`
+	TemperatureMin float64                  `json:"temperature_min"`
+	TemperatureMax float64                  `json:"temperature_max"`
+}
+
+type SkiWaxRules struct {
+	HistoryHours   float64             `json:"history_hours"`
+	ForecastHours  float64             `json:"forecast_hours"`
+	SnowConditions []SnowConditionRule `json:"snow_conditions"`
+	Wax            []WaxRule           `json:"wax"`
+}
+
+type skiWaxEngine struct {
+	rules   SkiWaxRules
+	history map[string][]Observation // emitted observations per location
+}
+
+func (b SkiRuleBounds) contains(value float64) bool {
+	if b.Min != nil && value < *b.Min {
+		return false
+	}
+	if b.Max != nil && value >= *b.Max {
+		return false
+	}
+	return true
+}
+
+func ruleMatches(when map[string]SkiRuleBounds, inputs map[string]float64) bool {
+	for input, bounds := range when {
+		if !bounds.contains(inputs[input]) {
+			return false
+		}
+	}
+	return true
+}
+
+func validateRuleInputs(when map[string]SkiRuleBounds) error {
+	for input := range when {
+		known := false
+		for _, name := range skiInputs {
+			if input == name {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown input '%s'", input)
+		}
+	}
+	return nil
+}
+
+func readSkiWaxRules(rulesFile io.Reader) (SkiWaxRules, error) {
+	var rules SkiWaxRules
+	decoder := json.NewDecoder(rulesFile)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&rules)
+	if err != nil {
+		return rules, err
+	}
+	if rules.HistoryHours <= 0 || rules.ForecastHours <= 0 {
+		return rules, fmt.Errorf("history_hours and forecast_hours must be positive")
+	}
+	for i, rule := range rules.SnowConditions {
+		if err := validateRuleInputs(rule.When); err != nil {
+			return rules, fmt.Errorf("snow condition rule %d: %s", i, err.Error())
+		}
+	}
+	for i, rule := range rules.Wax {
+		if err := validateRuleInputs(rule.When); err != nil {
+			return rules, fmt.Errorf("wax rule %d: %s", i, err.Error())
+		}
+	}
+	return rules, nil
+}
+
+func readSkiWaxRulesFromPath(rulesFilePath string) (SkiWaxRules, error) {
+	rulesFile, err := os.Open(rulesFilePath)
+	if err != nil {
+		return SkiWaxRules{}, err
+	}
+	defer rulesFile.Close()
+	return readSkiWaxRules(rulesFile)
+}
+
+func newSkiWaxEngine(rules SkiWaxRules) *skiWaxEngine {
+	return &skiWaxEngine{
+		rules:   rules,
+		history: make(map[string][]Observation),
+	}
+}
+
+// removeLocation forgets the history of a location, so it starts over if it is added again.
+func (e *skiWaxEngine) removeLocation(id string) {
+	delete(e.history, id)
+}
+
+// integratePrecipitation sums up the precipitation in mm over a sorted list of observations.
+func integratePrecipitation(obs []Observation) float64 {
+	var sum float64
+	for i := 1; i < len(obs); i++ {
+		sum += obs[i-1].PrecipitationRate * obs[i].Time.Sub(obs[i-1].Time).Hours()
+	}
+	return sum
+}
+
+// temperatureTrend is the change in temperature per hour between the first and last observation.
+func temperatureTrend(obs []Observation) float64 {
+	if len(obs) < 2 {
+		return 0
+	}
+	hours := obs[len(obs)-1].Time.Sub(obs[0].Time).Hours()
+	if hours == 0 {
+		return 0
+	}
+	return (obs[len(obs)-1].AirTemperature - obs[0].AirTemperature) / hours
+}
+
+// skiInputsFor computes the rule inputs from the past (history) and the forecast, which
+// both include the current observation.
+func skiInputsFor(obs Observation, past []Observation, next []Observation) map[string]float64 {
+	maxTemp := obs.AirTemperature
+	for _, o := range past {
+		if o.AirTemperature > maxTemp {
+			maxTemp = o.AirTemperature
+		}
+	}
+	return map[string]float64{
+		skiInputTemperature:          obs.AirTemperature,
+		skiInputHumidity:             obs.RelativeHumidity,
+		skiInputPrecipitationPast:    integratePrecipitation(past),
+		skiInputPrecipitationNext:    integratePrecipitation(next),
+		skiInputMaxTemperaturePast:   maxTemp,
+		skiInputTemperatureTrendPast: temperatureTrend(past),
+		skiInputTemperatureTrendNext: temperatureTrend(next),
+	}
+}
+
+// evaluate records the observation in the history of the location and runs the rules.
+func (e *skiWaxEngine) evaluate(loc Location, obs Observation, timeseries *ObservationTimeSeries) statushttp.SkiConditionStatus {
+	historyStart := obs.Time.Add(-time.Duration(e.rules.HistoryHours * float64(time.Hour)))
+	forecastEnd := obs.Time.Add(time.Duration(e.rules.ForecastHours * float64(time.Hour)))
+
+	// Keep what we have emitted within the history window.
+	history := make([]Observation, 0, len(e.history[loc.Id])+1)
+	for _, o := range e.history[loc.Id] {
+		if !o.Time.Before(historyStart) && o.Time.Before(obs.Time) {
+			history = append(history, o)
+		}
+	}
+	history = append(history, obs)
+	e.history[loc.Id] = history
+
+	// Past entries in the time series fill in what we haven't seen, like after a restart.
+	past := append([]Observation{}, history...)
+	next := []Observation{obs}
+	for _, o := range timeseries.ts {
+		switch {
+		case o.Time.Before(historyStart):
+		case o.Time.Before(history[0].Time):
+			past = append(past, o)
+		case o.Time.After(obs.Time) && !o.Time.After(forecastEnd):
+			next = append(next, o)
+		}
+	}
+	sort.Slice(past, func(i, j int) bool { return past[i].Time.Before(past[j].Time) })
+
+	inputs := skiInputsFor(obs, past, next)
+	status := statushttp.SkiConditionStatus{
+		Time:   obs.Time,
+		Inputs: inputs,
+	}
+	for _, rule := range e.rules.SnowConditions {
+		if ruleMatches(rule.When, inputs) {
+			status.SnowCondition = rule.Condition
+			break
+		}
+	}
+	for _, rule := range e.rules.Wax {
+		if rule.Condition == status.SnowCondition && ruleMatches(rule.When, inputs) {
+			status.Wax = rule.Wax
+			status.WaxTemperatureMin = rule.TemperatureMin
+			status.WaxTemperatureMax = rule.TemperatureMax
+			break
+		}
+	}
+	return status
+}
+
+// The built in rules. Use -skiwax-rules to load your own.
+func skiWaxRulesExample() string {
+	return `
+{
+  "history_hours": 24,
+  "forecast_hours": 6,
+  "snow_conditions": [
+    { "condition": "wet_snow", "when": { "temperature": { "min": 0 } } },
+    { "condition": "new_snow", "when": { "precipitation_past": { "min": 2 } } },
+    { "condition": "klister", "when": { "max_temperature_past": { "min": 0.5 } } },
+    { "condition": "old_snow", "when": {} }
+  ],
+  "wax": [
+    { "condition": "new_snow", "when": { "temperature": { "max": -12 } },
+      "wax": "polar hard wax", "temperature_min": -30, "temperature_max": -12 },
+    { "condition": "new_snow", "when": { "temperature": { "max": -7 } },
+      "wax": "green hard wax", "temperature_min": -15, "temperature_max": -7 },
+    { "condition": "new_snow", "when": { "temperature": { "max": -2 } },
+      "wax": "blue hard wax", "temperature_min": -10, "temperature_max": -2 },
+    { "condition": "new_snow", "when": {},
+      "wax": "violet hard wax", "temperature_min": -3, "temperature_max": 0 },
+    { "condition": "old_snow", "when": { "temperature": { "max": -10 } },
+      "wax": "green hard wax", "temperature_min": -15, "temperature_max": -8 },
+    { "condition": "old_snow", "when": { "temperature": { "max": -4 } },
+      "wax": "blue hard wax", "temperature_min": -10, "temperature_max": -3 },
+    { "condition": "old_snow", "when": { "temperature_trend_next": { "min": 1 } },
+      "wax": "violet klister", "temperature_min": -4, "temperature_max": 1 },
+    { "condition": "old_snow", "when": {},
+      "wax": "red hard wax", "temperature_min": -3, "temperature_max": 1 },
+    { "condition": "klister", "when": { "temperature": { "max": -4 } },
+      "wax": "blue klister", "temperature_min": -12, "temperature_max": -3 },
+    { "condition": "klister", "when": {},
+      "wax": "violet klister", "temperature_min": -4, "temperature_max": 1 },
+    { "condition": "wet_snow", "when": { "temperature": { "max": 3 } },
+      "wax": "red klister", "temperature_min": 0, "temperature_max": 4 },
+    { "condition": "wet_snow", "when": {},
+      "wax": "universal klister", "temperature_min": 2, "temperature_max": 10 }
+  ]
+}
+`
+}
@@ -0,0 +1,65 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readSkiWaxRules(t *testing.T) {
+	rules, err := readSkiWaxRules(strings.NewReader(skiWaxRulesExample()))
+	assert.Nil(t, err)
+	assert.Equal(t, 24.0, rules.HistoryHours)
+	assert.NotEmpty(t, rules.Wax)
+
+	_, err = readSkiWaxRules(strings.NewReader(`{"history_hours": 1, "forecast_hours": 1,
+		"snow_conditions": [{"condition": "wet", "when": {"temprature": {"min": 0}}}]}`))
+	assert.NotNil(t, err, "misspelled input should be rejected")
+}
+
+// Builds a series of hourly observations starting at start with the given temperatures.
+func generateHourlyObservations(start time.Time, temps []float64, precipitation float64) []Observation {
+	obs := make([]Observation, 0, len(temps))
+	for i, temp := range temps {
+		obs = append(obs, Observation{
+			Time:              start.Add(time.Duration(i) * time.Hour),
+			AirTemperature:    temp,
+			RelativeHumidity:  80,
+			PrecipitationRate: precipitation,
+		})
+	}
+	return obs
+}
+
+func Test_skiWaxEngine(t *testing.T) {
+	rules, err := readSkiWaxRules(strings.NewReader(skiWaxRulesExample()))
+	assert.Nil(t, err)
+	loc := generateOneTestLocation("tryvannstua")
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	// Snowing at -9 for the past six hours.
+	engine := newSkiWaxEngine(rules)
+	ts := ObservationTimeSeries{ts: generateHourlyObservations(start, []float64{-9, -9, -9, -9, -9, -9, -9, -9}, 1.0)}
+	status := engine.evaluate(loc, ts.ts[6], &ts)
+	assert.Equal(t, "new_snow", status.SnowCondition)
+	assert.Equal(t, "green hard wax", status.Wax)
+	assert.InDelta(t, 6.0, status.Inputs[skiInputPrecipitationPast], 0.01)
+
+	// Above zero
+	ts = ObservationTimeSeries{ts: generateHourlyObservations(start, []float64{1, 2}, 0)}
+	status = engine.evaluate(loc, ts.ts[0], &ts)
+	assert.Equal(t, "wet_snow", status.SnowCondition)
+	assert.Equal(t, "red klister", status.Wax)
+
+	// A thaw followed by frost, fed through the emitter history.
+	engine = newSkiWaxEngine(rules)
+	ts = ObservationTimeSeries{ts: generateHourlyObservations(start, []float64{2, 1, -2, -6, -8}, 0)}
+	for i := range ts.ts {
+		status = engine.evaluate(loc, ts.ts[i], &ObservationTimeSeries{ts: ts.ts[i:]})
+	}
+	assert.Equal(t, "klister", status.SnowCondition)
+	assert.Equal(t, "blue klister", status.Wax)
+	assert.InDelta(t, -2.5, status.Inputs[skiInputTemperatureTrendPast], 0.01)
+	assert.Len(t, engine.history[loc.Id], 5)
+}
@@ -0,0 +1,117 @@
+package yrsensor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+  Degree-day (temperature index) snowpack model. Precipitation that falls when
+  the temperature is below the rain/snow threshold accumulates as snow. Snow melts
+  at a rate proportional to the degrees above the melt temperature. Everything is
+  in mm of water.
+*/
+
+// Gaps longer than this, like when the daemon has been down, aren't integrated
+// since we don't know what happened in between.
+const snowpackMaxGap = 6 * time.Hour
+
+type SnowpackParams struct {
+	ThresholdTemperature float64 // °C, precipitation below this falls as snow
+	MeltTemperature      float64 // °C, melting starts above this
+	DegreeDayFactor      float64 // mm/°C/day
+}
+
+type SnowpackState struct {
+	Time                time.Time `json:"time"`
+	SnowWaterEquivalent float64   `json:"snow_water_equivalent"`
+	AccumulatedSnowfall float64   `json:"accumulated_snowfall"`
+	AccumulatedMelt     float64   `json:"accumulated_melt"`
+}
+
+type snowpackModel struct {
+	params    SnowpackParams
+	stateFile string
+	states    map[string]*SnowpackState
+}
+
+func newSnowpackModel(params SnowpackParams, stateFile string) (*snowpackModel, error) {
+	m := &snowpackModel{
+		params:    params,
+		stateFile: stateFile,
+		states:    make(map[string]*SnowpackState),
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &m.states)
+	return m, err
+}
+
+// stepSnowpack advances the snowpack to the time of the observation.
+func stepSnowpack(params SnowpackParams, state SnowpackState, obs Observation) SnowpackState {
+	dt := obs.Time.Sub(state.Time)
+	state.Time = obs.Time
+	if dt <= 0 || dt > snowpackMaxGap {
+		return state
+	}
+	if obs.AirTemperature < params.ThresholdTemperature {
+		snowfall := obs.PrecipitationRate * dt.Hours()
+		state.SnowWaterEquivalent += snowfall
+		state.AccumulatedSnowfall += snowfall
+	}
+	if obs.AirTemperature > params.MeltTemperature {
+		melt := params.DegreeDayFactor * (obs.AirTemperature - params.MeltTemperature) * dt.Hours() / 24
+		melt = math.Min(melt, state.SnowWaterEquivalent)
+		state.SnowWaterEquivalent -= melt
+		state.AccumulatedMelt += melt
+	}
+	return state
+}
+
+// update feeds an emitted observation to the model and returns the new state for the location.
+func (m *snowpackModel) update(obs Observation) *SnowpackState {
+	var state SnowpackState
+	if m.states[obs.Id] != nil {
+		state = *m.states[obs.Id]
+	}
+	state = stepSnowpack(m.params, state, obs)
+	m.states[obs.Id] = &state
+	return &state
+}
+
+// removeLocation drops the state of a location. It is gone from the state file on the next save.
+func (m *snowpackModel) removeLocation(id string) {
+	delete(m.states, id)
+}
+
+// save writes the state of all locations to the state file. The file is replaced
+// atomically so a crash won't leave us with a half written state.
+func (m *snowpackModel) save() error {
+	data, err := json.MarshalIndent(m.states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.stateFile), filepath.Base(m.stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), m.stateFile)
+}
@@ -0,0 +1,65 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testSnowpackParams = SnowpackParams{
+	ThresholdTemperature: 1.0,
+	MeltTemperature:      0.0,
+	DegreeDayFactor:      3.0,
+}
+
+func Test_stepSnowpack(t *testing.T) {
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+	state := SnowpackState{Time: start}
+
+	// Two hours of 2 mm/h snow.
+	state = stepSnowpack(testSnowpackParams, state, Observation{
+		Time: start.Add(2 * time.Hour), AirTemperature: -3, PrecipitationRate: 2})
+	assert.InDelta(t, 4.0, state.SnowWaterEquivalent, 0.001)
+	assert.InDelta(t, 4.0, state.AccumulatedSnowfall, 0.001)
+
+	// Rain at +4 for 6 hours adds no snow, melts 3 mm/°C/day * 4°C * 0.25 day = 3mm.
+	state = stepSnowpack(testSnowpackParams, state, Observation{
+		Time: start.Add(8 * time.Hour), AirTemperature: 4, PrecipitationRate: 2})
+	assert.InDelta(t, 1.0, state.SnowWaterEquivalent, 0.001)
+	assert.InDelta(t, 3.0, state.AccumulatedMelt, 0.001)
+
+	// Can't melt more than we have.
+	state = stepSnowpack(testSnowpackParams, state, Observation{
+		Time: start.Add(14 * time.Hour), AirTemperature: 10})
+	assert.Equal(t, 0.0, state.SnowWaterEquivalent)
+	assert.InDelta(t, 4.0, state.AccumulatedMelt, 0.001)
+
+	// Gaps are skipped.
+	state = stepSnowpack(testSnowpackParams, state, Observation{
+		Time: start.Add(48 * time.Hour), AirTemperature: -5, PrecipitationRate: 5})
+	assert.Equal(t, 0.0, state.SnowWaterEquivalent)
+	assert.Equal(t, start.Add(48*time.Hour), state.Time)
+}
+
+func Test_snowpackModelPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snowpack")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "snowpack.json")
+	start := time.Date(2021, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	m, err := newSnowpackModel(testSnowpackParams, stateFile)
+	assert.Nil(t, err)
+	m.update(Observation{Id: "skrindo", Time: start, AirTemperature: -5, PrecipitationRate: 1})
+	state := m.update(Observation{Id: "skrindo", Time: start.Add(time.Hour), AirTemperature: -5, PrecipitationRate: 1})
+	assert.InDelta(t, 1.0, state.SnowWaterEquivalent, 0.001)
+	assert.Nil(t, m.save())
+
+	restored, err := newSnowpackModel(testSnowpackParams, stateFile)
+	assert.Nil(t, err)
+	assert.Equal(t, state.SnowWaterEquivalent, restored.states["skrindo"].SnowWaterEquivalent)
+	assert.True(t, state.Time.Equal(restored.states["skrindo"].Time))
+}
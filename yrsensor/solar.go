@@ -0,0 +1,159 @@
+package yrsensor
+
+import (
+	"math"
+	"time"
+)
+
+/*
+  Local astronomical calculations. The solar position is computed with the
+  NOAA solar calculator equations (based on Meeus, Astronomical Algorithms),
+  which are accurate to within a minute for sunrise/sunset at our latitudes.
+  No network is needed.
+*/
+
+const (
+	zenithSunrise       = 90.833 // Includes refraction and the radius of the solar disc.
+	zenithCivilTwilight = 96.0
+)
+
+type SolarConditions struct {
+	Elevation float64 // degrees above the horizon, corrected for refraction
+	Azimuth   float64 // degrees clockwise from north
+	Sunrise   time.Time
+	Sunset    time.Time
+	CivilDawn time.Time
+	CivilDusk time.Time
+	DayLength time.Duration
+}
+
+// sunParams holds the values of the NOAA algorithm that only depend on time.
+type sunParams struct {
+	declination float64 // radians
+	eqTime      float64 // equation of time, in minutes
+}
+
+func deg2rad(d float64) float64 {
+	return d * math.Pi / 180.0
+}
+
+func rad2deg(r float64) float64 {
+	return r * 180.0 / math.Pi
+}
+
+func julianCentury(t time.Time) float64 {
+	jd := float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+	return (jd - 2451545.0) / 36525.0
+}
+
+func sunParamsAt(t time.Time) sunParams {
+	jc := julianCentury(t)
+	meanLong := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360.0)
+	meanAnom := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	ecc := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	mRad := deg2rad(meanAnom)
+	center := math.Sin(mRad)*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(2*mRad)*(0.019993-0.000101*jc) +
+		math.Sin(3*mRad)*0.000289
+	trueLong := meanLong + center
+	omega := deg2rad(125.04 - 1934.136*jc)
+	appLong := trueLong - 0.00569 - 0.00478*math.Sin(omega)
+	meanObliq := 23.0 + (26.0+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60.0)/60.0
+	obliq := deg2rad(meanObliq + 0.00256*math.Cos(omega))
+
+	y := math.Pow(math.Tan(obliq/2), 2)
+	l0 := deg2rad(meanLong)
+	eqTime := 4 * rad2deg(y*math.Sin(2*l0)-2*ecc*math.Sin(mRad)+
+		4*ecc*y*math.Sin(mRad)*math.Cos(2*l0)-
+		0.5*y*y*math.Sin(4*l0)-1.25*ecc*ecc*math.Sin(2*mRad))
+
+	return sunParams{
+		declination: math.Asin(math.Sin(obliq) * math.Sin(deg2rad(appLong))),
+		eqTime:      eqTime,
+	}
+}
+
+// Approximate atmospheric refraction in degrees for a given true elevation.
+func atmosphericRefraction(elevation float64) float64 {
+	var arcsec float64
+	te := math.Tan(deg2rad(elevation))
+	switch {
+	case elevation > 85.0:
+		arcsec = 0
+	case elevation > 5.0:
+		arcsec = 58.1/te - 0.07/math.Pow(te, 3) + 0.000086/math.Pow(te, 5)
+	case elevation > -0.575:
+		arcsec = 1735.0 + elevation*(-518.2+elevation*(103.4+elevation*(-12.79+elevation*0.711)))
+	default:
+		arcsec = -20.772 / te
+	}
+	return arcsec / 3600.0
+}
+
+// solarPosition returns the elevation and azimuth of the sun, in degrees, as seen from lat/long at time t.
+func solarPosition(lat float64, long float64, t time.Time) (float64, float64) {
+	t = t.UTC()
+	p := sunParamsAt(t)
+	minutes := float64(t.Hour()*60+t.Minute()) + float64(t.Second())/60.0
+	trueSolarTime := math.Mod(minutes+p.eqTime+4*long, 1440)
+	if trueSolarTime < 0 {
+		trueSolarTime += 1440
+	}
+	hourAngle := deg2rad(trueSolarTime/4 - 180)
+	latRad := deg2rad(lat)
+
+	cosZenith := math.Sin(latRad)*math.Sin(p.declination) +
+		math.Cos(latRad)*math.Cos(p.declination)*math.Cos(hourAngle)
+	zenith := math.Acos(math.Max(-1, math.Min(1, cosZenith)))
+	elevation := 90 - rad2deg(zenith)
+
+	azimuth := rad2deg(math.Atan2(math.Sin(hourAngle),
+		math.Cos(hourAngle)*math.Sin(latRad)-math.Tan(p.declination)*math.Cos(latRad))) + 180
+	azimuth = math.Mod(azimuth, 360)
+
+	return elevation + atmosphericRefraction(elevation), azimuth
+}
+
+// sunEvent computes when the sun crosses the given zenith angle on the UTC day of date.
+// The last return value is -1 if the sun stays below that zenith all day (polar night),
+// +1 if it stays above (midnight sun) and 0 if the rise/set times are valid.
+func sunEvent(lat float64, long float64, date time.Time, zenith float64) (time.Time, time.Time, int) {
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	// Evaluate the sun parameters close to local solar noon.
+	approxNoon := midnight.Add(time.Duration((720 - 4*long) * float64(time.Minute)))
+	p := sunParamsAt(approxNoon)
+
+	latRad := deg2rad(lat)
+	cosHA := math.Cos(deg2rad(zenith))/(math.Cos(latRad)*math.Cos(p.declination)) -
+		math.Tan(latRad)*math.Tan(p.declination)
+	if cosHA > 1 {
+		return time.Time{}, time.Time{}, -1
+	}
+	if cosHA < -1 {
+		return time.Time{}, time.Time{}, 1
+	}
+	hourAngle := rad2deg(math.Acos(cosHA))
+	noon := 720 - 4*long - p.eqTime
+	rise := midnight.Add(time.Duration((noon - 4*hourAngle) * float64(time.Minute)))
+	set := midnight.Add(time.Duration((noon + 4*hourAngle) * float64(time.Minute)))
+	return rise.Truncate(time.Second), set.Truncate(time.Second), 0
+}
+
+// solarConditions computes the solar position and the sun events for a location at a given time.
+// Events are computed for the UTC day of when. Events that don't happen (polar day/night) are
+// left as the zero time.
+func solarConditions(loc Location, when time.Time) SolarConditions {
+	var sc SolarConditions
+	sc.Elevation, sc.Azimuth = solarPosition(loc.Lat, loc.Long, when)
+
+	var polar int
+	sc.Sunrise, sc.Sunset, polar = sunEvent(loc.Lat, loc.Long, when, zenithSunrise)
+	switch polar {
+	case 0:
+		sc.DayLength = sc.Sunset.Sub(sc.Sunrise)
+	case 1:
+		sc.DayLength = 24 * time.Hour
+	}
+	sc.CivilDawn, sc.CivilDusk, _ = sunEvent(loc.Lat, loc.Long, when, zenithCivilTwilight)
+	return sc
+}
@@ -0,0 +1,41 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Reference times are from timeanddate.com for Oslo, converted to UTC.
+func Test_solarConditions(t *testing.T) {
+	oslo := Location{Id: "oslo", Lat: 59.9139, Long: 10.7522}
+	tolerance := 2 * time.Minute
+
+	summer := solarConditions(oslo, time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC))
+	assert.WithinDuration(t, time.Date(2021, 6, 21, 1, 53, 0, 0, time.UTC), summer.Sunrise, tolerance)
+	assert.WithinDuration(t, time.Date(2021, 6, 21, 20, 44, 0, 0, time.UTC), summer.Sunset, tolerance)
+	assert.InDelta(t, 18.85, summer.DayLength.Hours(), 0.1)
+	assert.True(t, summer.CivilDawn.Before(summer.Sunrise))
+	assert.True(t, summer.CivilDusk.After(summer.Sunset))
+
+	winter := solarConditions(oslo, time.Date(2020, 12, 21, 11, 15, 0, 0, time.UTC))
+	assert.WithinDuration(t, time.Date(2020, 12, 21, 8, 18, 0, 0, time.UTC), winter.Sunrise, tolerance)
+	assert.WithinDuration(t, time.Date(2020, 12, 21, 14, 12, 0, 0, time.UTC), winter.Sunset, tolerance)
+	assert.InDelta(t, 6.7, winter.Elevation, 0.5) // solar noon
+	assert.InDelta(t, 180, winter.Azimuth, 5)
+}
+
+func Test_solarConditionsPolar(t *testing.T) {
+	tromso := Location{Id: "tromso", Lat: 69.6492, Long: 18.9553}
+
+	night := solarConditions(tromso, time.Date(2020, 12, 21, 12, 0, 0, 0, time.UTC))
+	assert.True(t, night.Sunrise.IsZero())
+	assert.True(t, night.Sunset.IsZero())
+	assert.Equal(t, time.Duration(0), night.DayLength)
+	assert.False(t, night.CivilDawn.IsZero(), "there is civil twilight in Tromsø at midwinter")
+
+	day := solarConditions(tromso, time.Date(2021, 6, 21, 0, 0, 0, 0, time.UTC))
+	assert.True(t, day.Sunrise.IsZero())
+	assert.Equal(t, 24*time.Hour, day.DayLength)
+	assert.True(t, day.Elevation > 0, "midnight sun")
+}
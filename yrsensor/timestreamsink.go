@@ -0,0 +1,167 @@
+package yrsensor
+
+import (
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/statushttp"
+	"github.com/perbu/yrpoller/timestream"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+/*
+  Writes the emitted observations to AWS Timestream, either as one table per variable
+  or as multi-measure records in a single table. Failed writes are kept and retried by
+  the sink's queue, or spooled and replayed in the background if there is a spool.
+*/
+
+type timestreamSink struct {
+	state       timestream.TimestreamState
+	ds          *statushttp.DaemonStatus
+	stopDrainer chan bool
+}
+
+// newTimestreamSink sets up the tables and, if enabled, the history endpoint and the spool drainer.
+func newTimestreamSink(config timestream.Config, vars []outputVariable, emitterInterval time.Duration,
+	drainInterval time.Duration, ds *statushttp.DaemonStatus) (*timestreamSink, error) {
+	s := &timestreamSink{
+		state:       timestream.Factory(config),
+		ds:          ds,
+		stopDrainer: make(chan bool),
+	}
+	tables := outputVariableNames(vars)
+	if s.state.MultiMeasureTable != "" {
+		tables = []string{s.state.MultiMeasureTable}
+	}
+	if err := s.state.CheckAndCreateTables(tables); err != nil {
+		return nil, err
+	}
+	if s.state.QuerySession != nil && ds != nil {
+		ds.SetHistory(makeHistoryFunc(s.state, vars, emitterInterval))
+	}
+	if s.state.Spool != nil {
+		go s.spoolDrainer(drainInterval)
+	}
+	return s, nil
+}
+
+func (s *timestreamSink) Name() string {
+	return "timestream"
+}
+
+// addRecord buffers a record, either as one entry per variable or as a single multi-measure entry.
+func (s *timestreamSink) addRecord(record sink.Record) {
+	dims := make([]timestream.TimestreamDimension, len(record.Dimensions))
+	for i, d := range record.Dimensions {
+		dims[i] = timestream.TimestreamDimension{Name: d.Name, Value: d.Value}
+	}
+	if s.state.MultiMeasureTable != "" {
+		entry := timestream.TimestreamMultiEntry{
+			Time:       record.Time,
+			Dimensions: dims,
+			TableName:  s.state.MultiMeasureTable,
+			Measures:   make([]timestream.TimestreamMeasure, 0, len(record.Values)),
+		}
+		for _, v := range record.Values {
+			entry.Measures = append(entry.Measures, timestream.TimestreamMeasure{
+				Name:  v.Name,
+				Value: fmt.Sprintf("%v", v.Value),
+			})
+		}
+		s.state.MakeMultiEntry(entry)
+		return
+	}
+	for _, v := range record.Values {
+		s.state.MakeEntry(timestream.TimestreamEntry{
+			Time:        record.Time,
+			Dimensions:  dims,
+			TableName:   v.Name,
+			MeasureName: v.Name,
+			Value:       fmt.Sprintf("%v", v.Value),
+		})
+	}
+}
+
+func (s *timestreamSink) Write(records []sink.Record) error {
+	for _, r := range records {
+		s.addRecord(r)
+	}
+	var failed []error
+	for _, err := range s.state.FlushAwsTimestreamWrites() {
+		// Rejected records are dropped, the rest of the write went through.
+		if rejected, ok := err.(*timestream.RejectedRecordsError); ok {
+			s.countRejected(rejected)
+			continue
+		}
+		failed = append(failed, err)
+	}
+	s.updateSpoolStatus()
+	if len(failed) == 0 {
+		return nil
+	}
+	if s.state.Spool != nil {
+		return fmt.Errorf("%d writes failed and are spooled, the first: %s", len(failed), failed[0].Error())
+	}
+	return fmt.Errorf("%d writes failed and will be retried, the first: %s", len(failed), failed[0].Error())
+}
+
+// Pending is the number of records in the write buffer, not counting the spool.
+func (s *timestreamSink) Pending() int {
+	n := 0
+	for _, buffer := range s.state.WriteBuffer {
+		n += len(buffer)
+	}
+	return n
+}
+
+func (s *timestreamSink) Close() error {
+	if s.state.Spool == nil {
+		return nil
+	}
+	close(s.stopDrainer)
+	return s.state.Spool.Close()
+}
+
+func (s *timestreamSink) countRejected(rejected *timestream.RejectedRecordsError) {
+	if s.ds == nil {
+		return
+	}
+	for reason, count := range rejected.Reasons {
+		s.ds.IncRejectedRecords(reason, count)
+	}
+}
+
+func (s *timestreamSink) updateSpoolStatus() {
+	if s.state.Spool == nil || s.ds == nil {
+		return
+	}
+	stats := s.state.Spool.Stats()
+	s.ds.SetSpool(stats.Entries, stats.Bytes, stats.Oldest, stats.Dropped)
+}
+
+// spoolDrainer replays the spooled writes in the background, until the sink is closed.
+func (s *timestreamSink) spoolDrainer(interval time.Duration) {
+	log.Info("Starting spool drainer")
+	s.updateSpoolStatus()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, err := range s.state.DrainSpool() {
+				if rejected, ok := err.(*timestream.RejectedRecordsError); ok {
+					s.countRejected(rejected)
+					continue
+				}
+				log.Warnf("(spool) replay stopped, will try again in %s: %s", interval, err.Error())
+				if s.ds != nil {
+					s.ds.IncSpoolReplayError(err.Error())
+				}
+			}
+			s.updateSpoolStatus()
+		case <-s.stopDrainer:
+			log.Info("Spool drainer ending.")
+			return
+		}
+	}
+}
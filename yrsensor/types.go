@@ -1,6 +1,7 @@
 package yrsensor
 
 import (
+	"github.com/perbu/yrpoller/sink"
 	"github.com/perbu/yrpoller/statushttp"
 	"time"
 )
@@ -14,11 +15,15 @@ type EmitterConfig struct {
 	Finished            chan bool
 	EmitterInterval     time.Duration
 	Locations           Locations
+	OutputVariables     []outputVariable
+	SkiWax              *skiWaxEngine  // nil if disabled
+	Alerts              *alertEngine   // nil if disabled
+	Snowpack            *snowpackModel // nil if disabled
 	ObservationCachePtr *ObservationCache
-	AwsRegion           string
-	AwsTimestreamDbname string
+	Sinks               *sink.FanOut
 	DaemonStatusPtr     *statushttp.DaemonStatus
 	TsRequestChannel    chan TimeSeriesRequest
+	LocationUpdates     chan Locations // the locations to emit from now on, from the location API
 }
 
 type PollerConfig struct {
@@ -29,12 +34,19 @@ type PollerConfig struct {
 	ObservationCachePtr *ObservationCache
 	DaemonStatusPtr     *statushttp.DaemonStatus
 	TsRequestChannel    chan TimeSeriesRequest
+	LocationUpdates     chan Locations // the locations to poll from now on, from the location API
 }
 
 type Location struct {
-	Id   string  `json:"id"`
-	Lat  float64 `json:"lat"`
-	Long float64 `json:"long"`
+	Id       string            `json:"id" yaml:"id"`
+	Name     string            `json:"name,omitempty" yaml:"name,omitempty"` // display name, the id if not set
+	Lat      float64           `json:"lat" yaml:"lat"`
+	Long     float64           `json:"long" yaml:"long"`
+	Altitude *float64          `json:"altitude,omitempty" yaml:"altitude,omitempty"` // meters above sea level, sent to the API if set
+	Timezone string            `json:"timezone,omitempty" yaml:"timezone,omitempty"` // IANA name like "Europe/Oslo"
+	Provider string            `json:"provider,omitempty" yaml:"provider,omitempty"` // where the data comes from, "met.no" if not set
+	Enabled  *bool             `json:"enabled,omitempty" yaml:"enabled,omitempty"`   // polled and emitted unless set to false
+	Tags     map[string]string `json:"tags,omitempty" yaml:"tags,omitempty"`
 }
 
 type Locations struct {
@@ -51,13 +63,17 @@ type ObservationTimeSeries struct {
 }
 
 type Observation struct {
-	Id                    string    // Only used by the emitter
-	Time                  time.Time `json:"time"`
-	AirTemperature        float64   `json:"air_temperature"`
-	AirPressureAtSeaLevel float64   `json:"air_pressure_at_sealevel"`
-	RelativeHumidity      float64   `json:"relative_humidity"`
-	WindSpeed             float64   `json:"wind_speed"`
-	WindFromDirection     float64   `json:"wind_from_direction"`
+	Id                    string          // Only used by the emitter
+	Time                  time.Time       `json:"time"`
+	AirTemperature        float64         `json:"air_temperature"`
+	AirPressureAtSeaLevel float64         `json:"air_pressure_at_sealevel"`
+	RelativeHumidity      float64         `json:"relative_humidity"`
+	WindSpeed             float64         `json:"wind_speed"`
+	WindFromDirection     float64         `json:"wind_from_direction"`
+	WindSpeedOfGust       float64         `json:"wind_speed_of_gust"`
+	PrecipitationRate     float64         `json:"precipitation_rate"` // mm/h
+	Solar                 SolarConditions `json:"solar"`              // Computed locally by the emitter.
+	Snowpack              *SnowpackState  `json:"snowpack,omitempty"`
 }
 
 /* Most code below is (c) 2020 Andreas Palm and used under a MIT licence
@@ -156,6 +172,7 @@ type ForecastTimeInstant struct {
 	WindSpeedOfGust         float64 `json:"wind_speed_of_gust"`
 	CloudAreaFractionMedium float64 `json:"cloud_area_fraction_medium"`
 	CloudAreaFractionLow    float64 `json:"cloud_area_fraction_low"`
+	PrecipitationRate       float64 `json:"precipitation_rate"` // Only in nowcast.
 }
 
 // Next1HoursData => Inline Model 3
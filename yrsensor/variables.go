@@ -0,0 +1,133 @@
+package yrsensor
+
+import (
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	"strings"
+	"time"
+)
+
+// outputVariable is a named value the emitter writes for every location on each tick.
+// Value returns false if the variable has no meaningful value for the observation, in
+// which case nothing is emitted for it.
+type outputVariable struct {
+	Name  string
+	Value func(obs *Observation) (float64, bool)
+}
+
+// Times are emitted as seconds since the epoch.
+func unixValue(t time.Time) (float64, bool) {
+	if t.IsZero() {
+		return 0, false
+	}
+	return float64(t.Unix()), true
+}
+
+// exampleRecord has every output variable, for checking templates at startup.
+func exampleRecord(vars []outputVariable) sink.Record {
+	r := sink.Record{
+		Time:       time.Now().UTC(),
+		Location:   "example",
+		Dimensions: []sink.Dimension{{Name: "location", Value: "example"}},
+	}
+	for _, v := range vars {
+		r.Values = append(r.Values, sink.Value{Name: v.Name})
+	}
+	return r
+}
+
+// The variables emitted with unixValue.
+var timeVariables = map[string]bool{"sunrise": true, "sunset": true, "civil_dawn": true, "civil_dusk": true}
+
+var outputVariables = []outputVariable{
+	{"air_temperature", func(obs *Observation) (float64, bool) { return obs.AirTemperature, true }},
+	{"air_pressure_at_sealevel", func(obs *Observation) (float64, bool) { return obs.AirPressureAtSeaLevel, true }},
+	{"relative_humidity", func(obs *Observation) (float64, bool) { return obs.RelativeHumidity, true }},
+	{"wind_speed", func(obs *Observation) (float64, bool) { return obs.WindSpeed, true }},
+	{"wind_from_direction", func(obs *Observation) (float64, bool) { return obs.WindFromDirection, true }},
+	{"wind_speed_of_gust", func(obs *Observation) (float64, bool) { return obs.WindSpeedOfGust, true }},
+	{"precipitation_rate", func(obs *Observation) (float64, bool) { return obs.PrecipitationRate, true }},
+	// Astronomical variables, computed locally from lat/long.
+	{"solar_elevation", func(obs *Observation) (float64, bool) { return obs.Solar.Elevation, true }},
+	{"solar_azimuth", func(obs *Observation) (float64, bool) { return obs.Solar.Azimuth, true }},
+	{"sunrise", func(obs *Observation) (float64, bool) { return unixValue(obs.Solar.Sunrise) }},
+	{"sunset", func(obs *Observation) (float64, bool) { return unixValue(obs.Solar.Sunset) }},
+	{"civil_dawn", func(obs *Observation) (float64, bool) { return unixValue(obs.Solar.CivilDawn) }},
+	{"civil_dusk", func(obs *Observation) (float64, bool) { return unixValue(obs.Solar.CivilDusk) }},
+	{"day_length", func(obs *Observation) (float64, bool) { return obs.Solar.DayLength.Hours(), true }},
+	// Derived meteorological variables.
+	{"dew_point_temperature", func(obs *Observation) (float64, bool) {
+		return dewPoint(obs.AirTemperature, obs.RelativeHumidity)
+	}},
+	{"absolute_humidity", func(obs *Observation) (float64, bool) {
+		return absoluteHumidity(obs.AirTemperature, obs.RelativeHumidity), true
+	}},
+	{"wind_chill", func(obs *Observation) (float64, bool) {
+		return windChill(obs.AirTemperature, obs.WindSpeed), true
+	}},
+	{"heat_index", func(obs *Observation) (float64, bool) {
+		return heatIndex(obs.AirTemperature, obs.RelativeHumidity), true
+	}},
+	{"apparent_temperature", func(obs *Observation) (float64, bool) {
+		return apparentTemperature(obs.AirTemperature, obs.RelativeHumidity, obs.WindSpeed), true
+	}},
+	{"wet_bulb_temperature", func(obs *Observation) (float64, bool) {
+		return wetBulbTemperature(obs.AirTemperature, obs.RelativeHumidity), true
+	}},
+	{"feels_like", func(obs *Observation) (float64, bool) {
+		return feelsLike(obs.AirTemperature, obs.RelativeHumidity, obs.WindSpeed), true
+	}},
+	// Snowpack model, only emitted if enabled.
+	{"snow_water_equivalent", func(obs *Observation) (float64, bool) {
+		if obs.Snowpack == nil {
+			return 0, false
+		}
+		return obs.Snowpack.SnowWaterEquivalent, true
+	}},
+	{"snowfall_accumulated", func(obs *Observation) (float64, bool) {
+		if obs.Snowpack == nil {
+			return 0, false
+		}
+		return obs.Snowpack.AccumulatedSnowfall, true
+	}},
+	{"snowmelt_accumulated", func(obs *Observation) (float64, bool) {
+		if obs.Snowpack == nil {
+			return 0, false
+		}
+		return obs.Snowpack.AccumulatedMelt, true
+	}},
+}
+
+// selectOutputVariables picks the variables named in a comma separated list.
+// An empty list selects all of them.
+func selectOutputVariables(list string) ([]outputVariable, error) {
+	if strings.TrimSpace(list) == "" {
+		return outputVariables, nil
+	}
+	selected := make([]outputVariable, 0)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, v := range outputVariables {
+			if v.Name == name {
+				selected = append(selected, v)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown variable '%s', valid variables are: %s",
+				name, strings.Join(outputVariableNames(outputVariables), ", "))
+		}
+	}
+	return selected, nil
+}
+
+// outputVariableNames returns the names of the variables, which double as table names in Timestream.
+func outputVariableNames(vars []outputVariable) []string {
+	names := make([]string, 0, len(vars))
+	for _, v := range vars {
+		names = append(names, v.Name)
+	}
+	return names
+}
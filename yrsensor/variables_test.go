@@ -0,0 +1,19 @@
+package yrsensor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_selectOutputVariables(t *testing.T) {
+	all, err := selectOutputVariables("")
+	assert.Nil(t, err)
+	assert.Equal(t, len(outputVariables), len(all))
+
+	vars, err := selectOutputVariables("air_temperature, feels_like")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"air_temperature", "feels_like"}, outputVariableNames(vars))
+
+	_, err = selectOutputVariables("air_temperature,bogus")
+	assert.NotNil(t, err)
+}
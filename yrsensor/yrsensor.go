@@ -1,10 +1,24 @@
 package yrsensor
 
 import (
+	"fmt"
+	"github.com/perbu/yrpoller/sink"
+	"github.com/perbu/yrpoller/sink/file"
+	"github.com/perbu/yrpoller/sink/graphite"
+	"github.com/perbu/yrpoller/sink/kafka"
+	"github.com/perbu/yrpoller/sink/otlp"
+	"github.com/perbu/yrpoller/sink/parquet"
+	"github.com/perbu/yrpoller/sink/postgres"
+	"github.com/perbu/yrpoller/sink/sqlite"
+	"github.com/perbu/yrpoller/sink/statsd"
+	"github.com/perbu/yrpoller/sink/webhook"
+	"github.com/perbu/yrpoller/spool"
 	"github.com/perbu/yrpoller/statushttp"
+	"github.com/perbu/yrpoller/timestream"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -25,40 +39,276 @@ func setupLogging(level log.Level, logfile string) {
 	// log.SetReportCaller(true)
 }
 
-func addLocationsToStatus(ds *statushttp.DaemonStatus, locs Locations) {
+func addLocationsToStatus(ds *statushttp.DaemonStatus, locs Locations, skiWax bool) {
 	for _, loc := range locs.Locations {
-		ds.AddLocation(loc.Id)
+		addLocationToStatus(ds, loc, skiWax)
 	}
 }
 
-func Run(userAgent string, apiUrl string, emitterInterval time.Duration,
-	locationFileLocation string, awsRegion string, awsTimeseriesDbname string, bindAddress string,
-	logFileName string) {
+func addLocationToStatus(ds *statushttp.DaemonStatus, loc Location, skiWax bool) {
+	ds.AddLocation(loc.Id, statushttp.LocationInfo{
+		Name:     loc.displayName(),
+		Lat:      loc.Lat,
+		Long:     loc.Long,
+		Altitude: loc.Altitude,
+		Timezone: loc.Timezone,
+		Provider: loc.Provider,
+		Tags:     loc.Tags,
+	})
+	if skiWax {
+		ds.SetSkiConditions(loc.Id, statushttp.SkiConditionStatus{})
+	}
+}
+
+// newFanOut gives every sink a queue, with the flush interval given for it if there is one.
+// Each queue reports its status and failed writes to the daemon status.
+func newFanOut(sinks []sink.Sink, config sink.QueueConfig, flushIntervals map[string]time.Duration,
+	ds *statushttp.DaemonStatus) (*sink.FanOut, error) {
+	known := make(map[string]bool)
+	queues := make([]*sink.Queue, 0, len(sinks))
+	for _, sk := range sinks {
+		known[sk.Name()] = true
+		c := config
+		if d, ok := flushIntervals[sk.Name()]; ok {
+			c.FlushInterval = d
+		}
+		queues = append(queues, sink.NewQueue(sk, c, ds.SetSinkStatus, func(name string, err error) {
+			log.Errorf("(%s) write failed: %s", name, err.Error())
+			ds.IncEmitError(name + ": " + err.Error())
+		}))
+	}
+	for name := range flushIntervals {
+		if !known[name] {
+			return nil, fmt.Errorf("flush interval given for %s, which isn't enabled", name)
+		}
+	}
+	return sink.NewFanOut(queues...), nil
+}
+
+// Config is what the daemon runs with, the sinks are enabled by their configs.
+type Config struct {
+	UserAgent          string
+	ApiUrl             string
+	EmitterInterval    time.Duration
+	LocationFile       string
+	EnableTimestream   bool
+	Timestream         timestream.Config
+	Spool              spool.Config // spooling of failed Timestream writes, if Dir is given
+	SpoolDrainInterval time.Duration
+	Sqlite             sqlite.Config
+	Postgres           postgres.Config
+	File               file.Config
+	Parquet            parquet.Config
+	Kafka              kafka.Config
+	Graphite           graphite.Config
+	Statsd             statsd.Config
+	Otlp               otlp.Config
+	OtlpInterval       time.Duration // how often the daemon metrics are exported
+	WebhookFile        string
+	Queue              sink.QueueConfig
+	FlushIntervals     map[string]time.Duration // by sink name
+	BindAddress        string
+	ApiToken           string // enables the location API
+	ApiWriteBack       bool   // the location API writes the changes to LocationFile
+	LogFileName        string
+	Variables          string
+	SkiWax             bool
+	SkiWaxRulesFile    string
+	SnowpackStateFile  string // enables the snowpack model
+	Snowpack           SnowpackParams
+	AlertFile          string
+}
+
+func Run(config Config) {
 	var locations Locations
 	var err error
 	var forecastsCache ObservationCache
 
 	forecastsCache.observations = make(map[string]ObservationTimeSeries)
 
-	setupLogging(log.DebugLevel, logFileName)
-	locations.Locations, err = readLocationsFromPath(locationFileLocation)
+	setupLogging(log.DebugLevel, config.LogFileName)
+	locations.Locations, err = readLocationsFromPath(config.LocationFile)
 
+	if problems, ok := err.(LocationProblems); ok {
+		log.Errorf("%d problems in the location file:", len(problems))
+		for _, p := range problems {
+			log.Errorf("%s:%s", config.LocationFile, p.String())
+		}
+		log.Error("Example location file:")
+		log.Error(locationFileExample())
+		log.Fatal("Aborting")
+	}
 	if err != nil {
 		log.Errorf("could not parse location file: %v", err.Error())
 		log.Error("Example location file:")
 		log.Error(locationFileExample())
 		log.Fatal("Aborting")
 	}
+	if config.ApiWriteBack && config.ApiToken == "" {
+		log.Fatal("writing the locations back needs the location API, give it a token")
+	}
+	allLocations := locations.Locations
+	locations.Locations = enabledLocations(locations.Locations)
+	// With the location API the locations can be added later.
+	if len(locations.Locations) == 0 && config.ApiToken == "" {
+		log.Fatal("all locations are disabled, there is nothing to poll")
+	}
+	outputVars, err := selectOutputVariables(config.Variables)
+	if err != nil {
+		log.Fatalf("invalid variable selection: %s", err.Error())
+	}
+	var skiWaxEngine *skiWaxEngine
+	if config.SkiWax {
+		var rules SkiWaxRules
+		if config.SkiWaxRulesFile != "" {
+			rules, err = readSkiWaxRulesFromPath(config.SkiWaxRulesFile)
+		} else {
+			rules, err = readSkiWaxRules(strings.NewReader(skiWaxRulesExample()))
+		}
+		if err != nil {
+			log.Errorf("could not parse ski wax rules: %v", err.Error())
+			log.Error("Example rules file:")
+			log.Error(skiWaxRulesExample())
+			log.Fatal("Aborting")
+		}
+		skiWaxEngine = newSkiWaxEngine(rules)
+	}
+	var snowpack *snowpackModel
+	if config.SnowpackStateFile != "" {
+		snowpack, err = newSnowpackModel(config.Snowpack, config.SnowpackStateFile)
+		if err != nil {
+			log.Fatalf("could not read snowpack state from %s: %s", config.SnowpackStateFile, err.Error())
+		}
+	}
+	var alerts *alertEngine
+	if config.AlertFile != "" {
+		alertConfig, err := readAlertConfigFromPath(config.AlertFile)
+		if err == nil {
+			alerts, err = newAlertEngine(alertConfig, nil)
+		}
+		if err != nil {
+			log.Errorf("could not set up alerts from %s: %v", config.AlertFile, err.Error())
+			log.Error("Example alert file:")
+			log.Error(alertConfigExample())
+			log.Fatal("Aborting")
+		}
+	}
+	if config.EnableTimestream && config.Spool.Dir != "" {
+		if config.SpoolDrainInterval <= 0 {
+			log.Fatal("the spool drain interval must be positive")
+		}
+		config.Timestream.Spool, err = spool.Open(config.Spool)
+		if err != nil {
+			log.Fatalf("could not open spool in %s: %s", config.Spool.Dir, err.Error())
+		}
+	}
 	for _, loc := range locations.Locations {
 		log.Debugf("Polling location set: %s (%f, %f)", loc.Id, loc.Lat, loc.Long)
 	}
-	var ds = statushttp.Run(bindAddress)
+	var ds = statushttp.Run(config.BindAddress)
 	var tsReqChannel = make(chan TimeSeriesRequest)
 
+	sinks := make([]sink.Sink, 0)
+	if config.EnableTimestream {
+		ts, err := newTimestreamSink(config.Timestream, outputVars, config.EmitterInterval, config.SpoolDrainInterval, &ds)
+		if err != nil {
+			log.Fatalf("could not set up timestream: %s", err.Error())
+		}
+		sinks = append(sinks, ts)
+	}
+	if config.Sqlite.Path != "" {
+		db, err := sqlite.Open(config.Sqlite)
+		if err != nil {
+			log.Fatalf("could not open sqlite database %s: %s", config.Sqlite.Path, err.Error())
+		}
+		ds.SetObservations(db.Query)
+		sinks = append(sinks, db)
+	}
+	if config.Postgres.DSN != "" {
+		pg, err := postgres.Open(config.Postgres)
+		if err != nil {
+			log.Fatalf("invalid postgres DSN: %s", err.Error())
+		}
+		sinks = append(sinks, pg)
+	}
+	if config.File.Dir != "" {
+		config.File.Variables = outputVariableNames(outputVars)
+		fs, err := file.Open(config.File)
+		if err != nil {
+			log.Fatalf("could not set up the file sink in %s: %s", config.File.Dir, err.Error())
+		}
+		sinks = append(sinks, fs)
+	}
+	if config.Parquet.Dir != "" {
+		config.Parquet.Columns = parquetColumns(outputVars)
+		ps, err := parquet.Open(config.Parquet)
+		if err != nil {
+			log.Fatalf("could not set up the parquet sink in %s: %s", config.Parquet.Dir, err.Error())
+		}
+		sinks = append(sinks, ps)
+	}
+	if len(config.Kafka.Brokers) > 0 {
+		config.Kafka.Variables = outputVariableNames(outputVars)
+		config.Kafka.OnError = func(reason string, count int, err error) {
+			ds.IncProducerError(reason, count, err.Error())
+		}
+		ks, err := kafka.Open(config.Kafka)
+		if err != nil {
+			log.Fatalf("could not set up the kafka sink: %s", err.Error())
+		}
+		if config.Kafka.Format == kafka.FormatAvro {
+			log.Infof("kafka messages use the Avro schema %s", kafka.AvroSchema(config.Kafka.Variables))
+		}
+		sinks = append(sinks, ks)
+	}
+	if config.Graphite.Address != "" {
+		gs, err := graphite.Open(config.Graphite)
+		if err != nil {
+			log.Fatalf("could not set up the graphite sink: %s", err.Error())
+		}
+		sinks = append(sinks, gs)
+	}
+	if config.Statsd.Address != "" {
+		ss, err := statsd.Open(config.Statsd)
+		if err != nil {
+			log.Fatalf("could not set up the statsd sink: %s", err.Error())
+		}
+		sinks = append(sinks, ss)
+	}
+	if config.WebhookFile != "" {
+		hooks, err := webhook.ReadConfig(config.WebhookFile)
+		if err != nil {
+			log.Fatalf("could not read the webhooks: %s", err.Error())
+		}
+		ws, err := webhook.Open(hooks)
+		if err != nil {
+			log.Fatalf("could not set up the webhooks: %s", err.Error())
+		}
+		if err := ws.Check(exampleRecord(outputVars)); err != nil {
+			log.Fatalf("invalid template: %s", err.Error())
+		}
+		sinks = append(sinks, ws)
+	}
+	var exporter *otlp.Exporter
+	if config.Otlp.Endpoint != "" {
+		exporter, err = otlp.Open(config.Otlp)
+		if err != nil {
+			log.Fatalf("could not set up the OTLP exporter: %s", err.Error())
+		}
+		sinks = append(sinks, exporter)
+	}
+	if len(sinks) == 0 {
+		log.Fatal("no sinks enabled, there is nowhere to emit to")
+	}
+	fanOut, err := newFanOut(sinks, config.Queue, config.FlushIntervals, &ds)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	var pc = PollerConfig{
 		Finished:            make(chan bool),
-		ApiUrl:              apiUrl,
-		UserAgent:           userAgent,
+		ApiUrl:              config.ApiUrl,
+		UserAgent:           config.UserAgent,
 		Locations:           locations,
 		ObservationCachePtr: &forecastsCache,
 		DaemonStatusPtr:     &ds,
@@ -67,22 +317,49 @@ func Run(userAgent string, apiUrl string, emitterInterval time.Duration,
 
 	var ec = EmitterConfig{
 		Finished:            make(chan bool),
-		EmitterInterval:     emitterInterval,
+		EmitterInterval:     config.EmitterInterval,
 		Locations:           locations,
+		OutputVariables:     outputVars,
+		SkiWax:              skiWaxEngine,
+		Snowpack:            snowpack,
+		Alerts:              alerts,
 		ObservationCachePtr: &forecastsCache,
-		AwsRegion:           awsRegion,
-		AwsTimestreamDbname: awsTimeseriesDbname,
+		Sinks:               fanOut,
 		DaemonStatusPtr:     &ds,
 		TsRequestChannel:    tsReqChannel,
 	}
 
-	addLocationsToStatus(&ds, locations)
+	addLocationsToStatus(&ds, locations, config.SkiWax)
+	if alerts != nil {
+		alerts.initStatus(&ds, locations)
+	}
+	var metricsUpdates chan Locations
+	if config.ApiToken != "" {
+		pc.LocationUpdates = make(chan Locations, 1)
+		ec.LocationUpdates = make(chan Locations, 1)
+		updates := []chan Locations{pc.LocationUpdates, ec.LocationUpdates}
+		if exporter != nil {
+			metricsUpdates = make(chan Locations, 1)
+			updates = append(updates, metricsUpdates)
+		}
+		writeBackPath := ""
+		if config.ApiWriteBack {
+			writeBackPath = config.LocationFile
+		}
+		ds.SetLocationAPI(newLocationAPI(allLocations, writeBackPath, &ds, config.SkiWax, updates...), config.ApiToken)
+		log.Info("the location API is enabled on /api/locations")
+	}
 
+	var metricsFinished chan bool
+	if exporter != nil {
+		metricsFinished = make(chan bool)
+		go exportDaemonMetrics(exporter, &ds, locations, config.OtlpInterval, metricsUpdates, metricsFinished)
+	}
 	go poller(&pc)
 	go emitter(&ec)
 	// pollerControl = false
 	// Listen for signals:
-	mainControl := make(chan os.Signal)
+	mainControl := make(chan os.Signal, 1)
 	signal.Notify(mainControl, os.Interrupt, syscall.SIGINT)
 	signal.Notify(mainControl, os.Interrupt, syscall.SIGTERM)
 	log.Info("Daemon running")
@@ -94,6 +371,11 @@ func Run(userAgent string, apiUrl string, emitterInterval time.Duration,
 	pc.Finished <- true
 	<-ec.Finished
 	<-pc.Finished
+	// Last, so the final export has the counts of the emitter's last writes.
+	if metricsFinished != nil {
+		metricsFinished <- true
+		<-metricsFinished
+	}
 	log.Info("end of program")
 	os.Exit(0)
 }